@@ -21,106 +21,173 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/model"
 	"github.com/oklog/ulid"
 	"net/http"
-	"reflect"
+	"strconv"
 )
 
-var reflectedInitiatorUser = reflect.ValueOf(db.InitiatorUser)
-
-type managerHandlers struct {
-	newRv    reflect.Value
-	listRv   reflect.Value
-	getRv    reflect.Value
-	postRv   reflect.Value
-	putRv    reflect.Value
-	deleteRv reflect.Value
-}
-
-func (mh *managerHandlers) newEntity() reflect.Value {
-	return mh.newRv.Call(nil)[0]
-}
-
-func (mh *managerHandlers) list(ctx context.Context) (reflect.Value, error) {
-	result := mh.listRv.Call([]reflect.Value{reflect.ValueOf(ctx)})
-	return result[0], toError(result[1])
+type historyEntry struct {
+	ModifyRev int64
+	Entity    interface{}
 }
 
-func (mh *managerHandlers) get(ctx context.Context, id ulid.ULID) (reflect.Value, error) {
-	result := mh.getRv.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(id)})
-	return result[0], toError(result[1])
-}
-
-func (mh *managerHandlers) create(ctx context.Context, entity reflect.Value) error {
-	result := mh.postRv.Call([]reflect.Value{reflect.ValueOf(ctx), entity, reflectedInitiatorUser})
-	return toError(result[0])
-}
-
-func (mh *managerHandlers) update(ctx context.Context, entity reflect.Value) error {
-	result := mh.putRv.Call([]reflect.Value{reflect.ValueOf(ctx), entity, reflectedInitiatorUser})
-	return toError(result[0])
+type managerHandlers struct {
+	manager model.Manager
+	// Nil if entity names aren't unique
+	lookup model.NameLookup
 }
 
-func (mh *managerHandlers) delete(ctx context.Context, id ulid.ULID) error {
-	result := mh.deleteRv.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(id), reflectedInitiatorUser})
-	return toError(result[0])
+func adaptManager(manager model.Manager) *managerHandlers {
+	lookup, _ := manager.(model.NameLookup)
+	return &managerHandlers{manager: manager, lookup: lookup}
 }
 
-func adaptManager(manager interface{}) *managerHandlers {
-	managerRv := reflect.ValueOf(manager)
-
-	deleteFnRv := managerRv.MethodByName("IntentDelete")
-	if !deleteFnRv.IsValid() {
-		deleteFnRv = managerRv.MethodByName("Delete")
-	}
-	return &managerHandlers{
-		newRv:    managerRv.MethodByName("NewEntity"),
-		listRv:   managerRv.MethodByName("List"),
-		getRv:    managerRv.MethodByName("Get"),
-		postRv:   managerRv.MethodByName("Create"),
-		putRv:    managerRv.MethodByName("Update"),
-		deleteRv: deleteFnRv,
+func parseListOptions(req *http.Request) (*model.ListOptions, error) {
+	query := req.URL.Query()
+	opts := &model.ListOptions{
+		Continue: query.Get("continue"),
+		State:    db.State(query.Get("state")),
+		Name:     query.Get("name"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, &db.FieldError{Entity: "query", Field: "limit", Message: "Should be integer"}
+		}
+		opts.Limit = value
+	}
+	if project := query.Get("project"); project != "" {
+		id, err := ulid.Parse(project)
+		if err != nil {
+			return nil, &db.FieldError{Entity: "query", Field: "project", Message: "Should be ULID"}
+		}
+		opts.ProjectId = id
 	}
+	if disk := query.Get("disk"); disk != "" {
+		id, err := ulid.Parse(disk)
+		if err != nil {
+			return nil, &db.FieldError{Entity: "query", Field: "disk", Message: "Should be ULID"}
+		}
+		opts.DiskId = id
+	}
+	if network := query.Get("network"); network != "" {
+		id, err := ulid.Parse(network)
+		if err != nil {
+			return nil, &db.FieldError{Entity: "query", Field: "network", Message: "Should be ULID"}
+		}
+		opts.NetworkId = id
+	}
+	return opts, nil
 }
 
 func (mh *managerHandlers) handleList(ctx context.Context, w http.ResponseWriter, req *http.Request, params PathParams) {
-	entities, err := mh.list(ctx)
+	opts, err := parseListOptions(req)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	data, err := json.Marshal(entities.Interface())
+	entities, next, err := mh.manager.List(ctx, opts)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	data, err := json.Marshal(entities)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if next != "" {
+		w.Header().Set(HeaderContinue, next)
+	}
 	w.Header().Set(HeaderContentType, ContentTypeJson)
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
 func (mh *managerHandlers) handlePost(ctx context.Context, w http.ResponseWriter, req *http.Request, params PathParams) {
-	entity := mh.newEntity()
+	entity := mh.manager.NewEntity()
 	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(entity.Interface()); err != nil {
+	if err := decoder.Decode(entity); err != nil {
 		writeError(w, err)
 		return
 	}
-	if err := mh.create(ctx, entity); err != nil {
+	if err := mh.manager.Create(ctx, entity, db.InitiatorUser); err != nil {
 		writeError(w, err)
 		return
 	}
-	w.Header().Add(HeaderEntityId, getEntityId(entity).String())
+	w.Header().Add(HeaderEntityId, entity.Header().Id.String())
+	w.Header().Set(HeaderETag, formatETag(entity.Header().ModifyRev))
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (mh *managerHandlers) handleGet(ctx context.Context, w http.ResponseWriter, req *http.Request, params PathParams) {
-	entity, err := mh.get(ctx, params.GetULID(ctx, "id"))
+	var entity db.Entity
+	var err error
+	if revision := req.URL.Query().Get("revision"); revision != "" {
+		rev, parseErr := strconv.ParseInt(revision, 10, 64)
+		if parseErr != nil || rev <= 0 {
+			writeError(w, &db.FieldError{Entity: "query", Field: "revision", Message: "Should be positive integer"})
+			return
+		}
+		entity, err = mh.manager.GetRevision(ctx, params.GetULID(ctx, "id"), rev)
+	} else {
+		entity, err = mh.manager.Get(ctx, params.GetULID(ctx, "id"))
+	}
+	writeEntity(w, req, entity, err)
+}
+
+func (mh *managerHandlers) handleGetByName(ctx context.Context, w http.ResponseWriter, req *http.Request, params PathParams) {
+	var scope ulid.ULID
+	if mh.lookup.NameScoped() {
+		scope = params.GetULID(ctx, "id")
+	}
+	entity, err := mh.lookup.GetByName(ctx, scope, params.GetString(ctx, "name"))
+	writeEntity(w, req, entity, err)
+}
+
+func writeEntity(w http.ResponseWriter, req *http.Request, entity db.Entity, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rev := entity.Header().ModifyRev
+	w.Header().Set(HeaderETag, formatETag(rev))
+	if header := req.Header.Get(HeaderIfNoneMatch); header != "" && etagMatches(header, true, rev) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := json.Marshal(entity)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	data, err := json.Marshal(entity.Interface())
+	w.Header().Set(HeaderContentType, ContentTypeJson)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (mh *managerHandlers) handleHistory(ctx context.Context, w http.ResponseWriter, req *http.Request, params PathParams) {
+	limit := 0
+	if value := req.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeError(w, &db.FieldError{Entity: "query", Field: "limit", Message: "Should be non-negative integer"})
+			return
+		}
+	}
+	entities, err := mh.manager.History(ctx, params.GetULID(ctx, "id"), limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Entities don't serialize revisions, so pair them explicitly
+	versions := make([]historyEntry, len(entities))
+	for i, entity := range entities {
+		versions[i].ModifyRev = entity.Header().ModifyRev
+		versions[i].Entity = entity
+	}
+	data, err := json.Marshal(versions)
 	if err != nil {
 		writeError(w, err)
 		return
@@ -131,25 +198,26 @@ func (mh *managerHandlers) handleGet(ctx context.Context, w http.ResponseWriter,
 }
 
 func (mh *managerHandlers) handlePut(ctx context.Context, w http.ResponseWriter, req *http.Request, params PathParams) {
-	entity, err := mh.get(ctx, params.GetULID(ctx, "id"))
+	entity, err := mh.manager.Get(ctx, params.GetULID(ctx, "id"))
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(entity.Interface()); err != nil {
+	if err := decoder.Decode(entity); err != nil {
 		writeError(w, err)
 		return
 	}
-	if err := mh.update(ctx, entity); err != nil {
+	if err := mh.manager.Update(withIfMatch(ctx, req), entity, db.InitiatorUser); err != nil {
 		writeError(w, err)
 		return
 	}
+	w.Header().Set(HeaderETag, formatETag(entity.Header().ModifyRev))
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (mh *managerHandlers) handleDelete(ctx context.Context, w http.ResponseWriter, req *http.Request, params PathParams) {
-	err := mh.delete(ctx, params.GetULID(ctx, "id"))
+	err := mh.manager.IntentDelete(withIfMatch(ctx, req), params.GetULID(ctx, "id"), db.InitiatorUser)
 	if err != nil {
 		writeError(w, err)
 		return
@@ -20,7 +20,11 @@ package api
 const (
 	HeaderAllowed     = "Allowed"
 	HeaderEntityId    = "X-MiniCloud-Id"
+	HeaderContinue    = "X-MiniCloud-Continue"
 	HeaderContentType = "Content-Type"
+	HeaderETag        = "ETag"
+	HeaderIfMatch     = "If-Match"
+	HeaderIfNoneMatch = "If-None-Match"
 
 	ContentTypePlaintext = "text/plain"
 	ContentTypeJson      = "application/json"
@@ -0,0 +1,46 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/model"
+	"net/http"
+)
+
+func CaptureDisk(ctx context.Context, conn db.Connection, w http.ResponseWriter, req *http.Request, params PathParams) {
+	var body struct {
+		Name string
+	}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&body); err != nil {
+		writeError(w, err)
+		return
+	}
+	img, err := model.CaptureDisk(ctx, conn, params.GetULID(ctx, "id"), body.Name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Disk content is copied asynchronously by image state machine hook
+	w.Header().Add(HeaderEntityId, img.Id.String())
+	w.Header().Set(HeaderETag, formatETag(img.ModifyRev))
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,79 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonf/minicloud/model"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func formatETag(rev int64) string {
+	return fmt.Sprintf("\"%d\"", rev)
+}
+
+// Parse If-Match or If-None-Match header value, any is true for "*" and
+// unparsable entity tags are skipped
+func parseETags(header string, weak bool) (revs []int64, any bool) {
+	for _, elem := range strings.Split(header, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "*" {
+			any = true
+			continue
+		}
+		if weak {
+			elem = strings.TrimPrefix(elem, "W/")
+		}
+		if len(elem) < 2 || elem[0] != '"' || elem[len(elem)-1] != '"' {
+			continue
+		}
+		if rev, err := strconv.ParseInt(elem[1:len(elem)-1], 10, 64); err == nil {
+			revs = append(revs, rev)
+		}
+	}
+	return revs, any
+}
+
+func etagMatches(header string, weak bool, rev int64) bool {
+	revs, any := parseETags(header, weak)
+	if any {
+		return true
+	}
+	for _, r := range revs {
+		if r == rev {
+			return true
+		}
+	}
+	return false
+}
+
+// Make model fail modification of entity if it doesn't match If-Match header
+func withIfMatch(ctx context.Context, req *http.Request) context.Context {
+	header := req.Header.Get(HeaderIfMatch)
+	if header == "" {
+		return ctx
+	}
+	revs, any := parseETags(header, false)
+	if any {
+		return ctx
+	}
+	return model.WithExpectedRevisions(ctx, revs...)
+}
@@ -0,0 +1,105 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package api
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/log"
+	"github.com/antonf/minicloud/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.Initialize(context.Background())
+	os.Exit(m.Run())
+}
+
+func TestParseETags(t *testing.T) {
+	revs, any := parseETags(`"12", W/"13" ,"foo", *`, false)
+	if !reflect.DeepEqual(revs, []int64{12}) || !any {
+		t.Fatalf("unexpected strong parse result: %v %v", revs, any)
+	}
+	revs, any = parseETags(`"12", W/"13"`, true)
+	if !reflect.DeepEqual(revs, []int64{12, 13}) || any {
+		t.Fatalf("unexpected weak parse result: %v %v", revs, any)
+	}
+}
+
+func doRequest(api *Server, method, path string, headers ...string) *httptest.ResponseRecorder {
+	var body *strings.Reader
+	if method == "PUT" {
+		body = strings.NewReader(`{"Name": "renamed"}`)
+	} else {
+		body = strings.NewReader("")
+	}
+	req := httptest.NewRequest(method, path, body)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp := httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestConditionalRequests(t *testing.T) {
+	conn := memdb.NewConnection()
+	api := NewServer()
+	api.MountPoint("/projects").MountManager(model.GetManager(conn, "project"))
+	project := model.Projects(conn).NewEntity()
+	project.Name = "foo"
+	if err := model.Projects(conn).Create(context.Background(), project, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create project: %s", err)
+	}
+	path := "/projects/" + project.Id.String()
+
+	resp := doRequest(api, "GET", path)
+	etag := resp.Header().Get(HeaderETag)
+	if resp.Code != http.StatusOK || etag == "" {
+		t.Fatalf("unexpected GET response: %d %q", resp.Code, etag)
+	}
+	if resp := doRequest(api, "GET", path, HeaderIfNoneMatch, etag); resp.Code != http.StatusNotModified {
+		t.Fatalf("unexpected conditional GET status: %d", resp.Code)
+	}
+	if resp := doRequest(api, "PUT", path, HeaderIfMatch, `"1"`); resp.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with stale ETag not rejected: %d", resp.Code)
+	}
+	resp = doRequest(api, "PUT", path, HeaderIfMatch, etag)
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("PUT with current ETag failed: %d %s", resp.Code, resp.Body)
+	}
+	if newETag := resp.Header().Get(HeaderETag); newETag == etag || newETag != doRequest(api, "GET", path).Header().Get(HeaderETag) {
+		t.Fatalf("PUT returned unexpected ETag %q", newETag)
+	}
+	if resp := doRequest(api, "GET", path, HeaderIfNoneMatch, etag); resp.Code != http.StatusOK {
+		t.Fatalf("modified project not returned: %d", resp.Code)
+	}
+	if resp := doRequest(api, "DELETE", path, HeaderIfMatch, etag); resp.Code != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with stale ETag not rejected: %d", resp.Code)
+	}
+	etag = doRequest(api, "GET", path).Header().Get(HeaderETag)
+	if resp := doRequest(api, "DELETE", path, HeaderIfMatch, etag); resp.Code != http.StatusNoContent {
+		t.Fatalf("DELETE with current ETag failed: %d %s", resp.Code, resp.Body)
+	}
+}
@@ -79,13 +79,17 @@ func UploadImage(ctx context.Context, conn db.Connection, w http.ResponseWriter,
 
 	// Update image state
 	if err := utils.Retry(ctx, func(ctx context.Context) error {
-		image, err := imageManager.Get(ctx, id)
-		if err != nil {
-			return err
+		// Image header was refreshed by previous update, so it's re-read
+		// only if previous attempt failed
+		if image == nil {
+			if image, err = imageManager.Get(ctx, id); err != nil {
+				return err
+			}
 		}
 		image.State = db.StateReady
 		image.Checksum = fmt.Sprintf("%32x", md5hash.Sum(nil))
 		if err := imageManager.Update(ctx, image, db.InitiatorSystem); err != nil {
+			image = nil
 			return err
 		}
 		return nil
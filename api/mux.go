@@ -19,6 +19,7 @@ package api
 
 import (
 	"context"
+	"github.com/antonf/minicloud/model"
 	"github.com/oklog/ulid"
 	"net/http"
 	"strings"
@@ -109,24 +110,36 @@ func (mp *MountPoint) Child(elem string) *MountPoint {
 	return nextNode
 }
 
-func (mp *MountPoint) MountManager(manager interface{}) {
-	mh := adaptManager(manager)
-	if mh.listRv.IsValid() {
-		mp.Mount("GET", mh.handleList)
+// Manager is nil if it's not registered, which should fail at startup rather
+// than on request
+func (mp *MountPoint) MountManager(manager model.Manager) {
+	if manager == nil {
+		logger.Fatal(nil, "manager not registered", "mountpoint", mp.source)
+		return
 	}
-	if mh.postRv.IsValid() {
-		mp.Mount("POST", mh.handlePost)
+	mh := adaptManager(manager)
+	mp.Mount("GET", mh.handleList)
+	mp.Mount("POST", mh.handlePost)
+	if mh.lookup != nil && !mh.lookup.NameScoped() {
+		mp.Child("by-name").Child("{name:string}").Mount("GET", mh.handleGetByName)
 	}
 	childMp := mp.Child("{id:ulid}")
-	if mh.getRv.IsValid() {
-		childMp.Mount("GET", mh.handleGet)
-	}
-	if mh.putRv.IsValid() {
-		childMp.Mount("PUT", mh.handlePut)
-	}
-	if mh.deleteRv.IsValid() {
-		childMp.Mount("DELETE", mh.handleDelete)
+	childMp.Mount("GET", mh.handleGet)
+	childMp.Mount("PUT", mh.handlePut)
+	childMp.Mount("DELETE", mh.handleDelete)
+	childMp.Child("history").Mount("GET", mh.handleHistory)
+}
+
+// Mount lookup by name scoped by id of parent entity from path, like
+// /projects/{id:ulid}/servers/by-name/{name:string}
+func (mp *MountPoint) MountNameLookup(manager model.Manager) {
+	lookup, ok := manager.(model.NameLookup)
+	if !ok || !lookup.NameScoped() {
+		logger.Fatal(nil, "manager has no scoped name lookup", "mountpoint", mp.source)
+		return
 	}
+	mh := adaptManager(manager)
+	mp.Child("by-name").Child("{name:string}").Mount("GET", mh.handleGetByName)
 }
 
 func newMountPoint(source string) *MountPoint {
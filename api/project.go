@@ -0,0 +1,79 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/model"
+	"net/http"
+	"time"
+)
+
+func ProjectQuota(ctx context.Context, conn db.Connection, w http.ResponseWriter, req *http.Request, params PathParams) {
+	project, err := model.Projects(conn).Get(ctx, params.GetULID(ctx, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data, err := json.Marshal(struct {
+		Limits model.Quota
+		Usage  model.Quota
+	}{project.Limits, project.Usage})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(HeaderETag, formatETag(project.ModifyRev))
+	w.Header().Set(HeaderContentType, ContentTypeJson)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// Period defaults to everything recorded until now, bounds are RFC 3339 times
+func ProjectUsage(ctx context.Context, conn db.Connection, w http.ResponseWriter, req *http.Request, params PathParams) {
+	var from time.Time
+	to := time.Now().UTC()
+	for _, bound := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if value := req.URL.Query().Get(bound.name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeError(w, &db.FieldError{Entity: "query", Field: bound.name, Message: "Should be RFC 3339 time"})
+				return
+			}
+			*bound.value = parsed
+		}
+	}
+	report, err := model.ProjectUsage(ctx, conn, params.GetULID(ctx, "id"), from, to)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(HeaderContentType, ContentTypeJson)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,93 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/model"
+	"github.com/oklog/ulid"
+	"net/http"
+)
+
+func ServerAction(ctx context.Context, conn db.Connection, w http.ResponseWriter, req *http.Request, params PathParams) {
+	id, action := params.GetULID(ctx, "id"), params.GetString(ctx, "action")
+	server, err := model.ServerAction(withIfMatch(ctx, req), conn, id, action)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Action is performed asynchronously by server state machine hook
+	w.Header().Set(HeaderETag, formatETag(server.ModifyRev))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func AttachDisk(ctx context.Context, conn db.Connection, w http.ResponseWriter, req *http.Request, params PathParams) {
+	id, diskId := params.GetULID(ctx, "id"), params.GetULID(ctx, "disk_id")
+	server, err := model.AttachDisk(withIfMatch(ctx, req), conn, id, diskId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(HeaderETag, formatETag(server.ModifyRev))
+	// Disk of running server is hot plugged by disk state machine hook
+	if server.State == db.StateReady {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func DetachDisk(ctx context.Context, conn db.Connection, w http.ResponseWriter, req *http.Request, params PathParams) {
+	id, diskId := params.GetULID(ctx, "id"), params.GetULID(ctx, "disk_id")
+	server, err := model.DetachDisk(withIfMatch(ctx, req), conn, id, diskId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(HeaderETag, formatETag(server.ModifyRev))
+	// Disk of running server is hot plugged by disk state machine hook
+	if server.State == db.StateReady {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ResizeServer(ctx context.Context, conn db.Connection, w http.ResponseWriter, req *http.Request, params PathParams) {
+	var body struct {
+		FlavorId ulid.ULID
+	}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&body); err != nil {
+		writeError(w, err)
+		return
+	}
+	server, err := model.ResizeServer(withIfMatch(ctx, req), conn, params.GetULID(ctx, "id"), body.FlavorId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(HeaderETag, formatETag(server.ModifyRev))
+	if server.State == db.StateResizing {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -27,8 +27,8 @@ import (
 func BenchmarkProcess(b *testing.B) {
 	api := NewServer()
 	handler := func(ctx context.Context, w http.ResponseWriter, req *http.Request, params PathParams) {
-		params.GetULID("id")
-		params.GetString("foo")
+		params.GetULID(ctx, "id")
+		params.GetString(ctx, "foo")
 	}
 	api.MountPoint("/bar/{id:ulid}/{foo:string}").Mount("GET", handler)
 	req := httptest.NewRequest("GET", "/bar/01B984TSNZSVK7VX6STPAE95D0/vasya", nil)
@@ -37,3 +37,26 @@ func BenchmarkProcess(b *testing.B) {
 		api.ServeHTTP(nil, req)
 	}
 }
+
+func TestMountPrecedence(t *testing.T) {
+	api := NewServer()
+	var called string
+	mount := func(path, name string) {
+		api.MountPoint(path).Mount("POST", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params PathParams) {
+			called = name
+		})
+	}
+	// Children are matched in mount order
+	mount("/servers/{id:ulid}/actions/resize", "resize")
+	mount("/servers/{id:ulid}/actions/{action:string}", "action")
+	for path, expected := range map[string]string{
+		"/servers/01B984TSNZSVK7VX6STPAE95D0/actions/resize": "resize",
+		"/servers/01B984TSNZSVK7VX6STPAE95D0/actions/stop":   "action",
+	} {
+		called = ""
+		api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path, nil))
+		if called != expected {
+			t.Fatalf("%s handled by %q, expected %q", path, called, expected)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package api
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/model"
+	"net/http"
+)
+
+func RollbackSnapshot(ctx context.Context, conn db.Connection, w http.ResponseWriter, req *http.Request, params PathParams) {
+	snapshot, err := model.RollbackSnapshot(withIfMatch(ctx, req), conn, params.GetULID(ctx, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Rollback is performed asynchronously by snapshot state machine hook
+	w.Header().Set(HeaderETag, formatETag(snapshot.ModifyRev))
+	w.WriteHeader(http.StatusAccepted)
+}
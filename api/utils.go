@@ -20,9 +20,8 @@ package api
 import (
 	"encoding/json"
 	"github.com/antonf/minicloud/db"
-	"github.com/oklog/ulid"
+	"github.com/antonf/minicloud/model"
 	"net/http"
-	"reflect"
 	"strings"
 )
 
@@ -62,15 +61,24 @@ func writeError(w http.ResponseWriter, err error) {
 	// TODO: respond with different status codes depending on error
 	enc := json.NewEncoder(w)
 	switch err.(type) {
-	case *db.ConflictError:
+	case *db.ConflictError, *model.InvalidTransitionError, *model.InvalidStateError:
 		w.Header().Add(HeaderContentType, ContentTypeJson)
 		w.WriteHeader(http.StatusConflict)
-	case *db.FieldError:
+	case *db.FieldError, *db.FutureRevisionError:
 		w.Header().Add(HeaderContentType, ContentTypeJson)
 		w.WriteHeader(http.StatusBadRequest)
-	case *db.NotFoundError:
+	case *db.NotFoundError, *db.NameNotFoundError:
 		w.Header().Add(HeaderContentType, ContentTypeJson)
 		w.WriteHeader(http.StatusNotFound)
+	case *model.QuotaExceededError:
+		w.Header().Add(HeaderContentType, ContentTypeJson)
+		w.WriteHeader(http.StatusForbidden)
+	case *db.PreconditionFailedError:
+		w.Header().Add(HeaderContentType, ContentTypeJson)
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case *db.CompactedError:
+		w.Header().Add(HeaderContentType, ContentTypeJson)
+		w.WriteHeader(http.StatusGone)
 	default:
 		w.Header().Add(HeaderContentType, ContentTypePlaintext)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -84,17 +92,3 @@ func writeError(w http.ResponseWriter, err error) {
 		logger.Error(nil, "failed convert error to json", "error", err)
 	}
 }
-
-func toError(rv reflect.Value) error {
-	if rv.IsNil() {
-		return nil
-	}
-	return rv.Interface().(error)
-}
-
-func getEntityId(rv reflect.Value) ulid.ULID {
-	if rv.Kind() == reflect.Ptr {
-		rv = rv.Elem()
-	}
-	return rv.FieldByName("Id").Interface().(ulid.ULID)
-}
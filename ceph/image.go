@@ -19,6 +19,8 @@ package ceph
 
 import (
 	"context"
+	"crypto/md5"
+	"fmt"
 	"github.com/antonf/minicloud/log"
 	"github.com/ceph/go-ceph/rbd"
 	"io"
@@ -87,6 +89,78 @@ func CreateImageWithContent(ctx context.Context, pool, name string, size uint64,
 	return nil
 }
 
+// Copy disk to new image with protected base snapshot, returns md5 checksum of
+// image content. Disk shouldn't be written meanwhile.
+func CreateImageFromDisk(ctx context.Context, diskPool, diskName, imagePool, imageName string) (string, error) {
+	opCtx := log.WithValues(ctx,
+		"disk_pool", diskPool, "disk_name", diskName,
+		"image_pool", imagePool, "image_name", imageName)
+
+	// Create connection; defer shutdown
+	conn, err := NewConnection(ctx, diskPool, imagePool)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// Copy disk, clones are flattened by copy
+	disk := rbd.GetImage(conn.ioctx[diskPool], diskName)
+	if err := disk.Open(); err != nil {
+		logger.Error(opCtx, "failed to open disk", "error", err)
+		return "", err
+	}
+	err = disk.Copy(*conn.ioctx[imagePool], imageName)
+	disk.Close()
+	if err != nil {
+		logger.Error(opCtx, "failed to copy disk", "error", err)
+		return "", err
+	}
+
+	// Checksum copied content
+	needImageRemove := false
+	img := rbd.GetImage(conn.ioctx[imagePool], imageName)
+	if err := img.Open(); err != nil {
+		logger.Error(opCtx, "failed to open image", "error", err)
+		if err := img.Remove(); err != nil {
+			logger.Error(opCtx, "failed to cleanup image", "error", err)
+		}
+		return "", err
+	}
+	defer func() {
+		img.Close()
+		if needImageRemove {
+			if err := img.Remove(); err != nil {
+				logger.Error(opCtx, "failed to cleanup image", "error", err)
+			}
+		}
+	}()
+	md5hash := md5.New()
+	if _, err := io.Copy(md5hash, img); err != nil {
+		needImageRemove = true
+		logger.Error(opCtx, "image read error", "error", err)
+		return "", err
+	}
+
+	// Create and protect snapshot
+	snap, err := img.CreateSnapshot("base")
+	if err != nil {
+		needImageRemove = true
+		logger.Error(opCtx, "failed to create snapshot", "error", err)
+		return "", err
+	}
+	if err := snap.Protect(); err != nil {
+		if snapErr := snap.Remove(); snapErr != nil {
+			logger.Error(opCtx, "failed to cleanup snapshot", "error", snapErr)
+		} else {
+			needImageRemove = true
+		}
+		return "", err
+	}
+
+	logger.Info(opCtx, "created image from disk")
+	return fmt.Sprintf("%32x", md5hash.Sum(nil)), nil
+}
+
 func DeleteImage(ctx context.Context, pool, name string) error {
 	opCtx := log.WithValues(ctx, "pool", pool, "name", name)
 
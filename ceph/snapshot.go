@@ -0,0 +1,109 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package ceph
+
+import (
+	"context"
+	"github.com/antonf/minicloud/log"
+	"github.com/ceph/go-ceph/rbd"
+)
+
+func CreateDiskSnapshot(ctx context.Context, pool, name, snap string) error {
+	opCtx := log.WithValues(ctx, "pool", pool, "name", name, "snap", snap)
+
+	// Create connection; defer shutdown
+	conn, err := NewConnection(ctx, pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Open disk
+	disk := rbd.GetImage(conn.ioctx[pool], name)
+	if err := disk.Open(); err != nil {
+		logger.Error(opCtx, "failed to open disk", "error", err)
+		return err
+	}
+	defer disk.Close()
+
+	if _, err := disk.CreateSnapshot(snap); err != nil {
+		logger.Error(opCtx, "failed to create snapshot", "error", err)
+		return err
+	}
+
+	logger.Info(opCtx, "created disk snapshot")
+	return nil
+}
+
+func RollbackDiskSnapshot(ctx context.Context, pool, name, snap string) error {
+	opCtx := log.WithValues(ctx, "pool", pool, "name", name, "snap", snap)
+
+	// Create connection; defer shutdown
+	conn, err := NewConnection(ctx, pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Open disk
+	disk := rbd.GetImage(conn.ioctx[pool], name)
+	if err := disk.Open(); err != nil {
+		logger.Error(opCtx, "failed to open disk", "error", err)
+		return err
+	}
+	defer disk.Close()
+
+	if err := disk.GetSnapshot(snap).Rollback(); err != nil {
+		logger.Error(opCtx, "failed to rollback snapshot", "error", err)
+		return err
+	}
+
+	logger.Info(opCtx, "disk rolled back to snapshot")
+	return nil
+}
+
+func DeleteDiskSnapshot(ctx context.Context, pool, name, snap string) error {
+	opCtx := log.WithValues(ctx, "pool", pool, "name", name, "snap", snap)
+
+	// Create connection; defer shutdown
+	conn, err := NewConnection(ctx, pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Open disk
+	disk := rbd.GetImage(conn.ioctx[pool], name)
+	if err := disk.Open(); err != nil {
+		if err == rbd.RbdErrorNotFound {
+			// Disk don't exists in Ceph, so snapshot neither
+			return nil
+		}
+		logger.Error(opCtx, "failed to open disk", "error", err)
+		return err
+	}
+	defer disk.Close()
+
+	if err := disk.GetSnapshot(snap).Remove(); err != nil && err != rbd.RbdErrorNotFound {
+		logger.Error(opCtx, "failed to delete snapshot", "error", err)
+		return err
+	}
+
+	logger.Info(opCtx, "deleted disk snapshot")
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/model"
+	"os"
+)
+
+var errArchiveArg = errors.New("archive file name expected, use - for standard input/output")
+
+func backup(ctx context.Context, conn db.Connection, args []string) error {
+	if len(args) != 1 {
+		return errArchiveArg
+	}
+	if args[0] == "-" {
+		return model.Backup(ctx, conn, os.Stdout)
+	}
+	file, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := model.Backup(ctx, conn, file); err != nil {
+		file.Close()
+		os.Remove(args[0])
+		return err
+	}
+	return file.Close()
+}
+
+func restore(ctx context.Context, conn db.Connection, args []string) error {
+	if len(args) != 1 {
+		return errArchiveArg
+	}
+	if args[0] == "-" {
+		return model.Restore(ctx, conn, os.Stdin)
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return model.Restore(ctx, conn, file)
+}
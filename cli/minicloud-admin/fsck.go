@@ -0,0 +1,59 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/model"
+)
+
+var errProblemsFound = errors.New("problems found")
+
+func fsck(ctx context.Context, conn db.Connection, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "repair problems that can be repaired")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	report, err := model.Fsck(ctx, conn, *repair)
+	if report == nil {
+		return err
+	}
+	unresolved := 0
+	for _, problem := range report.Problems {
+		status := "repairable"
+		if problem.Repaired {
+			status = "repaired"
+		} else if !problem.Repairable {
+			status = "not repairable"
+		}
+		if !problem.Repaired {
+			unresolved += 1
+		}
+		fmt.Printf("%s %s: %s (%s)\n", problem.Kind, problem.Key, problem.Message, status)
+	}
+	fmt.Printf("%d problems found at revision %d, %d unresolved\n", len(report.Problems), report.Revision, unresolved)
+	if err == nil && unresolved != 0 {
+		err = errProblemsFound
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/dbimpl"
+	"github.com/antonf/minicloud/log"
+	"os"
+	"sort"
+)
+
+type command func(ctx context.Context, conn db.Connection, args []string) error
+
+var commands = map[string]command{
+	"backup":  backup,
+	"fsck":    fsck,
+	"migrate": migrate,
+	"restore": restore,
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [args]\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", name)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	ctx := context.Background()
+	log.Initialize(ctx)
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	conn, err := dbimpl.NewConnection(ctx, 1)
+	if err != nil {
+		log.Sync()
+		os.Exit(1)
+	}
+	err = cmd(ctx, conn, flag.Args()[1:])
+	log.Sync()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
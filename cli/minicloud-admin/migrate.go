@@ -0,0 +1,33 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/model"
+)
+
+// Server migrates entities in background on startup, command waits for all
+// of them to be migrated, e.g. before migration code is dropped
+func migrate(ctx context.Context, conn db.Connection, args []string) error {
+	count, err := model.MigrateEntities(ctx, conn)
+	fmt.Printf("%d entities migrated\n", count)
+	return err
+}
@@ -19,6 +19,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/antonf/minicloud/api"
 	"github.com/antonf/minicloud/config"
 	"github.com/antonf/minicloud/db/dbimpl"
@@ -33,6 +34,10 @@ func main() {
 	log.Initialize(ctx)
 	//logger := log.New("main")
 
+	if err := model.CheckManagers(); err != nil {
+		fmt.Fprintf(os.Stderr, "inconsistent model: %s\n", err)
+		os.Exit(1)
+	}
 	conn, err := dbimpl.NewConnection(ctx, 1)
 	if err != nil {
 		os.Exit(1)
@@ -44,16 +49,59 @@ func main() {
 		os.Exit(1)
 		return
 	}
+	model.ServeDHCP(conn)
+	model.MigrateInBackground(ctx, conn)
 
 	apiServer := api.NewServer()
-	apiServer.MountPoint("/projects").MountManager(model.Projects(conn))
-	apiServer.MountPoint("/images").MountManager(model.Images(conn))
-	apiServer.MountPoint("/disks").MountManager(model.Disks(conn))
+	apiServer.MountPoint("/projects").MountManager(model.GetManager(conn, "project"))
+	apiServer.MountPoint("/projects/{id:ulid}/quota").Mount(
+		"GET", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params api.PathParams) {
+			api.ProjectQuota(ctx, conn, w, req, params)
+		})
+	apiServer.MountPoint("/projects/{id:ulid}/usage").Mount(
+		"GET", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params api.PathParams) {
+			api.ProjectUsage(ctx, conn, w, req, params)
+		})
+	apiServer.MountPoint("/images").MountManager(model.GetManager(conn, "image"))
+	apiServer.MountPoint("/disks").MountManager(model.GetManager(conn, "disk"))
+	apiServer.MountPoint("/disks/{id:ulid}/actions/capture").Mount(
+		"POST", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params api.PathParams) {
+			api.CaptureDisk(ctx, conn, w, req, params)
+		})
 	apiServer.MountPoint("/images/{id:ulid}/contents").Mount(
 		"PUT", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params api.PathParams) {
 			api.UploadImage(ctx, conn, w, req, params)
 		})
-	apiServer.MountPoint("/flavors").MountManager(model.Flavors(conn))
-	apiServer.MountPoint("/servers").MountManager(model.Servers(conn))
+	apiServer.MountPoint("/snapshots").MountManager(model.GetManager(conn, "snapshot"))
+	apiServer.MountPoint("/snapshots/{id:ulid}/rollback").Mount(
+		"POST", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params api.PathParams) {
+			api.RollbackSnapshot(ctx, conn, w, req, params)
+		})
+	apiServer.MountPoint("/flavors").MountManager(model.GetManager(conn, "flavor"))
+	apiServer.MountPoint("/servers").MountManager(model.GetManager(conn, "server"))
+	// Mounted before generic actions, so it's matched first
+	apiServer.MountPoint("/servers/{id:ulid}/actions/resize").Mount(
+		"POST", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params api.PathParams) {
+			api.ResizeServer(ctx, conn, w, req, params)
+		})
+	apiServer.MountPoint("/servers/{id:ulid}/actions/{action:string}").Mount(
+		"POST", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params api.PathParams) {
+			api.ServerAction(ctx, conn, w, req, params)
+		})
+	apiServer.MountPoint("/networks").MountManager(model.GetManager(conn, "network"))
+	apiServer.MountPoint("/ports").MountManager(model.GetManager(conn, "port"))
+	serverDisk := apiServer.MountPoint("/servers/{id:ulid}/disks/{disk_id:ulid}")
+	serverDisk.Mount("PUT", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params api.PathParams) {
+		api.AttachDisk(ctx, conn, w, req, params)
+	})
+	serverDisk.Mount("DELETE", func(ctx context.Context, w http.ResponseWriter, req *http.Request, params api.PathParams) {
+		api.DetachDisk(ctx, conn, w, req, params)
+	})
+	apiServer.MountPoint("/projects/{id:ulid}/images").MountNameLookup(model.GetManager(conn, "image"))
+	apiServer.MountPoint("/projects/{id:ulid}/servers").MountNameLookup(model.GetManager(conn, "server"))
+	apiServer.MountPoint("/disks/{id:ulid}/snapshots").MountNameLookup(model.GetManager(conn, "snapshot"))
+	apiServer.MountPoint("/projects/{id:ulid}/networks").MountNameLookup(model.GetManager(conn, "network"))
+	// Ports are named by their address within network
+	apiServer.MountPoint("/networks/{id:ulid}/ports").MountNameLookup(model.GetManager(conn, "port"))
 	http.ListenAndServe("0.0.0.0:1959", apiServer)
 }
@@ -104,25 +104,41 @@ func registerOpt(opt option) {
 	options[hdr.name] = opt
 }
 
-func processConfigEvents(ctx context.Context, rawValueCh chan *db.RawValue) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case rawValue := <-rawValueCh:
-			if opt := getOption(ctx, rawValue); opt != nil {
-				updateOption(ctx, opt, rawValue)
+func processConfigEvents(ctx context.Context, eventCh chan *db.WatchEvent) {
+	for event := range eventCh {
+		processConfigEvent(ctx, event)
+	}
+}
+
+func processConfigEvent(ctx context.Context, event *db.WatchEvent) {
+	if !event.Snapshot {
+		for i := range event.Values {
+			if opt := getOption(ctx, &event.Values[i]); opt != nil {
+				updateOption(ctx, opt, &event.Values[i])
 			}
 		}
+		return
 	}
-}
 
-func initializeOpt(ctx context.Context, opt option, conn db.Connection) {
-	hdr := opt.headerPtr()
-	key := fmt.Sprintf("%s/%s", GlobalConfigPrefix, hdr.name)
-	if rawValue, err := conn.RawRead(ctx, key); err != nil {
-		fmt.Printf("config: error getting opt '%s' initial value: %s", hdr.name, err)
-	} else {
+	// Options missing from snapshot are reset to default values
+	rawValues := make(map[option]*db.RawValue)
+	for i := range event.Values {
+		if opt := getOption(ctx, &event.Values[i]); opt != nil {
+			rawValues[opt] = &event.Values[i]
+		}
+	}
+	optionsMutex.Lock()
+	allOptions := make([]option, 0, len(options))
+	for _, opt := range options {
+		allOptions = append(allOptions, opt)
+	}
+	optionsMutex.Unlock()
+	for _, opt := range allOptions {
+		rawValue := rawValues[opt]
+		if rawValue == nil {
+			key := fmt.Sprintf("%s/%s", GlobalConfigPrefix, opt.headerPtr().name)
+			rawValue = &db.RawValue{ModifyRev: event.Revision, Key: key}
+		}
 		updateOption(ctx, opt, rawValue)
 	}
 }
@@ -173,12 +189,11 @@ func init() {
 }
 
 func InitOptions(ctx context.Context, conn db.Connection) {
-	rawValCh := conn.RawWatchPrefix(ctx, GlobalConfigPrefix)
+	eventCh := conn.RawListWatchPrefix(ctx, GlobalConfigPrefix+"/")
 	logger.Info(ctx, "start to initialize options")
-	for _, opt := range options {
-		logger.Info(ctx, "initializing option", "name", opt.headerPtr().name)
-		initializeOpt(ctx, opt, conn)
+	if event := <-eventCh; event != nil {
+		processConfigEvent(ctx, event)
 	}
 	logger.Info(ctx, "done initializing options")
-	go processConfigEvents(ctx, rawValCh)
+	go processConfigEvents(ctx, eventCh)
 }
@@ -19,7 +19,11 @@ package db
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/oklog/ulid"
+	"reflect"
+	"strings"
 )
 
 type Initiator int
@@ -27,6 +31,7 @@ type Initiator int
 const (
 	InitiatorSystem Initiator = 1 << 0
 	InitiatorUser   Initiator = 1 << 1
+	DataPrefix                = "/minicloud/db/data"
 	MetaPrefix                = "/minicloud/db/meta"
 )
 
@@ -36,23 +41,56 @@ type RawValue struct {
 	Data                 []byte
 }
 
+// Changes of watched prefix. Snapshot event contains complete prefix contents
+// at Revision and is always sent first, and then again whenever watch can't
+// be resumed because of compaction. Other events contain values changed at
+// Revision, deleted keys have nil Data.
+type WatchEvent struct {
+	Revision int64
+	Snapshot bool
+	Values   []RawValue
+}
+
+// Part of prefix contents read by RawReadPage: up to limit values (0 means no
+// limit) with keys starting from fromKey at revision rev (0 means current).
+// More is set when there are keys after the last value.
+type RawPage struct {
+	Revision int64
+	Values   []RawValue
+	More     bool
+}
+
+// Lease backing locks. Done channel is closed when lease is lost, so locks
+// acquired within session are not held anymore. Connection starts new session
+// after that.
+type Session interface {
+	Done() <-chan struct{}
+}
+
+// RawReadRev reads key as it was at revision rev. RawReadHistory returns up to
+// limit (0 means no limit) versions of key since it was created, newest
+// first, versions that were compacted are omitted.
 type Connection interface {
 	RawRead(ctx context.Context, key string) (*RawValue, error)
 	RawReadPrefix(ctx context.Context, key string) ([]RawValue, error)
-	RawWatchPrefix(ctx context.Context, prefix string) chan *RawValue
+	RawReadPage(ctx context.Context, prefix, fromKey string, rev int64, limit int) (*RawPage, error)
+	RawReadRev(ctx context.Context, key string, rev int64) (*RawValue, error)
+	RawReadHistory(ctx context.Context, key string, limit int) ([]RawValue, error)
+	RawListWatchPrefix(ctx context.Context, prefix string) chan *WatchEvent
+	Session() Session
 	NewTransaction() Transaction
 }
 
 type Transaction interface {
-	Commit(ctx context.Context) error
+	Commit(ctx context.Context) (int64, error)
 	Create(ctx context.Context, entity Entity)
 	Update(ctx context.Context, entity Entity)
 	Delete(ctx context.Context, entity Entity)
 	CreateMeta(ctx context.Context, key, content string)
 	CheckMeta(ctx context.Context, key, content string)
 	DeleteMeta(ctx context.Context, key string)
-	AcquireLock(ctx context.Context, key string)
-	ReleaseLock(ctx context.Context, key string)
+	AcquireLock(ctx context.Context, session Session, key string)
+	ReleaseLock(ctx context.Context, session Session, key string)
 }
 
 type Entity interface {
@@ -72,3 +110,26 @@ type EntityHeader struct {
 func (hdr *EntityHeader) Header() *EntityHeader {
 	return hdr
 }
+
+func DataKey(entity Entity) string {
+	return fmt.Sprintf("%s/%s/%s", DataPrefix, strings.ToLower(entity.EntityName()), entity.Header().Id)
+}
+
+// Update header of entity stored as data by transaction committed at rev,
+// Original is decoded from data so entity can be updated again right away
+func RefreshHeader(entity Entity, data []byte, rev int64, created bool) error {
+	original := reflect.New(reflect.TypeOf(entity).Elem()).Interface().(Entity)
+	if err := json.Unmarshal(data, original); err != nil {
+		return err
+	}
+	hdr := entity.Header()
+	if created {
+		hdr.CreateRev = rev
+	}
+	hdr.ModifyRev = rev
+	origHdr := original.Header()
+	origHdr.CreateRev = hdr.CreateRev
+	origHdr.ModifyRev = rev
+	hdr.Original = original
+	return nil
+}
@@ -19,18 +19,22 @@ package dbimpl
 
 import (
 	"context"
-	"errors"
 	"github.com/antonf/minicloud/db"
 	"github.com/antonf/minicloud/env"
 	"github.com/antonf/minicloud/log"
 	backend "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"strings"
+	"sync"
 	"time"
 )
 
 type etcdConnection struct {
-	client         *backend.Client
-	leaseId        backend.LeaseID
+	sync.Mutex
+	client   *backend.Client
+	leaseTTL int64
+	session  *etcdSession
 }
 
 func (c *etcdConnection) RawRead(ctx context.Context, key string) (*db.RawValue, error) {
@@ -55,41 +59,89 @@ func (c *etcdConnection) RawReadPrefix(ctx context.Context, key string) ([]db.Ra
 	if err != nil {
 		return nil, err
 	}
-	result := make([]db.RawValue, resp.Count)
-	for i, kv := range resp.Kvs {
-		result[i].CreateRev = kv.CreateRevision
-		result[i].ModifyRev = kv.ModRevision
-		result[i].Key = string(kv.Key)
-		result[i].Data = kv.Value
+	return rawValues(resp.Kvs), nil
+}
+
+func (c *etcdConnection) RawReadPage(ctx context.Context, prefix, fromKey string, rev int64, limit int) (*db.RawPage, error) {
+	if fromKey < prefix {
+		fromKey = prefix
+	}
+	opts := []backend.OpOption{
+		backend.WithSerializable(),
+		backend.WithRange(backend.GetPrefixRangeEnd(prefix)),
+		backend.WithRev(rev),
+		backend.WithLimit(int64(limit)),
+	}
+	resp, err := c.client.Get(ctx, fromKey, opts...)
+	if err != nil {
+		return nil, revisionError(err, rev)
+	}
+	page := &db.RawPage{Revision: rev, Values: rawValues(resp.Kvs), More: resp.More}
+	if rev == 0 {
+		page.Revision = resp.Header.Revision
+	}
+	return page, nil
+}
+
+func (c *etcdConnection) RawReadRev(ctx context.Context, key string, rev int64) (*db.RawValue, error) {
+	resp, err := c.client.Get(ctx, key, backend.WithSerializable(), backend.WithRev(rev))
+	if err != nil {
+		return nil, revisionError(err, rev)
+	}
+	result := &db.RawValue{Key: key}
+	if resp.Count != 0 {
+		kv := resp.Kvs[0]
+		result.CreateRev = kv.CreateRevision
+		result.ModifyRev = kv.ModRevision
+		result.Data = kv.Value
 	}
 	return result, nil
 }
 
-func (c *etcdConnection) RawWatchPrefix(ctx context.Context, prefix string) chan *db.RawValue {
-	respCh := c.client.Watch(ctx, prefix, backend.WithPrefix())
-	resultCh := make(chan *db.RawValue)
-	go func() {
-		logger.Debug(ctx, "watching prefix", "prefix", prefix)
-		for {
-			select {
-			case <-ctx.Done():
-				logger.Debug(ctx, "stopped watching prefix", "prefix", prefix)
-				close(resultCh)
-				return
-			case eventBatch := <-respCh:
-				for _, ev := range eventBatch.Events {
-					var value []byte
-					kv := ev.Kv
-					key := string(kv.Key)
-					if ev.Type == backend.EventTypePut {
-						value = kv.Value
-					}
-					resultCh <- &db.RawValue{kv.CreateRevision, kv.ModRevision, key, value}
-				}
-			}
+// etcd keeps only revisions of keys, so history is read walking back from the
+// current version one revision before previous version modification
+func (c *etcdConnection) RawReadHistory(ctx context.Context, key string, limit int) ([]db.RawValue, error) {
+	value, err := c.RawRead(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var result []db.RawValue
+	for value.Data != nil && (limit == 0 || len(result) < limit) {
+		value.Key = key
+		result = append(result, *value)
+		if value.ModifyRev == value.CreateRev {
+			break
+		}
+		value, err = c.RawReadRev(ctx, key, value.ModifyRev-1)
+		if _, compacted := err.(*db.CompactedError); compacted {
+			break
+		} else if err != nil {
+			return nil, err
 		}
-	}()
-	return resultCh
+	}
+	return result, nil
+}
+
+func revisionError(err error, rev int64) error {
+	switch err {
+	case rpctypes.ErrCompacted:
+		return &db.CompactedError{Revision: rev}
+	case rpctypes.ErrFutureRev:
+		return &db.FutureRevisionError{Revision: rev}
+	default:
+		return err
+	}
+}
+
+func rawValues(kvs []*mvccpb.KeyValue) []db.RawValue {
+	result := make([]db.RawValue, len(kvs))
+	for i, kv := range kvs {
+		result[i].CreateRev = kv.CreateRevision
+		result[i].ModifyRev = kv.ModRevision
+		result[i].Key = string(kv.Key)
+		result[i].Data = kv.Value
+	}
+	return result
 }
 
 func NewConnection(ctx context.Context, leaseTTL int64) (db.Connection, error) {
@@ -104,26 +156,12 @@ func NewConnection(ctx context.Context, leaseTTL int64) (db.Connection, error) {
 		return nil, err
 	}
 
-	// Grant lease
-	leaseResp, err := cli.Grant(ctx, leaseTTL)
-	if err != nil {
-		logger.Error(opCtx, "error obtaining lease", "error", err)
-		return nil, err
-	}
-	if leaseResp.Error != "" {
-		logger.Error(opCtx, "leaseResp.Error not empty", "error", leaseResp.Error)
-		return nil, errors.New(leaseResp.Error)
-	}
-
-	// Keep lease alive
-	keepAliveCh, err := cli.KeepAlive(ctx, leaseResp.ID)
-	if err != nil {
-		logger.Error(opCtx, "error keeping lease alive", "error", err)
+	conn := &etcdConnection{client: cli, leaseTTL: leaseTTL}
+	if conn.session, err = conn.grantSession(opCtx); err != nil {
 		return nil, err
 	}
-	<-keepAliveCh
+	go conn.maintainSessions(ctx)
 
-	logger.Info(opCtx, "connected to etcd cluster", "lease_ttl", leaseResp.TTL)
-	conn := &etcdConnection{client: cli, leaseId: leaseResp.ID}
+	logger.Info(opCtx, "connected to etcd cluster", "lease_ttl", leaseTTL)
 	return conn, nil
 }
@@ -0,0 +1,131 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dbimpl
+
+import (
+	"context"
+	"errors"
+	"github.com/antonf/minicloud/db"
+	backend "github.com/coreos/etcd/clientv3"
+	"time"
+)
+
+const sessionRetryInterval = time.Second
+
+type etcdSession struct {
+	leaseId backend.LeaseID
+	ttl     int64
+	doneCh  chan struct{}
+}
+
+func (s *etcdSession) Done() <-chan struct{} {
+	return s.doneCh
+}
+
+func (c *etcdConnection) Session() db.Session {
+	c.Lock()
+	defer c.Unlock()
+	return c.session
+}
+
+func (c *etcdConnection) grantSession(ctx context.Context) (*etcdSession, error) {
+	leaseResp, err := c.client.Grant(ctx, c.leaseTTL)
+	if err != nil {
+		logger.Error(ctx, "error obtaining lease", "error", err)
+		return nil, err
+	}
+	if leaseResp.Error != "" {
+		logger.Error(ctx, "leaseResp.Error not empty", "error", leaseResp.Error)
+		return nil, errors.New(leaseResp.Error)
+	}
+	logger.Info(ctx, "session started", "lease_id", leaseResp.ID, "lease_ttl", leaseResp.TTL)
+	return &etcdSession{leaseId: leaseResp.ID, ttl: leaseResp.TTL, doneCh: make(chan struct{})}, nil
+}
+
+// Keep current session alive, start new one when it is lost
+func (c *etcdConnection) maintainSessions(ctx context.Context) {
+	for {
+		session := c.Session().(*etcdSession)
+		c.keepAlive(ctx, session)
+		close(session.doneCh)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn(ctx, "session lost", "lease_id", session.leaseId)
+		c.revokeSession(ctx, session)
+		for {
+			newSession, err := c.grantSession(ctx)
+			if err == nil {
+				c.Lock()
+				c.session = newSession
+				c.Unlock()
+				break
+			}
+			if !sleep(ctx, sessionRetryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// Lease may still be alive in etcd if keepalive gave up on local deadline,
+// revoking it releases locks held under it right away instead of after TTL
+func (c *etcdConnection) revokeSession(ctx context.Context, session *etcdSession) {
+	revokeCtx, cancel := context.WithTimeout(ctx, sessionRetryInterval)
+	defer cancel()
+	if _, err := c.client.Revoke(revokeCtx, session.leaseId); err != nil {
+		logger.Warn(ctx, "failed to revoke lost lease", "lease_id", session.leaseId, "error", err)
+	}
+}
+
+// Returns when lease is expired or wasn't refreshed in time
+func (c *etcdConnection) keepAlive(ctx context.Context, session *etcdSession) {
+	keepAliveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keepAliveCh, err := c.client.KeepAlive(keepAliveCtx, session.leaseId)
+	if err != nil {
+		logger.Error(ctx, "error keeping lease alive", "lease_id", session.leaseId, "error", err)
+		return
+	}
+	deadline := time.NewTimer(leaseDeadline(session.ttl))
+	defer deadline.Stop()
+	for {
+		select {
+		case resp, ok := <-keepAliveCh:
+			if !ok || resp.TTL <= 0 {
+				return
+			}
+			if !deadline.Stop() {
+				<-deadline.C
+			}
+			deadline.Reset(leaseDeadline(resp.TTL))
+		case <-deadline.C:
+			logger.Error(ctx, "lease keepalive timed out", "lease_id", session.leaseId)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Consider lease lost a bit earlier than its TTL passes, since etcd counts TTL
+// from the moment it handled keepalive request, not from the moment we got
+// response
+func leaseDeadline(ttl int64) time.Duration {
+	return time.Duration(ttl) * time.Second * 2 / 3
+}
@@ -25,13 +25,8 @@ import (
 	"github.com/antonf/minicloud/utils"
 	backend "github.com/coreos/etcd/clientv3"
 	"strconv"
-	"strings"
 )
 
-func dataKey(entity db.Entity) string {
-	return fmt.Sprintf("/minicloud/db/data/%s/%s", strings.ToLower(entity.EntityName()), entity.Header().Id)
-}
-
 func (c *etcdConnection) NewTransaction() db.Transaction {
 	return &etcdTransaction{
 		xid:  utils.NewULID().String(),
@@ -40,11 +35,26 @@ func (c *etcdConnection) NewTransaction() db.Transaction {
 }
 
 type etcdTransaction struct {
-	xid  string
-	err  error
-	conn *etcdConnection
-	cmps []backend.Cmp
-	ops  []backend.Op
+	xid     string
+	err     error
+	conn    *etcdConnection
+	written []writtenEntity
+	cmps    []backend.Cmp
+	ops     []backend.Op
+}
+
+type writtenEntity struct {
+	entity  db.Entity
+	data    []byte
+	created bool
+}
+
+func (t *etcdTransaction) refreshEntities(ctx context.Context, rev int64) {
+	for _, written := range t.written {
+		if err := db.RefreshHeader(written.entity, written.data, rev, written.created); err != nil {
+			logger.Error(ctx, "failed to refresh entity header", "xid", t.xid, "entity", fmt.Sprint(written.entity), "error", err)
+		}
+	}
 }
 
 func (t *etcdTransaction) addCmp(cmp backend.Cmp, result string, v interface{}) {
@@ -55,63 +65,67 @@ func (t *etcdTransaction) addOp(op backend.Op) {
 	t.ops = append(t.ops, op)
 }
 
-func (t *etcdTransaction) Commit(ctx context.Context) error {
+func (t *etcdTransaction) Commit(ctx context.Context) (int64, error) {
 	if t.err != nil {
 		logger.Error(ctx, "aborting transaction", "xid", t.xid, "error", t.err)
-		return t.err
+		return 0, t.err
 	}
 	logger.Debug(ctx, "commiting transaction", "xid", t.xid)
 	txn := t.conn.client.KV.Txn(ctx)
 	resp, err := txn.If(t.cmps...).Then(t.ops...).Commit()
 	if err != nil {
 		logger.Error(ctx, "error commiting transaction", "xid", t.xid, "error", err)
-		return err
+		return 0, err
 	}
 	if !resp.Succeeded {
-		return &db.ConflictError{Xid: t.xid}
+		return 0, &db.ConflictError{Xid: t.xid}
 	}
-	return nil
+	rev := resp.Header.Revision
+	t.refreshEntities(ctx, rev)
+	return rev, nil
 }
 
 func (t *etcdTransaction) Create(ctx context.Context, entity db.Entity) {
 	if t.err != nil {
 		return
 	}
-	logger.Debug(ctx, "creating entity", "xid", t.xid, "entity", entity)
+	logger.Debug(ctx, "creating entity", "xid", t.xid, "entity", fmt.Sprint(entity))
 	marshaledEntity, err := json.Marshal(entity)
 	if err != nil {
-		logger.Debug(ctx, "marshal failed", "xid", t.xid, "entity", entity, "error", err)
+		logger.Debug(ctx, "marshal failed", "xid", t.xid, "entity", fmt.Sprint(entity), "error", err)
 		t.err = err
 		return
 	}
-	key := dataKey(entity)
+	key := db.DataKey(entity)
 	t.addCmp(backend.Version(key), "=", 0)
 	t.addOp(backend.OpPut(key, string(marshaledEntity)))
+	t.written = append(t.written, writtenEntity{entity: entity, data: marshaledEntity, created: true})
 }
 
 func (t *etcdTransaction) Update(ctx context.Context, entity db.Entity) {
 	if t.err != nil {
 		return
 	}
-	logger.Debug(ctx, "updating entity", "xid", t.xid, "entity", entity)
+	logger.Debug(ctx, "updating entity", "xid", t.xid, "entity", fmt.Sprint(entity))
 	marshaledEntity, err := json.Marshal(entity)
 	if err != nil {
-		logger.Debug(ctx, "marshal failed", "xid", t.xid, "entity", entity, "error", err)
+		logger.Debug(ctx, "marshal failed", "xid", t.xid, "entity", fmt.Sprint(entity), "error", err)
 		t.err = err
 		return
 	}
-	key := dataKey(entity)
+	key := db.DataKey(entity)
 	t.addCmp(backend.Version(key), "!=", 0)
 	t.addCmp(backend.ModRevision(key), "=", entity.Header().ModifyRev)
 	t.addOp(backend.OpPut(key, string(marshaledEntity)))
+	t.written = append(t.written, writtenEntity{entity: entity, data: marshaledEntity})
 }
 
 func (t *etcdTransaction) Delete(ctx context.Context, entity db.Entity) {
 	if t.err != nil {
 		return
 	}
-	logger.Debug(ctx, "deleting entity", "xid", t.xid, "entity", entity)
-	key := dataKey(entity)
+	logger.Debug(ctx, "deleting entity", "xid", t.xid, "entity", fmt.Sprint(entity))
+	key := db.DataKey(entity)
 	t.addCmp(backend.ModRevision(key), "=", entity.Header().ModifyRev)
 	t.addOp(backend.OpDelete(key))
 }
@@ -141,16 +155,16 @@ func (t *etcdTransaction) CheckMeta(ctx context.Context, key, content string) {
 	t.addCmp(backend.Value(key), "=", content)
 }
 
-func (t *etcdTransaction) AcquireLock(ctx context.Context, key string) {
-	leaseId := t.conn.leaseId
+func (t *etcdTransaction) AcquireLock(ctx context.Context, session db.Session, key string) {
+	leaseId := session.(*etcdSession).leaseId
 	content := strconv.FormatInt(int64(leaseId), 16)
 	logger.Debug(ctx, "acquiring lock", "key", key, "lease_id", content)
 	t.addCmp(backend.Version(key), "=", 0)
 	t.addOp(backend.OpPut(key, content, backend.WithLease(leaseId)))
 }
 
-func (t *etcdTransaction) ReleaseLock(ctx context.Context, key string) {
-	leaseId := t.conn.leaseId
+func (t *etcdTransaction) ReleaseLock(ctx context.Context, session db.Session, key string) {
+	leaseId := session.(*etcdSession).leaseId
 	content := strconv.FormatInt(int64(leaseId), 16)
 	logger.Debug(ctx, "releasing lock", "key", key, "content", content)
 	t.addCmp(backend.Value(key), "=", content)
@@ -0,0 +1,133 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dbimpl
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	backend "github.com/coreos/etcd/clientv3"
+	"time"
+)
+
+const (
+	listRetryInterval  = time.Second
+	watchRetryInterval = 100 * time.Millisecond
+)
+
+func (c *etcdConnection) RawListWatchPrefix(ctx context.Context, prefix string) chan *db.WatchEvent {
+	resultCh := make(chan *db.WatchEvent)
+	go func() {
+		logger.Debug(ctx, "watching prefix", "prefix", prefix)
+		for {
+			rev, ok := c.list(ctx, prefix, resultCh)
+			if !ok || !c.watch(ctx, prefix, rev, resultCh) {
+				break
+			}
+		}
+		logger.Debug(ctx, "stopped watching prefix", "prefix", prefix)
+		close(resultCh)
+	}()
+	return resultCh
+}
+
+// read whole prefix and send it as snapshot, retry until succeeded
+func (c *etcdConnection) list(ctx context.Context, prefix string, resultCh chan *db.WatchEvent) (int64, bool) {
+	for {
+		resp, err := c.client.Get(ctx, prefix, backend.WithPrefix())
+		if err == nil {
+			event := &db.WatchEvent{
+				Revision: resp.Header.Revision,
+				Snapshot: true,
+				Values:   rawValues(resp.Kvs),
+			}
+			return event.Revision, sendEvent(ctx, resultCh, event)
+		}
+		logger.Error(ctx, "failed to list prefix", "prefix", prefix, "error", err)
+		if !sleep(ctx, listRetryInterval) {
+			return 0, false
+		}
+	}
+}
+
+// send changes made after rev, resuming watch on errors; return true if
+// prefix should be listed again because required revision was compacted
+func (c *etcdConnection) watch(ctx context.Context, prefix string, rev int64, resultCh chan *db.WatchEvent) bool {
+	for {
+		watchCtx, cancelWatch := context.WithCancel(ctx)
+		respCh := c.client.Watch(watchCtx, prefix, backend.WithPrefix(), backend.WithRev(rev+1))
+		for resp := range respCh {
+			if resp.CompactRevision != 0 {
+				logger.Notice(ctx, "watched revision compacted, listing again",
+					"prefix", prefix, "rev", rev, "compact_rev", resp.CompactRevision)
+				cancelWatch()
+				return true
+			}
+			if err := resp.Err(); err != nil {
+				logger.Warn(ctx, "watch failed", "prefix", prefix, "rev", rev, "error", err)
+				break
+			}
+			for _, event := range groupEvents(resp.Events) {
+				if !sendEvent(ctx, resultCh, event) {
+					cancelWatch()
+					return false
+				}
+				rev = event.Revision
+			}
+		}
+		cancelWatch()
+		if !sleep(ctx, watchRetryInterval) {
+			return false
+		}
+		logger.Notice(ctx, "resuming watch", "prefix", prefix, "rev", rev)
+	}
+}
+
+func groupEvents(events []*backend.Event) []*db.WatchEvent {
+	var result []*db.WatchEvent
+	for _, ev := range events {
+		kv := ev.Kv
+		value := db.RawValue{CreateRev: kv.CreateRevision, ModifyRev: kv.ModRevision, Key: string(kv.Key)}
+		if ev.Type == backend.EventTypePut {
+			value.Data = kv.Value
+		}
+		if count := len(result); count == 0 || result[count-1].Revision != kv.ModRevision {
+			result = append(result, &db.WatchEvent{Revision: kv.ModRevision})
+		}
+		last := result[len(result)-1]
+		last.Values = append(last.Values, value)
+	}
+	return result
+}
+
+func sendEvent(ctx context.Context, resultCh chan *db.WatchEvent, event *db.WatchEvent) bool {
+	select {
+	case resultCh <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func sleep(ctx context.Context, duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -47,3 +47,38 @@ type NotFoundError struct {
 func (e *NotFoundError) Error() string {
 	return fmt.Sprintf("%s with id %s not found", strings.Title(e.Entity), e.Id)
 }
+
+type CompactedError struct {
+	Revision int64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("Revision %d is compacted", e.Revision)
+}
+
+type FutureRevisionError struct {
+	Revision int64
+}
+
+func (e *FutureRevisionError) Error() string {
+	return fmt.Sprintf("Revision %d is a future revision", e.Revision)
+}
+
+type PreconditionFailedError struct {
+	Entity    string
+	Id        ulid.ULID
+	ModifyRev int64
+}
+
+func (e *PreconditionFailedError) Error() string {
+	return fmt.Sprintf("%s with id %s has different revision %d", strings.Title(e.Entity), e.Id, e.ModifyRev)
+}
+
+type NameNotFoundError struct {
+	Entity string
+	Name   string
+}
+
+func (e *NameNotFoundError) Error() string {
+	return fmt.Sprintf("%s with name %s not found", strings.Title(e.Entity), e.Name)
+}
@@ -0,0 +1,253 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package memdb
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"strings"
+	"sync"
+)
+
+type memConnection struct {
+	sync.Mutex
+	store   *Store
+	session *memSession
+}
+
+type memSession struct {
+	leaseId int64
+	doneCh  chan struct{}
+}
+
+func (s *memSession) Done() <-chan struct{} {
+	return s.doneCh
+}
+
+func (c *memConnection) Session() db.Session {
+	c.Lock()
+	defer c.Unlock()
+	return c.session
+}
+
+func (c *memConnection) RawRead(ctx context.Context, key string) (*db.RawValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := c.store
+	s.Lock()
+	defer s.Unlock()
+	kv := s.kvs[key]
+	if kv == nil {
+		return &db.RawValue{ModifyRev: s.revision}, nil
+	}
+	result := s.rawValue(key, kv)
+	return &result, nil
+}
+
+func (c *memConnection) RawReadPrefix(ctx context.Context, key string) ([]db.RawValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := c.store
+	s.Lock()
+	defer s.Unlock()
+	keys := s.sortedKeys(key)
+	result := make([]db.RawValue, len(keys))
+	for i, k := range keys {
+		result[i] = s.rawValue(k, s.kvs[k])
+	}
+	return result, nil
+}
+
+func (c *memConnection) RawReadPage(ctx context.Context, prefix, fromKey string, rev int64, limit int) (*db.RawPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := c.store
+	s.Lock()
+	defer s.Unlock()
+	if rev == 0 {
+		rev = s.revision
+	} else if err := s.checkRevision(rev); err != nil {
+		return nil, err
+	}
+	page := &db.RawPage{Revision: rev}
+	for _, key := range s.historyKeys(prefix) {
+		if key < fromKey {
+			continue
+		}
+		value := s.valueAt(key, rev)
+		if value == nil {
+			continue
+		}
+		if limit != 0 && len(page.Values) == limit {
+			page.More = true
+			break
+		}
+		page.Values = append(page.Values, *value)
+	}
+	return page, nil
+}
+
+func (c *memConnection) RawReadRev(ctx context.Context, key string, rev int64) (*db.RawValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := c.store
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkRevision(rev); err != nil {
+		return nil, err
+	}
+	if value := s.valueAt(key, rev); value != nil {
+		return value, nil
+	}
+	return &db.RawValue{Key: key}, nil
+}
+
+func (c *memConnection) RawReadHistory(ctx context.Context, key string, limit int) ([]db.RawValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := c.store
+	s.Lock()
+	defer s.Unlock()
+	var result []db.RawValue
+	values := s.history[key]
+	for i := len(values) - 1; i >= 0 && values[i].Data != nil; i-- {
+		if limit != 0 && len(result) == limit {
+			break
+		}
+		value := values[i]
+		value.Data = copyBytes(value.Data)
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+func (c *memConnection) RawListWatchPrefix(ctx context.Context, prefix string) chan *db.WatchEvent {
+	w := &watcher{
+		prefix: prefix,
+		relist: true,
+		wakeCh: make(chan struct{}, 1),
+	}
+	s := c.store
+	s.Lock()
+	s.watchers[w] = struct{}{}
+	s.Unlock()
+	resultCh := make(chan *db.WatchEvent)
+	go func() {
+		logger.Debug(ctx, "watching prefix", "prefix", prefix)
+		w.pump(ctx, s, resultCh)
+		s.Lock()
+		delete(s.watchers, w)
+		s.Unlock()
+		logger.Debug(ctx, "stopped watching prefix", "prefix", prefix)
+		close(resultCh)
+	}()
+	return resultCh
+}
+
+type watcher struct {
+	sync.Mutex
+	prefix string
+	relist bool
+	queue  []*db.WatchEvent
+	wakeCh chan struct{}
+}
+
+func (w *watcher) wake() {
+	select {
+	case w.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// store should be locked by caller
+func (w *watcher) enqueue(rev int64, values []db.RawValue) {
+	w.Lock()
+	defer w.Unlock()
+	event := &db.WatchEvent{Revision: rev}
+	for i := range values {
+		if strings.HasPrefix(values[i].Key, w.prefix) {
+			value := values[i]
+			value.Data = copyBytes(value.Data)
+			event.Values = append(event.Values, value)
+		}
+	}
+	if len(event.Values) != 0 {
+		w.queue = append(w.queue, event)
+		w.wake()
+	}
+}
+
+// store should be locked by caller
+func (w *watcher) compact(rev int64) {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.queue) != 0 && w.queue[0].Revision <= rev {
+		w.queue = nil
+		w.relist = true
+		w.wake()
+	}
+}
+
+// pop next event to send, store is locked to make snapshot consistent with
+// the queue
+func (w *watcher) next(s *Store) *db.WatchEvent {
+	s.Lock()
+	defer s.Unlock()
+	w.Lock()
+	defer w.Unlock()
+	if w.relist {
+		// Snapshot already includes all queued changes
+		w.relist = false
+		w.queue = nil
+		keys := s.sortedKeys(w.prefix)
+		snapshot := &db.WatchEvent{Revision: s.revision, Snapshot: true, Values: make([]db.RawValue, len(keys))}
+		for i, key := range keys {
+			snapshot.Values[i] = s.rawValue(key, s.kvs[key])
+		}
+		return snapshot
+	}
+	if len(w.queue) == 0 {
+		return nil
+	}
+	event := w.queue[0]
+	w.queue = w.queue[1:]
+	return event
+}
+
+func (w *watcher) pump(ctx context.Context, s *Store, resultCh chan *db.WatchEvent) {
+	for {
+		if event := w.next(s); event != nil {
+			select {
+			case resultCh <- event:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		select {
+		case <-w.wakeCh:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
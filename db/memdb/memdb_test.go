@@ -0,0 +1,404 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package memdb
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/log"
+	"github.com/antonf/minicloud/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+type testEntity struct {
+	db.EntityHeader
+	Value string
+}
+
+func (e *testEntity) EntityName() string {
+	return "Test"
+}
+
+func newTestEntity(value string) *testEntity {
+	return &testEntity{EntityHeader: db.EntityHeader{Id: utils.NewULID(), SchemaVersion: 1}, Value: value}
+}
+
+func readEntity(t *testing.T, conn db.Connection, entity *testEntity) *db.RawValue {
+	value, err := conn.RawRead(context.Background(), db.DataKey(entity))
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	return value
+}
+
+func commit(t *testing.T, txn db.Transaction, expectConflict bool) int64 {
+	rev, err := txn.Commit(context.Background())
+	if _, isConflict := err.(*db.ConflictError); isConflict != expectConflict || (err != nil && !isConflict) {
+		t.Fatalf("unexpected commit result: %v (expected conflict: %v)", err, expectConflict)
+	}
+	return rev
+}
+
+func TestMain(m *testing.M) {
+	log.Initialize(context.Background())
+	os.Exit(m.Run())
+}
+
+func TestCreateUpdateDelete(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+	conn := store.NewConnection()
+	entity := newTestEntity("foo")
+
+	txn := conn.NewTransaction()
+	txn.Create(ctx, entity)
+	rev := commit(t, txn, false)
+	value := readEntity(t, conn, entity)
+	if value.Data == nil || value.CreateRev != rev || value.ModifyRev != value.CreateRev {
+		t.Fatalf("unexpected value after create: %+v", value)
+	}
+	if entity.CreateRev != rev || entity.ModifyRev != rev || entity.Original.(*testEntity).Value != "foo" {
+		t.Fatalf("entity header not refreshed after create: %+v", entity.EntityHeader)
+	}
+
+	txn = conn.NewTransaction()
+	txn.Create(ctx, entity)
+	commit(t, txn, true)
+
+	entity.Value = "bar"
+	txn = conn.NewTransaction()
+	txn.Update(ctx, entity)
+	rev = commit(t, txn, false)
+	updated := readEntity(t, conn, entity)
+	if updated.CreateRev != value.CreateRev || updated.ModifyRev != rev || rev <= value.ModifyRev {
+		t.Fatalf("unexpected value after update: %+v", updated)
+	}
+	if entity.CreateRev != value.CreateRev || entity.ModifyRev != rev || entity.Original.(*testEntity).Value != "bar" {
+		t.Fatalf("entity header not refreshed after update: %+v", entity.EntityHeader)
+	}
+
+	// Stale revision should be rejected
+	entity.ModifyRev = value.ModifyRev
+	txn = conn.NewTransaction()
+	txn.Update(ctx, entity)
+	commit(t, txn, true)
+	txn = conn.NewTransaction()
+	txn.Delete(ctx, entity)
+	commit(t, txn, true)
+
+	entity.ModifyRev = updated.ModifyRev
+	txn = conn.NewTransaction()
+	txn.Delete(ctx, entity)
+	commit(t, txn, false)
+	if deleted := readEntity(t, conn, entity); deleted.Data != nil || deleted.ModifyRev != store.Revision() {
+		t.Fatalf("unexpected value after delete: %+v", deleted)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	ctx := context.Background()
+	conn := NewConnection()
+	entity := newTestEntity("foo")
+
+	txn := conn.NewTransaction()
+	txn.Create(ctx, entity)
+	txn.CreateMeta(ctx, "/minicloud/db/meta/test/name/foo", entity.Id.String())
+	commit(t, txn, false)
+
+	// Failed comparison shouldn't apply any operation
+	other := newTestEntity("foo")
+	txn = conn.NewTransaction()
+	txn.Create(ctx, other)
+	txn.CreateMeta(ctx, "/minicloud/db/meta/test/name/foo", other.Id.String())
+	commit(t, txn, true)
+	if value := readEntity(t, conn, other); value.Data != nil {
+		t.Fatalf("entity created by failed transaction")
+	}
+
+	txn = conn.NewTransaction()
+	txn.CheckMeta(ctx, "/minicloud/db/meta/test/name/foo", other.Id.String())
+	txn.DeleteMeta(ctx, "/minicloud/db/meta/test/name/foo")
+	commit(t, txn, true)
+
+	txn = conn.NewTransaction()
+	txn.CheckMeta(ctx, "/minicloud/db/meta/test/name/bar", "")
+	commit(t, txn, true)
+
+	txn = conn.NewTransaction()
+	txn.CheckMeta(ctx, "/minicloud/db/meta/test/name/foo", entity.Id.String())
+	txn.DeleteMeta(ctx, "/minicloud/db/meta/test/name/foo")
+	commit(t, txn, false)
+}
+
+func TestDuplicateKey(t *testing.T) {
+	ctx := context.Background()
+	conn := NewConnection()
+	txn := conn.NewTransaction()
+	txn.CreateMeta(ctx, "/foo", "1")
+	txn.DeleteMeta(ctx, "/foo")
+	if _, err := txn.Commit(ctx); err == nil {
+		t.Fatalf("transaction with duplicate key committed")
+	}
+}
+
+func TestLeaseBoundLock(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+	conn1 := store.NewConnection()
+	conn2 := store.NewConnection()
+	session1 := conn1.Session()
+
+	txn := conn1.NewTransaction()
+	txn.AcquireLock(ctx, session1, "/lock")
+	commit(t, txn, false)
+
+	txn = conn2.NewTransaction()
+	txn.AcquireLock(ctx, conn2.Session(), "/lock")
+	commit(t, txn, true)
+	txn = conn2.NewTransaction()
+	txn.ReleaseLock(ctx, conn2.Session(), "/lock")
+	commit(t, txn, true)
+
+	store.RevokeLease(conn1)
+	if value, _ := conn2.RawRead(ctx, "/lock"); value.Data != nil {
+		t.Fatalf("lock survived lease revocation")
+	}
+	select {
+	case <-session1.Done():
+	default:
+		t.Fatalf("session not done after lease revocation")
+	}
+	txn = conn1.NewTransaction()
+	txn.AcquireLock(ctx, session1, "/lock")
+	if _, err := txn.Commit(ctx); err != ErrLeaseNotFound {
+		t.Fatalf("lock acquired with revoked lease: %v", err)
+	}
+
+	// Connection should have started new session
+	if conn1.Session() == session1 {
+		t.Fatalf("session not renewed after lease revocation")
+	}
+	txn = conn1.NewTransaction()
+	txn.AcquireLock(ctx, conn1.Session(), "/lock")
+	commit(t, txn, false)
+	txn = conn1.NewTransaction()
+	txn.ReleaseLock(ctx, conn1.Session(), "/lock")
+	commit(t, txn, false)
+}
+
+func TestReadPage(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+	conn := store.NewConnection()
+	entities := []*testEntity{newTestEntity("a"), newTestEntity("b"), newTestEntity("c")}
+	for _, entity := range entities {
+		txn := conn.NewTransaction()
+		txn.Create(ctx, entity)
+		commit(t, txn, false)
+	}
+	prefix := db.DataPrefix + "/test/"
+
+	page, err := conn.RawReadPage(ctx, prefix, "", 0, 2)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if page.Revision != store.Revision() || !page.More || len(page.Values) != 2 || page.Values[0].Key >= page.Values[1].Key {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	var last *testEntity
+	for _, entity := range entities {
+		if key := db.DataKey(entity); key != page.Values[0].Key && key != page.Values[1].Key {
+			last = entity
+		}
+	}
+
+	// Next page should be read at the same revision despite deletion
+	txn := conn.NewTransaction()
+	txn.Delete(ctx, last)
+	commit(t, txn, false)
+	next, err := conn.RawReadPage(ctx, prefix, page.Values[1].Key+"\x00", page.Revision, 2)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if next.Revision != page.Revision || next.More || len(next.Values) != 1 || next.Values[0].Key != db.DataKey(last) {
+		t.Fatalf("unexpected second page: %+v", next)
+	}
+	if current, err := conn.RawReadPage(ctx, prefix, "", 0, 0); err != nil || len(current.Values) != 2 {
+		t.Fatalf("unexpected current contents: %+v (%v)", current, err)
+	}
+
+	store.Compact(store.Revision())
+	if _, err := conn.RawReadPage(ctx, prefix, "", page.Revision, 2); err == nil {
+		t.Fatal("read at compacted revision succeeded")
+	} else if _, ok := err.(*db.CompactedError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if current, err := conn.RawReadPage(ctx, prefix, "", 0, 0); err != nil || len(current.Values) != 2 || current.More {
+		t.Fatalf("unexpected contents after compaction: %+v (%v)", current, err)
+	}
+}
+
+func TestReadHistory(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+	conn := store.NewConnection()
+	entity := newTestEntity("v1")
+	key := db.DataKey(entity)
+	txn := conn.NewTransaction()
+	txn.Create(ctx, entity)
+	rev1 := commit(t, txn, false)
+	entity.Value = "v2"
+	txn = conn.NewTransaction()
+	txn.Update(ctx, entity)
+	rev2 := commit(t, txn, false)
+
+	if value, err := conn.RawReadRev(ctx, key, rev1); err != nil || value.ModifyRev != rev1 || value.Data == nil {
+		t.Fatalf("unexpected value at revision %d: %+v (%v)", rev1, value, err)
+	}
+	if value, err := conn.RawReadRev(ctx, key, rev1-1); err != nil || value.Data != nil {
+		t.Fatalf("unexpected value before creation: %+v (%v)", value, err)
+	}
+	if _, err := conn.RawReadRev(ctx, key, rev2+1); err == nil {
+		t.Fatalf("read at future revision succeeded")
+	}
+
+	// Versions before deletion don't belong to recreated key history
+	txn = conn.NewTransaction()
+	txn.Delete(ctx, entity)
+	commit(t, txn, false)
+	if history, err := conn.RawReadHistory(ctx, key, 0); err != nil || len(history) != 0 {
+		t.Fatalf("unexpected history of deleted key: %+v (%v)", history, err)
+	}
+	entity.Value = "v3"
+	txn = conn.NewTransaction()
+	txn.Create(ctx, entity)
+	rev3 := commit(t, txn, false)
+	entity.Value = "v4"
+	txn = conn.NewTransaction()
+	txn.Update(ctx, entity)
+	rev4 := commit(t, txn, false)
+	history, err := conn.RawReadHistory(ctx, key, 0)
+	if err != nil || len(history) != 2 || history[0].ModifyRev != rev4 || history[1].ModifyRev != rev3 || history[1].CreateRev != rev3 {
+		t.Fatalf("unexpected history: %+v (%v)", history, err)
+	}
+	if history, _ := conn.RawReadHistory(ctx, key, 1); len(history) != 1 || history[0].ModifyRev != rev4 {
+		t.Fatalf("unexpected limited history: %+v", history)
+	}
+
+	store.Compact(rev4)
+	if history, _ := conn.RawReadHistory(ctx, key, 0); len(history) != 1 || history[0].ModifyRev != rev4 {
+		t.Fatalf("unexpected history after compaction: %+v", history)
+	}
+	if _, err := conn.RawReadRev(ctx, key, rev2); err == nil {
+		t.Fatalf("read at compacted revision succeeded")
+	}
+}
+
+func receiveEvent(t *testing.T, watchCh chan *db.WatchEvent) *db.WatchEvent {
+	select {
+	case event := <-watchCh:
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for watch event")
+		return nil
+	}
+}
+
+func checkEvent(t *testing.T, event *db.WatchEvent, rev int64, snapshot bool, expected ...db.RawValue) {
+	if event.Revision != rev || event.Snapshot != snapshot || len(event.Values) != len(expected) {
+		t.Fatalf("unexpected event %+v, expected rev=%d snapshot=%v values=%+v", event, rev, snapshot, expected)
+	}
+	for i, exp := range expected {
+		rv := event.Values[i]
+		if rv.Key != exp.Key || rv.CreateRev != exp.CreateRev || rv.ModifyRev != exp.ModifyRev || string(rv.Data) != string(exp.Data) {
+			t.Fatalf("unexpected value %+v, expected %+v", rv, exp)
+		}
+	}
+}
+
+func TestListWatchPrefix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewStore()
+	conn := store.NewConnection()
+
+	txn := conn.NewTransaction()
+	txn.CreateMeta(ctx, "/watched/a", "1")
+	commit(t, txn, false)
+	rev1 := store.Revision()
+
+	watchCh := conn.RawListWatchPrefix(ctx, "/watched/")
+	checkEvent(t, receiveEvent(t, watchCh), rev1, true,
+		db.RawValue{CreateRev: rev1, ModifyRev: rev1, Key: "/watched/a", Data: []byte("1")})
+
+	txn = conn.NewTransaction()
+	txn.CreateMeta(ctx, "/watched/b", "2")
+	txn.CreateMeta(ctx, "/ignored/b", "2")
+	commit(t, txn, false)
+	rev2 := store.Revision()
+	txn = conn.NewTransaction()
+	txn.DeleteMeta(ctx, "/watched/a")
+	commit(t, txn, false)
+	rev3 := store.Revision()
+
+	checkEvent(t, receiveEvent(t, watchCh), rev2, false,
+		db.RawValue{CreateRev: rev2, ModifyRev: rev2, Key: "/watched/b", Data: []byte("2")})
+	checkEvent(t, receiveEvent(t, watchCh), rev3, false,
+		db.RawValue{ModifyRev: rev3, Key: "/watched/a"})
+
+	cancel()
+	for range watchCh {
+	}
+}
+
+func TestListWatchCompacted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewStore()
+	conn := store.NewConnection()
+	watchCh := conn.RawListWatchPrefix(ctx, "/watched/")
+	checkEvent(t, receiveEvent(t, watchCh), store.Revision(), true)
+
+	// Changes not yet delivered to watcher are compacted away
+	txn := conn.NewTransaction()
+	txn.CreateMeta(ctx, "/watched/a", "1")
+	commit(t, txn, false)
+	rev1 := store.Revision()
+	txn = conn.NewTransaction()
+	txn.CreateMeta(ctx, "/watched/b", "2")
+	commit(t, txn, false)
+	rev2 := store.Revision()
+	store.Compact(rev2)
+
+	// Event which was already being sent can still arrive before snapshot
+	event := receiveEvent(t, watchCh)
+	if !event.Snapshot {
+		checkEvent(t, event, rev1, false,
+			db.RawValue{CreateRev: rev1, ModifyRev: rev1, Key: "/watched/a", Data: []byte("1")})
+		event = receiveEvent(t, watchCh)
+	}
+	checkEvent(t, event, rev2, true,
+		db.RawValue{CreateRev: rev1, ModifyRev: rev1, Key: "/watched/a", Data: []byte("1")},
+		db.RawValue{CreateRev: rev2, ModifyRev: rev2, Key: "/watched/b", Data: []byte("2")})
+
+	cancel()
+	for range watchCh {
+	}
+}
@@ -0,0 +1,232 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package memdb
+
+import (
+	"github.com/antonf/minicloud/db"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// In-memory keyspace mimicking etcd revisions, leases and watches, so model
+// code can be run and tested without etcd cluster
+type Store struct {
+	sync.Mutex
+	revision   int64
+	compactRev int64
+	nextLease  int64
+	leases     map[int64]bool
+	kvs        map[string]*keyValue
+	history    map[string][]db.RawValue
+	watchers   map[*watcher]struct{}
+}
+
+type keyValue struct {
+	createRev int64
+	modifyRev int64
+	version   int64
+	lease     int64
+	data      []byte
+}
+
+func NewStore() *Store {
+	return &Store{
+		revision: 1,
+		leases:   make(map[int64]bool),
+		kvs:      make(map[string]*keyValue),
+		history:  make(map[string][]db.RawValue),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+func NewConnection() db.Connection {
+	return NewStore().NewConnection()
+}
+
+// Every connection gets its own lease, like separate MiniCloud process would
+func (s *Store) NewConnection() db.Connection {
+	return &memConnection{store: s, session: s.newSession()}
+}
+
+func (s *Store) Revision() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.revision
+}
+
+// Forget history before rev, so reads at older revisions fail and watchers
+// that haven't received dropped events yet have to list watched prefix again
+func (s *Store) Compact(rev int64) {
+	s.Lock()
+	defer s.Unlock()
+	if rev > s.revision {
+		rev = s.revision
+	}
+	if rev <= s.compactRev {
+		return
+	}
+	s.compactRev = rev
+	for key, values := range s.history {
+		// Keep last value visible at rev unless it's deletion
+		idx := sort.Search(len(values), func(i int) bool { return values[i].ModifyRev > rev }) - 1
+		if idx >= 0 && values[idx].Data == nil {
+			idx += 1
+		}
+		if idx > 0 {
+			values = values[idx:]
+		}
+		if len(values) == 0 {
+			delete(s.history, key)
+		} else {
+			s.history[key] = values
+		}
+	}
+	for w := range s.watchers {
+		w.compact(rev)
+	}
+}
+
+// Revoke lease of connection session, deleting all keys bound to it like etcd
+// does. Connection starts new session right away.
+func (s *Store) RevokeLease(conn db.Connection) {
+	c := conn.(*memConnection)
+	c.Lock()
+	defer c.Unlock()
+	s.revokeLease(c.session.leaseId)
+	close(c.session.doneCh)
+	c.session = s.newSession()
+}
+
+func (s *Store) revokeLease(leaseId int64) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.leases, leaseId)
+	var ops []operation
+	for _, key := range s.sortedKeys("") {
+		if s.kvs[key].lease == leaseId {
+			ops = append(ops, operation{key: key, delete: true})
+		}
+	}
+	s.apply(ops)
+}
+
+func (s *Store) newSession() *memSession {
+	s.Lock()
+	defer s.Unlock()
+	s.nextLease += 1
+	s.leases[s.nextLease] = true
+	return &memSession{leaseId: s.nextLease, doneCh: make(chan struct{})}
+}
+
+func (s *Store) sortedKeys(prefix string) []string {
+	var keys []string
+	for key := range s.kvs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Store) historyKeys(prefix string) []string {
+	var keys []string
+	for key := range s.history {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Store) checkRevision(rev int64) error {
+	if rev < s.compactRev {
+		return &db.CompactedError{Revision: rev}
+	} else if rev > s.revision {
+		return &db.FutureRevisionError{Revision: rev}
+	}
+	return nil
+}
+
+// Value of key as it was at rev, nil if key didn't exist
+func (s *Store) valueAt(key string, rev int64) *db.RawValue {
+	values := s.history[key]
+	idx := sort.Search(len(values), func(i int) bool { return values[i].ModifyRev > rev }) - 1
+	if idx < 0 || values[idx].Data == nil {
+		return nil
+	}
+	result := values[idx]
+	result.Data = copyBytes(result.Data)
+	return &result
+}
+
+func (s *Store) rawValue(key string, kv *keyValue) db.RawValue {
+	return db.RawValue{
+		CreateRev: kv.createRev,
+		ModifyRev: kv.modifyRev,
+		Key:       key,
+		Data:      copyBytes(kv.data),
+	}
+}
+
+// apply executes operations as one revision and notifies watchers, store
+// should be locked by caller
+func (s *Store) apply(ops []operation) {
+	rev := s.revision + 1
+	var events []db.RawValue
+	for _, op := range ops {
+		kv := s.kvs[op.key]
+		if op.delete {
+			if kv != nil {
+				delete(s.kvs, op.key)
+				events = append(events, db.RawValue{ModifyRev: rev, Key: op.key})
+			}
+			continue
+		}
+		if kv == nil {
+			kv = &keyValue{createRev: rev}
+			s.kvs[op.key] = kv
+		}
+		kv.modifyRev = rev
+		kv.version += 1
+		kv.lease = op.lease
+		kv.data = copyBytes(op.data)
+		events = append(events, s.rawValue(op.key, kv))
+	}
+	if len(events) == 0 {
+		return
+	}
+	s.revision = rev
+	for _, event := range events {
+		s.history[event.Key] = append(s.history[event.Key], event)
+	}
+	for w := range s.watchers {
+		w.enqueue(rev, events)
+	}
+}
+
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
@@ -0,0 +1,239 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"strconv"
+)
+
+var (
+	ErrLeaseNotFound = errors.New("Requested lease not found")
+)
+
+type compareTarget int
+
+const (
+	targetVersion compareTarget = iota
+	targetModifyRev
+	targetValue
+)
+
+type compare struct {
+	key    string
+	target compareTarget
+	equal  bool
+	rev    int64
+	value  []byte
+}
+
+type operation struct {
+	key    string
+	data   []byte
+	lease  int64
+	delete bool
+}
+
+func (c *compare) check(kv *keyValue) bool {
+	var result bool
+	switch c.target {
+	case targetVersion:
+		var version int64
+		if kv != nil {
+			version = kv.version
+		}
+		result = version == c.rev
+	case targetModifyRev:
+		var modifyRev int64
+		if kv != nil {
+			modifyRev = kv.modifyRev
+		}
+		result = modifyRev == c.rev
+	case targetValue:
+		// Like in etcd, comparing value of missing key always fails
+		if kv == nil {
+			return false
+		}
+		result = bytes.Equal(kv.data, c.value)
+	}
+	return result == c.equal
+}
+
+func (c *memConnection) NewTransaction() db.Transaction {
+	return &memTransaction{
+		xid:  utils.NewULID().String(),
+		conn: c,
+	}
+}
+
+type memTransaction struct {
+	xid     string
+	err     error
+	conn    *memConnection
+	written []writtenEntity
+	cmps    []compare
+	ops     []operation
+}
+
+type writtenEntity struct {
+	entity  db.Entity
+	data    []byte
+	created bool
+}
+
+func (t *memTransaction) refreshEntities(ctx context.Context, rev int64) {
+	for _, written := range t.written {
+		if err := db.RefreshHeader(written.entity, written.data, rev, written.created); err != nil {
+			logger.Error(ctx, "failed to refresh entity header", "xid", t.xid, "entity", fmt.Sprint(written.entity), "error", err)
+		}
+	}
+}
+
+func (t *memTransaction) addCmp(key string, target compareTarget, equal bool, rev int64, value []byte) {
+	t.cmps = append(t.cmps, compare{key: key, target: target, equal: equal, rev: rev, value: value})
+}
+
+func (t *memTransaction) addOp(op operation) {
+	for i := range t.ops {
+		if t.ops[i].key == op.key {
+			t.err = fmt.Errorf("Duplicate key %s in transaction %s", op.key, t.xid)
+			return
+		}
+	}
+	t.ops = append(t.ops, op)
+}
+
+func (t *memTransaction) Commit(ctx context.Context) (int64, error) {
+	if t.err != nil {
+		logger.Error(ctx, "aborting transaction", "xid", t.xid, "error", t.err)
+		return 0, t.err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	logger.Debug(ctx, "commiting transaction", "xid", t.xid)
+	s := t.conn.store
+	s.Lock()
+	defer s.Unlock()
+	for i := range t.cmps {
+		if !t.cmps[i].check(s.kvs[t.cmps[i].key]) {
+			return 0, &db.ConflictError{Xid: t.xid}
+		}
+	}
+	for i := range t.ops {
+		if lease := t.ops[i].lease; lease != 0 && !s.leases[lease] {
+			logger.Error(ctx, "error commiting transaction", "xid", t.xid, "error", ErrLeaseNotFound)
+			return 0, ErrLeaseNotFound
+		}
+	}
+	s.apply(t.ops)
+	t.refreshEntities(ctx, s.revision)
+	return s.revision, nil
+}
+
+func (t *memTransaction) Create(ctx context.Context, entity db.Entity) {
+	if t.err != nil {
+		return
+	}
+	logger.Debug(ctx, "creating entity", "xid", t.xid, "entity", fmt.Sprint(entity))
+	marshaledEntity, err := json.Marshal(entity)
+	if err != nil {
+		logger.Debug(ctx, "marshal failed", "xid", t.xid, "entity", fmt.Sprint(entity), "error", err)
+		t.err = err
+		return
+	}
+	key := db.DataKey(entity)
+	t.addCmp(key, targetVersion, true, 0, nil)
+	t.addOp(operation{key: key, data: marshaledEntity})
+	t.written = append(t.written, writtenEntity{entity: entity, data: marshaledEntity, created: true})
+}
+
+func (t *memTransaction) Update(ctx context.Context, entity db.Entity) {
+	if t.err != nil {
+		return
+	}
+	logger.Debug(ctx, "updating entity", "xid", t.xid, "entity", fmt.Sprint(entity))
+	marshaledEntity, err := json.Marshal(entity)
+	if err != nil {
+		logger.Debug(ctx, "marshal failed", "xid", t.xid, "entity", fmt.Sprint(entity), "error", err)
+		t.err = err
+		return
+	}
+	key := db.DataKey(entity)
+	t.addCmp(key, targetVersion, false, 0, nil)
+	t.addCmp(key, targetModifyRev, true, entity.Header().ModifyRev, nil)
+	t.addOp(operation{key: key, data: marshaledEntity})
+	t.written = append(t.written, writtenEntity{entity: entity, data: marshaledEntity})
+}
+
+func (t *memTransaction) Delete(ctx context.Context, entity db.Entity) {
+	if t.err != nil {
+		return
+	}
+	logger.Debug(ctx, "deleting entity", "xid", t.xid, "entity", fmt.Sprint(entity))
+	key := db.DataKey(entity)
+	t.addCmp(key, targetModifyRev, true, entity.Header().ModifyRev, nil)
+	t.addOp(operation{key: key, delete: true})
+}
+
+func (t *memTransaction) CreateMeta(ctx context.Context, key string, content string) {
+	if t.err != nil {
+		return
+	}
+	logger.Debug(ctx, "create meta", "key", key, "content", content, "xid", t.xid)
+	t.addCmp(key, targetVersion, true, 0, nil)
+	t.addOp(operation{key: key, data: []byte(content)})
+}
+
+func (t *memTransaction) DeleteMeta(ctx context.Context, key string) {
+	if t.err != nil {
+		return
+	}
+	logger.Debug(ctx, "delete meta", "key", key, "xid", t.xid)
+	t.addOp(operation{key: key, delete: true})
+}
+
+func (t *memTransaction) CheckMeta(ctx context.Context, key, content string) {
+	if t.err != nil {
+		return
+	}
+	logger.Debug(ctx, "check meta content", "key", key, "content", content, "xid", t.xid)
+	t.addCmp(key, targetValue, true, 0, []byte(content))
+}
+
+func (t *memTransaction) AcquireLock(ctx context.Context, session db.Session, key string) {
+	leaseId := session.(*memSession).leaseId
+	content := strconv.FormatInt(leaseId, 16)
+	logger.Debug(ctx, "acquiring lock", "key", key, "lease_id", content)
+	t.addCmp(key, targetVersion, true, 0, nil)
+	t.addOp(operation{key: key, data: []byte(content), lease: leaseId})
+}
+
+func (t *memTransaction) ReleaseLock(ctx context.Context, session db.Session, key string) {
+	leaseId := session.(*memSession).leaseId
+	content := strconv.FormatInt(leaseId, 16)
+	logger.Debug(ctx, "releasing lock", "key", key, "content", content)
+	t.addCmp(key, targetValue, true, 0, []byte(content))
+	t.addOp(operation{key: key, delete: true})
+}
@@ -30,4 +30,16 @@ const (
 	StateDeleting       State = "deleting"
 	StateDeleted        State = "deleted"
 	StateDecommissioned State = "decommissioned"
+	StateStarting       State = "starting"
+	StateStopping       State = "stopping"
+	StateStopped        State = "stopped"
+	StateRebooting      State = "rebooting"
+	StatePausing        State = "pausing"
+	StatePaused         State = "paused"
+	StateResuming       State = "resuming"
+	StateRollingBack    State = "rolling-back"
+	StateCapturing      State = "capturing"
+	StateResizing       State = "resizing"
+	StateAttaching      State = "attaching"
+	StateDetaching      State = "detaching"
 )
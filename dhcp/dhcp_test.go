@@ -0,0 +1,225 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/antonf/minicloud/netlink"
+	"github.com/antonf/minicloud/netlink/nettest"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPacket(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 300)
+	packet := &Packet{
+		Op:           opBootReply,
+		Xid:          42,
+		YourIP:       net.ParseIP("10.0.0.5"),
+		ClientHWAddr: net.HardwareAddr{0x52, 0x54, 0, 1, 2, 3},
+		Options: map[uint8][]byte{
+			OptionMessageType: {uint8(MessageOffer)},
+			OptionRouter:      {10, 0, 0, 1},
+			OptionHostname:    long,
+		},
+	}
+	data := packet.Marshal()
+	if data[headerLength+4] != OptionMessageType {
+		t.Fatalf("message type isn't first option: %v", data[headerLength+4:])
+	}
+	parsed, err := ParsePacket(data)
+	if err != nil {
+		t.Fatalf("failed to parse packet: %s", err)
+	}
+	if parsed.Xid != 42 || parsed.MessageType() != MessageOffer || !parsed.YourIP.Equal(packet.YourIP) || !parsed.ClientIP.Equal(net.IPv4zero) {
+		t.Fatalf("unexpected packet: %+v", parsed)
+	}
+	if parsed.ClientHWAddr.String() != "52:54:00:01:02:03" || !parsed.IPOption(OptionRouter).Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("unexpected packet: %+v", parsed)
+	}
+	// Option longer than 255 bytes is split
+	if !bytes.Equal(parsed.Options[OptionHostname], long) {
+		t.Fatalf("unexpected long option: %d bytes", len(parsed.Options[OptionHostname]))
+	}
+	if _, err := ParsePacket(data[:headerLength]); err != ErrInvalidPacket {
+		t.Fatalf("expected invalid packet, got %v", err)
+	}
+	data[len(data)-1], data[headerLength+4] = 0, OptionRouter
+	data[headerLength+5] = 255
+	if _, err := ParsePacket(data); err != ErrInvalidPacket {
+		t.Fatalf("expected invalid packet for truncated option, got %v", err)
+	}
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// Ethernet frame with UDP datagram broadcast by client without address
+func clientFrame(req *Packet) []byte {
+	payload := req.Marshal()
+	udpLen := 8 + len(payload)
+	frame := make([]byte, 14+20+udpLen)
+	copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:12], req.ClientHWAddr)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	ip := frame[14:34]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+udpLen))
+	ip[8], ip[9] = 64, syscall.IPPROTO_UDP
+	copy(ip[16:20], net.IPv4bcast.To4())
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip))
+	udp := frame[34:]
+	binary.BigEndian.PutUint16(udp[0:2], clientPort)
+	binary.BigEndian.PutUint16(udp[2:4], serverPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[8:], payload)
+	return frame
+}
+
+// Send request through tap and wait for reply with the same transaction id,
+// nil if there is none within timeout
+func exchange(t *testing.T, tap *os.File, req *Packet, timeout time.Duration) *Packet {
+	if _, err := tap.Write(clientFrame(req)); err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	tap.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	for {
+		nr, err := tap.Read(buf)
+		if os.IsTimeout(err) {
+			return nil
+		} else if err != nil {
+			t.Fatalf("failed to receive reply: %s", err)
+		}
+		frame := buf[:nr]
+		if nr < 42 || binary.BigEndian.Uint16(frame[12:14]) != 0x0800 || frame[23] != syscall.IPPROTO_UDP {
+			continue
+		}
+		udp := frame[14+int(frame[14]&0x0f)*4:]
+		if binary.BigEndian.Uint16(udp[2:4]) != clientPort {
+			continue
+		}
+		reply, err := ParsePacket(udp[8:])
+		if err != nil {
+			t.Fatalf("failed to parse reply: %s", err)
+		}
+		if reply.Xid == req.Xid {
+			return reply
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	nettest.EnterNetns(t)
+	ctx := context.Background()
+	s, err := netlink.Open()
+	if err != nil {
+		t.Fatalf("failed to open netlink socket: %s", err)
+	}
+	defer s.Close()
+	if err := s.LinkAdd(ctx, &netlink.Link{Name: "brtest", Kind: "bridge", Flags: syscall.IFF_UP}); err != nil {
+		t.Fatalf("failed to create bridge: %s", err)
+	}
+	tap := nettest.OpenTap(t, "taptest", "brtest")
+	defer tap.Close()
+
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	lease := &Lease{
+		IP:       net.ParseIP("10.0.0.5"),
+		Mask:     net.CIDRMask(24, 32),
+		Gateway:  net.ParseIP("10.0.0.1"),
+		DNS:      []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1")},
+		Hostname: "vm1",
+		Duration: time.Hour,
+	}
+	server, err := Listen("brtest", func(ctx context.Context, clientMac net.HardwareAddr) (*Lease, error) {
+		if clientMac.String() == mac.String() {
+			return lease, nil
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	done := make(chan error)
+	go func() { done <- server.Serve(ctx) }()
+
+	request := func(xid uint32, msgType MessageType, clientMac net.HardwareAddr, options map[uint8][]byte) *Packet {
+		req := &Packet{Op: opBootRequest, Xid: xid, ClientHWAddr: clientMac, Options: options}
+		req.Options[OptionMessageType] = []byte{uint8(msgType)}
+		return req
+	}
+
+	offer := exchange(t, tap, request(1, MessageDiscover, mac, map[uint8][]byte{}), 5*time.Second)
+	if offer == nil || offer.MessageType() != MessageOffer || !offer.YourIP.Equal(lease.IP) || offer.Op != opBootReply {
+		t.Fatalf("unexpected offer: %+v", offer)
+	}
+	if !offer.IPOption(OptionServerId).Equal(lease.Gateway) || !offer.IPOption(OptionRouter).Equal(lease.Gateway) {
+		t.Fatalf("unexpected offer options: %v", offer.Options)
+	}
+	if !bytes.Equal(offer.Options[OptionSubnetMask], []byte{255, 255, 255, 0}) || string(offer.Options[OptionHostname]) != "vm1" {
+		t.Fatalf("unexpected offer options: %v", offer.Options)
+	}
+	if !bytes.Equal(offer.Options[OptionDNS], []byte{8, 8, 8, 8, 1, 1, 1, 1}) || binary.BigEndian.Uint32(offer.Options[OptionLeaseTime]) != 3600 {
+		t.Fatalf("unexpected offer options: %v", offer.Options)
+	}
+
+	ack := exchange(t, tap, request(2, MessageRequest, mac, map[uint8][]byte{
+		OptionRequestedIP: {10, 0, 0, 5},
+		OptionServerId:    {10, 0, 0, 1},
+	}), 5*time.Second)
+	if ack == nil || ack.MessageType() != MessageAck || !ack.YourIP.Equal(lease.IP) {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+	nak := exchange(t, tap, request(3, MessageRequest, mac, map[uint8][]byte{
+		OptionRequestedIP: {10, 0, 0, 9},
+	}), 5*time.Second)
+	if nak == nil || nak.MessageType() != MessageNak || nak.YourIP.Equal(lease.IP) {
+		t.Fatalf("unexpected nak: %+v", nak)
+	}
+
+	// Unknown clients and requests to other servers are ignored
+	other, _ := net.ParseMAC("52:54:00:65:43:21")
+	if reply := exchange(t, tap, request(4, MessageDiscover, other, map[uint8][]byte{}), 200*time.Millisecond); reply != nil {
+		t.Fatalf("unknown client got reply: %+v", reply)
+	}
+	if reply := exchange(t, tap, request(5, MessageRequest, mac, map[uint8][]byte{
+		OptionRequestedIP: {10, 0, 0, 5},
+		OptionServerId:    {10, 0, 0, 2},
+	}), 200*time.Millisecond); reply != nil {
+		t.Fatalf("request to other server got reply: %+v", reply)
+	}
+
+	server.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("server failed: %s", err)
+	}
+}
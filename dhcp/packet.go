@@ -0,0 +1,187 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+)
+
+var ErrInvalidPacket = errors.New("Invalid DHCP packet")
+
+const (
+	opBootRequest = 1
+	opBootReply   = 2
+
+	hardwareEthernet = 1
+	// Fixed part of BOOTP packet followed by magic cookie
+	headerLength = 236
+	magicCookie  = 0x63825363
+	// Flag asking server to broadcast replies
+	flagBroadcast = 0x8000
+)
+
+type MessageType uint8
+
+const (
+	MessageDiscover MessageType = 1
+	MessageOffer    MessageType = 2
+	MessageRequest  MessageType = 3
+	MessageDecline  MessageType = 4
+	MessageAck      MessageType = 5
+	MessageNak      MessageType = 6
+	MessageRelease  MessageType = 7
+	MessageInform   MessageType = 8
+)
+
+const (
+	OptionPad           = 0
+	OptionSubnetMask    = 1
+	OptionRouter        = 3
+	OptionDNS           = 6
+	OptionHostname      = 12
+	OptionRequestedIP   = 50
+	OptionLeaseTime     = 51
+	OptionMessageType   = 53
+	OptionServerId      = 54
+	OptionParamRequests = 55
+	OptionRenewalTime   = 58
+	OptionRebindingTime = 59
+	OptionEnd           = 255
+)
+
+type Packet struct {
+	Op           uint8
+	Xid          uint32
+	Secs         uint16
+	Flags        uint16
+	ClientIP     net.IP
+	YourIP       net.IP
+	ServerIP     net.IP
+	RelayIP      net.IP
+	ClientHWAddr net.HardwareAddr
+	Options      map[uint8][]byte
+}
+
+func (p *Packet) MessageType() MessageType {
+	if value := p.Options[OptionMessageType]; len(value) == 1 {
+		return MessageType(value[0])
+	}
+	return 0
+}
+
+// Address option, nil if it's missing or malformed
+func (p *Packet) IPOption(code uint8) net.IP {
+	if value := p.Options[code]; len(value) == net.IPv4len {
+		return net.IP(value)
+	}
+	return nil
+}
+
+func ParsePacket(data []byte) (*Packet, error) {
+	if len(data) < headerLength+4 || binary.BigEndian.Uint32(data[headerLength:]) != magicCookie {
+		return nil, ErrInvalidPacket
+	}
+	if data[1] != hardwareEthernet || data[2] != 6 {
+		return nil, ErrInvalidPacket
+	}
+	// Packet shouldn't refer to buffer which is reused for next packet
+	data = append([]byte(nil), data...)
+	p := &Packet{
+		Op:           data[0],
+		Xid:          binary.BigEndian.Uint32(data[4:8]),
+		Secs:         binary.BigEndian.Uint16(data[8:10]),
+		Flags:        binary.BigEndian.Uint16(data[10:12]),
+		ClientIP:     net.IP(data[12:16]),
+		YourIP:       net.IP(data[16:20]),
+		ServerIP:     net.IP(data[20:24]),
+		RelayIP:      net.IP(data[24:28]),
+		ClientHWAddr: net.HardwareAddr(data[28:34]),
+		Options:      make(map[uint8][]byte),
+	}
+	// Options split into several parts are concatenated, see RFC 3396
+	options := data[headerLength+4:]
+	for len(options) > 0 {
+		code := options[0]
+		if code == OptionEnd {
+			break
+		} else if code == OptionPad {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return nil, ErrInvalidPacket
+		}
+		length := int(options[1])
+		p.Options[code] = append(p.Options[code], options[2:2+length]...)
+		options = options[2+length:]
+	}
+	return p, nil
+}
+
+func (p *Packet) Marshal() []byte {
+	data := make([]byte, headerLength+4, 300)
+	data[0] = p.Op
+	data[1] = hardwareEthernet
+	data[2] = 6
+	binary.BigEndian.PutUint32(data[4:8], p.Xid)
+	binary.BigEndian.PutUint16(data[8:10], p.Secs)
+	binary.BigEndian.PutUint16(data[10:12], p.Flags)
+	for offset, ip := range map[int]net.IP{12: p.ClientIP, 16: p.YourIP, 20: p.ServerIP, 24: p.RelayIP} {
+		if ip4 := ip.To4(); ip4 != nil {
+			copy(data[offset:offset+4], ip4)
+		}
+	}
+	copy(data[28:34], p.ClientHWAddr)
+	binary.BigEndian.PutUint32(data[headerLength:], magicCookie)
+
+	// Message type goes first, some clients expect it
+	codes := make([]int, 0, len(p.Options))
+	for code := range p.Options {
+		if code != OptionMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if _, ok := p.Options[OptionMessageType]; ok {
+		codes = append([]int{OptionMessageType}, codes...)
+	}
+	for _, code := range codes {
+		value := p.Options[uint8(code)]
+		for {
+			part := value
+			if len(part) > 255 {
+				part = part[:255]
+			}
+			data = append(data, uint8(code), uint8(len(part)))
+			data = append(data, part...)
+			value = value[len(part):]
+			if len(value) == 0 {
+				break
+			}
+		}
+	}
+	data = append(data, OptionEnd)
+	// BOOTP relays may drop packets shorter than 300 bytes
+	for len(data) < 300 {
+		data = append(data, OptionPad)
+	}
+	return data
+}
@@ -0,0 +1,186 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dhcp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	serverPort = 67
+	clientPort = 68
+)
+
+type Lease struct {
+	IP   net.IP
+	Mask net.IPMask
+	// Gateway also identifies server to client, as there is no other address
+	// server could be reached by within network
+	Gateway  net.IP
+	DNS      []net.IP
+	Hostname string
+	Duration time.Duration
+}
+
+// Lease of client with given hardware address, nil if client is unknown
+type LeaseFunc func(ctx context.Context, mac net.HardwareAddr) (*Lease, error)
+
+// Server answering requests of clients attached to single interface, like
+// bridge of network. Leases are static, so nothing is stored by server.
+type Server struct {
+	iface  string
+	conn   net.PacketConn
+	leases LeaseFunc
+	closed int32
+}
+
+func Listen(iface string, leases LeaseFunc) (*Server, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "dhcp-"+iface)
+	defer file.Close()
+	// Server of every interface listens on the same port
+	for _, opt := range []int{syscall.SO_REUSEADDR, syscall.SO_BROADCAST} {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, 1); err != nil {
+			return nil, err
+		}
+	}
+	if err := syscall.BindToDevice(fd, iface); err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: serverPort}); err != nil {
+		return nil, err
+	}
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{iface: iface, conn: conn, leases: leases}, nil
+}
+
+func (s *Server) Close() {
+	atomic.StoreInt32(&s.closed, 1)
+	s.conn.Close()
+}
+
+// Serve requests until server is closed
+func (s *Server) Serve(ctx context.Context) error {
+	buf := make([]byte, 1500)
+	for {
+		nr, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadInt32(&s.closed) != 0 {
+				return nil
+			}
+			return err
+		}
+		req, err := ParsePacket(buf[:nr])
+		if err != nil || req.Op != opBootRequest {
+			logger.Debug(ctx, "ignoring invalid packet", "interface", s.iface, "error", err)
+			continue
+		}
+		reply, err := s.handle(ctx, req)
+		if err != nil {
+			logger.Error(ctx, "failed to handle request", "interface", s.iface, "mac", req.ClientHWAddr, "error", err)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		// Client has no address yet, so replies are broadcast on interface
+		dst := &net.UDPAddr{IP: net.IPv4bcast, Port: clientPort}
+		if _, err := s.conn.WriteTo(reply.Marshal(), dst); err != nil {
+			logger.Error(ctx, "failed to send reply", "interface", s.iface, "mac", req.ClientHWAddr, "error", err)
+		}
+	}
+}
+
+func (s *Server) handle(ctx context.Context, req *Packet) (*Packet, error) {
+	msgType := req.MessageType()
+	// Declined and released addresses are still allocated to port
+	if msgType != MessageDiscover && msgType != MessageRequest && msgType != MessageInform {
+		return nil, nil
+	}
+	lease, err := s.leases(ctx, req.ClientHWAddr)
+	if err != nil || lease == nil {
+		return nil, err
+	}
+	if serverId := req.IPOption(OptionServerId); serverId != nil && !serverId.Equal(lease.Gateway) {
+		// Client has chosen offer of other server
+		return nil, nil
+	}
+	reply := &Packet{
+		Op:           opBootReply,
+		Xid:          req.Xid,
+		Flags:        req.Flags,
+		RelayIP:      req.RelayIP,
+		ClientHWAddr: req.ClientHWAddr,
+		Options: map[uint8][]byte{
+			OptionServerId: lease.Gateway.To4(),
+		},
+	}
+	switch msgType {
+	case MessageDiscover:
+		reply.Options[OptionMessageType] = []byte{uint8(MessageOffer)}
+		reply.YourIP = lease.IP
+	case MessageRequest:
+		requested := req.IPOption(OptionRequestedIP)
+		if requested == nil {
+			// Client renewing lease doesn't include requested address
+			requested = req.ClientIP
+		}
+		if !requested.Equal(lease.IP) {
+			logger.Info(ctx, "rejecting request of unknown address", "interface", s.iface, "mac", req.ClientHWAddr, "ip", requested)
+			reply.Options[OptionMessageType] = []byte{uint8(MessageNak)}
+			return reply, nil
+		}
+		reply.Options[OptionMessageType] = []byte{uint8(MessageAck)}
+		reply.YourIP = lease.IP
+		logger.Info(ctx, "address leased", "interface", s.iface, "mac", req.ClientHWAddr, "ip", lease.IP)
+	case MessageInform:
+		// Client configured address itself and wants only other parameters
+		reply.Options[OptionMessageType] = []byte{uint8(MessageAck)}
+		reply.ClientIP = req.ClientIP
+	}
+	if msgType != MessageInform {
+		duration := make([]byte, 4)
+		binary.BigEndian.PutUint32(duration, uint32(lease.Duration/time.Second))
+		reply.Options[OptionLeaseTime] = duration
+	}
+	reply.Options[OptionSubnetMask] = []byte(lease.Mask)
+	reply.Options[OptionRouter] = lease.Gateway.To4()
+	if len(lease.DNS) != 0 {
+		var dns []byte
+		for _, ip := range lease.DNS {
+			dns = append(dns, ip.To4()...)
+		}
+		reply.Options[OptionDNS] = dns
+	}
+	if lease.Hostname != "" {
+		reply.Options[OptionHostname] = []byte(lease.Hostname)
+	}
+	return reply, nil
+}
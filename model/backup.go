@@ -0,0 +1,154 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antonf/minicloud/config"
+	"github.com/antonf/minicloud/db"
+	"io"
+	"strings"
+)
+
+const backupVersion = 1
+
+var (
+	// Name uniqueness keys are not backed up and re-created from entities
+	// on restore
+	backupPrefixes = []string{
+		db.DataPrefix + "/",
+		prefix,
+		usagePrefix,
+		config.GlobalConfigPrefix + "/",
+	}
+	ErrKeyspaceNotEmpty = errors.New("Keyspace should be empty for restore")
+)
+
+type BackupArchive struct {
+	Version  int
+	Revision int64
+	Values   []BackupValue
+}
+
+type BackupValue struct {
+	Key   string
+	Value string
+}
+
+// Write consistent snapshot of MiniCloud keyspace as JSON archive
+func Backup(ctx context.Context, conn db.Connection, w io.Writer) error {
+	archive := &BackupArchive{Version: backupVersion}
+	for _, backupPrefix := range backupPrefixes {
+		rev, err := scanPrefix(ctx, conn, backupPrefix, archive.Revision, func(value *db.RawValue) error {
+			if backupPrefix == prefix && strings.HasSuffix(value.Key, "/lock") {
+				return nil
+			}
+			archive.Values = append(archive.Values, BackupValue{Key: value.Key, Value: string(value.Data)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		archive.Revision = rev
+	}
+	logger.Info(ctx, "keyspace backed up", "revision", archive.Revision, "keys", len(archive.Values))
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(archive)
+}
+
+// Restore archive written by Backup into empty keyspace, MiniCloud shouldn't
+// be running meanwhile. Keys are restored in separate transactions, so if
+// restore fails midway it can be run again with the same archive, which skips
+// keys restored already. Keyspace may contain only keys of the archive.
+func Restore(ctx context.Context, conn db.Connection, r io.Reader) error {
+	archive := &BackupArchive{}
+	if err := json.NewDecoder(r).Decode(archive); err != nil {
+		return err
+	}
+	if archive.Version != backupVersion {
+		return fmt.Errorf("Unsupported backup version %d", archive.Version)
+	}
+	// Contents of keys written by restore, including unique keys of entities
+	expected := make(map[string]string)
+	keyEntities := make(map[string]db.Entity)
+	for _, value := range archive.Values {
+		expected[value.Key] = value.Value
+		if strings.HasPrefix(value.Key, db.DataPrefix+"/") {
+			entity, err := decodeKeyEntity(value.Key, []byte(value.Value))
+			if err != nil {
+				return err
+			}
+			keyEntities[value.Key] = entity
+			for _, key := range uniqueKeys(entity) {
+				expected[key] = entity.Header().Id.String()
+			}
+		} else if !hasBackupPrefix(value.Key) {
+			return fmt.Errorf("Unexpected key %s in backup", value.Key)
+		}
+	}
+	for _, checkPrefix := range []string{db.DataPrefix + "/", db.MetaPrefix + "/", config.GlobalConfigPrefix + "/"} {
+		_, err := scanPrefix(ctx, conn, checkPrefix, 0, func(value *db.RawValue) error {
+			if content, ok := expected[value.Key]; !ok || content != string(value.Data) {
+				return ErrKeyspaceNotEmpty
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	restored, skipped := 0, 0
+	for _, value := range archive.Values {
+		existing, err := conn.RawRead(ctx, value.Key)
+		if err != nil {
+			return err
+		}
+		if existing.Data != nil {
+			// Restored by previous run together with its unique keys
+			skipped += 1
+			continue
+		}
+		txn := conn.NewTransaction()
+		txn.CreateMeta(ctx, value.Key, value.Value)
+		if entity := keyEntities[value.Key]; entity != nil {
+			for _, key := range uniqueKeys(entity) {
+				txn.CreateMeta(ctx, key, entity.Header().Id.String())
+			}
+		}
+		if _, err := txn.Commit(ctx); err != nil {
+			logger.Error(ctx, "restore interrupted, run it again to complete", "key", value.Key, "restored", restored+skipped, "keys", len(archive.Values), "error", err)
+			return err
+		}
+		restored += 1
+	}
+	logger.Info(ctx, "keyspace restored", "revision", archive.Revision, "keys", len(archive.Values), "skipped", skipped)
+	return nil
+}
+
+func hasBackupPrefix(key string) bool {
+	for _, backupPrefix := range backupPrefixes {
+		if strings.HasPrefix(key, backupPrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/antonf/minicloud/config"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	// Disk creation records usage event
+	createDisk(t, conn, project)
+	notificationKey := prefix + "project/" + project.Id.String() + "/created"
+	txn := conn.NewTransaction()
+	txn.CreateMeta(ctx, config.GlobalConfigPrefix+"/retry_count", "7")
+	txn.CreateMeta(ctx, notificationKey, project.Id.String())
+	txn.AcquireLock(ctx, conn.Session(), notificationKey+"/lock")
+	if _, err := txn.Commit(ctx); err != nil {
+		t.Fatalf("failed to create meta keys: %s", err)
+	}
+
+	archive := &bytes.Buffer{}
+	if err := Backup(ctx, conn, archive); err != nil {
+		t.Fatalf("backup failed: %s", err)
+	}
+	if err := Restore(ctx, conn, bytes.NewReader(archive.Bytes())); err != ErrKeyspaceNotEmpty {
+		t.Fatalf("restored into non-empty keyspace: %v", err)
+	}
+
+	restored := memdb.NewConnection()
+	if err := Restore(ctx, restored, bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatalf("restore failed: %s", err)
+	}
+	if stored, err := Projects(restored).Get(ctx, project.Id); err != nil || stored.Name != "foo" {
+		t.Fatalf("project not restored: %v (%v)", stored, err)
+	}
+	for key, expected := range map[string]string{
+		config.GlobalConfigPrefix + "/retry_count": "7",
+		notificationKey:           project.Id.String(),
+		notificationKey + "/lock": "",
+	} {
+		if value, _ := restored.RawRead(ctx, key); string(value.Data) != expected {
+			t.Fatalf("unexpected value of %s after restore: %q", key, value.Data)
+		}
+	}
+	now := time.Now()
+	usage, err := ProjectUsage(ctx, restored, project.Id, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil || len(usage.Disks) != 1 {
+		t.Fatalf("usage not restored: %+v (%v)", usage, err)
+	}
+
+	// Restore that failed midway is completed by running it again
+	partial := memdb.NewConnection()
+	first := archive.Bytes()
+	decoded := &BackupArchive{}
+	if err := json.Unmarshal(first, decoded); err != nil {
+		t.Fatalf("failed to decode archive: %s", err)
+	}
+	txn = partial.NewTransaction()
+	txn.CreateMeta(ctx, decoded.Values[0].Key, decoded.Values[0].Value)
+	if _, err := txn.Commit(ctx); err != nil {
+		t.Fatalf("failed to write restored key: %s", err)
+	}
+	if err := Restore(ctx, partial, bytes.NewReader(first)); err != nil {
+		t.Fatalf("failed to resume restore: %s", err)
+	}
+	if stored, err := Projects(partial).Get(ctx, project.Id); err != nil || stored.Name != "foo" {
+		t.Fatalf("project not restored: %v (%v)", stored, err)
+	}
+	if err := Restore(ctx, partial, bytes.NewReader(first)); err != nil {
+		t.Fatalf("failed to run completed restore again: %s", err)
+	}
+	txn = partial.NewTransaction()
+	txn.CreateMeta(ctx, config.GlobalConfigPrefix+"/other", "1")
+	if _, err := txn.Commit(ctx); err != nil {
+		t.Fatalf("failed to create meta key: %s", err)
+	}
+	if err := Restore(ctx, partial, bytes.NewReader(first)); err != ErrKeyspaceNotEmpty {
+		t.Fatalf("restored into keyspace with foreign keys: %v", err)
+	}
+
+	// Name uniqueness should be enforced for restored projects
+	duplicate := Projects(restored).NewEntity()
+	duplicate.Name = "foo"
+	err = Projects(restored).Create(ctx, duplicate, db.InitiatorUser)
+	if _, ok := err.(*db.ConflictError); !ok {
+		t.Fatalf("expected conflict creating project with restored name, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonf/minicloud/config"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/dhcp"
+	"github.com/antonf/minicloud/log"
+	"github.com/antonf/minicloud/qemu"
+	"github.com/antonf/minicloud/utils"
+	"github.com/oklog/ulid"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var OptDHCPLeaseTime = config.NewDurationOpt("dhcp_lease_time", time.Hour)
+
+// DHCP server runs on bridge of every network servers of this host are
+// attached to, so guests get addresses of their ports
+type dhcpService struct {
+	conn    db.Connection
+	lock    sync.Mutex
+	servers map[string]*dhcp.Server
+}
+
+func ServeDHCP(conn db.Connection) {
+	qemu.RegisterBridgeService(&dhcpService{conn: conn, servers: make(map[string]*dhcp.Server)})
+}
+
+func (s *dhcpService) Start(ctx context.Context, bridge string) error {
+	server, err := dhcp.Listen(bridge, func(ctx context.Context, mac net.HardwareAddr) (*dhcp.Lease, error) {
+		return portLease(ctx, s.conn, bridge, mac)
+	})
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.servers[bridge] = server
+	s.lock.Unlock()
+	// Bridge outlives VM it was created for, so does server
+	serverCtx := log.WithValues(context.Background(), "bridge", bridge)
+	go func() {
+		if err := server.Serve(serverCtx); err != nil {
+			logger.Error(serverCtx, "DHCP server failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+func (s *dhcpService) Stop(ctx context.Context, bridge string) {
+	s.lock.Lock()
+	server := s.servers[bridge]
+	delete(s.servers, bridge)
+	s.lock.Unlock()
+	if server != nil {
+		server.Close()
+	}
+}
+
+// Lease of port with MAC address if it's attached to server and belongs to
+// network of bridge, nil otherwise
+func portLease(ctx context.Context, conn db.Connection, bridge string, mac net.HardwareAddr) (*dhcp.Lease, error) {
+	value, err := conn.RawRead(ctx, fmt.Sprintf("%s/port/macaddress/%s", db.MetaPrefix, mac))
+	if err != nil || value.Data == nil {
+		return nil, err
+	}
+	portId, err := ulid.Parse(string(value.Data))
+	if err != nil {
+		return nil, err
+	}
+	port, err := Ports(conn).Get(ctx, portId)
+	if _, notFound := err.(*db.NotFoundError); notFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if port.ServerId == utils.Zero {
+		return nil, nil
+	}
+	network, err := Networks(conn).Get(ctx, port.NetworkId)
+	if err != nil {
+		return nil, err
+	}
+	if network.BridgeName != bridge {
+		return nil, nil
+	}
+	server, err := Servers(conn).Get(ctx, port.ServerId)
+	if err != nil {
+		return nil, err
+	}
+	_, ipNet, err := net.ParseCIDR(network.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	lease := &dhcp.Lease{
+		IP:       net.ParseIP(port.IPAddress),
+		Mask:     ipNet.Mask,
+		Gateway:  net.ParseIP(network.Gateway),
+		Hostname: server.Name,
+		Duration: OptDHCPLeaseTime.Value(),
+	}
+	if network.DNS != "" {
+		for _, addr := range strings.Split(network.DNS, ",") {
+			lease.DNS = append(lease.DNS, net.ParseIP(addr))
+		}
+	}
+	return lease, nil
+}
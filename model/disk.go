@@ -15,11 +15,13 @@
  * You should have received a copy of the GNU Affero General Public License
  * along with this program.  If not, see <http://www.gnu.org/licenses/>.
  */
+
+// Code generated by gen/main.go from entities.json. DO NOT EDIT.
+
 package model
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/antonf/minicloud/db"
 	"github.com/antonf/minicloud/utils"
@@ -34,7 +36,37 @@ func Disks(conn db.Connection) *DiskManager {
 	return &DiskManager{conn: conn}
 }
 func (m *DiskManager) NewEntity() *Disk {
-	return &Disk{EntityHeader: db.EntityHeader{SchemaVersion: 1, State: db.StateCreated}}
+	return &Disk{EntityHeader: db.EntityHeader{SchemaVersion: SchemaVersion("Disk"), State: db.StateCreated}}
+}
+func (m *DiskManager) List(ctx context.Context, opts *ListOptions) ([]*Disk, string, error) {
+	if opts.Name != "" {
+		return nil, "", &db.FieldError{Entity: "disk", Field: "Name", Message: "Filter not supported"}
+	}
+	if opts.DiskId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "disk", Field: "DiskId", Message: "Filter not supported"}
+	}
+	if opts.NetworkId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "disk", Field: "NetworkId", Message: "Filter not supported"}
+	}
+	result := []*Disk{}
+	next, err := listEntities(ctx, m.conn, "disk", opts, func(value *db.RawValue) (bool, error) {
+		entity := &Disk{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return false, err
+		}
+		if !opts.matchState(entity.State) || !opts.matchProject(entity.ProjectId) {
+			return false, nil
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result = append(result, entity)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return result, next, nil
 }
 func (m *DiskManager) Get(ctx context.Context, id ulid.ULID) (*Disk, error) {
 	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/data/disk/%s", id))
@@ -45,7 +77,24 @@ func (m *DiskManager) Get(ctx context.Context, id ulid.ULID) (*Disk, error) {
 		return nil, &db.NotFoundError{Entity: "Disk", Id: id}
 	}
 	entity := &Disk{}
-	if err := json.Unmarshal(value.Data, entity); err != nil {
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *DiskManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (*Disk, error) {
+	value, err := m.conn.RawReadRev(ctx, fmt.Sprintf("/minicloud/db/data/disk/%s", id), rev)
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Disk", Id: id}
+	}
+	entity := &Disk{}
+	if err := decodeEntity(value.Data, entity); err != nil {
 		return nil, err
 	}
 	entity.CreateRev = value.CreateRev
@@ -53,6 +102,27 @@ func (m *DiskManager) Get(ctx context.Context, id ulid.ULID) (*Disk, error) {
 	entity.Original = entity.Copy()
 	return entity, nil
 }
+func (m *DiskManager) History(ctx context.Context, id ulid.ULID, limit int) ([]*Disk, error) {
+	values, err := m.conn.RawReadHistory(ctx, fmt.Sprintf("/minicloud/db/data/disk/%s", id), limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &db.NotFoundError{Entity: "Disk", Id: id}
+	}
+	result := make([]*Disk, len(values))
+	for i, value := range values {
+		entity := &Disk{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return nil, err
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result[i] = entity
+	}
+	return result, nil
+}
 func (m *DiskManager) Create(ctx context.Context, entity *Disk, initiator db.Initiator) error {
 	entity.Id = utils.NewULID()
 	if err := DiskFSM.CheckInitialState(entity.State); err != nil {
@@ -61,12 +131,20 @@ func (m *DiskManager) Create(ctx context.Context, entity *Disk, initiator db.Ini
 	if entity.ServerId != utils.Zero {
 		return &db.FieldError{Entity: "disk", Field: "ServerId", Message: "Should be empty"}
 	}
+	if len(entity.SnapshotIds) != 0 {
+		return &db.FieldError{Entity: "disk", Field: "SnapshotIds", Message: "Should be empty"}
+	}
 	txn := m.conn.NewTransaction()
 	txn.Create(ctx, entity)
 	if project, err := Projects(m.conn).Get(ctx, entity.ProjectId); err != nil {
 		return err
 	} else {
 		project.DiskIds = append(project.DiskIds, entity.Id)
+		if usage, err := diskUsage(ctx, m.conn, entity); err != nil {
+			return err
+		} else if err := project.charge(usage); err != nil {
+			return err
+		}
 		txn.Update(ctx, project)
 	}
 	if image, err := Images(m.conn).Get(ctx, entity.ImageId); err != nil {
@@ -76,10 +154,16 @@ func (m *DiskManager) Create(ctx context.Context, entity *Disk, initiator db.Ini
 		txn.Update(ctx, image)
 	}
 	DiskFSM.Notify(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *DiskManager) Update(ctx context.Context, entity *Disk, initiator db.Initiator) error {
 	origEntity := entity.Original.(*Disk)
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if err := DiskFSM.CheckTransition(origEntity.State, entity.State, initiator); err != nil {
 		return err
 	}
@@ -92,45 +176,97 @@ func (m *DiskManager) Update(ctx context.Context, entity *Disk, initiator db.Ini
 	if entity.ServerId != origEntity.ServerId {
 		return &db.FieldError{Entity: "disk", Field: "ServerId", Message: "Field change prohibited"}
 	}
+	if !utils.ULIDListsEqual(entity.SnapshotIds, origEntity.SnapshotIds) {
+		return &db.FieldError{Entity: "disk", Field: "SnapshotIds", Message: "Field change prohibited"}
+	}
 	txn := m.conn.NewTransaction()
 	txn.Update(ctx, entity)
+	if entity.Size != origEntity.Size {
+		project, err := Projects(m.conn).Get(ctx, entity.ProjectId)
+		if err != nil {
+			return err
+		}
+		origUsage, err := diskUsage(ctx, m.conn, origEntity)
+		if err != nil {
+			return err
+		}
+		usage, err := diskUsage(ctx, m.conn, entity)
+		if err != nil {
+			return err
+		}
+		project.release(origUsage)
+		if err := project.charge(usage); err != nil {
+			return err
+		}
+		txn.Update(ctx, project)
+	}
 	DiskFSM.Notify(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if entity.State == db.StateReady && origEntity.State != db.StateReady {
+		if usage, err := diskUsage(ctx, m.conn, entity); err != nil {
+			return err
+		} else if err := recordUsage(ctx, txn, entity, usage); err != nil {
+			return err
+		}
+	}
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *DiskManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
 	entity, err := Disks(m.conn).Get(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if err := DiskFSM.CheckTransition(entity.State, db.StateDeleting, initiator); err != nil {
 		return err
 	}
 	if entity.ServerId != utils.Zero {
 		return &db.FieldError{Entity: "disk", Field: "ServerId", Message: "Should be empty"}
 	}
+	if len(entity.SnapshotIds) != 0 {
+		return &db.FieldError{Entity: "disk", Field: "SnapshotIds", Message: "Should be empty"}
+	}
 	entity.State = db.StateDeleting
 	txn := m.conn.NewTransaction()
 	txn.Update(ctx, entity)
 	DiskFSM.Notify(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *DiskManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
 	entity, err := Disks(m.conn).Get(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if err := DiskFSM.CheckTransition(entity.State, db.StateDeleted, initiator); err != nil {
 		return err
 	}
 	if entity.ServerId != utils.Zero {
 		return &db.FieldError{Entity: "disk", Field: "ServerId", Message: "Should be empty"}
 	}
+	if len(entity.SnapshotIds) != 0 {
+		return &db.FieldError{Entity: "disk", Field: "SnapshotIds", Message: "Should be empty"}
+	}
 	txn := m.conn.NewTransaction()
 	txn.Delete(ctx, entity)
 	if project, err := Projects(m.conn).Get(ctx, entity.ProjectId); err != nil {
 		return err
 	} else {
 		project.DiskIds = utils.RemoveULID(project.DiskIds, entity.Id)
+		if usage, err := diskUsage(ctx, m.conn, entity); err != nil {
+			return err
+		} else {
+			project.release(usage)
+		}
 		txn.Update(ctx, project)
 	}
 	if image, err := Images(m.conn).Get(ctx, entity.ImageId); err != nil {
@@ -140,5 +276,83 @@ func (m *DiskManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Ini
 		txn.Update(ctx, image)
 	}
 	DiskFSM.DeleteNotification(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if err := recordUsage(ctx, txn, entity, Quota{}); err != nil {
+		return err
+	}
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+type diskManager struct {
+	typed *DiskManager
+}
+
+func init() {
+	registerManager("disk", true, func(conn db.Connection) Manager {
+		return &diskManager{typed: Disks(conn)}
+	})
+}
+func (m *diskManager) EntityName() string {
+	return "Disk"
+}
+func (m *diskManager) StateMachine() *StateMachine {
+	return DiskFSM
+}
+func (m *diskManager) NewEntity() db.Entity {
+	return m.typed.NewEntity()
+}
+func (m *diskManager) List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error) {
+	entities, next, err := m.typed.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, next, nil
+}
+func (m *diskManager) Get(ctx context.Context, id ulid.ULID) (db.Entity, error) {
+	entity, err := m.typed.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *diskManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (db.Entity, error) {
+	entity, err := m.typed.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *diskManager) History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error) {
+	entities, err := m.typed.History(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *diskManager) Create(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Disk)
+	if !ok {
+		return &EntityTypeError{Expected: "Disk", Actual: entity.EntityName()}
+	}
+	return m.typed.Create(ctx, typedEntity, initiator)
+}
+func (m *diskManager) Update(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Disk)
+	if !ok {
+		return &EntityTypeError{Expected: "Disk", Actual: entity.EntityName()}
+	}
+	return m.typed.Update(ctx, typedEntity, initiator)
+}
+func (m *diskManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	return m.typed.IntentDelete(ctx, id, initiator)
 }
@@ -36,6 +36,18 @@ func init() {
 		SystemTransition(db.StateUpdated, db.StateReady).
 		SystemTransition(db.StateInUse, db.StateReady).
 		SystemTransition(db.StateReady, db.StateInUse).
+		SystemTransition(db.StateReady, db.StateRollingBack).
+		SystemTransition(db.StateInUse, db.StateRollingBack).
+		SystemTransition(db.StateRollingBack, db.StateReady).
+		SystemTransition(db.StateReady, db.StateCapturing).
+		SystemTransition(db.StateInUse, db.StateCapturing).
+		SystemTransition(db.StateCapturing, db.StateReady).
+		SystemTransition(db.StateReady, db.StateAttaching).
+		SystemTransition(db.StateAttaching, db.StateInUse).
+		SystemTransition(db.StateAttaching, db.StateReady).
+		SystemTransition(db.StateInUse, db.StateDetaching).
+		SystemTransition(db.StateDetaching, db.StateReady).
+		SystemTransition(db.StateDetaching, db.StateInUse).
 		SystemTransition(db.StateCreated, db.StateError).
 		SystemTransition(db.StateReady, db.StateError).
 		SystemTransition(db.StateUpdated, db.StateError).
@@ -43,7 +55,47 @@ func init() {
 		SystemTransition(db.StateDeleting, db.StateDeleted).
 		Hook(db.StateCreated, HandleDiskCreated).
 		Hook(db.StateUpdated, HandleDiskUpdated).
-		Hook(db.StateDeleting, HandleDiskDeleting)
+		Hook(db.StateDeleting, HandleDiskDeleting).
+		Hook(db.StateAttaching, HandleDiskAttaching).
+		Hook(db.StateDetaching, HandleDiskDetaching)
+}
+
+// Switch disk to busy state in txn while its content is changed or copied,
+// server using disk should be stopped and is updated in txn as well, so that
+// concurrent start, attach or detach conflicts with txn
+func holdDisk(ctx context.Context, conn db.Connection, txn db.Transaction, disk *Disk, state db.State) error {
+	if disk.ServerId != utils.Zero {
+		server, err := Servers(conn).Get(ctx, disk.ServerId)
+		if err != nil {
+			return err
+		}
+		if server.State != db.StateStopped {
+			return &db.FieldError{Entity: "disk", Field: "ServerId", Message: "Disk is used by running server"}
+		}
+		txn.Update(ctx, server)
+	}
+	if err := DiskFSM.ChangeState(disk, state, db.InitiatorSystem); err != nil {
+		return err
+	}
+	txn.Update(ctx, disk)
+	DiskFSM.Notify(ctx, txn, disk)
+	return nil
+}
+
+// Switch busy disk back to ready or in-use state in txn. Busy disk can't be
+// claimed by server directly, so it goes through ready state.
+func releaseHeldDisk(ctx context.Context, txn db.Transaction, disk *Disk) error {
+	if err := DiskFSM.ChangeState(disk, db.StateReady, db.InitiatorSystem); err != nil {
+		return err
+	}
+	if disk.ServerId != utils.Zero {
+		if err := DiskFSM.ChangeState(disk, db.StateInUse, db.InitiatorSystem); err != nil {
+			return err
+		}
+	}
+	txn.Update(ctx, disk)
+	DiskFSM.Notify(ctx, txn, disk)
+	return nil
 }
 
 func HandleDiskCreated(ctx context.Context, conn db.Connection, entity db.Entity) {
@@ -83,14 +135,19 @@ func HandleDiskDeleting(ctx context.Context, conn db.Connection, entity db.Entit
 	diskManager := Disks(conn)
 	if err := ceph.DeleteDisk(ctx, disk.Pool, disk.Id.String()); err != nil {
 		logger.Debug(ctx, "setting disk state to error", "id", disk.Id, "cause", err)
+		id := disk.Id
 		utils.Retry(ctx, func(ctx context.Context) error {
-			disk, err := diskManager.Get(ctx, disk.Id)
-			if err != nil {
-				return err
+			// Re-read disk only if previous attempt failed
+			if disk == nil {
+				var err error
+				if disk, err = diskManager.Get(ctx, id); err != nil {
+					return err
+				}
 			}
 			disk.State = db.StateError
 			if err := diskManager.Update(ctx, disk, db.InitiatorSystem); err != nil {
-				logger.Error(ctx, "failed to change disk state", "id", disk.Id, "state", disk.State, "error", err)
+				logger.Error(ctx, "failed to change disk state", "id", id, "state", disk.State, "error", err)
+				disk = nil
 				return err
 			}
 			return nil
@@ -104,3 +161,23 @@ func HandleDiskDeleting(ctx context.Context, conn db.Connection, entity db.Entit
 		logger.Error(ctx, "failed to delete disk from database", "id", disk.Id, "error", err)
 	}
 }
+
+func setDiskState(ctx context.Context, conn db.Connection, disk *Disk, state db.State) {
+	id := disk.Id
+	utils.Retry(ctx, func(ctx context.Context) error {
+		// Re-read disk only if previous attempt failed
+		if disk == nil {
+			var err error
+			if disk, err = Disks(conn).Get(ctx, id); err != nil {
+				return err
+			}
+		}
+		disk.State = state
+		if err := Disks(conn).Update(ctx, disk, db.InitiatorSystem); err != nil {
+			logger.Error(ctx, "failed to change disk state", "id", id, "state", state, "error", err)
+			disk = nil
+			return err
+		}
+		return nil
+	})
+}
@@ -15,6 +15,9 @@
  * You should have received a copy of the GNU Affero General Public License
  * along with this program.  If not, see <http://www.gnu.org/licenses/>.
  */
+
+// Code generated by gen/main.go from entities.json. DO NOT EDIT.
+
 package model
 
 import (
@@ -26,10 +29,13 @@ import (
 
 type Project struct {
 	db.EntityHeader
-	Name      string
-	ImageIds  []ulid.ULID
-	DiskIds   []ulid.ULID
-	ServerIds []ulid.ULID
+	Name       string
+	ImageIds   []ulid.ULID
+	DiskIds    []ulid.ULID
+	ServerIds  []ulid.ULID
+	NetworkIds []ulid.ULID
+	Limits     Quota
+	Usage      Quota
 }
 
 func (e *Project) String() string {
@@ -39,7 +45,7 @@ func (e *Project) EntityName() string {
 	return "Project"
 }
 func (e *Project) Copy() *Project {
-	return &Project{EntityHeader: e.EntityHeader, Name: e.Name, ImageIds: utils.ULIDListCopy(e.ImageIds), DiskIds: utils.ULIDListCopy(e.DiskIds), ServerIds: utils.ULIDListCopy(e.ServerIds)}
+	return &Project{EntityHeader: e.EntityHeader, Name: e.Name, ImageIds: utils.ULIDListCopy(e.ImageIds), DiskIds: utils.ULIDListCopy(e.DiskIds), ServerIds: utils.ULIDListCopy(e.ServerIds), NetworkIds: utils.ULIDListCopy(e.NetworkIds), Limits: e.Limits, Usage: e.Usage}
 }
 
 type Flavor struct {
@@ -51,7 +57,7 @@ type Flavor struct {
 }
 
 func (e *Flavor) String() string {
-	return fmt.Sprintf("Flavor{Id:%s Name:%s NumCPUs:%s RAM:%s [sv=%d cr=%d mr=%d]}", e.Id, e.Name, e.NumCPUs, e.RAM, e.SchemaVersion, e.CreateRev, e.ModifyRev)
+	return fmt.Sprintf("Flavor{Id:%s Name:%s NumCPUs:%d RAM:%d [sv=%d cr=%d mr=%d]}", e.Id, e.Name, e.NumCPUs, e.RAM, e.SchemaVersion, e.CreateRev, e.ModifyRev)
 }
 func (e *Flavor) EntityName() string {
 	return "Flavor"
@@ -62,10 +68,11 @@ func (e *Flavor) Copy() *Flavor {
 
 type Image struct {
 	db.EntityHeader
-	Name      string
-	Checksum  string
-	ProjectId ulid.ULID
-	DiskIds   []ulid.ULID
+	Name         string
+	Checksum     string
+	SourceDiskId ulid.ULID
+	ProjectId    ulid.ULID
+	DiskIds      []ulid.ULID
 }
 
 func (e *Image) String() string {
@@ -75,17 +82,18 @@ func (e *Image) EntityName() string {
 	return "Image"
 }
 func (e *Image) Copy() *Image {
-	return &Image{EntityHeader: e.EntityHeader, Name: e.Name, Checksum: e.Checksum, ProjectId: e.ProjectId, DiskIds: utils.ULIDListCopy(e.DiskIds)}
+	return &Image{EntityHeader: e.EntityHeader, Name: e.Name, Checksum: e.Checksum, SourceDiskId: e.SourceDiskId, ProjectId: e.ProjectId, DiskIds: utils.ULIDListCopy(e.DiskIds)}
 }
 
 type Disk struct {
 	db.EntityHeader
-	ProjectId ulid.ULID
-	ImageId   ulid.ULID
-	Desc      string
-	Pool      string
-	Size      uint64
-	ServerId  ulid.ULID
+	ProjectId   ulid.ULID
+	ImageId     ulid.ULID
+	Desc        string
+	Pool        string
+	Size        uint64
+	ServerId    ulid.ULID
+	SnapshotIds []ulid.ULID
 }
 
 func (e *Disk) String() string {
@@ -95,7 +103,24 @@ func (e *Disk) EntityName() string {
 	return "Disk"
 }
 func (e *Disk) Copy() *Disk {
-	return &Disk{EntityHeader: e.EntityHeader, ProjectId: e.ProjectId, ImageId: e.ImageId, Desc: e.Desc, Pool: e.Pool, Size: e.Size, ServerId: e.ServerId}
+	return &Disk{EntityHeader: e.EntityHeader, ProjectId: e.ProjectId, ImageId: e.ImageId, Desc: e.Desc, Pool: e.Pool, Size: e.Size, ServerId: e.ServerId, SnapshotIds: utils.ULIDListCopy(e.SnapshotIds)}
+}
+
+type Snapshot struct {
+	db.EntityHeader
+	DiskId ulid.ULID
+	Name   string
+	Desc   string
+}
+
+func (e *Snapshot) String() string {
+	return fmt.Sprintf("Snapshot{Id:%s Name:%s [sv=%d cr=%d mr=%d]}", e.Id, e.Name, e.SchemaVersion, e.CreateRev, e.ModifyRev)
+}
+func (e *Snapshot) EntityName() string {
+	return "Snapshot"
+}
+func (e *Snapshot) Copy() *Snapshot {
+	return &Snapshot{EntityHeader: e.EntityHeader, DiskId: e.DiskId, Name: e.Name, Desc: e.Desc}
 }
 
 type Server struct {
@@ -103,6 +128,7 @@ type Server struct {
 	ProjectId ulid.ULID
 	FlavorId  ulid.ULID
 	DiskIds   []ulid.ULID
+	PortIds   []ulid.ULID
 	Name      string
 }
 
@@ -113,5 +139,67 @@ func (e *Server) EntityName() string {
 	return "Server"
 }
 func (e *Server) Copy() *Server {
-	return &Server{EntityHeader: e.EntityHeader, ProjectId: e.ProjectId, FlavorId: e.FlavorId, DiskIds: utils.ULIDListCopy(e.DiskIds), Name: e.Name}
+	return &Server{EntityHeader: e.EntityHeader, ProjectId: e.ProjectId, FlavorId: e.FlavorId, DiskIds: utils.ULIDListCopy(e.DiskIds), PortIds: utils.ULIDListCopy(e.PortIds), Name: e.Name}
+}
+
+type Network struct {
+	db.EntityHeader
+	ProjectId  ulid.ULID
+	Name       string
+	CIDR       string
+	Gateway    string
+	DNS        string
+	BridgeName string
+	PortIds    []ulid.ULID
+}
+
+func (e *Network) String() string {
+	return fmt.Sprintf("Network{Id:%s Name:%s CIDR:%s BridgeName:%s [sv=%d cr=%d mr=%d]}", e.Id, e.Name, e.CIDR, e.BridgeName, e.SchemaVersion, e.CreateRev, e.ModifyRev)
+}
+func (e *Network) EntityName() string {
+	return "Network"
+}
+func (e *Network) Copy() *Network {
+	return &Network{EntityHeader: e.EntityHeader, ProjectId: e.ProjectId, Name: e.Name, CIDR: e.CIDR, Gateway: e.Gateway, DNS: e.DNS, BridgeName: e.BridgeName, PortIds: utils.ULIDListCopy(e.PortIds)}
+}
+
+type Port struct {
+	db.EntityHeader
+	NetworkId     ulid.ULID
+	IPAddress     string
+	MacAddress    string
+	InterfaceName string
+	ServerId      ulid.ULID
+}
+
+func (e *Port) String() string {
+	return fmt.Sprintf("Port{Id:%s IPAddress:%s MacAddress:%s InterfaceName:%s [sv=%d cr=%d mr=%d]}", e.Id, e.IPAddress, e.MacAddress, e.InterfaceName, e.SchemaVersion, e.CreateRev, e.ModifyRev)
+}
+func (e *Port) EntityName() string {
+	return "Port"
+}
+func (e *Port) Copy() *Port {
+	return &Port{EntityHeader: e.EntityHeader, NetworkId: e.NetworkId, IPAddress: e.IPAddress, MacAddress: e.MacAddress, InterfaceName: e.InterfaceName, ServerId: e.ServerId}
+}
+
+// Meta keys claimed by entity to keep its names unique
+func uniqueKeys(entity db.Entity) []string {
+	switch e := entity.(type) {
+	case *Project:
+		return []string{fmt.Sprintf("/minicloud/db/meta/project/name/%s", e.Name)}
+	case *Flavor:
+		return []string{fmt.Sprintf("/minicloud/db/meta/flavor/name/%s", e.Name)}
+	case *Image:
+		return []string{fmt.Sprintf("/minicloud/db/meta/image/project/%s/name/%s", e.ProjectId, e.Name)}
+	case *Snapshot:
+		return []string{fmt.Sprintf("/minicloud/db/meta/snapshot/disk/%s/name/%s", e.DiskId, e.Name)}
+	case *Server:
+		return []string{fmt.Sprintf("/minicloud/db/meta/server/project/%s/name/%s", e.ProjectId, e.Name)}
+	case *Network:
+		return []string{fmt.Sprintf("/minicloud/db/meta/network/project/%s/name/%s", e.ProjectId, e.Name), fmt.Sprintf("/minicloud/db/meta/network/bridgename/%s", e.BridgeName)}
+	case *Port:
+		return []string{fmt.Sprintf("/minicloud/db/meta/port/network/%s/ipaddress/%s", e.NetworkId, e.IPAddress), fmt.Sprintf("/minicloud/db/meta/port/macaddress/%s", e.MacAddress), fmt.Sprintf("/minicloud/db/meta/port/interfacename/%s", e.InterfaceName)}
+	default:
+		return nil
+	}
 }
@@ -18,10 +18,13 @@
 package model
 
 import (
+	"errors"
 	"fmt"
 	"github.com/antonf/minicloud/db"
 )
 
+var ErrVirtualMachineNotRunning = errors.New("Virtual machine is not running")
+
 type InvalidStateError struct {
 	State db.State
 }
@@ -38,3 +41,23 @@ type InvalidTransitionError struct {
 func (e *InvalidTransitionError) Error() string {
 	return fmt.Sprintf("Invalid state transition: %s -> %s", e.From, e.To)
 }
+
+type EntityTypeError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *EntityTypeError) Error() string {
+	return fmt.Sprintf("Expected %s entity, got %s", e.Expected, e.Actual)
+}
+
+type QuotaExceededError struct {
+	Resource  string
+	Limit     uint64
+	Usage     uint64
+	Requested uint64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("Quota exceeded for %s: limit %d, used %d, requested %d", e.Resource, e.Limit, e.Usage, e.Requested)
+}
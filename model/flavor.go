@@ -15,11 +15,13 @@
  * You should have received a copy of the GNU Affero General Public License
  * along with this program.  If not, see <http://www.gnu.org/licenses/>.
  */
+
+// Code generated by gen/main.go from entities.json. DO NOT EDIT.
+
 package model
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/antonf/minicloud/db"
 	"github.com/antonf/minicloud/utils"
@@ -38,29 +40,37 @@ func Flavors(conn db.Connection) *FlavorManager {
 var regexpFlavorName = regexp.MustCompile("^[a-z0-9_.-]{3,}$")
 
 func (m *FlavorManager) NewEntity() *Flavor {
-	return &Flavor{EntityHeader: db.EntityHeader{SchemaVersion: 1, State: db.StateCreated}}
+	return &Flavor{EntityHeader: db.EntityHeader{SchemaVersion: SchemaVersion("Flavor"), State: db.StateCreated}}
 }
-func (m *FlavorManager) List(ctx context.Context) ([]*Flavor, error) {
-	values, err := m.conn.RawReadPrefix(ctx, "/minicloud/db/data/flavor/")
-	if err != nil {
-		return nil, err
+func (m *FlavorManager) List(ctx context.Context, opts *ListOptions) ([]*Flavor, string, error) {
+	if opts.ProjectId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "flavor", Field: "ProjectId", Message: "Filter not supported"}
 	}
-	result := make([]*Flavor, len(values))
-	for i, value := range values {
+	if opts.DiskId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "flavor", Field: "DiskId", Message: "Filter not supported"}
+	}
+	if opts.NetworkId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "flavor", Field: "NetworkId", Message: "Filter not supported"}
+	}
+	result := []*Flavor{}
+	next, err := listEntities(ctx, m.conn, "flavor", opts, func(value *db.RawValue) (bool, error) {
 		entity := &Flavor{}
-		origEntity := &Flavor{}
-		if err := json.Unmarshal(value.Data, entity); err != nil {
-			return nil, err
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return false, err
 		}
-		if err := json.Unmarshal(value.Data, origEntity); err != nil {
-			return nil, err
+		if !opts.matchState(entity.State) || !opts.matchName(entity.Name) {
+			return false, nil
 		}
 		entity.CreateRev = value.CreateRev
 		entity.ModifyRev = value.ModifyRev
-		entity.Original = origEntity
-		result[i] = entity
+		entity.Original = entity.Copy()
+		result = append(result, entity)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
 	}
-	return result, nil
+	return result, next, nil
 }
 func (m *FlavorManager) Get(ctx context.Context, id ulid.ULID) (*Flavor, error) {
 	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/data/flavor/%s", id))
@@ -71,7 +81,7 @@ func (m *FlavorManager) Get(ctx context.Context, id ulid.ULID) (*Flavor, error)
 		return nil, &db.NotFoundError{Entity: "Flavor", Id: id}
 	}
 	entity := &Flavor{}
-	if err := json.Unmarshal(value.Data, entity); err != nil {
+	if err := decodeEntity(value.Data, entity); err != nil {
 		return nil, err
 	}
 	entity.CreateRev = value.CreateRev
@@ -79,6 +89,63 @@ func (m *FlavorManager) Get(ctx context.Context, id ulid.ULID) (*Flavor, error)
 	entity.Original = entity.Copy()
 	return entity, nil
 }
+func (m *FlavorManager) GetByName(ctx context.Context, name string) (*Flavor, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/meta/flavor/name/%s", name))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NameNotFoundError{Entity: "Flavor", Name: name}
+	}
+	id, err := ulid.Parse(string(value.Data))
+	if err != nil {
+		return nil, err
+	}
+	entity, err := m.Get(ctx, id)
+	if _, notFound := err.(*db.NotFoundError); notFound || (err == nil && (entity.Name != name)) {
+		// Renamed or deleted after name lookup
+		return nil, &db.NameNotFoundError{Entity: "Flavor", Name: name}
+	}
+	return entity, err
+}
+func (m *FlavorManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (*Flavor, error) {
+	value, err := m.conn.RawReadRev(ctx, fmt.Sprintf("/minicloud/db/data/flavor/%s", id), rev)
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Flavor", Id: id}
+	}
+	entity := &Flavor{}
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *FlavorManager) History(ctx context.Context, id ulid.ULID, limit int) ([]*Flavor, error) {
+	values, err := m.conn.RawReadHistory(ctx, fmt.Sprintf("/minicloud/db/data/flavor/%s", id), limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &db.NotFoundError{Entity: "Flavor", Id: id}
+	}
+	result := make([]*Flavor, len(values))
+	for i, value := range values {
+		entity := &Flavor{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return nil, err
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result[i] = entity
+	}
+	return result, nil
+}
 func (m *FlavorManager) Create(ctx context.Context, entity *Flavor, initiator db.Initiator) error {
 	entity.Id = utils.NewULID()
 	if !regexpFlavorName.MatchString(entity.Name) {
@@ -91,13 +158,25 @@ func (m *FlavorManager) Create(ctx context.Context, entity *Flavor, initiator db
 	txn.Create(ctx, entity)
 	key0 := fmt.Sprintf("/minicloud/db/meta/flavor/name/%s", entity.Name)
 	txn.CreateMeta(ctx, key0, entity.Id.String())
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *FlavorManager) Update(ctx context.Context, entity *Flavor, initiator db.Initiator) error {
 	origEntity := entity.Original.(*Flavor)
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if !regexpFlavorName.MatchString(entity.Name) {
 		return &db.FieldError{Entity: "flavor", Field: "Name", Message: "Flavor name can only consist of lowercase letters 'a' to 'z', digits, dot, dash or underscore."}
 	}
+	if len(origEntity.ServerIds) != 0 && entity.NumCPUs != origEntity.NumCPUs {
+		return &db.FieldError{Entity: "flavor", Field: "NumCPUs", Message: "Field change prohibited while ServerIds isn't empty"}
+	}
+	if len(origEntity.ServerIds) != 0 && entity.RAM != origEntity.RAM {
+		return &db.FieldError{Entity: "flavor", Field: "RAM", Message: "Field change prohibited while ServerIds isn't empty"}
+	}
 	if !utils.ULIDListsEqual(entity.ServerIds, origEntity.ServerIds) {
 		return &db.FieldError{Entity: "flavor", Field: "ServerIds", Message: "Field change prohibited"}
 	}
@@ -110,13 +189,19 @@ func (m *FlavorManager) Update(ctx context.Context, entity *Flavor, initiator db
 		claimKey0 := fmt.Sprintf("/minicloud/db/meta/flavor/name/%s", entity.Name)
 		txn.CreateMeta(ctx, claimKey0, entity.Id.String())
 	}
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *FlavorManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
 	entity, err := Flavors(m.conn).Get(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if len(entity.ServerIds) != 0 {
 		return &db.FieldError{Entity: "flavor", Field: "ServerIds", Message: "Should be empty"}
 	}
@@ -125,5 +210,90 @@ func (m *FlavorManager) Delete(ctx context.Context, id ulid.ULID, initiator db.I
 	key0 := fmt.Sprintf("/minicloud/db/meta/flavor/name/%s", entity.Name)
 	txn.CheckMeta(ctx, key0, entity.Id.String())
 	txn.DeleteMeta(ctx, key0)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+type flavorManager struct {
+	typed *FlavorManager
+}
+
+func init() {
+	registerManager("flavor", false, func(conn db.Connection) Manager {
+		return &flavorManager{typed: Flavors(conn)}
+	})
+}
+func (m *flavorManager) EntityName() string {
+	return "Flavor"
+}
+func (m *flavorManager) StateMachine() *StateMachine {
+	return nil
+}
+func (m *flavorManager) NewEntity() db.Entity {
+	return m.typed.NewEntity()
+}
+func (m *flavorManager) List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error) {
+	entities, next, err := m.typed.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, next, nil
+}
+func (m *flavorManager) Get(ctx context.Context, id ulid.ULID) (db.Entity, error) {
+	entity, err := m.typed.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *flavorManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (db.Entity, error) {
+	entity, err := m.typed.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *flavorManager) NameScoped() bool {
+	return false
+}
+func (m *flavorManager) GetByName(ctx context.Context, scope ulid.ULID, name string) (db.Entity, error) {
+	entity, err := m.typed.GetByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *flavorManager) History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error) {
+	entities, err := m.typed.History(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *flavorManager) Create(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Flavor)
+	if !ok {
+		return &EntityTypeError{Expected: "Flavor", Actual: entity.EntityName()}
+	}
+	return m.typed.Create(ctx, typedEntity, initiator)
+}
+func (m *flavorManager) Update(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Flavor)
+	if !ok {
+		return &EntityTypeError{Expected: "Flavor", Actual: entity.EntityName()}
+	}
+	return m.typed.Update(ctx, typedEntity, initiator)
+}
+func (m *flavorManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	return m.typed.Delete(ctx, id, initiator)
 }
@@ -0,0 +1,511 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"github.com/oklog/ulid"
+	"sort"
+)
+
+const (
+	ProblemDanglingReference    = "dangling-reference"
+	ProblemMissingBackReference = "missing-back-reference"
+	ProblemOrphanedNameKey      = "orphaned-name-key"
+	ProblemMissingNameKey       = "missing-name-key"
+	ProblemQuotaUsageMismatch   = "quota-usage-mismatch"
+	ProblemStateMismatch        = "state-mismatch"
+)
+
+// Prefixes of meta keys claimed by entity names, see uniqueKeys
+var nameKeyPrefixes = []string{
+	db.MetaPrefix + "/project/",
+	db.MetaPrefix + "/flavor/",
+	db.MetaPrefix + "/image/",
+	db.MetaPrefix + "/server/",
+	db.MetaPrefix + "/snapshot/",
+	db.MetaPrefix + "/network/",
+	db.MetaPrefix + "/port/",
+}
+
+type FsckProblem struct {
+	Kind       string
+	Key        string
+	Message    string
+	Repairable bool
+	Repaired   bool
+}
+
+type FsckReport struct {
+	Revision int64
+	Problems []*FsckProblem
+}
+
+// Repair of one or more problems committed as single transaction
+type fsckFix struct {
+	problems []*FsckProblem
+	apply    func(ctx context.Context, txn db.Transaction)
+}
+
+type fsckState struct {
+	report    *FsckReport
+	data      map[string][]byte
+	projects  map[ulid.ULID]*Project
+	flavors   map[ulid.ULID]*Flavor
+	images    map[ulid.ULID]*Image
+	disks     map[ulid.ULID]*Disk
+	servers   map[ulid.ULID]*Server
+	snapshots map[ulid.ULID]*Snapshot
+	networks  map[ulid.ULID]*Network
+	ports     map[ulid.ULID]*Port
+	nameKeys  map[string]string
+	keyFixes  []*fsckFix
+	entityFix map[db.Entity]*fsckFix
+	fixOrder  []db.Entity
+}
+
+// Check that back-references between entities and name keys are consistent.
+// With repair, fixes all repairable problems, each entity or name key in its
+// own transaction which fails if it was changed since check.
+func Fsck(ctx context.Context, conn db.Connection, repair bool) (*FsckReport, error) {
+	s := &fsckState{
+		report:    &FsckReport{},
+		data:      make(map[string][]byte),
+		projects:  make(map[ulid.ULID]*Project),
+		flavors:   make(map[ulid.ULID]*Flavor),
+		images:    make(map[ulid.ULID]*Image),
+		disks:     make(map[ulid.ULID]*Disk),
+		servers:   make(map[ulid.ULID]*Server),
+		snapshots: make(map[ulid.ULID]*Snapshot),
+		networks:  make(map[ulid.ULID]*Network),
+		ports:     make(map[ulid.ULID]*Port),
+		nameKeys:  make(map[string]string),
+		entityFix: make(map[db.Entity]*fsckFix),
+	}
+	if err := s.load(ctx, conn); err != nil {
+		return nil, err
+	}
+	s.checkProjects()
+	s.checkFlavors()
+	s.checkImages()
+	s.checkDisks()
+	s.checkServers()
+	s.checkSnapshots()
+	s.checkNetworks()
+	s.checkPorts()
+	s.checkQuotaUsage()
+	s.checkNameKeys()
+	sort.SliceStable(s.report.Problems, func(i, j int) bool {
+		return s.report.Problems[i].Key < s.report.Problems[j].Key
+	})
+	logger.Info(ctx, "fsck complete", "revision", s.report.Revision, "problems", len(s.report.Problems))
+	if !repair {
+		return s.report, nil
+	}
+	fixes := s.keyFixes
+	for _, entity := range s.fixOrder {
+		fixes = append(fixes, s.entityFix[entity])
+	}
+	for _, fix := range fixes {
+		txn := conn.NewTransaction()
+		fix.apply(ctx, txn)
+		if _, err := txn.Commit(ctx); err != nil {
+			return s.report, err
+		}
+		for _, problem := range fix.problems {
+			problem.Repaired = true
+		}
+	}
+	return s.report, nil
+}
+
+func (s *fsckState) load(ctx context.Context, conn db.Connection) error {
+	rev, err := scanPrefix(ctx, conn, db.DataPrefix+"/", 0, func(value *db.RawValue) error {
+		entity, err := decodeKeyEntity(value.Key, value.Data)
+		if err != nil {
+			return err
+		}
+		hdr := entity.Header()
+		hdr.CreateRev = value.CreateRev
+		hdr.ModifyRev = value.ModifyRev
+		s.data[value.Key] = value.Data
+		switch e := entity.(type) {
+		case *Project:
+			s.projects[e.Id] = e
+		case *Flavor:
+			s.flavors[e.Id] = e
+		case *Image:
+			s.images[e.Id] = e
+		case *Disk:
+			s.disks[e.Id] = e
+		case *Server:
+			s.servers[e.Id] = e
+		case *Snapshot:
+			s.snapshots[e.Id] = e
+		case *Network:
+			s.networks[e.Id] = e
+		case *Port:
+			s.ports[e.Id] = e
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.report.Revision = rev
+	for _, keyPrefix := range nameKeyPrefixes {
+		_, err := scanPrefix(ctx, conn, keyPrefix, rev, func(value *db.RawValue) error {
+			s.nameKeys[value.Key] = string(value.Data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsckState) addProblem(kind, key string, repairable bool, format string, args ...interface{}) *FsckProblem {
+	problem := &FsckProblem{Kind: kind, Key: key, Message: fmt.Sprintf(format, args...), Repairable: repairable}
+	s.report.Problems = append(s.report.Problems, problem)
+	return problem
+}
+
+// Report problem repaired by changing entity in place, entity is updated
+// once after all checks
+func (s *fsckState) fixEntity(entity db.Entity, kind string, format string, args ...interface{}) {
+	problem := s.addProblem(kind, db.DataKey(entity), true, format, args...)
+	fix := s.entityFix[entity]
+	if fix == nil {
+		fix = &fsckFix{apply: func(ctx context.Context, txn db.Transaction) {
+			txn.Update(ctx, entity)
+		}}
+		s.entityFix[entity] = fix
+		s.fixOrder = append(s.fixOrder, entity)
+	}
+	fix.problems = append(fix.problems, problem)
+}
+
+func (s *fsckState) checkProjects() {
+	for _, project := range s.projects {
+		for _, id := range utils.ULIDListCopy(project.ImageIds) {
+			if image := s.images[id]; image == nil || image.ProjectId != project.Id {
+				project.ImageIds = utils.RemoveULID(project.ImageIds, id)
+				s.fixEntity(project, ProblemDanglingReference, "ImageIds contains %s which is missing or belongs to other project", id)
+			}
+		}
+		for _, id := range utils.ULIDListCopy(project.DiskIds) {
+			if disk := s.disks[id]; disk == nil || disk.ProjectId != project.Id {
+				project.DiskIds = utils.RemoveULID(project.DiskIds, id)
+				s.fixEntity(project, ProblemDanglingReference, "DiskIds contains %s which is missing or belongs to other project", id)
+			}
+		}
+		for _, id := range utils.ULIDListCopy(project.ServerIds) {
+			if server := s.servers[id]; server == nil || server.ProjectId != project.Id {
+				project.ServerIds = utils.RemoveULID(project.ServerIds, id)
+				s.fixEntity(project, ProblemDanglingReference, "ServerIds contains %s which is missing or belongs to other project", id)
+			}
+		}
+		for _, id := range utils.ULIDListCopy(project.NetworkIds) {
+			if network := s.networks[id]; network == nil || network.ProjectId != project.Id {
+				project.NetworkIds = utils.RemoveULID(project.NetworkIds, id)
+				s.fixEntity(project, ProblemDanglingReference, "NetworkIds contains %s which is missing or belongs to other project", id)
+			}
+		}
+	}
+}
+
+func (s *fsckState) checkFlavors() {
+	for _, flavor := range s.flavors {
+		for _, id := range utils.ULIDListCopy(flavor.ServerIds) {
+			if server := s.servers[id]; server == nil || server.FlavorId != flavor.Id {
+				flavor.ServerIds = utils.RemoveULID(flavor.ServerIds, id)
+				s.fixEntity(flavor, ProblemDanglingReference, "ServerIds contains %s which is missing or has other flavor", id)
+			}
+		}
+	}
+}
+
+func (s *fsckState) checkImages() {
+	for _, image := range s.images {
+		if project := s.projects[image.ProjectId]; project == nil {
+			s.addProblem(ProblemDanglingReference, db.DataKey(image), false, "ProjectId refers to missing project %s", image.ProjectId)
+		} else if !utils.ContainsULID(project.ImageIds, image.Id) {
+			project.ImageIds = append(project.ImageIds, image.Id)
+			s.fixEntity(project, ProblemMissingBackReference, "ImageIds doesn't contain image %s", image.Id)
+		}
+		for _, id := range utils.ULIDListCopy(image.DiskIds) {
+			if disk := s.disks[id]; disk == nil || disk.ImageId != image.Id {
+				image.DiskIds = utils.RemoveULID(image.DiskIds, id)
+				s.fixEntity(image, ProblemDanglingReference, "DiskIds contains %s which is missing or has other image", id)
+			}
+		}
+	}
+}
+
+// AttachDisk and DetachDisk update Server.DiskIds and Disk.ServerId in one
+// transaction, so disk attached to server that doesn't list it is detached
+// and put back to ready like DetachDisk does
+func (s *fsckState) checkDisks() {
+	users := make(map[ulid.ULID]bool)
+	for _, server := range s.servers {
+		for _, id := range server.DiskIds {
+			users[id] = true
+		}
+	}
+	for _, disk := range s.disks {
+		if project := s.projects[disk.ProjectId]; project == nil {
+			s.addProblem(ProblemDanglingReference, db.DataKey(disk), false, "ProjectId refers to missing project %s", disk.ProjectId)
+		} else if !utils.ContainsULID(project.DiskIds, disk.Id) {
+			project.DiskIds = append(project.DiskIds, disk.Id)
+			s.fixEntity(project, ProblemMissingBackReference, "DiskIds doesn't contain disk %s", disk.Id)
+		}
+		if image := s.images[disk.ImageId]; image == nil {
+			s.addProblem(ProblemDanglingReference, db.DataKey(disk), false, "ImageId refers to missing image %s", disk.ImageId)
+		} else if !utils.ContainsULID(image.DiskIds, disk.Id) {
+			image.DiskIds = append(image.DiskIds, disk.Id)
+			s.fixEntity(image, ProblemMissingBackReference, "DiskIds doesn't contain disk %s", disk.Id)
+		}
+		for _, id := range utils.ULIDListCopy(disk.SnapshotIds) {
+			if snapshot := s.snapshots[id]; snapshot == nil || snapshot.DiskId != disk.Id {
+				disk.SnapshotIds = utils.RemoveULID(disk.SnapshotIds, id)
+				s.fixEntity(disk, ProblemDanglingReference, "SnapshotIds contains %s which is missing or belongs to other disk", id)
+			}
+		}
+		if disk.ServerId != utils.Zero {
+			if server := s.servers[disk.ServerId]; server == nil || !utils.ContainsULID(server.DiskIds, disk.Id) {
+				serverId := disk.ServerId
+				disk.ServerId = utils.Zero
+				s.fixEntity(disk, ProblemDanglingReference, "ServerId refers to server %s which is missing or doesn't use disk", serverId)
+			}
+		}
+		// Disk listed by some server gets its ServerId back in checkServers
+		if disk.ServerId == utils.Zero && disk.State == db.StateInUse && !users[disk.Id] {
+			disk.State = db.StateReady
+			s.fixEntity(disk, ProblemStateMismatch, "State is %s while disk isn't attached", db.StateInUse)
+		}
+	}
+}
+
+func (s *fsckState) checkServers() {
+	for _, server := range s.servers {
+		if project := s.projects[server.ProjectId]; project == nil {
+			s.addProblem(ProblemDanglingReference, db.DataKey(server), false, "ProjectId refers to missing project %s", server.ProjectId)
+		} else if !utils.ContainsULID(project.ServerIds, server.Id) {
+			project.ServerIds = append(project.ServerIds, server.Id)
+			s.fixEntity(project, ProblemMissingBackReference, "ServerIds doesn't contain server %s", server.Id)
+		}
+		if flavor := s.flavors[server.FlavorId]; flavor == nil {
+			s.addProblem(ProblemDanglingReference, db.DataKey(server), false, "FlavorId refers to missing flavor %s", server.FlavorId)
+		} else if !utils.ContainsULID(flavor.ServerIds, server.Id) {
+			flavor.ServerIds = append(flavor.ServerIds, server.Id)
+			s.fixEntity(flavor, ProblemMissingBackReference, "ServerIds doesn't contain server %s", server.Id)
+		}
+		for _, id := range utils.ULIDListCopy(server.DiskIds) {
+			disk := s.disks[id]
+			if disk == nil {
+				server.DiskIds = utils.RemoveULID(server.DiskIds, id)
+				s.fixEntity(server, ProblemDanglingReference, "DiskIds contains missing disk %s", id)
+			} else if disk.ServerId == utils.Zero {
+				disk.ServerId = server.Id
+				s.fixEntity(disk, ProblemMissingBackReference, "ServerId is empty while disk is used by server %s", server.Id)
+				if disk.State == db.StateReady {
+					disk.State = db.StateInUse
+					s.fixEntity(disk, ProblemStateMismatch, "State is %s while disk is used by server %s", db.StateReady, server.Id)
+				}
+			} else if disk.ServerId != server.Id {
+				s.addProblem(ProblemDanglingReference, db.DataKey(server), false, "DiskIds contains disk %s attached to server %s", id, disk.ServerId)
+			}
+		}
+		for _, id := range utils.ULIDListCopy(server.PortIds) {
+			port := s.ports[id]
+			if port == nil {
+				server.PortIds = utils.RemoveULID(server.PortIds, id)
+				s.fixEntity(server, ProblemDanglingReference, "PortIds contains missing port %s", id)
+			} else if port.ServerId == utils.Zero {
+				port.ServerId = server.Id
+				s.fixEntity(port, ProblemMissingBackReference, "ServerId is empty while port is used by server %s", server.Id)
+			} else if port.ServerId != server.Id {
+				s.addProblem(ProblemDanglingReference, db.DataKey(server), false, "PortIds contains port %s attached to server %s", id, port.ServerId)
+			}
+		}
+	}
+}
+
+func (s *fsckState) checkSnapshots() {
+	for _, snapshot := range s.snapshots {
+		if disk := s.disks[snapshot.DiskId]; disk == nil {
+			s.addProblem(ProblemDanglingReference, db.DataKey(snapshot), false, "DiskId refers to missing disk %s", snapshot.DiskId)
+		} else if !utils.ContainsULID(disk.SnapshotIds, snapshot.Id) {
+			disk.SnapshotIds = append(disk.SnapshotIds, snapshot.Id)
+			s.fixEntity(disk, ProblemMissingBackReference, "SnapshotIds doesn't contain snapshot %s", snapshot.Id)
+		}
+	}
+}
+
+func (s *fsckState) checkNetworks() {
+	for _, network := range s.networks {
+		if project := s.projects[network.ProjectId]; project == nil {
+			s.addProblem(ProblemDanglingReference, db.DataKey(network), false, "ProjectId refers to missing project %s", network.ProjectId)
+		} else if !utils.ContainsULID(project.NetworkIds, network.Id) {
+			project.NetworkIds = append(project.NetworkIds, network.Id)
+			s.fixEntity(project, ProblemMissingBackReference, "NetworkIds doesn't contain network %s", network.Id)
+		}
+		for _, id := range utils.ULIDListCopy(network.PortIds) {
+			if port := s.ports[id]; port == nil || port.NetworkId != network.Id {
+				network.PortIds = utils.RemoveULID(network.PortIds, id)
+				s.fixEntity(network, ProblemDanglingReference, "PortIds contains %s which is missing or belongs to other network", id)
+			}
+		}
+	}
+}
+
+// Server.PortIds can't be changed after server is created, unlike DiskIds,
+// so port attached to server that doesn't list it is detached
+func (s *fsckState) checkPorts() {
+	for _, port := range s.ports {
+		if network := s.networks[port.NetworkId]; network == nil {
+			s.addProblem(ProblemDanglingReference, db.DataKey(port), false, "NetworkId refers to missing network %s", port.NetworkId)
+		} else if !utils.ContainsULID(network.PortIds, port.Id) {
+			network.PortIds = append(network.PortIds, port.Id)
+			s.fixEntity(network, ProblemMissingBackReference, "PortIds doesn't contain port %s", port.Id)
+		}
+		if port.ServerId == utils.Zero {
+			continue
+		}
+		if server := s.servers[port.ServerId]; server == nil || !utils.ContainsULID(server.PortIds, port.Id) {
+			serverId := port.ServerId
+			port.ServerId = utils.Zero
+			s.fixEntity(port, ProblemDanglingReference, "ServerId refers to server %s which is missing or doesn't use port", serverId)
+		}
+	}
+}
+
+// Projects stored before quotas were introduced have zero usage, which is
+// fixed here as well
+func (s *fsckState) checkQuotaUsage() {
+	usage := make(map[ulid.ULID]*Quota)
+	for id := range s.projects {
+		usage[id] = &Quota{}
+	}
+	charge := func(projectId ulid.ULID, amount Quota) {
+		if total := usage[projectId]; total != nil {
+			totals, amounts := total.values(), amount.values()
+			for i := range quotaResources {
+				*totals[i] += *amounts[i]
+			}
+		}
+	}
+	for _, server := range s.servers {
+		if flavor := s.flavors[server.FlavorId]; flavor != nil {
+			charge(server.ProjectId, flavorUsage(flavor))
+		} else {
+			charge(server.ProjectId, Quota{Servers: 1})
+		}
+	}
+	for _, disk := range s.disks {
+		charge(disk.ProjectId, Quota{Disks: 1, DiskSize: disk.Size})
+	}
+	for _, image := range s.images {
+		charge(image.ProjectId, Quota{Images: 1})
+	}
+	for id, project := range s.projects {
+		if project.Usage != *usage[id] {
+			s.fixEntity(project, ProblemQuotaUsageMismatch, "Usage %+v doesn't match actual usage %+v", project.Usage, *usage[id])
+			project.Usage = *usage[id]
+		}
+	}
+}
+
+func (s *fsckState) checkNameKeys() {
+	claims := make(map[string][]db.Entity)
+	for _, entity := range s.entities() {
+		for _, key := range uniqueKeys(entity) {
+			claims[key] = append(claims[key], entity)
+		}
+	}
+	valid := make(map[string]bool)
+	for key, content := range s.nameKeys {
+		for _, entity := range claims[key] {
+			if entity.Header().Id.String() == content {
+				valid[key] = true
+			}
+		}
+		if valid[key] {
+			continue
+		}
+		key, content := key, content
+		problem := s.addProblem(ProblemOrphanedNameKey, key, true, "Key refers to %s which is missing or has other name", content)
+		s.keyFixes = append(s.keyFixes, &fsckFix{problems: []*FsckProblem{problem}, apply: func(ctx context.Context, txn db.Transaction) {
+			txn.CheckMeta(ctx, key, content)
+			txn.DeleteMeta(ctx, key)
+		}})
+	}
+	for key, entities := range claims {
+		if valid[key] {
+			continue
+		}
+		// Only one of entities with same name can get the key, oldest one
+		// is chosen
+		for i, entity := range entities {
+			dataKey, id := db.DataKey(entity), entity.Header().Id.String()
+			if i > 0 {
+				s.addProblem(ProblemMissingNameKey, dataKey, false, "Name key %s is also claimed by %s", key, entities[0].Header().Id)
+				continue
+			}
+			key, data := key, s.data[dataKey]
+			problem := s.addProblem(ProblemMissingNameKey, dataKey, true, "Name key %s is missing", key)
+			s.keyFixes = append(s.keyFixes, &fsckFix{problems: []*FsckProblem{problem}, apply: func(ctx context.Context, txn db.Transaction) {
+				txn.CheckMeta(ctx, dataKey, string(data))
+				txn.CreateMeta(ctx, key, id)
+			}})
+		}
+	}
+}
+
+func (s *fsckState) entities() []db.Entity {
+	var result []db.Entity
+	for _, e := range s.projects {
+		result = append(result, e)
+	}
+	for _, e := range s.flavors {
+		result = append(result, e)
+	}
+	for _, e := range s.images {
+		result = append(result, e)
+	}
+	for _, e := range s.servers {
+		result = append(result, e)
+	}
+	for _, e := range s.snapshots {
+		result = append(result, e)
+	}
+	for _, e := range s.networks {
+		result = append(result, e)
+	}
+	for _, e := range s.ports {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Header().CreateRev < result[j].Header().CreateRev
+	})
+	return result
+}
@@ -0,0 +1,164 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/utils"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	other := createProject(t, conn, "bar")
+
+	// Break references bypassing managers like manual etcd edit would
+	project.ServerIds = append(project.ServerIds, utils.NewULID())
+	image := Images(conn).NewEntity()
+	image.Id = utils.NewULID()
+	image.Name = "img"
+	image.ProjectId = project.Id
+	orphan := Images(conn).NewEntity()
+	orphan.Id = utils.NewULID()
+	orphan.Name = "orphan"
+	orphan.ProjectId = utils.NewULID()
+	txn := conn.NewTransaction()
+	txn.Update(ctx, project)
+	txn.Create(ctx, image)
+	txn.Create(ctx, orphan)
+	txn.DeleteMeta(ctx, "/minicloud/db/meta/project/name/bar")
+	txn.CreateMeta(ctx, "/minicloud/db/meta/project/name/ghost", utils.NewULID().String())
+	if _, err := txn.Commit(ctx); err != nil {
+		t.Fatalf("failed to break references: %s", err)
+	}
+
+	report, err := Fsck(ctx, conn, false)
+	if err != nil {
+		t.Fatalf("fsck failed: %s", err)
+	}
+	kinds := make(map[string]int)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind] += 1
+		if problem.Repaired {
+			t.Fatalf("problem repaired without repair: %v", problem)
+		}
+	}
+	// Image name keys are missing too, since images were created directly
+	expected := map[string]int{
+		ProblemDanglingReference:    2,
+		ProblemMissingBackReference: 1,
+		ProblemOrphanedNameKey:      1,
+		ProblemMissingNameKey:       3,
+		ProblemQuotaUsageMismatch:   1,
+	}
+	if len(kinds) != len(expected) {
+		t.Fatalf("unexpected problems: %v", kinds)
+	}
+	for kind, count := range expected {
+		if kinds[kind] != count {
+			t.Fatalf("unexpected problems: %v", kinds)
+		}
+	}
+
+	if report, err = Fsck(ctx, conn, true); err != nil {
+		t.Fatalf("fsck repair failed: %s", err)
+	}
+	for _, problem := range report.Problems {
+		if problem.Repaired != problem.Repairable {
+			t.Fatalf("unexpected repair result: %v", problem)
+		}
+	}
+	report, err = Fsck(ctx, conn, false)
+	if err != nil || len(report.Problems) != 1 || report.Problems[0].Key != db.DataKey(orphan) {
+		t.Fatalf("unexpected problems after repair: %v (%v)", report.Problems, err)
+	}
+	if stored, _ := Projects(conn).Get(ctx, project.Id); len(stored.ServerIds) != 0 || !utils.ContainsULID(stored.ImageIds, image.Id) || stored.Usage.Images != 1 {
+		t.Fatalf("project not repaired: %v", stored)
+	}
+	if found, err := Projects(conn).GetByName(ctx, "bar"); err != nil || found.Id != other.Id {
+		t.Fatalf("name key not repaired: %v (%v)", found, err)
+	}
+}
+
+func TestFsckSnapshots(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	disk := createDisk(t, conn, createProject(t, conn, "foo"))
+	snapshot := createSnapshot(t, conn, disk, "first")
+	if report, err := Fsck(ctx, conn, false); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems: %v (%v)", report, err)
+	}
+
+	disk, _ = Disks(conn).Get(ctx, disk.Id)
+	disk.SnapshotIds = nil
+	txn := conn.NewTransaction()
+	txn.Update(ctx, disk)
+	if _, err := txn.Commit(ctx); err != nil {
+		t.Fatalf("failed to break references: %s", err)
+	}
+	report, err := Fsck(ctx, conn, true)
+	if err != nil || len(report.Problems) != 1 || report.Problems[0].Kind != ProblemMissingBackReference || !report.Problems[0].Repaired {
+		t.Fatalf("unexpected problems: %v (%v)", report.Problems, err)
+	}
+	if disk, _ := Disks(conn).Get(ctx, disk.Id); !utils.ContainsULID(disk.SnapshotIds, snapshot.Id) {
+		t.Fatalf("back-reference not repaired: %v", disk.SnapshotIds)
+	}
+}
+
+func TestFsckAttachedDisks(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+	project, _ := Projects(conn).Get(ctx, server.ProjectId)
+	detached := createDisk(t, conn, project)
+	attached := createDisk(t, conn, project)
+
+	// Disk left in use by server that doesn't list it, and disk listed by
+	// server without back-reference
+	detached.ServerId = server.Id
+	detached.State = db.StateInUse
+	server.DiskIds = append(server.DiskIds, attached.Id)
+	txn := conn.NewTransaction()
+	txn.Update(ctx, detached)
+	txn.Update(ctx, server)
+	if _, err := txn.Commit(ctx); err != nil {
+		t.Fatalf("failed to break references: %s", err)
+	}
+	report, err := Fsck(ctx, conn, true)
+	if err != nil || len(report.Problems) != 4 {
+		t.Fatalf("unexpected problems: %v (%v)", report.Problems, err)
+	}
+	for _, problem := range report.Problems {
+		if !problem.Repaired {
+			t.Fatalf("problem not repaired: %v", problem)
+		}
+	}
+	if disk, _ := Disks(conn).Get(ctx, detached.Id); disk.ServerId != utils.Zero || disk.State != db.StateReady {
+		t.Fatalf("detached disk not repaired: %v", disk)
+	}
+	if disk, _ := Disks(conn).Get(ctx, attached.Id); disk.ServerId != server.Id || disk.State != db.StateInUse {
+		t.Fatalf("attached disk not repaired: %v", disk)
+	}
+	if report, err := Fsck(ctx, conn, false); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems after repair: %v (%v)", report.Problems, err)
+	}
+}
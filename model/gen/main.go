@@ -0,0 +1,966 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+// Generates entities.go and manager for every entity declared in spec
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const header = `/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Code generated by gen/main.go from %s. DO NOT EDIT.
+
+package model
+`
+
+// Field value should match Regexp, or hand-written Func should return true
+// for it
+type Validation struct {
+	Regexp  string
+	Func    string
+	Message string
+}
+
+// Reference to other entity which keeps back-reference to this entity in
+// field BackRef. If back-reference is single ULID, referenced entity is
+// claimed exclusively and optionally switched to ClaimState/ReleaseState.
+// Entity not in ClaimState is busy with other operation and keeps its state
+// on release.
+type Reference struct {
+	Entity       string
+	BackRef      string
+	ClaimState   string
+	ReleaseState string
+}
+
+type Field struct {
+	Name      string
+	Type      string
+	InString  bool
+	Immutable bool
+	// Field can only be changed by system and should be empty on create
+	SystemOnly bool
+	// Field is maintained by entities referencing this one
+	BackRef bool
+	// Field can't be changed while back-reference LockedBy isn't empty
+	LockedBy string
+	// Change of field changes project quota usage of entity
+	Charged bool
+	// Field is filled in by prepare function if it's empty, create is retried
+	// with new value when unique key of field conflicts
+	Allocated bool
+	Validate  *Validation
+	Ref       *Reference
+}
+
+type Entity struct {
+	Name   string
+	Plural string
+	FSM    bool
+	// Entity is charged to project quota, usage is computed by hand-written
+	// <entity>Usage function
+	Quota bool
+	// Usage of entity is recorded when it gets ready and when it's deleted
+	Metered bool
+	// Hand-written prepare<Entity> function fills in or checks fields of
+	// entity before it's created
+	Prepared bool
+	Fields   []*Field
+	// Fields of unique key, last of them is unique within scope of others
+	UniqueKeys [][]string
+}
+
+type generator struct {
+	specName string
+	entities map[string]*Entity
+	buf      bytes.Buffer
+}
+
+func (g *generator) p(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+	g.buf.WriteByte('\n')
+}
+
+func lowerFirst(s string) string {
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func isList(field *Field) bool {
+	return strings.HasPrefix(field.Type, "[]")
+}
+
+// Struct types are declared in model package, so they aren't qualified
+func isStruct(field *Field) bool {
+	first := field.Type[:1]
+	return !strings.Contains(field.Type, ".") && first != strings.ToLower(first)
+}
+
+func (e *Entity) field(name string) *Field {
+	for _, field := range e.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+func (e *Entity) inUniqueKey(name string) bool {
+	for _, fields := range e.UniqueKeys {
+		for _, field := range fields {
+			if field == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *Entity) hasRegexp() bool {
+	for _, field := range e.Fields {
+		if field.Validate != nil && field.Validate.Regexp != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Entity) lower() string {
+	return strings.ToLower(e.Name)
+}
+
+func (e *Entity) fsm() string {
+	return e.Name + "FSM"
+}
+
+// Format string and arguments of meta key claimed by entity
+func (e *Entity) uniqueKey(fields []string, entityVar string) (string, string) {
+	path := "/minicloud/db/meta/" + e.lower()
+	var args []string
+	for _, name := range fields {
+		path += "/" + strings.ToLower(strings.TrimSuffix(name, "Id")) + "/%s"
+		args = append(args, entityVar+"."+name)
+	}
+	return path, strings.Join(args, ", ")
+}
+
+func zeroCheck(field *Field, entityVar string) string {
+	switch {
+	case isList(field):
+		return fmt.Sprintf("len(%s.%s) != 0", entityVar, field.Name)
+	case field.Type == "ulid.ULID":
+		return fmt.Sprintf("%s.%s != utils.Zero", entityVar, field.Name)
+	case field.Type == "string":
+		return fmt.Sprintf("%s.%s != \"\"", entityVar, field.Name)
+	case isStruct(field):
+		return fmt.Sprintf("%s.%s != (%s{})", entityVar, field.Name, field.Type)
+	default:
+		return fmt.Sprintf("%s.%s != 0", entityVar, field.Name)
+	}
+}
+
+func changeCheck(field *Field) string {
+	if isList(field) {
+		return fmt.Sprintf("!utils.ULIDListsEqual(entity.%s, origEntity.%s)", field.Name, field.Name)
+	}
+	return fmt.Sprintf("entity.%s != origEntity.%s", field.Name, field.Name)
+}
+
+func verb(field *Field) string {
+	switch field.Type {
+	case "string", "ulid.ULID":
+		return "%s"
+	default:
+		return "%d"
+	}
+}
+
+func (g *generator) fieldError(entity, field, message string) {
+	g.p("return &db.FieldError{Entity: %q, Field: %q, Message: %q}", entity, field, message)
+}
+
+func (g *generator) generateEntities(entities []*Entity) {
+	g.p(header, g.specName)
+	g.p("import (")
+	g.p(`"fmt"`)
+	g.p(`"github.com/antonf/minicloud/db"`)
+	g.p(`"github.com/antonf/minicloud/utils"`)
+	g.p(`"github.com/oklog/ulid"`)
+	g.p(")")
+	for _, e := range entities {
+		g.p("")
+		g.p("type %s struct {", e.Name)
+		g.p("db.EntityHeader")
+		for _, field := range e.Fields {
+			g.p("%s %s", field.Name, field.Type)
+		}
+		g.p("}")
+		g.p("")
+		format, args := e.Name+"{Id:%s", []string{"e.Id"}
+		for _, field := range e.Fields {
+			if field.InString {
+				format += fmt.Sprintf(" %s:%s", field.Name, verb(field))
+				args = append(args, "e."+field.Name)
+			}
+		}
+		format += " [sv=%d cr=%d mr=%d]}"
+		args = append(args, "e.SchemaVersion", "e.CreateRev", "e.ModifyRev")
+		g.p("func (e *%s) String() string {", e.Name)
+		g.p("return fmt.Sprintf(%q, %s)", format, strings.Join(args, ", "))
+		g.p("}")
+		g.p("func (e *%s) EntityName() string {", e.Name)
+		g.p("return %q", e.Name)
+		g.p("}")
+		copies := []string{"EntityHeader: e.EntityHeader"}
+		for _, field := range e.Fields {
+			if isList(field) {
+				copies = append(copies, fmt.Sprintf("%s: utils.ULIDListCopy(e.%s)", field.Name, field.Name))
+			} else {
+				copies = append(copies, fmt.Sprintf("%s: e.%s", field.Name, field.Name))
+			}
+		}
+		g.p("func (e *%s) Copy() *%s {", e.Name, e.Name)
+		g.p("return &%s{%s}", e.Name, strings.Join(copies, ", "))
+		g.p("}")
+	}
+	g.p("")
+	g.p("// Meta keys claimed by entity to keep its names unique")
+	g.p("func uniqueKeys(entity db.Entity) []string {")
+	g.p("switch e := entity.(type) {")
+	for _, e := range entities {
+		if len(e.UniqueKeys) == 0 {
+			continue
+		}
+		var keys []string
+		for _, fields := range e.UniqueKeys {
+			path, args := e.uniqueKey(fields, "e")
+			keys = append(keys, fmt.Sprintf("fmt.Sprintf(%q, %s)", path, args))
+		}
+		g.p("case *%s:", e.Name)
+		g.p("return []string{%s}", strings.Join(keys, ", "))
+	}
+	g.p("default:")
+	g.p("return nil")
+	g.p("}")
+	g.p("}")
+}
+
+func (g *generator) generateManager(e *Entity) {
+	name := e.Name
+	g.p(header, g.specName)
+	g.p("import (")
+	g.p(`"context"`)
+	g.p(`"fmt"`)
+	g.p(`"github.com/antonf/minicloud/db"`)
+	g.p(`"github.com/antonf/minicloud/utils"`)
+	g.p(`"github.com/oklog/ulid"`)
+	if e.hasRegexp() {
+		g.p(`"regexp"`)
+	}
+	g.p(")")
+	g.p("")
+	g.p("type %sManager struct {", name)
+	g.p("conn db.Connection")
+	g.p("}")
+	g.p("")
+	g.p("func %s(conn db.Connection) *%sManager {", e.Plural, name)
+	g.p("return &%sManager{conn: conn}", name)
+	g.p("}")
+	for _, field := range e.Fields {
+		if field.Validate != nil && field.Validate.Regexp != "" {
+			g.p("")
+			g.p("var regexp%s%s = regexp.MustCompile(%q)", name, field.Name, field.Validate.Regexp)
+			g.p("")
+		}
+	}
+	g.generateNewEntity(e)
+	g.generateList(e)
+	g.generateRead(e, "Get", "id ulid.ULID", "m.conn.RawRead(ctx, fmt.Sprintf(%q, id))")
+	if len(e.UniqueKeys) != 0 {
+		g.generateGetByName(e)
+	}
+	g.generateRead(e, "GetRevision", "id ulid.ULID, rev int64", "m.conn.RawReadRev(ctx, fmt.Sprintf(%q, id), rev)")
+	g.generateHistory(e)
+	g.generateCreate(e)
+	g.generateUpdate(e)
+	if e.FSM {
+		g.generateIntentDelete(e)
+	}
+	g.generateDelete(e)
+	g.generateAdapter(e)
+}
+
+func (g *generator) dataKeyFormat(e *Entity) string {
+	return fmt.Sprintf("/minicloud/db/data/%s/%%s", e.lower())
+}
+
+func (g *generator) decodeValue(e *Entity, errReturn string) {
+	g.p("entity := &%s{}", e.Name)
+	g.p("if err := decodeEntity(value.Data, entity); err != nil {")
+	g.p("return %s", errReturn)
+	g.p("}")
+}
+
+func (g *generator) setHeader() {
+	g.p("entity.CreateRev = value.CreateRev")
+	g.p("entity.ModifyRev = value.ModifyRev")
+	g.p("entity.Original = entity.Copy()")
+}
+
+func (g *generator) generateNewEntity(e *Entity) {
+	g.p("func (m *%sManager) NewEntity() *%s {", e.Name, e.Name)
+	g.p("return &%s{EntityHeader: db.EntityHeader{SchemaVersion: SchemaVersion(%q), State: db.StateCreated}}", e.Name, e.Name)
+	g.p("}")
+}
+
+// List filters by reference fields, see ListOptions
+var listFilters = []struct {
+	Field string
+	Match string
+}{
+	{"ProjectId", "matchProject"},
+	{"DiskId", "matchDisk"},
+	{"NetworkId", "matchNetwork"},
+}
+
+func (g *generator) generateList(e *Entity) {
+	hasName := e.field("Name") != nil
+	g.p("func (m *%sManager) List(ctx context.Context, opts *ListOptions) ([]*%s, string, error) {", e.Name, e.Name)
+	if !hasName {
+		g.p("if opts.Name != \"\" {")
+		g.p("return nil, \"\", &db.FieldError{Entity: %q, Field: \"Name\", Message: \"Filter not supported\"}", e.lower())
+		g.p("}")
+	}
+	for _, filter := range listFilters {
+		if e.field(filter.Field) == nil {
+			g.p("if opts.%s != (ulid.ULID{}) {", filter.Field)
+			g.p("return nil, \"\", &db.FieldError{Entity: %q, Field: %q, Message: \"Filter not supported\"}", e.lower(), filter.Field)
+			g.p("}")
+		}
+	}
+	g.p("result := []*%s{}", e.Name)
+	g.p("next, err := listEntities(ctx, m.conn, %q, opts, func(value *db.RawValue) (bool, error) {", e.lower())
+	g.decodeValue(e, "false, err")
+	match := "!opts.matchState(entity.State)"
+	if hasName {
+		match += " || !opts.matchName(entity.Name)"
+	}
+	for _, filter := range listFilters {
+		if e.field(filter.Field) != nil {
+			match += fmt.Sprintf(" || !opts.%s(entity.%s)", filter.Match, filter.Field)
+		}
+	}
+	g.p("if %s {", match)
+	g.p("return false, nil")
+	g.p("}")
+	g.setHeader()
+	g.p("result = append(result, entity)")
+	g.p("return true, nil")
+	g.p("})")
+	g.p("if err != nil {")
+	g.p("return nil, \"\", err")
+	g.p("}")
+	g.p("return result, next, nil")
+	g.p("}")
+}
+
+func (g *generator) generateRead(e *Entity, method, params, read string) {
+	g.p("func (m *%sManager) %s(ctx context.Context, %s) (*%s, error) {", e.Name, method, params, e.Name)
+	g.p("value, err := "+read, g.dataKeyFormat(e))
+	g.p("if err != nil {")
+	g.p("return nil, err")
+	g.p("}")
+	g.p("if value.Data == nil {")
+	g.p("return nil, &db.NotFoundError{Entity: %q, Id: id}", e.Name)
+	g.p("}")
+	g.decodeValue(e, "nil, err")
+	g.setHeader()
+	g.p("return entity, nil")
+	g.p("}")
+}
+
+func (g *generator) generateGetByName(e *Entity) {
+	fields := e.UniqueKeys[0]
+	var params, matches []string
+	for _, name := range fields {
+		field := e.field(name)
+		params = append(params, fmt.Sprintf("%s %s", lowerFirst(name), field.Type))
+		matches = append(matches, fmt.Sprintf("entity.%s != %s", name, lowerFirst(name)))
+	}
+	path, _ := e.uniqueKey(fields, "")
+	args := make([]string, len(fields))
+	for i, name := range fields {
+		args[i] = lowerFirst(name)
+	}
+	last := lowerFirst(fields[len(fields)-1])
+	g.p("func (m *%sManager) GetByName(ctx context.Context, %s) (*%s, error) {", e.Name, strings.Join(params, ", "), e.Name)
+	g.p("value, err := m.conn.RawRead(ctx, fmt.Sprintf(%q, %s))", path, strings.Join(args, ", "))
+	g.p("if err != nil {")
+	g.p("return nil, err")
+	g.p("}")
+	g.p("if value.Data == nil {")
+	g.p("return nil, &db.NameNotFoundError{Entity: %q, Name: %s}", e.Name, last)
+	g.p("}")
+	g.p("id, err := ulid.Parse(string(value.Data))")
+	g.p("if err != nil {")
+	g.p("return nil, err")
+	g.p("}")
+	g.p("entity, err := m.Get(ctx, id)")
+	g.p("if _, notFound := err.(*db.NotFoundError); notFound || (err == nil && (%s)) {", strings.Join(matches, " || "))
+	g.p("// Renamed or deleted after name lookup")
+	g.p("return nil, &db.NameNotFoundError{Entity: %q, Name: %s}", e.Name, last)
+	g.p("}")
+	g.p("return entity, err")
+	g.p("}")
+}
+
+func (g *generator) generateHistory(e *Entity) {
+	g.p("func (m *%sManager) History(ctx context.Context, id ulid.ULID, limit int) ([]*%s, error) {", e.Name, e.Name)
+	g.p("values, err := m.conn.RawReadHistory(ctx, fmt.Sprintf(%q, id), limit)", g.dataKeyFormat(e))
+	g.p("if err != nil {")
+	g.p("return nil, err")
+	g.p("}")
+	g.p("if len(values) == 0 {")
+	g.p("return nil, &db.NotFoundError{Entity: %q, Id: id}", e.Name)
+	g.p("}")
+	g.p("result := make([]*%s, len(values))", e.Name)
+	g.p("for i, value := range values {")
+	g.decodeValue(e, "nil, err")
+	g.setHeader()
+	g.p("result[i] = entity")
+	g.p("}")
+	g.p("return result, nil")
+	g.p("}")
+}
+
+func (g *generator) validate(e *Entity, field *Field) {
+	if field.Validate.Func != "" {
+		g.p("if !%s(entity.%s) {", field.Validate.Func, field.Name)
+	} else {
+		g.p("if !regexp%s%s.MatchString(entity.%s) {", e.Name, field.Name, field.Name)
+	}
+	g.fieldError(e.lower(), field.Name, field.Validate.Message)
+	g.p("}")
+}
+
+func (g *generator) commit() {
+	g.commitTxn()
+	g.p("}")
+}
+
+func (g *generator) commitTxn() {
+	g.p("if _, err := txn.Commit(ctx); err != nil {")
+	g.p("return err")
+	g.p("}")
+	g.p("return nil")
+}
+
+// Add or remove entity from back-references of referenced entities
+func (g *generator) updateRefs(e *Entity, create bool) {
+	for _, field := range e.Fields {
+		if field.Ref == nil {
+			continue
+		}
+		ref := g.entities[field.Ref.Entity]
+		refVar := lowerFirst(ref.Name)
+		backRef := ref.field(field.Ref.BackRef)
+		if isList(field) {
+			g.p("for _, refEntityId := range entity.%s {", field.Name)
+			g.p("if %s, err := %s(m.conn).Get(ctx, refEntityId); err != nil {", refVar, ref.Plural)
+		} else {
+			g.p("if %s, err := %s(m.conn).Get(ctx, entity.%s); err != nil {", refVar, ref.Plural, field.Name)
+		}
+		g.p("return err")
+		g.p("} else {")
+		state := field.Ref.ReleaseState
+		switch {
+		case isList(backRef) && create:
+			g.p("%s.%s = append(%s.%s, entity.Id)", refVar, backRef.Name, refVar, backRef.Name)
+		case isList(backRef):
+			g.p("%s.%s = utils.RemoveULID(%s.%s, entity.Id)", refVar, backRef.Name, refVar, backRef.Name)
+		case create:
+			g.p("if %s {", zeroCheck(backRef, refVar))
+			g.fieldError(ref.Name, backRef.Name, "Should be empty")
+			g.p("}")
+			g.p("%s.%s = entity.Id", refVar, backRef.Name)
+			state = field.Ref.ClaimState
+		default:
+			g.p("%s.%s = utils.Zero", refVar, backRef.Name)
+		}
+		if state != "" {
+			claimed := !create && field.Ref.ClaimState != ""
+			if claimed {
+				g.p("if %s.State == %s {", refVar, field.Ref.ClaimState)
+			}
+			g.p("if err := %s.ChangeState(%s, %s, db.InitiatorSystem); err != nil {", ref.fsm(), refVar, state)
+			g.p("return err")
+			g.p("}")
+			if claimed {
+				g.p("}")
+			}
+		}
+		if e.Quota && ref.Name == "Project" {
+			g.p("if usage, err := %sUsage(ctx, m.conn, entity); err != nil {", e.lower())
+			g.p("return err")
+			if create {
+				g.p("} else if err := %s.charge(usage); err != nil {", refVar)
+				g.p("return err")
+				g.p("}")
+			} else {
+				g.p("} else {")
+				g.p("%s.release(usage)", refVar)
+				g.p("}")
+			}
+		}
+		g.p("txn.Update(ctx, %s)", refVar)
+		g.p("}")
+		if isList(field) {
+			g.p("}")
+		}
+	}
+}
+
+func (g *generator) generateCreate(e *Entity) {
+	g.p("func (m *%sManager) Create(ctx context.Context, entity *%s, initiator db.Initiator) error {", e.Name, e.Name)
+	g.p("entity.Id = utils.NewULID()")
+	if e.FSM {
+		g.p("if err := %s.CheckInitialState(entity.State); err != nil {", e.fsm())
+		g.p("return err")
+		g.p("}")
+	}
+	var allocated, requested []string
+	for _, field := range e.Fields {
+		if field.Allocated {
+			allocated = append(allocated, "entity."+field.Name)
+			requested = append(requested, "requested"+field.Name)
+		}
+	}
+	if len(allocated) != 0 {
+		g.p("// Every attempt starts with requested values, so values allocated by")
+		g.p("// attempt that conflicted aren't reused")
+		g.p("%s := %s", strings.Join(requested, ", "), strings.Join(allocated, ", "))
+		g.p("return utils.Retry(ctx, func(ctx context.Context) error {")
+		g.p("%s = %s", strings.Join(allocated, ", "), strings.Join(requested, ", "))
+	}
+	if e.Prepared {
+		g.p("if err := prepare%s(ctx, m.conn, entity); err != nil {", e.Name)
+		g.p("return err")
+		g.p("}")
+	}
+	for _, field := range e.Fields {
+		if field.Validate != nil {
+			g.validate(e, field)
+		}
+		if field.SystemOnly || field.BackRef {
+			g.p("if %s {", zeroCheck(field, "entity"))
+			g.fieldError(e.lower(), field.Name, "Should be empty")
+			g.p("}")
+		}
+	}
+	g.p("txn := m.conn.NewTransaction()")
+	g.p("txn.Create(ctx, entity)")
+	g.updateRefs(e, true)
+	for i, fields := range e.UniqueKeys {
+		path, args := e.uniqueKey(fields, "entity")
+		g.p("key%d := fmt.Sprintf(%q, %s)", i, path, args)
+		g.p("txn.CreateMeta(ctx, key%d, entity.Id.String())", i)
+	}
+	if e.FSM {
+		g.p("%s.Notify(ctx, txn, entity)", e.fsm())
+	}
+	if len(allocated) != 0 {
+		g.commitTxn()
+		g.p("})")
+		g.p("}")
+	} else {
+		g.commit()
+	}
+}
+
+func (g *generator) generateUpdate(e *Entity) {
+	g.p("func (m *%sManager) Update(ctx context.Context, entity *%s, initiator db.Initiator) error {", e.Name, e.Name)
+	g.p("origEntity := entity.Original.(*%s)", e.Name)
+	g.p("if err := checkExpectedRevision(ctx, entity); err != nil {")
+	g.p("return err")
+	g.p("}")
+	if e.FSM {
+		g.p("if err := %s.CheckTransition(origEntity.State, entity.State, initiator); err != nil {", e.fsm())
+		g.p("return err")
+		g.p("}")
+	}
+	for _, field := range e.Fields {
+		if field.Validate != nil {
+			g.validate(e, field)
+		}
+		if field.SystemOnly {
+			g.p("if initiator != db.InitiatorSystem && %s {", changeCheck(field))
+			g.fieldError(e.lower(), field.Name, "Field change prohibited")
+			g.p("}")
+		} else if field.Immutable {
+			g.p("if %s {", changeCheck(field))
+			g.fieldError(e.lower(), field.Name, "Field change prohibited")
+			g.p("}")
+		} else if field.LockedBy != "" {
+			g.p("if %s && %s {", zeroCheck(e.field(field.LockedBy), "origEntity"), changeCheck(field))
+			g.fieldError(e.lower(), field.Name, "Field change prohibited while "+field.LockedBy+" isn't empty")
+			g.p("}")
+		}
+	}
+	g.p("txn := m.conn.NewTransaction()")
+	g.p("txn.Update(ctx, entity)")
+	g.recharge(e)
+	for i, fields := range e.UniqueKeys {
+		var changed []string
+		for _, name := range fields {
+			changed = append(changed, fmt.Sprintf("entity.%s != origEntity.%s", name, name))
+		}
+		g.p("if %s {", strings.Join(changed, " || "))
+		path, args := e.uniqueKey(fields, "origEntity")
+		g.p("forfeitKey%d := fmt.Sprintf(%q, %s)", i, path, args)
+		g.p("txn.CheckMeta(ctx, forfeitKey%d, origEntity.Id.String())", i)
+		g.p("txn.DeleteMeta(ctx, forfeitKey%d)", i)
+		path, args = e.uniqueKey(fields, "entity")
+		g.p("claimKey%d := fmt.Sprintf(%q, %s)", i, path, args)
+		g.p("txn.CreateMeta(ctx, claimKey%d, entity.Id.String())", i)
+		g.p("}")
+	}
+	if e.FSM {
+		g.p("%s.Notify(ctx, txn, entity)", e.fsm())
+	}
+	if e.Metered {
+		g.p("if entity.State == db.StateReady && origEntity.State != db.StateReady {")
+		g.p("if usage, err := %sUsage(ctx, m.conn, entity); err != nil {", e.lower())
+		g.p("return err")
+		g.p("} else if err := recordUsage(ctx, txn, entity, usage); err != nil {")
+		g.p("return err")
+		g.p("}")
+		g.p("}")
+	}
+	g.commit()
+}
+
+// Move project quota usage of entity from original to updated values of
+// charged fields
+func (g *generator) recharge(e *Entity) {
+	var changed []string
+	for _, field := range e.Fields {
+		if field.Charged {
+			changed = append(changed, changeCheck(field))
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	g.p("if %s {", strings.Join(changed, " || "))
+	g.p("project, err := Projects(m.conn).Get(ctx, entity.ProjectId)")
+	g.p("if err != nil {")
+	g.p("return err")
+	g.p("}")
+	g.p("origUsage, err := %sUsage(ctx, m.conn, origEntity)", e.lower())
+	g.p("if err != nil {")
+	g.p("return err")
+	g.p("}")
+	g.p("usage, err := %sUsage(ctx, m.conn, entity)", e.lower())
+	g.p("if err != nil {")
+	g.p("return err")
+	g.p("}")
+	g.p("project.release(origUsage)")
+	g.p("if err := project.charge(usage); err != nil {")
+	g.p("return err")
+	g.p("}")
+	g.p("txn.Update(ctx, project)")
+	g.p("}")
+}
+
+func (g *generator) getForDelete(e *Entity, state string) {
+	g.p("entity, err := %s(m.conn).Get(ctx, id)", e.Plural)
+	g.p("if err != nil {")
+	g.p("return err")
+	g.p("}")
+	g.p("if err := checkExpectedRevision(ctx, entity); err != nil {")
+	g.p("return err")
+	g.p("}")
+	if e.FSM {
+		g.p("if err := %s.CheckTransition(entity.State, %s, initiator); err != nil {", e.fsm(), state)
+		g.p("return err")
+		g.p("}")
+	}
+	for _, field := range e.Fields {
+		if field.BackRef {
+			g.p("if %s {", zeroCheck(field, "entity"))
+			g.fieldError(e.lower(), field.Name, "Should be empty")
+			g.p("}")
+		}
+	}
+}
+
+func (g *generator) generateIntentDelete(e *Entity) {
+	g.p("func (m *%sManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {", e.Name)
+	g.getForDelete(e, "db.StateDeleting")
+	g.p("entity.State = db.StateDeleting")
+	g.p("txn := m.conn.NewTransaction()")
+	g.p("txn.Update(ctx, entity)")
+	g.p("%s.Notify(ctx, txn, entity)", e.fsm())
+	g.commit()
+}
+
+func (g *generator) generateDelete(e *Entity) {
+	g.p("func (m *%sManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {", e.Name)
+	g.getForDelete(e, "db.StateDeleted")
+	g.p("txn := m.conn.NewTransaction()")
+	g.p("txn.Delete(ctx, entity)")
+	g.updateRefs(e, false)
+	for i, fields := range e.UniqueKeys {
+		path, args := e.uniqueKey(fields, "entity")
+		g.p("key%d := fmt.Sprintf(%q, %s)", i, path, args)
+		g.p("txn.CheckMeta(ctx, key%d, entity.Id.String())", i)
+		g.p("txn.DeleteMeta(ctx, key%d)", i)
+	}
+	if e.FSM {
+		g.p("%s.DeleteNotification(ctx, txn, entity)", e.fsm())
+	}
+	if e.Metered {
+		g.p("if err := recordUsage(ctx, txn, entity, Quota{}); err != nil {")
+		g.p("return err")
+		g.p("}")
+	}
+	g.commit()
+}
+
+// Adapter of typed manager to Manager interface, registered in init
+func (g *generator) generateAdapter(e *Entity) {
+	adapter := lowerFirst(e.Name) + "Manager"
+	fsm := "nil"
+	if e.FSM {
+		fsm = e.fsm()
+	}
+	g.p("")
+	g.p("type %s struct {", adapter)
+	g.p("typed *%sManager", e.Name)
+	g.p("}")
+	g.p("")
+	g.p("func init() {")
+	g.p("registerManager(%q, %t, func(conn db.Connection) Manager {", e.lower(), e.FSM)
+	g.p("return &%s{typed: %s(conn)}", adapter, e.Plural)
+	g.p("})")
+	g.p("}")
+	g.p("func (m *%s) EntityName() string {", adapter)
+	g.p("return %q", e.Name)
+	g.p("}")
+	g.p("func (m *%s) StateMachine() *StateMachine {", adapter)
+	g.p("return %s", fsm)
+	g.p("}")
+	g.p("func (m *%s) NewEntity() db.Entity {", adapter)
+	g.p("return m.typed.NewEntity()")
+	g.p("}")
+	g.p("func (m *%s) List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error) {", adapter)
+	g.p("entities, next, err := m.typed.List(ctx, opts)")
+	g.p("if err != nil {")
+	g.p("return nil, \"\", err")
+	g.p("}")
+	g.p("result := make([]db.Entity, len(entities))")
+	g.p("for i, entity := range entities {")
+	g.p("result[i] = entity")
+	g.p("}")
+	g.p("return result, next, nil")
+	g.p("}")
+	g.adaptRead(adapter, "Get", "id ulid.ULID", "id")
+	g.adaptRead(adapter, "GetRevision", "id ulid.ULID, rev int64", "id, rev")
+	if len(e.UniqueKeys) != 0 {
+		scoped := len(e.UniqueKeys[0]) == 2
+		g.p("func (m *%s) NameScoped() bool {", adapter)
+		g.p("return %t", scoped)
+		g.p("}")
+		args := "name"
+		if scoped {
+			args = "scope, name"
+		}
+		g.adaptRead(adapter, "GetByName", "scope ulid.ULID, name string", args)
+	}
+	g.p("func (m *%s) History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error) {", adapter)
+	g.p("entities, err := m.typed.History(ctx, id, limit)")
+	g.p("if err != nil {")
+	g.p("return nil, err")
+	g.p("}")
+	g.p("result := make([]db.Entity, len(entities))")
+	g.p("for i, entity := range entities {")
+	g.p("result[i] = entity")
+	g.p("}")
+	g.p("return result, nil")
+	g.p("}")
+	for _, method := range []string{"Create", "Update"} {
+		g.p("func (m *%s) %s(ctx context.Context, entity db.Entity, initiator db.Initiator) error {", adapter, method)
+		g.p("typedEntity, ok := entity.(*%s)", e.Name)
+		g.p("if !ok {")
+		g.p("return &EntityTypeError{Expected: %q, Actual: entity.EntityName()}", e.Name)
+		g.p("}")
+		g.p("return m.typed.%s(ctx, typedEntity, initiator)", method)
+		g.p("}")
+	}
+	deleteMethod := "Delete"
+	if e.FSM {
+		deleteMethod = "IntentDelete"
+	}
+	g.p("func (m *%s) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {", adapter)
+	g.p("return m.typed.%s(ctx, id, initiator)", deleteMethod)
+	g.p("}")
+}
+
+// Typed nil pointer shouldn't be returned as non-nil interface
+func (g *generator) adaptRead(adapter, method, params, args string) {
+	g.p("func (m *%s) %s(ctx context.Context, %s) (db.Entity, error) {", adapter, method, params)
+	g.p("entity, err := m.typed.%s(ctx, %s)", method, args)
+	g.p("if err != nil {")
+	g.p("return nil, err")
+	g.p("}")
+	g.p("return entity, nil")
+	g.p("}")
+}
+
+func checkSpec(entities map[string]*Entity, list []*Entity) error {
+	for _, e := range list {
+		for _, field := range e.Fields {
+			if field.Ref == nil {
+				continue
+			}
+			ref := entities[field.Ref.Entity]
+			if ref == nil {
+				return fmt.Errorf("%s.%s refers to unknown entity %s", e.Name, field.Name, field.Ref.Entity)
+			}
+			backRef := ref.field(field.Ref.BackRef)
+			if backRef == nil || !backRef.BackRef {
+				return fmt.Errorf("%s.%s refers to unknown back-reference %s.%s", e.Name, field.Name, ref.Name, field.Ref.BackRef)
+			}
+			// Back-references are only maintained on create and delete
+			if !field.Immutable {
+				return fmt.Errorf("%s.%s should be immutable", e.Name, field.Name)
+			}
+			if (field.Ref.ClaimState != "" || field.Ref.ReleaseState != "") && (!ref.FSM || isList(backRef)) {
+				return fmt.Errorf("%s.%s can't change state of %s", e.Name, field.Name, ref.Name)
+			}
+		}
+		if projectId := e.field("ProjectId"); e.Quota && (projectId == nil || projectId.Ref == nil || projectId.Ref.Entity != "Project") {
+			return fmt.Errorf("%s should refer to project to be charged to its quota", e.Name)
+		}
+		if e.Metered && (!e.Quota || !e.FSM) {
+			return fmt.Errorf("%s should be charged to quota and have state machine to be metered", e.Name)
+		}
+		for _, field := range e.Fields {
+			if field.Charged && !e.Quota {
+				return fmt.Errorf("%s.%s is charged, but %s isn't charged to quota", e.Name, field.Name, e.Name)
+			}
+			if field.LockedBy != "" && (e.field(field.LockedBy) == nil || !e.field(field.LockedBy).BackRef) {
+				return fmt.Errorf("%s.%s is locked by unknown back-reference %s", e.Name, field.Name, field.LockedBy)
+			}
+			if field.Validate != nil && (field.Validate.Regexp == "") == (field.Validate.Func == "") {
+				return fmt.Errorf("%s.%s should be validated either by regexp or by function", e.Name, field.Name)
+			}
+			if field.Allocated && (!e.Prepared || !e.inUniqueKey(field.Name)) {
+				return fmt.Errorf("%s.%s should be part of unique key and filled in by prepare function to be allocated", e.Name, field.Name)
+			}
+		}
+		for _, fields := range e.UniqueKeys {
+			for _, name := range fields {
+				if e.field(name) == nil {
+					return fmt.Errorf("unique key of %s refers to unknown field %s", e.Name, name)
+				}
+			}
+		}
+		// Name lookup supports only names unique globally or within parent
+		if len(e.UniqueKeys) != 0 {
+			fields := e.UniqueKeys[0]
+			if len(fields) > 2 || (len(fields) == 2 && e.field(fields[0]).Type != "ulid.ULID") || e.field(fields[len(fields)-1]).Type != "string" {
+				return fmt.Errorf("first unique key of %s should be name optionally scoped by parent id", e.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (g *generator) write(outDir, fileName string) error {
+	source, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("%s: %s", fileName, err)
+	}
+	g.buf.Reset()
+	return ioutil.WriteFile(filepath.Join(outDir, fileName), source, 0644)
+}
+
+func generate(specPath, outDir string) error {
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return err
+	}
+	var list []*Entity
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	g := &generator{specName: filepath.Base(specPath), entities: make(map[string]*Entity)}
+	for _, e := range list {
+		g.entities[e.Name] = e
+	}
+	if err := checkSpec(g.entities, list); err != nil {
+		return err
+	}
+	g.generateEntities(list)
+	if err := g.write(outDir, "entities.go"); err != nil {
+		return err
+	}
+	for _, e := range list {
+		g.generateManager(e)
+		if err := g.write(outDir, e.lower()+".go"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	specPath := flag.String("spec", "entities.json", "entity spec")
+	outDir := flag.String("out", ".", "output directory")
+	flag.Parse()
+	if err := generate(*specPath, *outDir); err != nil {
+		fmt.Fprintf(os.Stderr, "gen: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Generated files should be regenerated after every change of spec or generator
+func TestGeneratedUpToDate(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "minicloud-gen")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(outDir)
+	if err := generate("../entities.json", outDir); err != nil {
+		t.Fatalf("generate failed: %s", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(outDir, "*.go"))
+	if len(files) == 0 {
+		t.Fatalf("nothing generated")
+	}
+	for _, file := range files {
+		generated, _ := ioutil.ReadFile(file)
+		committed, err := ioutil.ReadFile(filepath.Join("..", filepath.Base(file)))
+		if err != nil || !bytes.Equal(generated, committed) {
+			t.Fatalf("%s is out of date, run go generate", filepath.Base(file))
+		}
+	}
+}
+
+func TestCheckSpec(t *testing.T) {
+	entities := map[string]*Entity{
+		"Project": {Name: "Project", Fields: []*Field{{Name: "ImageIds", Type: "[]ulid.ULID", BackRef: true}}},
+		"Image": {Name: "Image", Fields: []*Field{
+			{Name: "ProjectId", Type: "ulid.ULID", Ref: &Reference{Entity: "Project", BackRef: "ImageIds"}},
+		}},
+	}
+	list := []*Entity{entities["Project"], entities["Image"]}
+	if err := checkSpec(entities, list); err == nil {
+		t.Fatalf("mutable reference accepted")
+	}
+	entities["Image"].Fields[0].Immutable = true
+	if err := checkSpec(entities, list); err != nil {
+		t.Fatalf("valid spec rejected: %s", err)
+	}
+	entities["Image"].Fields[0].Ref.BackRef = "DiskIds"
+	if err := checkSpec(entities, list); err == nil {
+		t.Fatalf("unknown back-reference accepted")
+	}
+}
+
+func TestCheckSpecQuota(t *testing.T) {
+	entities := map[string]*Entity{
+		"Project": {Name: "Project", Fields: []*Field{{Name: "ImageIds", Type: "[]ulid.ULID", BackRef: true}}},
+		"Image": {Name: "Image", Quota: true, Fields: []*Field{
+			{Name: "Size", Type: "uint64", Charged: true},
+		}},
+	}
+	list := []*Entity{entities["Project"], entities["Image"]}
+	if err := checkSpec(entities, list); err == nil {
+		t.Fatalf("quota entity without project accepted")
+	}
+	entities["Image"].Fields = append(entities["Image"].Fields, &Field{
+		Name: "ProjectId", Type: "ulid.ULID", Immutable: true, Ref: &Reference{Entity: "Project", BackRef: "ImageIds"},
+	})
+	if err := checkSpec(entities, list); err != nil {
+		t.Fatalf("valid spec rejected: %s", err)
+	}
+	entities["Image"].Metered = true
+	if err := checkSpec(entities, list); err == nil {
+		t.Fatalf("metered entity without state machine accepted")
+	}
+	entities["Image"].Metered = false
+	entities["Image"].Quota = false
+	if err := checkSpec(entities, list); err == nil {
+		t.Fatalf("charged field of entity without quota accepted")
+	}
+	entities["Project"].Fields = append(entities["Project"].Fields, &Field{Name: "Name", Type: "string", LockedBy: "ServerIds"})
+	if err := checkSpec(entities, list[:1]); err == nil {
+		t.Fatalf("field locked by unknown back-reference accepted")
+	}
+}
+
+func TestCheckSpecAllocated(t *testing.T) {
+	port := &Entity{Name: "Port", Fields: []*Field{{Name: "MacAddress", Type: "string", Allocated: true}}}
+	entities := map[string]*Entity{"Port": port}
+	if err := checkSpec(entities, []*Entity{port}); err == nil {
+		t.Fatalf("allocated field without prepare function accepted")
+	}
+	port.Prepared = true
+	if err := checkSpec(entities, []*Entity{port}); err == nil {
+		t.Fatalf("allocated field outside of unique key accepted")
+	}
+	port.UniqueKeys = [][]string{{"MacAddress"}}
+	if err := checkSpec(entities, []*Entity{port}); err != nil {
+		t.Fatalf("valid spec rejected: %s", err)
+	}
+}
+
+func TestCheckSpecValidation(t *testing.T) {
+	network := &Entity{Name: "Network", Fields: []*Field{{Name: "DNS", Type: "string", Validate: &Validation{Message: "Invalid"}}}}
+	entities := map[string]*Entity{"Network": network}
+	if err := checkSpec(entities, []*Entity{network}); err == nil {
+		t.Fatalf("validation without regexp and function accepted")
+	}
+	network.Fields[0].Validate.Regexp = "^[0-9.,]*$"
+	network.Fields[0].Validate.Func = "isIPv4List"
+	if err := checkSpec(entities, []*Entity{network}); err == nil {
+		t.Fatalf("validation with both regexp and function accepted")
+	}
+	network.Fields[0].Validate.Regexp = ""
+	if err := checkSpec(entities, []*Entity{network}); err != nil {
+		t.Fatalf("valid spec rejected: %s", err)
+	}
+}
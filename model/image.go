@@ -15,11 +15,13 @@
  * You should have received a copy of the GNU Affero General Public License
  * along with this program.  If not, see <http://www.gnu.org/licenses/>.
  */
+
+// Code generated by gen/main.go from entities.json. DO NOT EDIT.
+
 package model
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/antonf/minicloud/db"
 	"github.com/antonf/minicloud/utils"
@@ -38,7 +40,34 @@ func Images(conn db.Connection) *ImageManager {
 var regexpImageName = regexp.MustCompile("^[a-zA-Z0-9_.:-]{3,200}$")
 
 func (m *ImageManager) NewEntity() *Image {
-	return &Image{EntityHeader: db.EntityHeader{SchemaVersion: 1, State: db.StateCreated}}
+	return &Image{EntityHeader: db.EntityHeader{SchemaVersion: SchemaVersion("Image"), State: db.StateCreated}}
+}
+func (m *ImageManager) List(ctx context.Context, opts *ListOptions) ([]*Image, string, error) {
+	if opts.DiskId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "image", Field: "DiskId", Message: "Filter not supported"}
+	}
+	if opts.NetworkId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "image", Field: "NetworkId", Message: "Filter not supported"}
+	}
+	result := []*Image{}
+	next, err := listEntities(ctx, m.conn, "image", opts, func(value *db.RawValue) (bool, error) {
+		entity := &Image{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return false, err
+		}
+		if !opts.matchState(entity.State) || !opts.matchName(entity.Name) || !opts.matchProject(entity.ProjectId) {
+			return false, nil
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result = append(result, entity)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return result, next, nil
 }
 func (m *ImageManager) Get(ctx context.Context, id ulid.ULID) (*Image, error) {
 	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/data/image/%s", id))
@@ -49,7 +78,43 @@ func (m *ImageManager) Get(ctx context.Context, id ulid.ULID) (*Image, error) {
 		return nil, &db.NotFoundError{Entity: "Image", Id: id}
 	}
 	entity := &Image{}
-	if err := json.Unmarshal(value.Data, entity); err != nil {
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *ImageManager) GetByName(ctx context.Context, projectId ulid.ULID, name string) (*Image, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/meta/image/project/%s/name/%s", projectId, name))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NameNotFoundError{Entity: "Image", Name: name}
+	}
+	id, err := ulid.Parse(string(value.Data))
+	if err != nil {
+		return nil, err
+	}
+	entity, err := m.Get(ctx, id)
+	if _, notFound := err.(*db.NotFoundError); notFound || (err == nil && (entity.ProjectId != projectId || entity.Name != name)) {
+		// Renamed or deleted after name lookup
+		return nil, &db.NameNotFoundError{Entity: "Image", Name: name}
+	}
+	return entity, err
+}
+func (m *ImageManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (*Image, error) {
+	value, err := m.conn.RawReadRev(ctx, fmt.Sprintf("/minicloud/db/data/image/%s", id), rev)
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Image", Id: id}
+	}
+	entity := &Image{}
+	if err := decodeEntity(value.Data, entity); err != nil {
 		return nil, err
 	}
 	entity.CreateRev = value.CreateRev
@@ -57,6 +122,27 @@ func (m *ImageManager) Get(ctx context.Context, id ulid.ULID) (*Image, error) {
 	entity.Original = entity.Copy()
 	return entity, nil
 }
+func (m *ImageManager) History(ctx context.Context, id ulid.ULID, limit int) ([]*Image, error) {
+	values, err := m.conn.RawReadHistory(ctx, fmt.Sprintf("/minicloud/db/data/image/%s", id), limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &db.NotFoundError{Entity: "Image", Id: id}
+	}
+	result := make([]*Image, len(values))
+	for i, value := range values {
+		entity := &Image{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return nil, err
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result[i] = entity
+	}
+	return result, nil
+}
 func (m *ImageManager) Create(ctx context.Context, entity *Image, initiator db.Initiator) error {
 	entity.Id = utils.NewULID()
 	if err := ImageFSM.CheckInitialState(entity.State); err != nil {
@@ -68,6 +154,9 @@ func (m *ImageManager) Create(ctx context.Context, entity *Image, initiator db.I
 	if entity.Checksum != "" {
 		return &db.FieldError{Entity: "image", Field: "Checksum", Message: "Should be empty"}
 	}
+	if entity.SourceDiskId != utils.Zero {
+		return &db.FieldError{Entity: "image", Field: "SourceDiskId", Message: "Should be empty"}
+	}
 	if len(entity.DiskIds) != 0 {
 		return &db.FieldError{Entity: "image", Field: "DiskIds", Message: "Should be empty"}
 	}
@@ -77,15 +166,26 @@ func (m *ImageManager) Create(ctx context.Context, entity *Image, initiator db.I
 		return err
 	} else {
 		project.ImageIds = append(project.ImageIds, entity.Id)
+		if usage, err := imageUsage(ctx, m.conn, entity); err != nil {
+			return err
+		} else if err := project.charge(usage); err != nil {
+			return err
+		}
 		txn.Update(ctx, project)
 	}
 	key0 := fmt.Sprintf("/minicloud/db/meta/image/project/%s/name/%s", entity.ProjectId, entity.Name)
 	txn.CreateMeta(ctx, key0, entity.Id.String())
 	ImageFSM.Notify(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *ImageManager) Update(ctx context.Context, entity *Image, initiator db.Initiator) error {
 	origEntity := entity.Original.(*Image)
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if err := ImageFSM.CheckTransition(origEntity.State, entity.State, initiator); err != nil {
 		return err
 	}
@@ -95,6 +195,9 @@ func (m *ImageManager) Update(ctx context.Context, entity *Image, initiator db.I
 	if initiator != db.InitiatorSystem && entity.Checksum != origEntity.Checksum {
 		return &db.FieldError{Entity: "image", Field: "Checksum", Message: "Field change prohibited"}
 	}
+	if initiator != db.InitiatorSystem && entity.SourceDiskId != origEntity.SourceDiskId {
+		return &db.FieldError{Entity: "image", Field: "SourceDiskId", Message: "Field change prohibited"}
+	}
 	if entity.ProjectId != origEntity.ProjectId {
 		return &db.FieldError{Entity: "image", Field: "ProjectId", Message: "Field change prohibited"}
 	}
@@ -111,13 +214,19 @@ func (m *ImageManager) Update(ctx context.Context, entity *Image, initiator db.I
 		txn.CreateMeta(ctx, claimKey0, entity.Id.String())
 	}
 	ImageFSM.Notify(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *ImageManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
 	entity, err := Images(m.conn).Get(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if err := ImageFSM.CheckTransition(entity.State, db.StateDeleting, initiator); err != nil {
 		return err
 	}
@@ -128,13 +237,19 @@ func (m *ImageManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator
 	txn := m.conn.NewTransaction()
 	txn.Update(ctx, entity)
 	ImageFSM.Notify(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *ImageManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
 	entity, err := Images(m.conn).Get(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if err := ImageFSM.CheckTransition(entity.State, db.StateDeleted, initiator); err != nil {
 		return err
 	}
@@ -147,11 +262,101 @@ func (m *ImageManager) Delete(ctx context.Context, id ulid.ULID, initiator db.In
 		return err
 	} else {
 		project.ImageIds = utils.RemoveULID(project.ImageIds, entity.Id)
+		if usage, err := imageUsage(ctx, m.conn, entity); err != nil {
+			return err
+		} else {
+			project.release(usage)
+		}
 		txn.Update(ctx, project)
 	}
 	key0 := fmt.Sprintf("/minicloud/db/meta/image/project/%s/name/%s", entity.ProjectId, entity.Name)
 	txn.CheckMeta(ctx, key0, entity.Id.String())
 	txn.DeleteMeta(ctx, key0)
 	ImageFSM.DeleteNotification(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+type imageManager struct {
+	typed *ImageManager
+}
+
+func init() {
+	registerManager("image", true, func(conn db.Connection) Manager {
+		return &imageManager{typed: Images(conn)}
+	})
+}
+func (m *imageManager) EntityName() string {
+	return "Image"
+}
+func (m *imageManager) StateMachine() *StateMachine {
+	return ImageFSM
+}
+func (m *imageManager) NewEntity() db.Entity {
+	return m.typed.NewEntity()
+}
+func (m *imageManager) List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error) {
+	entities, next, err := m.typed.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, next, nil
+}
+func (m *imageManager) Get(ctx context.Context, id ulid.ULID) (db.Entity, error) {
+	entity, err := m.typed.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *imageManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (db.Entity, error) {
+	entity, err := m.typed.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *imageManager) NameScoped() bool {
+	return true
+}
+func (m *imageManager) GetByName(ctx context.Context, scope ulid.ULID, name string) (db.Entity, error) {
+	entity, err := m.typed.GetByName(ctx, scope, name)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *imageManager) History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error) {
+	entities, err := m.typed.History(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *imageManager) Create(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Image)
+	if !ok {
+		return &EntityTypeError{Expected: "Image", Actual: entity.EntityName()}
+	}
+	return m.typed.Create(ctx, typedEntity, initiator)
+}
+func (m *imageManager) Update(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Image)
+	if !ok {
+		return &EntityTypeError{Expected: "Image", Actual: entity.EntityName()}
+	}
+	return m.typed.Update(ctx, typedEntity, initiator)
+}
+func (m *imageManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	return m.typed.IntentDelete(ctx, id, initiator)
 }
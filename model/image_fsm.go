@@ -19,9 +19,11 @@ package model
 
 import (
 	"context"
+	"fmt"
 	"github.com/antonf/minicloud/ceph"
 	"github.com/antonf/minicloud/db"
 	"github.com/antonf/minicloud/utils"
+	"github.com/oklog/ulid"
 )
 
 var ImageFSM *StateMachine
@@ -38,23 +40,123 @@ func init() {
 		SystemTransition(db.StateUploading, db.StateReady).
 		SystemTransition(db.StateCreated, db.StateError).
 		SystemTransition(db.StateUploading, db.StateError).
+		SystemTransition(db.StateCreated, db.StateCapturing).
+		SystemTransition(db.StateCapturing, db.StateReady).
+		SystemTransition(db.StateCapturing, db.StateError).
 		SystemTransition(db.StateDeleting, db.StateDeleted).
 		SystemTransition(db.StateDeleting, db.StateError).
+		Hook(db.StateCapturing, HandleImageCapturing).
 		Hook(db.StateDeleting, HandleImageDeleting)
 }
 
+// Create image in disk's project from disk content, content is copied by
+// image state machine hook. Image is created in capturing state in the same
+// transaction which holds disk, so disk can't be used by started server or
+// changed meanwhile.
+func CaptureDisk(ctx context.Context, conn db.Connection, diskId ulid.ULID, name string) (*Image, error) {
+	img := Images(conn).NewEntity()
+	img.Id = utils.NewULID()
+	img.Name = name
+	if !regexpImageName.MatchString(img.Name) {
+		return nil, &db.FieldError{Entity: "image", Field: "Name", Message: "Name should be between 3 and 200 characters from following set: a-z A-Z 0-9 _.:-"}
+	}
+	disk, err := Disks(conn).Get(ctx, diskId)
+	if err != nil {
+		return nil, err
+	}
+	img.ProjectId = disk.ProjectId
+	img.SourceDiskId = disk.Id
+	if err := ImageFSM.ChangeState(img, db.StateCapturing, db.InitiatorSystem); err != nil {
+		return nil, err
+	}
+	project, err := Projects(conn).Get(ctx, img.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	project.ImageIds = append(project.ImageIds, img.Id)
+	if usage, err := imageUsage(ctx, conn, img); err != nil {
+		return nil, err
+	} else if err := project.charge(usage); err != nil {
+		return nil, err
+	}
+	txn := conn.NewTransaction()
+	if err := holdDisk(ctx, conn, txn, disk, db.StateCapturing); err != nil {
+		return nil, err
+	}
+	txn.Create(ctx, img)
+	txn.Update(ctx, project)
+	txn.CreateMeta(ctx, fmt.Sprintf("/minicloud/db/meta/image/project/%s/name/%s", img.ProjectId, img.Name), img.Id.String())
+	ImageFSM.Notify(ctx, txn, img)
+	if _, err := txn.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func HandleImageCapturing(ctx context.Context, conn db.Connection, entity db.Entity) {
+	img := entity.(*Image)
+	var checksum string
+	disk, captureErr := Disks(conn).Get(ctx, img.SourceDiskId)
+	if captureErr == nil {
+		checksum, captureErr = ceph.CreateImageFromDisk(ctx, disk.Pool, disk.Id.String(), "images", img.Id.String())
+	}
+	finishImageCapture(ctx, conn, img.Id, checksum, captureErr)
+}
+
+// Set image ready, or error if capture failed, and release source disk in the
+// same transaction
+func finishImageCapture(ctx context.Context, conn db.Connection, id ulid.ULID, checksum string, captureErr error) {
+	state := db.StateReady
+	if captureErr != nil {
+		logger.Debug(ctx, "setting image state to error", "id", id, "cause", captureErr)
+		state = db.StateError
+	}
+	err := utils.Retry(ctx, func(ctx context.Context) error {
+		img, err := Images(conn).Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		disk, err := Disks(conn).Get(ctx, img.SourceDiskId)
+		if err != nil {
+			return err
+		}
+		if err := ImageFSM.ChangeState(img, state, db.InitiatorSystem); err != nil {
+			return err
+		}
+		if captureErr == nil {
+			img.Checksum = checksum
+		}
+		txn := conn.NewTransaction()
+		txn.Update(ctx, img)
+		ImageFSM.Notify(ctx, txn, img)
+		if err := releaseHeldDisk(ctx, txn, disk); err != nil {
+			return err
+		}
+		_, err = txn.Commit(ctx)
+		return err
+	})
+	if err != nil {
+		logger.Error(ctx, "failed to finish image capture", "id", id, "state", state, "error", err)
+	}
+}
+
 func HandleImageDeleting(ctx context.Context, conn db.Connection, entity db.Entity) {
 	img := entity.(*Image)
 	if err := ceph.DeleteImage(ctx, "images", img.Id.String()); err != nil {
 		logger.Debug(ctx, "setting image state to error", "id", img.Id, "cause", err)
+		id := img.Id
 		utils.Retry(ctx, func(ctx context.Context) error {
-			img, err := Images(conn).Get(ctx, img.Id)
-			if err != nil {
-				return err
+			// Re-read image only if previous attempt failed
+			if img == nil {
+				var err error
+				if img, err = Images(conn).Get(ctx, id); err != nil {
+					return err
+				}
 			}
 			img.State = db.StateError
 			if err := Images(conn).Update(ctx, img, db.InitiatorSystem); err != nil {
-				logger.Error(ctx, "failed to change image state", "id", img.Id, "state", img.State, "error", err)
+				logger.Error(ctx, "failed to change image state", "id", id, "state", img.State, "error", err)
+				img = nil
 				return err
 			}
 			return nil
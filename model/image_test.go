@@ -0,0 +1,99 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"errors"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/utils"
+	"testing"
+)
+
+func TestCaptureDisk(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+	project, _ := Projects(conn).Get(ctx, server.ProjectId)
+	disk := createDisk(t, conn, project)
+
+	img, err := CaptureDisk(ctx, conn, disk.Id, "golden")
+	if err != nil || img.State != db.StateCapturing || img.SourceDiskId != disk.Id || img.ProjectId != project.Id {
+		t.Fatalf("unexpected captured image: %v (%v)", img, err)
+	}
+	if project, _ := Projects(conn).Get(ctx, project.Id); !utils.ContainsULID(project.ImageIds, img.Id) || project.Usage.Images != 2 {
+		t.Fatalf("captured image not charged to project: %v", project)
+	}
+	if disk, _ := Disks(conn).Get(ctx, disk.Id); disk.State != db.StateCapturing {
+		t.Fatalf("disk not held by capture: %v", disk)
+	}
+	if _, err := CaptureDisk(ctx, conn, disk.Id, "again"); err == nil {
+		t.Fatalf("captured disk twice at once")
+	}
+	img.SourceDiskId = utils.NewULID()
+	if err := Images(conn).Update(ctx, img, db.InitiatorUser); err == nil {
+		t.Fatalf("user changed source disk of image")
+	}
+	finishImageCapture(ctx, conn, img.Id, "checksum", nil)
+	if img, _ := Images(conn).Get(ctx, img.Id); img.State != db.StateReady || img.Checksum != "checksum" {
+		t.Fatalf("unexpected image after capture: %v", img)
+	}
+	if disk, _ := Disks(conn).Get(ctx, disk.Id); disk.State != db.StateReady {
+		t.Fatalf("disk not released after capture: %v", disk)
+	}
+	if _, err := CaptureDisk(ctx, conn, disk.Id, "golden"); err == nil {
+		t.Fatalf("captured image with duplicate name")
+	}
+	if _, err := CaptureDisk(ctx, conn, disk.Id, "<html>"); err == nil {
+		t.Fatalf("captured image with invalid name")
+	}
+	if disk, _ := Disks(conn).Get(ctx, disk.Id); disk.State != db.StateReady {
+		t.Fatalf("disk held by failed capture: %v", disk)
+	}
+
+	// Server using disk can't be started during capture
+	setServerState(ctx, conn, server, db.StateReady)
+	server, _ = ServerAction(ctx, conn, server.Id, "stop")
+	setServerState(ctx, conn, server, db.StateStopped)
+	if _, err := AttachDisk(ctx, conn, server.Id, disk.Id); err != nil {
+		t.Fatalf("failed to attach disk: %s", err)
+	}
+	img, err = CaptureDisk(ctx, conn, disk.Id, "stopped")
+	if err != nil {
+		t.Fatalf("failed to capture disk of stopped server: %s", err)
+	}
+	if _, err := ServerAction(ctx, conn, server.Id, "start"); err == nil {
+		t.Fatalf("server started during capture")
+	}
+	finishImageCapture(ctx, conn, img.Id, "", errors.New("capture failed"))
+	if img, _ := Images(conn).Get(ctx, img.Id); img.State != db.StateError {
+		t.Fatalf("unexpected image after failed capture: %v", img)
+	}
+	if disk, _ := Disks(conn).Get(ctx, disk.Id); disk.State != db.StateInUse {
+		t.Fatalf("disk not released after failed capture: %v", disk)
+	}
+
+	// Disk can't be captured while it's used by running server
+	if _, err := ServerAction(ctx, conn, server.Id, "start"); err != nil {
+		t.Fatalf("failed to start server after capture: %s", err)
+	}
+	if _, err := CaptureDisk(ctx, conn, disk.Id, "running"); err == nil {
+		t.Fatalf("captured disk of running server")
+	}
+}
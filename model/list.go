@@ -0,0 +1,150 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/oklog/ulid"
+	"strings"
+)
+
+const scanPageSize = 100
+
+type ListOptions struct {
+	Limit     int
+	Continue  string
+	ProjectId ulid.ULID
+	DiskId    ulid.ULID
+	NetworkId ulid.ULID
+	State     db.State
+	Name      string
+}
+
+type continueToken struct {
+	Revision int64
+	Key      string
+}
+
+func (opts *ListOptions) matchState(state db.State) bool {
+	return opts.State == db.StateNone || opts.State == state
+}
+
+func (opts *ListOptions) matchName(name string) bool {
+	return opts.Name == "" || opts.Name == name
+}
+
+func (opts *ListOptions) matchProject(projectId ulid.ULID) bool {
+	return opts.ProjectId == (ulid.ULID{}) || opts.ProjectId == projectId
+}
+
+func (opts *ListOptions) matchDisk(diskId ulid.ULID) bool {
+	return opts.DiskId == (ulid.ULID{}) || opts.DiskId == diskId
+}
+
+func (opts *ListOptions) matchNetwork(networkId ulid.ULID) bool {
+	return opts.NetworkId == (ulid.ULID{}) || opts.NetworkId == networkId
+}
+
+func encodeContinueToken(rev int64, key string) string {
+	data, _ := json.Marshal(&continueToken{Revision: rev, Key: key})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeContinueToken(token string) (*continueToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	result := &continueToken{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Reads entities in fixed size pages at the same revision passing them to
+// accept callback until it accepts opts.Limit values, so that selective
+// filter doesn't turn into read per key. Returns continue token pointing past
+// last accepted entity if there might be more entities to list.
+func listEntities(ctx context.Context, conn db.Connection, entityName string, opts *ListOptions, accept func(value *db.RawValue) (bool, error)) (string, error) {
+	if opts.Limit < 0 {
+		return "", &db.FieldError{Entity: entityName, Field: "Limit", Message: "Should not be negative"}
+	}
+	prefix := fmt.Sprintf("%s/%s/", db.DataPrefix, entityName)
+	fromKey, rev := prefix, int64(0)
+	if opts.Continue != "" {
+		token, err := decodeContinueToken(opts.Continue)
+		if err != nil || token.Revision <= 0 || !strings.HasPrefix(token.Key, prefix) {
+			return "", &db.FieldError{Entity: entityName, Field: "Continue", Message: "Invalid continue token"}
+		}
+		fromKey, rev = token.Key, token.Revision
+	}
+	accepted := 0
+	for {
+		page, err := conn.RawReadPage(ctx, prefix, fromKey, rev, scanPageSize)
+		if err != nil {
+			return "", err
+		}
+		rev = page.Revision
+		for i := range page.Values {
+			ok, err := accept(&page.Values[i])
+			if err != nil {
+				return "", err
+			}
+			fromKey = page.Values[i].Key + "\x00"
+			if ok {
+				accepted += 1
+			}
+			if opts.Limit != 0 && accepted == opts.Limit {
+				if i == len(page.Values)-1 && !page.More {
+					return "", nil
+				}
+				return encodeContinueToken(rev, fromKey), nil
+			}
+		}
+		if !page.More {
+			return "", nil
+		}
+	}
+}
+
+// Reads all values under keyPrefix page by page at revision rev, or at current
+// revision if rev is 0. Returns revision values were read at.
+func scanPrefix(ctx context.Context, conn db.Connection, keyPrefix string, rev int64, fn func(value *db.RawValue) error) (int64, error) {
+	fromKey := keyPrefix
+	for {
+		page, err := conn.RawReadPage(ctx, keyPrefix, fromKey, rev, scanPageSize)
+		if err != nil {
+			return 0, err
+		}
+		rev = page.Revision
+		for i := range page.Values {
+			if err := fn(&page.Values[i]); err != nil {
+				return 0, err
+			}
+			fromKey = page.Values[i].Key + "\x00"
+		}
+		if !page.More {
+			return rev, nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/oklog/ulid"
+	"sort"
+	"strings"
+)
+
+// Entity manager independent of entity type, implemented by generated
+// adapters of typed managers
+type Manager interface {
+	EntityName() string
+	// State machine of entity, nil if entity has none
+	StateMachine() *StateMachine
+	NewEntity() db.Entity
+	List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error)
+	Get(ctx context.Context, id ulid.ULID) (db.Entity, error)
+	GetRevision(ctx context.Context, id ulid.ULID, rev int64) (db.Entity, error)
+	History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error)
+	Create(ctx context.Context, entity db.Entity, initiator db.Initiator) error
+	Update(ctx context.Context, entity db.Entity, initiator db.Initiator) error
+	// Entities with state machine are moved to deleting state, others are
+	// deleted right away
+	IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error
+}
+
+// Implemented by managers of entities with unique names
+type NameLookup interface {
+	// Names are unique within parent entity rather than globally, scope is
+	// id of parent entity
+	NameScoped() bool
+	GetByName(ctx context.Context, scope ulid.ULID, name string) (db.Entity, error)
+}
+
+type registration struct {
+	hasFSM     bool
+	newManager func(conn db.Connection) Manager
+}
+
+// Managers by lowercase entity name, registered by generated code
+var registry = make(map[string]*registration)
+
+func registerManager(entityName string, hasFSM bool, newManager func(conn db.Connection) Manager) {
+	if registry[entityName] != nil {
+		logger.Panic(nil, "manager registered twice", "entity_name", entityName)
+	}
+	registry[entityName] = &registration{hasFSM: hasFSM, newManager: newManager}
+}
+
+// Manager of entity by lowercase entity name, nil if there is no such entity
+func GetManager(conn db.Connection, entityName string) Manager {
+	if reg := registry[entityName]; reg != nil {
+		return reg.newManager(conn)
+	}
+	return nil
+}
+
+// Lowercase names of all entities in sorted order
+func EntityNames() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check that registered managers are consistent with their entities, should
+// be called at startup after all package initializers ran
+func CheckManagers() error {
+	for _, name := range EntityNames() {
+		reg := registry[name]
+		manager := reg.newManager(nil)
+		if strings.ToLower(manager.EntityName()) != name {
+			return fmt.Errorf("manager of %s registered as %s", manager.EntityName(), name)
+		}
+		if entity := manager.NewEntity(); entity.EntityName() != manager.EntityName() {
+			return fmt.Errorf("manager of %s creates %s entities", manager.EntityName(), entity.EntityName())
+		}
+		if reg.hasFSM && manager.StateMachine() == nil {
+			return fmt.Errorf("state machine of %s isn't initialized", manager.EntityName())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/utils"
+	"testing"
+)
+
+func TestManagerRegistry(t *testing.T) {
+	if err := CheckManagers(); err != nil {
+		t.Fatalf("inconsistent managers: %s", err)
+	}
+	if GetManager(nil, "unknown") != nil {
+		t.Fatalf("got manager of unknown entity")
+	}
+	for _, name := range EntityNames() {
+		_, isLookup := GetManager(nil, name).(NameLookup)
+		if hasKeys := len(uniqueKeys(GetManager(nil, name).NewEntity())) != 0; hasKeys != isLookup {
+			t.Fatalf("name lookup of %s doesn't match its unique keys", name)
+		}
+	}
+}
+
+func TestManagerAdapter(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	manager := GetManager(conn, "project")
+	project := manager.NewEntity().(*Project)
+	project.Name = "foo"
+	if err := manager.Create(ctx, project, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create project: %s", err)
+	}
+	found, err := manager.(NameLookup).GetByName(ctx, project.Id, "foo")
+	if err != nil || found.Header().Id != project.Id {
+		t.Fatalf("unexpected project found by name: %v (%v)", found, err)
+	}
+	if found, err := manager.Get(ctx, utils.NewULID()); found != nil || err == nil {
+		t.Fatalf("expected nil entity and error, got %v (%v)", found, err)
+	}
+	err = manager.Update(ctx, Flavors(conn).NewEntity(), db.InitiatorUser)
+	if _, ok := err.(*EntityTypeError); !ok {
+		t.Fatalf("expected entity type error, got %v", err)
+	}
+	if err := manager.IntentDelete(ctx, project.Id, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to delete project: %s", err)
+	}
+	if _, err := Projects(conn).Get(ctx, project.Id); err == nil {
+		t.Fatalf("project without state machine not deleted right away")
+	}
+}
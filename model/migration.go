@@ -0,0 +1,194 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/antonf/minicloud/config"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"strings"
+	"time"
+)
+
+// Upgrades JSON document of entity from one schema version to the next one
+type Migration func(doc map[string]interface{}) error
+
+// Migrations by entity name, migration with index i upgrades schema version
+// i+1 to i+2
+var migrations = make(map[string][]Migration)
+
+const migratePageSize = 100
+
+var OptMigrateRetryInterval = config.NewDurationOpt("migrate_retry_interval", time.Minute)
+
+// Decode entity stored under data key
+func decodeKeyEntity(key string, data []byte) (db.Entity, error) {
+	elements := strings.Split(strings.TrimPrefix(key, db.DataPrefix+"/"), "/")
+	manager := GetManager(nil, elements[0])
+	if len(elements) != 2 || manager == nil || !strings.HasPrefix(key, db.DataPrefix+"/") {
+		return nil, fmt.Errorf("Unexpected data key %s", key)
+	}
+	entity := manager.NewEntity()
+	if err := decodeEntity(data, entity); err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// Migrations must be registered from init functions in version order
+func RegisterMigration(entityName string, fromVersion int64, migration Migration) {
+	if fromVersion != SchemaVersion(entityName) {
+		logger.Panic(nil, "migration registered out of order", "entity_name", entityName, "from_version", fromVersion)
+	}
+	migrations[entityName] = append(migrations[entityName], migration)
+}
+
+// Current schema version of entity
+func SchemaVersion(entityName string) int64 {
+	return int64(len(migrations[entityName])) + 1
+}
+
+func storedSchemaVersion(data []byte) (int64, error) {
+	var hdr struct {
+		SchemaVersion int64
+	}
+	if err := json.Unmarshal(data, &hdr); err != nil {
+		return 0, err
+	}
+	return hdr.SchemaVersion, nil
+}
+
+// Decode stored entity upgrading it to current schema version
+func decodeEntity(data []byte, entity db.Entity) error {
+	entityName := entity.EntityName()
+	version, err := storedSchemaVersion(data)
+	if err != nil {
+		return err
+	}
+	current := SchemaVersion(entityName)
+	if version < 1 || version > current {
+		return fmt.Errorf("Unsupported %s schema version %d", entityName, version)
+	}
+	if version < current {
+		doc := make(map[string]interface{})
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		for _, migration := range migrations[entityName][version-1:] {
+			if err := migration(doc); err != nil {
+				return err
+			}
+		}
+		doc["SchemaVersion"] = current
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, entity)
+}
+
+// Rewrite all stored entities with outdated schema version, returns number of
+// rewritten entities
+func MigrateEntities(ctx context.Context, conn db.Connection) (int, error) {
+	count := 0
+	for _, entityName := range EntityNames() {
+		newEntity := GetManager(nil, entityName).NewEntity
+		prefix := fmt.Sprintf("%s/%s/", db.DataPrefix, entityName)
+		fromKey := prefix
+		for {
+			page, err := conn.RawReadPage(ctx, prefix, fromKey, 0, migratePageSize)
+			if err != nil {
+				return count, err
+			}
+			for _, value := range page.Values {
+				fromKey = value.Key + "\x00"
+				migrated, err := migrateEntity(ctx, conn, value.Key, newEntity)
+				if err != nil {
+					return count, err
+				}
+				if migrated {
+					count += 1
+				}
+			}
+			if !page.More {
+				break
+			}
+		}
+	}
+	return count, nil
+}
+
+// Rewrite outdated entities in background until all of them are migrated, so
+// stored data catches up with schema without waiting for entities to be read.
+// Returned channel is closed once migration is complete.
+func MigrateInBackground(ctx context.Context, conn db.Connection) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for {
+			count, err := MigrateEntities(ctx, conn)
+			if err == nil {
+				logger.Info(ctx, "background migration complete", "migrated", count)
+				close(done)
+				return
+			}
+			logger.Error(ctx, "background migration failed", "migrated", count, "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(OptMigrateRetryInterval.Value()):
+			}
+		}
+	}()
+	return done
+}
+
+func migrateEntity(ctx context.Context, conn db.Connection, key string, newEntity func() db.Entity) (bool, error) {
+	migrated := false
+	err := utils.Retry(ctx, func(ctx context.Context) error {
+		value, err := conn.RawRead(ctx, key)
+		if err != nil {
+			return err
+		}
+		if value.Data == nil {
+			// Deleted concurrently
+			return nil
+		}
+		entity := newEntity()
+		if version, err := storedSchemaVersion(value.Data); err != nil {
+			return err
+		} else if version == SchemaVersion(entity.EntityName()) {
+			return nil
+		}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return err
+		}
+		entity.Header().ModifyRev = value.ModifyRev
+		txn := conn.NewTransaction()
+		txn.Update(ctx, entity)
+		if _, err := txn.Commit(ctx); err != nil {
+			return err
+		}
+		logger.Info(ctx, "entity migrated", "entity", entity)
+		migrated = true
+		return nil
+	})
+	return migrated, err
+}
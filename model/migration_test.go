@@ -0,0 +1,83 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"testing"
+	"time"
+)
+
+func TestMigration(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	defer delete(migrations, "Project")
+	RegisterMigration("Project", 1, func(doc map[string]interface{}) error {
+		doc["Name"] = doc["Name"].(string) + "-v2"
+		return nil
+	})
+
+	upgraded, err := Projects(conn).Get(ctx, project.Id)
+	if err != nil {
+		t.Fatalf("failed to get project: %s", err)
+	}
+	if upgraded.SchemaVersion != 2 || upgraded.Name != "foo-v2" {
+		t.Fatalf("project not upgraded on read: %s", upgraded)
+	}
+
+	for expected := 1; expected >= 0; expected-- {
+		count, err := MigrateEntities(ctx, conn)
+		if err != nil || count != expected {
+			t.Fatalf("unexpected migration result: %d %v (expected %d)", count, err, expected)
+		}
+	}
+	value, _ := conn.RawRead(ctx, db.DataKey(project))
+	if version, _ := storedSchemaVersion(value.Data); version != 2 {
+		t.Fatalf("stored project not migrated: %s", value.Data)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("migration registered out of order")
+		}
+	}()
+	RegisterMigration("Project", 1, func(doc map[string]interface{}) error { return nil })
+}
+
+func TestMigrateInBackground(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	defer delete(migrations, "Project")
+	RegisterMigration("Project", 1, func(doc map[string]interface{}) error {
+		return nil
+	})
+
+	select {
+	case <-MigrateInBackground(ctx, conn):
+	case <-time.After(5 * time.Second):
+		t.Fatalf("background migration not complete")
+	}
+	value, _ := conn.RawRead(ctx, db.DataKey(project))
+	if version, _ := storedSchemaVersion(value.Data); version != 2 {
+		t.Fatalf("stored project not migrated in background: %s", value.Data)
+	}
+}
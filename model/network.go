@@ -0,0 +1,376 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Code generated by gen/main.go from entities.json. DO NOT EDIT.
+
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"github.com/oklog/ulid"
+	"regexp"
+)
+
+type NetworkManager struct {
+	conn db.Connection
+}
+
+func Networks(conn db.Connection) *NetworkManager {
+	return &NetworkManager{conn: conn}
+}
+
+var regexpNetworkName = regexp.MustCompile("^[a-zA-Z0-9_.:-]{3,200}$")
+
+func (m *NetworkManager) NewEntity() *Network {
+	return &Network{EntityHeader: db.EntityHeader{SchemaVersion: SchemaVersion("Network"), State: db.StateCreated}}
+}
+func (m *NetworkManager) List(ctx context.Context, opts *ListOptions) ([]*Network, string, error) {
+	if opts.DiskId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "network", Field: "DiskId", Message: "Filter not supported"}
+	}
+	if opts.NetworkId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "network", Field: "NetworkId", Message: "Filter not supported"}
+	}
+	result := []*Network{}
+	next, err := listEntities(ctx, m.conn, "network", opts, func(value *db.RawValue) (bool, error) {
+		entity := &Network{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return false, err
+		}
+		if !opts.matchState(entity.State) || !opts.matchName(entity.Name) || !opts.matchProject(entity.ProjectId) {
+			return false, nil
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result = append(result, entity)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return result, next, nil
+}
+func (m *NetworkManager) Get(ctx context.Context, id ulid.ULID) (*Network, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/data/network/%s", id))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Network", Id: id}
+	}
+	entity := &Network{}
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *NetworkManager) GetByName(ctx context.Context, projectId ulid.ULID, name string) (*Network, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/meta/network/project/%s/name/%s", projectId, name))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NameNotFoundError{Entity: "Network", Name: name}
+	}
+	id, err := ulid.Parse(string(value.Data))
+	if err != nil {
+		return nil, err
+	}
+	entity, err := m.Get(ctx, id)
+	if _, notFound := err.(*db.NotFoundError); notFound || (err == nil && (entity.ProjectId != projectId || entity.Name != name)) {
+		// Renamed or deleted after name lookup
+		return nil, &db.NameNotFoundError{Entity: "Network", Name: name}
+	}
+	return entity, err
+}
+func (m *NetworkManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (*Network, error) {
+	value, err := m.conn.RawReadRev(ctx, fmt.Sprintf("/minicloud/db/data/network/%s", id), rev)
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Network", Id: id}
+	}
+	entity := &Network{}
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *NetworkManager) History(ctx context.Context, id ulid.ULID, limit int) ([]*Network, error) {
+	values, err := m.conn.RawReadHistory(ctx, fmt.Sprintf("/minicloud/db/data/network/%s", id), limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &db.NotFoundError{Entity: "Network", Id: id}
+	}
+	result := make([]*Network, len(values))
+	for i, value := range values {
+		entity := &Network{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return nil, err
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *NetworkManager) Create(ctx context.Context, entity *Network, initiator db.Initiator) error {
+	entity.Id = utils.NewULID()
+	if err := NetworkFSM.CheckInitialState(entity.State); err != nil {
+		return err
+	}
+	// Every attempt starts with requested values, so values allocated by
+	// attempt that conflicted aren't reused
+	requestedBridgeName := entity.BridgeName
+	return utils.Retry(ctx, func(ctx context.Context) error {
+		entity.BridgeName = requestedBridgeName
+		if err := prepareNetwork(ctx, m.conn, entity); err != nil {
+			return err
+		}
+		if !regexpNetworkName.MatchString(entity.Name) {
+			return &db.FieldError{Entity: "network", Field: "Name", Message: "Name should be between 3 and 200 characters from following set: a-z A-Z 0-9 _.:-"}
+		}
+		if !isIPv4List(entity.DNS) {
+			return &db.FieldError{Entity: "network", Field: "DNS", Message: "Should be comma separated list of IPv4 addresses"}
+		}
+		if len(entity.PortIds) != 0 {
+			return &db.FieldError{Entity: "network", Field: "PortIds", Message: "Should be empty"}
+		}
+		txn := m.conn.NewTransaction()
+		txn.Create(ctx, entity)
+		if project, err := Projects(m.conn).Get(ctx, entity.ProjectId); err != nil {
+			return err
+		} else {
+			project.NetworkIds = append(project.NetworkIds, entity.Id)
+			txn.Update(ctx, project)
+		}
+		key0 := fmt.Sprintf("/minicloud/db/meta/network/project/%s/name/%s", entity.ProjectId, entity.Name)
+		txn.CreateMeta(ctx, key0, entity.Id.String())
+		key1 := fmt.Sprintf("/minicloud/db/meta/network/bridgename/%s", entity.BridgeName)
+		txn.CreateMeta(ctx, key1, entity.Id.String())
+		NetworkFSM.Notify(ctx, txn, entity)
+		if _, err := txn.Commit(ctx); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+func (m *NetworkManager) Update(ctx context.Context, entity *Network, initiator db.Initiator) error {
+	origEntity := entity.Original.(*Network)
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
+	if err := NetworkFSM.CheckTransition(origEntity.State, entity.State, initiator); err != nil {
+		return err
+	}
+	if entity.ProjectId != origEntity.ProjectId {
+		return &db.FieldError{Entity: "network", Field: "ProjectId", Message: "Field change prohibited"}
+	}
+	if !regexpNetworkName.MatchString(entity.Name) {
+		return &db.FieldError{Entity: "network", Field: "Name", Message: "Name should be between 3 and 200 characters from following set: a-z A-Z 0-9 _.:-"}
+	}
+	if entity.CIDR != origEntity.CIDR {
+		return &db.FieldError{Entity: "network", Field: "CIDR", Message: "Field change prohibited"}
+	}
+	if entity.Gateway != origEntity.Gateway {
+		return &db.FieldError{Entity: "network", Field: "Gateway", Message: "Field change prohibited"}
+	}
+	if !isIPv4List(entity.DNS) {
+		return &db.FieldError{Entity: "network", Field: "DNS", Message: "Should be comma separated list of IPv4 addresses"}
+	}
+	if entity.BridgeName != origEntity.BridgeName {
+		return &db.FieldError{Entity: "network", Field: "BridgeName", Message: "Field change prohibited"}
+	}
+	if !utils.ULIDListsEqual(entity.PortIds, origEntity.PortIds) {
+		return &db.FieldError{Entity: "network", Field: "PortIds", Message: "Field change prohibited"}
+	}
+	txn := m.conn.NewTransaction()
+	txn.Update(ctx, entity)
+	if entity.ProjectId != origEntity.ProjectId || entity.Name != origEntity.Name {
+		forfeitKey0 := fmt.Sprintf("/minicloud/db/meta/network/project/%s/name/%s", origEntity.ProjectId, origEntity.Name)
+		txn.CheckMeta(ctx, forfeitKey0, origEntity.Id.String())
+		txn.DeleteMeta(ctx, forfeitKey0)
+		claimKey0 := fmt.Sprintf("/minicloud/db/meta/network/project/%s/name/%s", entity.ProjectId, entity.Name)
+		txn.CreateMeta(ctx, claimKey0, entity.Id.String())
+	}
+	if entity.BridgeName != origEntity.BridgeName {
+		forfeitKey1 := fmt.Sprintf("/minicloud/db/meta/network/bridgename/%s", origEntity.BridgeName)
+		txn.CheckMeta(ctx, forfeitKey1, origEntity.Id.String())
+		txn.DeleteMeta(ctx, forfeitKey1)
+		claimKey1 := fmt.Sprintf("/minicloud/db/meta/network/bridgename/%s", entity.BridgeName)
+		txn.CreateMeta(ctx, claimKey1, entity.Id.String())
+	}
+	NetworkFSM.Notify(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+func (m *NetworkManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	entity, err := Networks(m.conn).Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
+	if err := NetworkFSM.CheckTransition(entity.State, db.StateDeleting, initiator); err != nil {
+		return err
+	}
+	if len(entity.PortIds) != 0 {
+		return &db.FieldError{Entity: "network", Field: "PortIds", Message: "Should be empty"}
+	}
+	entity.State = db.StateDeleting
+	txn := m.conn.NewTransaction()
+	txn.Update(ctx, entity)
+	NetworkFSM.Notify(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+func (m *NetworkManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	entity, err := Networks(m.conn).Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
+	if err := NetworkFSM.CheckTransition(entity.State, db.StateDeleted, initiator); err != nil {
+		return err
+	}
+	if len(entity.PortIds) != 0 {
+		return &db.FieldError{Entity: "network", Field: "PortIds", Message: "Should be empty"}
+	}
+	txn := m.conn.NewTransaction()
+	txn.Delete(ctx, entity)
+	if project, err := Projects(m.conn).Get(ctx, entity.ProjectId); err != nil {
+		return err
+	} else {
+		project.NetworkIds = utils.RemoveULID(project.NetworkIds, entity.Id)
+		txn.Update(ctx, project)
+	}
+	key0 := fmt.Sprintf("/minicloud/db/meta/network/project/%s/name/%s", entity.ProjectId, entity.Name)
+	txn.CheckMeta(ctx, key0, entity.Id.String())
+	txn.DeleteMeta(ctx, key0)
+	key1 := fmt.Sprintf("/minicloud/db/meta/network/bridgename/%s", entity.BridgeName)
+	txn.CheckMeta(ctx, key1, entity.Id.String())
+	txn.DeleteMeta(ctx, key1)
+	NetworkFSM.DeleteNotification(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+type networkManager struct {
+	typed *NetworkManager
+}
+
+func init() {
+	registerManager("network", true, func(conn db.Connection) Manager {
+		return &networkManager{typed: Networks(conn)}
+	})
+}
+func (m *networkManager) EntityName() string {
+	return "Network"
+}
+func (m *networkManager) StateMachine() *StateMachine {
+	return NetworkFSM
+}
+func (m *networkManager) NewEntity() db.Entity {
+	return m.typed.NewEntity()
+}
+func (m *networkManager) List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error) {
+	entities, next, err := m.typed.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, next, nil
+}
+func (m *networkManager) Get(ctx context.Context, id ulid.ULID) (db.Entity, error) {
+	entity, err := m.typed.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *networkManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (db.Entity, error) {
+	entity, err := m.typed.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *networkManager) NameScoped() bool {
+	return true
+}
+func (m *networkManager) GetByName(ctx context.Context, scope ulid.ULID, name string) (db.Entity, error) {
+	entity, err := m.typed.GetByName(ctx, scope, name)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *networkManager) History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error) {
+	entities, err := m.typed.History(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *networkManager) Create(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Network)
+	if !ok {
+		return &EntityTypeError{Expected: "Network", Actual: entity.EntityName()}
+	}
+	return m.typed.Create(ctx, typedEntity, initiator)
+}
+func (m *networkManager) Update(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Network)
+	if !ok {
+		return &EntityTypeError{Expected: "Network", Actual: entity.EntityName()}
+	}
+	return m.typed.Update(ctx, typedEntity, initiator)
+}
+func (m *networkManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	return m.typed.IntentDelete(ctx, id, initiator)
+}
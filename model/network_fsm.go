@@ -0,0 +1,157 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"net"
+	"strings"
+)
+
+var NetworkFSM *StateMachine
+
+func init() {
+	NetworkFSM = NewStateMachine().
+		InitialState(db.StateCreated).
+		UserTransition(db.StateReady, db.StateReady). // Allow update in ready state
+		UserTransition(db.StateReady, db.StateDeleting).
+		UserTransition(db.StateError, db.StateDeleting).
+		SystemTransition(db.StateCreated, db.StateReady).
+		SystemTransition(db.StateCreated, db.StateError).
+		SystemTransition(db.StateDeleting, db.StateDeleted).
+		Hook(db.StateCreated, HandleNetworkCreated).
+		Hook(db.StateDeleting, HandleNetworkDeleting)
+	RegisterMigration("Network", 1, migrateNetworkBridgeName)
+}
+
+// Networks created before bridge names were allocated keep bridge named after
+// their id, fsck creates missing unique keys of these names
+func migrateNetworkBridgeName(doc map[string]interface{}) error {
+	id, ok := doc["Id"].(string)
+	if !ok || len(id) < 12 {
+		return fmt.Errorf("Unexpected network id %v", doc["Id"])
+	}
+	doc["BridgeName"] = "br" + id[len(id)-12:]
+	return nil
+}
+
+// Only IPv4 networks are supported, gateway defaults to first host address
+func prepareNetwork(ctx context.Context, conn db.Connection, network *Network) error {
+	if network.BridgeName != "" {
+		return &db.FieldError{Entity: "network", Field: "BridgeName", Message: "Should be empty"}
+	}
+	ip, ipNet, err := net.ParseCIDR(network.CIDR)
+	if err != nil || ip.To4() == nil {
+		return &db.FieldError{Entity: "network", Field: "CIDR", Message: "Should be IPv4 network in CIDR notation"}
+	}
+	if ones, _ := ipNet.Mask.Size(); ones > 30 {
+		return &db.FieldError{Entity: "network", Field: "CIDR", Message: "Network should have at least two host addresses"}
+	}
+	network.CIDR = ipNet.String()
+	if network.Gateway == "" {
+		network.Gateway = hostAddress(ipNet, 1).String()
+	} else {
+		gateway := net.ParseIP(network.Gateway).To4()
+		if gateway == nil || !isHostAddress(ipNet, gateway) {
+			return &db.FieldError{Entity: "network", Field: "Gateway", Message: "Should be host address within network"}
+		}
+		network.Gateway = gateway.String()
+	}
+	// Servers of network share bridge on every host, its name is claimed by
+	// unique key of network and should fit into IFNAMSIZ
+	suffix := make([]byte, 5)
+	if _, err := randomRead(suffix); err != nil {
+		return err
+	}
+	network.BridgeName = "br" + hex.EncodeToString(suffix)
+	return nil
+}
+
+// Empty string or comma separated list of IPv4 addresses, used to validate
+// network DNS servers
+func isIPv4List(value string) bool {
+	if value == "" {
+		return true
+	}
+	for _, addr := range strings.Split(value, ",") {
+		if net.ParseIP(addr).To4() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Address with host part set to n
+func hostAddress(ipNet *net.IPNet, n uint32) net.IP {
+	base := ipNet.IP.To4()
+	value := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	value += n
+	return net.IPv4(byte(value>>24), byte(value>>16), byte(value>>8), byte(value)).To4()
+}
+
+// Number of host addresses in network, excluding network and broadcast ones
+func hostCount(ipNet *net.IPNet) uint32 {
+	ones, bits := ipNet.Mask.Size()
+	return uint32(1)<<uint(bits-ones) - 2
+}
+
+func isHostAddress(ipNet *net.IPNet, ip net.IP) bool {
+	if !ipNet.Contains(ip) {
+		return false
+	}
+	return !ip.Equal(hostAddress(ipNet, 0)) && !ip.Equal(hostAddress(ipNet, hostCount(ipNet)+1))
+}
+
+func HandleNetworkCreated(ctx context.Context, conn db.Connection, entity db.Entity) {
+	network := entity.(*Network)
+	setNetworkState(ctx, conn, network, db.StateReady)
+}
+
+func HandleNetworkDeleting(ctx context.Context, conn db.Connection, entity db.Entity) {
+	network := entity.(*Network)
+	err := utils.Retry(ctx, func(ctx context.Context) error {
+		return Networks(conn).Delete(ctx, network.Id, db.InitiatorSystem)
+	})
+	if err != nil {
+		logger.Error(ctx, "failed to delete network from database", "id", network.Id, "error", err)
+	}
+}
+
+func setNetworkState(ctx context.Context, conn db.Connection, network *Network, state db.State) {
+	id := network.Id
+	utils.Retry(ctx, func(ctx context.Context) error {
+		// Re-read network only if previous attempt failed
+		if network == nil {
+			var err error
+			if network, err = Networks(conn).Get(ctx, id); err != nil {
+				return err
+			}
+		}
+		network.State = state
+		if err := Networks(conn).Update(ctx, network, db.InitiatorSystem); err != nil {
+			logger.Error(ctx, "failed to change network state", "id", id, "state", state, "error", err)
+			network = nil
+			return err
+		}
+		return nil
+	})
+}
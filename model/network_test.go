@@ -0,0 +1,302 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/utils"
+	"net"
+	"testing"
+)
+
+func createNetwork(t *testing.T, conn db.Connection, project *Project, cidr string) *Network {
+	network := Networks(conn).NewEntity()
+	network.ProjectId = project.Id
+	network.Name = "net-" + cidr[:len(cidr)-3]
+	network.CIDR = cidr
+	if err := Networks(conn).Create(context.Background(), network, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create network %s: %s", cidr, err)
+	}
+	return network
+}
+
+func createPort(ctx context.Context, conn db.Connection, network *Network, ip, mac string) (*Port, error) {
+	port := Ports(conn).NewEntity()
+	port.NetworkId = network.Id
+	port.IPAddress = ip
+	port.MacAddress = mac
+	if err := Ports(conn).Create(ctx, port, db.InitiatorUser); err != nil {
+		return nil, err
+	}
+	return port, nil
+}
+
+func TestNetwork(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	network := createNetwork(t, conn, project, "10.0.0.7/24")
+	if network.CIDR != "10.0.0.0/24" || network.Gateway != "10.0.0.1" {
+		t.Fatalf("unexpected network: %v %s %s", network, network.CIDR, network.Gateway)
+	}
+	for _, invalid := range []struct{ cidr, gateway, dns string }{
+		{"10.0.0.0", "", ""},
+		{"fd00::/64", "", ""},
+		{"10.0.0.0/31", "", ""},
+		{"10.1.0.0/24", "10.0.0.1", ""},
+		{"10.1.0.0/24", "10.1.0.255", ""},
+		{"10.1.0.0/24", "", "8.8.8.8;1.1.1.1"},
+		{"10.1.0.0/24", "", "999.1.1.1"},
+		{"10.1.0.0/24", "", "8.8.8.8,"},
+	} {
+		network := Networks(conn).NewEntity()
+		network.ProjectId = project.Id
+		network.Name = "invalid"
+		network.CIDR, network.Gateway, network.DNS = invalid.cidr, invalid.gateway, invalid.dns
+		if err := Networks(conn).Create(ctx, network, db.InitiatorUser); err == nil {
+			t.Fatalf("invalid network accepted: %+v", invalid)
+		} else if _, ok := err.(*db.FieldError); !ok {
+			t.Fatalf("expected field error for %+v, got %v", invalid, err)
+		}
+	}
+}
+
+func TestBridgeNameAllocation(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+
+	// Second network gets the same random name as first one on first attempt
+	var draws []byte
+	randomRead = func(b []byte) (int, error) {
+		for i := range b {
+			b[i] = draws[0]
+		}
+		draws = draws[1:]
+		return len(b), nil
+	}
+	defer func() { randomRead = rand.Read }()
+
+	draws = []byte{1}
+	first := createNetwork(t, conn, project, "10.0.0.0/24")
+	draws = []byte{1, 2}
+	second := createNetwork(t, conn, project, "10.1.0.0/24")
+	if first.BridgeName != "br0101010101" || second.BridgeName != "br0202020202" {
+		t.Fatalf("unexpected bridge names: %s %s", first.BridgeName, second.BridgeName)
+	}
+
+	network := Networks(conn).NewEntity()
+	network.ProjectId = project.Id
+	network.Name = "requested"
+	network.CIDR = "10.2.0.0/24"
+	network.BridgeName = "br0"
+	if err := Networks(conn).Create(ctx, network, db.InitiatorUser); err == nil {
+		t.Fatalf("network with requested bridge name created")
+	}
+
+	// Network created before bridge names were allocated
+	data, _ := json.Marshal(map[string]interface{}{"SchemaVersion": 1, "Id": first.Id, "Name": "legacy"})
+	legacy := Networks(conn).NewEntity()
+	if err := decodeEntity(data, legacy); err != nil || len(legacy.BridgeName) != 14 || legacy.SchemaVersion != 2 {
+		t.Fatalf("unexpected legacy network: %v (%v)", legacy, err)
+	}
+}
+
+func TestPortAllocation(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	network := createNetwork(t, conn, project, "10.0.0.0/29")
+
+	fixed, err := createPort(ctx, conn, network, "10.0.0.2", "52:54:00:AA:BB:CC")
+	if err != nil || fixed.MacAddress != "52:54:00:aa:bb:cc" {
+		t.Fatalf("unexpected port with fixed address: %v (%v)", fixed, err)
+	}
+	if _, err := createPort(ctx, conn, network, "10.0.0.2", ""); err == nil {
+		t.Fatalf("address allocated twice")
+	} else if _, ok := err.(*db.ConflictError); !ok {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if _, err := createPort(ctx, conn, network, "", "52:54:00:aa:bb:cc"); err == nil {
+		t.Fatalf("MAC address allocated twice")
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.0", "10.0.0.7", "10.0.1.2", "garbage"} {
+		if _, err := createPort(ctx, conn, network, ip, ""); err == nil {
+			t.Fatalf("port with invalid address %s created", ip)
+		}
+	}
+	if _, err := createPort(ctx, conn, network, "", "01:00:5e:00:00:01"); err == nil {
+		t.Fatalf("port with multicast MAC address created")
+	}
+
+	// Gateway and fixed addresses are skipped
+	seen := map[string]bool{fixed.MacAddress: true}
+	for _, expected := range []string{"10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		port, err := createPort(ctx, conn, network, "", "")
+		if err != nil || port.IPAddress != expected || seen[port.MacAddress] {
+			t.Fatalf("unexpected allocated port: %v %s (%v)", port, port.MacAddress, err)
+		}
+		seen[port.MacAddress] = true
+	}
+	if _, err := createPort(ctx, conn, network, "", ""); err == nil {
+		t.Fatalf("port allocated in full network")
+	}
+
+	found, err := Ports(conn).GetByName(ctx, network.Id, "10.0.0.2")
+	if err != nil || found.Id != fixed.Id {
+		t.Fatalf("port not found by address: %v (%v)", found, err)
+	}
+	ports, _, err := Ports(conn).List(ctx, &ListOptions{NetworkId: network.Id})
+	if err != nil || len(ports) != 5 {
+		t.Fatalf("unexpected ports of network: %v (%v)", ports, err)
+	}
+	if err := Networks(conn).IntentDelete(ctx, network.Id, db.InitiatorUser); err == nil {
+		t.Fatalf("network with ports deleted")
+	}
+}
+
+func TestPortAllocationRetry(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	network := createNetwork(t, conn, project, "10.0.0.0/24")
+
+	// Second port gets the same random values as first one on first attempt
+	var draws []byte
+	randomRead = func(b []byte) (int, error) {
+		for i := range b {
+			b[i] = draws[0]
+		}
+		draws = draws[1:]
+		return len(b), nil
+	}
+	defer func() { randomRead = rand.Read }()
+
+	draws = []byte{1, 1}
+	first, err := createPort(ctx, conn, network, "", "")
+	if err != nil || first.MacAddress != "52:54:00:01:01:01" || first.InterfaceName != "tap0101010101" {
+		t.Fatalf("unexpected port: %v %s %s (%v)", first, first.MacAddress, first.InterfaceName, err)
+	}
+	draws = []byte{1, 1, 2, 2}
+	second, err := createPort(ctx, conn, network, "", "")
+	if err != nil || second.MacAddress != "52:54:00:02:02:02" || second.InterfaceName != "tap0202020202" {
+		t.Fatalf("unexpected port: %v %s %s (%v)", second, second.MacAddress, second.InterfaceName, err)
+	}
+	if first.IPAddress == second.IPAddress {
+		t.Fatalf("address %s allocated twice", first.IPAddress)
+	}
+
+	port := Ports(conn).NewEntity()
+	port.NetworkId = network.Id
+	port.InterfaceName = "tap0"
+	if err := Ports(conn).Create(ctx, port, db.InitiatorUser); err == nil {
+		t.Fatalf("port with requested interface name created")
+	}
+
+	// Deleted port releases its values
+	setPortState(ctx, conn, first, db.StateReady)
+	if err := Ports(conn).IntentDelete(ctx, first.Id, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to delete port: %s", err)
+	}
+	if err := Ports(conn).Delete(ctx, first.Id, db.InitiatorSystem); err != nil {
+		t.Fatalf("failed to delete port: %s", err)
+	}
+	draws = []byte{1, 1}
+	if third, err := createPort(ctx, conn, network, "", ""); err != nil || third.InterfaceName != first.InterfaceName {
+		t.Fatalf("released values not reused: %v (%v)", third, err)
+	}
+}
+
+func TestServerPorts(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	network := createNetwork(t, conn, project, "10.0.0.0/24")
+	port, err := createPort(ctx, conn, network, "", "")
+	if err != nil {
+		t.Fatalf("failed to create port: %s", err)
+	}
+	flavor := Flavors(conn).NewEntity()
+	flavor.Name = "small"
+	flavor.NumCPUs = 1
+	flavor.RAM = 512
+	if err := Flavors(conn).Create(ctx, flavor, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create flavor: %s", err)
+	}
+	server := Servers(conn).NewEntity()
+	server.Name = "foo"
+	server.ProjectId = project.Id
+	server.FlavorId = flavor.Id
+	server.PortIds = append(server.PortIds, port.Id)
+	if err := Servers(conn).Create(ctx, server, db.InitiatorUser); err == nil {
+		t.Fatalf("server attached to port being created")
+	}
+	setPortState(ctx, conn, port, db.StateReady)
+	if err := Servers(conn).Create(ctx, server, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	port, _ = Ports(conn).Get(ctx, port.Id)
+	if port.ServerId != server.Id || port.State != db.StateInUse {
+		t.Fatalf("port not attached to server: %v", port)
+	}
+	if report, err := Fsck(ctx, conn, false); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("unexpected fsck problems: %v (%v)", report.Problems, err)
+	}
+
+	setNetworkState(ctx, conn, network, db.StateReady)
+	network, _ = Networks(conn).Get(ctx, network.Id)
+	network.DNS = "8.8.8.8,999.1.1.1"
+	if err := Networks(conn).Update(ctx, network, db.InitiatorUser); err == nil {
+		t.Fatalf("network updated with invalid DNS")
+	}
+	network.DNS = "8.8.8.8,1.1.1.1"
+	if err := Networks(conn).Update(ctx, network, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to update network: %s", err)
+	}
+	bridge := network.BridgeName
+	mac, _ := net.ParseMAC(port.MacAddress)
+	lease, err := portLease(ctx, conn, bridge, mac)
+	if err != nil || lease == nil || lease.IP.String() != port.IPAddress || lease.Gateway.String() != "10.0.0.1" || lease.Hostname != "foo" {
+		t.Fatalf("unexpected lease: %+v (%v)", lease, err)
+	}
+	if len(lease.DNS) != 2 || lease.DNS[1].String() != "1.1.1.1" || lease.Mask.String() != "ffffff00" {
+		t.Fatalf("unexpected lease: %+v", lease)
+	}
+	if lease, err := portLease(ctx, conn, "brother", mac); err != nil || lease != nil {
+		t.Fatalf("got lease on other bridge: %+v (%v)", lease, err)
+	}
+
+	setServerState(ctx, conn, server, db.StateReady)
+	if err := Servers(conn).IntentDelete(ctx, server.Id, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to delete server: %s", err)
+	}
+	if err := Servers(conn).Delete(ctx, server.Id, db.InitiatorSystem); err != nil {
+		t.Fatalf("failed to delete server: %s", err)
+	}
+	port, _ = Ports(conn).Get(ctx, port.Id)
+	if port.ServerId != utils.Zero || port.State != db.StateReady {
+		t.Fatalf("port not released: %v", port)
+	}
+	if lease, err := portLease(ctx, conn, bridge, mac); err != nil || lease != nil {
+		t.Fatalf("got lease of detached port: %+v (%v)", lease, err)
+	}
+}
@@ -0,0 +1,375 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Code generated by gen/main.go from entities.json. DO NOT EDIT.
+
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"github.com/oklog/ulid"
+)
+
+type PortManager struct {
+	conn db.Connection
+}
+
+func Ports(conn db.Connection) *PortManager {
+	return &PortManager{conn: conn}
+}
+func (m *PortManager) NewEntity() *Port {
+	return &Port{EntityHeader: db.EntityHeader{SchemaVersion: SchemaVersion("Port"), State: db.StateCreated}}
+}
+func (m *PortManager) List(ctx context.Context, opts *ListOptions) ([]*Port, string, error) {
+	if opts.Name != "" {
+		return nil, "", &db.FieldError{Entity: "port", Field: "Name", Message: "Filter not supported"}
+	}
+	if opts.ProjectId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "port", Field: "ProjectId", Message: "Filter not supported"}
+	}
+	if opts.DiskId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "port", Field: "DiskId", Message: "Filter not supported"}
+	}
+	result := []*Port{}
+	next, err := listEntities(ctx, m.conn, "port", opts, func(value *db.RawValue) (bool, error) {
+		entity := &Port{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return false, err
+		}
+		if !opts.matchState(entity.State) || !opts.matchNetwork(entity.NetworkId) {
+			return false, nil
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result = append(result, entity)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return result, next, nil
+}
+func (m *PortManager) Get(ctx context.Context, id ulid.ULID) (*Port, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/data/port/%s", id))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Port", Id: id}
+	}
+	entity := &Port{}
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *PortManager) GetByName(ctx context.Context, networkId ulid.ULID, iPAddress string) (*Port, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/meta/port/network/%s/ipaddress/%s", networkId, iPAddress))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NameNotFoundError{Entity: "Port", Name: iPAddress}
+	}
+	id, err := ulid.Parse(string(value.Data))
+	if err != nil {
+		return nil, err
+	}
+	entity, err := m.Get(ctx, id)
+	if _, notFound := err.(*db.NotFoundError); notFound || (err == nil && (entity.NetworkId != networkId || entity.IPAddress != iPAddress)) {
+		// Renamed or deleted after name lookup
+		return nil, &db.NameNotFoundError{Entity: "Port", Name: iPAddress}
+	}
+	return entity, err
+}
+func (m *PortManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (*Port, error) {
+	value, err := m.conn.RawReadRev(ctx, fmt.Sprintf("/minicloud/db/data/port/%s", id), rev)
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Port", Id: id}
+	}
+	entity := &Port{}
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *PortManager) History(ctx context.Context, id ulid.ULID, limit int) ([]*Port, error) {
+	values, err := m.conn.RawReadHistory(ctx, fmt.Sprintf("/minicloud/db/data/port/%s", id), limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &db.NotFoundError{Entity: "Port", Id: id}
+	}
+	result := make([]*Port, len(values))
+	for i, value := range values {
+		entity := &Port{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return nil, err
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *PortManager) Create(ctx context.Context, entity *Port, initiator db.Initiator) error {
+	entity.Id = utils.NewULID()
+	if err := PortFSM.CheckInitialState(entity.State); err != nil {
+		return err
+	}
+	// Every attempt starts with requested values, so values allocated by
+	// attempt that conflicted aren't reused
+	requestedIPAddress, requestedMacAddress, requestedInterfaceName := entity.IPAddress, entity.MacAddress, entity.InterfaceName
+	return utils.Retry(ctx, func(ctx context.Context) error {
+		entity.IPAddress, entity.MacAddress, entity.InterfaceName = requestedIPAddress, requestedMacAddress, requestedInterfaceName
+		if err := preparePort(ctx, m.conn, entity); err != nil {
+			return err
+		}
+		if entity.ServerId != utils.Zero {
+			return &db.FieldError{Entity: "port", Field: "ServerId", Message: "Should be empty"}
+		}
+		txn := m.conn.NewTransaction()
+		txn.Create(ctx, entity)
+		if network, err := Networks(m.conn).Get(ctx, entity.NetworkId); err != nil {
+			return err
+		} else {
+			network.PortIds = append(network.PortIds, entity.Id)
+			txn.Update(ctx, network)
+		}
+		key0 := fmt.Sprintf("/minicloud/db/meta/port/network/%s/ipaddress/%s", entity.NetworkId, entity.IPAddress)
+		txn.CreateMeta(ctx, key0, entity.Id.String())
+		key1 := fmt.Sprintf("/minicloud/db/meta/port/macaddress/%s", entity.MacAddress)
+		txn.CreateMeta(ctx, key1, entity.Id.String())
+		key2 := fmt.Sprintf("/minicloud/db/meta/port/interfacename/%s", entity.InterfaceName)
+		txn.CreateMeta(ctx, key2, entity.Id.String())
+		PortFSM.Notify(ctx, txn, entity)
+		if _, err := txn.Commit(ctx); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+func (m *PortManager) Update(ctx context.Context, entity *Port, initiator db.Initiator) error {
+	origEntity := entity.Original.(*Port)
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
+	if err := PortFSM.CheckTransition(origEntity.State, entity.State, initiator); err != nil {
+		return err
+	}
+	if entity.NetworkId != origEntity.NetworkId {
+		return &db.FieldError{Entity: "port", Field: "NetworkId", Message: "Field change prohibited"}
+	}
+	if entity.IPAddress != origEntity.IPAddress {
+		return &db.FieldError{Entity: "port", Field: "IPAddress", Message: "Field change prohibited"}
+	}
+	if entity.MacAddress != origEntity.MacAddress {
+		return &db.FieldError{Entity: "port", Field: "MacAddress", Message: "Field change prohibited"}
+	}
+	if entity.InterfaceName != origEntity.InterfaceName {
+		return &db.FieldError{Entity: "port", Field: "InterfaceName", Message: "Field change prohibited"}
+	}
+	if entity.ServerId != origEntity.ServerId {
+		return &db.FieldError{Entity: "port", Field: "ServerId", Message: "Field change prohibited"}
+	}
+	txn := m.conn.NewTransaction()
+	txn.Update(ctx, entity)
+	if entity.NetworkId != origEntity.NetworkId || entity.IPAddress != origEntity.IPAddress {
+		forfeitKey0 := fmt.Sprintf("/minicloud/db/meta/port/network/%s/ipaddress/%s", origEntity.NetworkId, origEntity.IPAddress)
+		txn.CheckMeta(ctx, forfeitKey0, origEntity.Id.String())
+		txn.DeleteMeta(ctx, forfeitKey0)
+		claimKey0 := fmt.Sprintf("/minicloud/db/meta/port/network/%s/ipaddress/%s", entity.NetworkId, entity.IPAddress)
+		txn.CreateMeta(ctx, claimKey0, entity.Id.String())
+	}
+	if entity.MacAddress != origEntity.MacAddress {
+		forfeitKey1 := fmt.Sprintf("/minicloud/db/meta/port/macaddress/%s", origEntity.MacAddress)
+		txn.CheckMeta(ctx, forfeitKey1, origEntity.Id.String())
+		txn.DeleteMeta(ctx, forfeitKey1)
+		claimKey1 := fmt.Sprintf("/minicloud/db/meta/port/macaddress/%s", entity.MacAddress)
+		txn.CreateMeta(ctx, claimKey1, entity.Id.String())
+	}
+	if entity.InterfaceName != origEntity.InterfaceName {
+		forfeitKey2 := fmt.Sprintf("/minicloud/db/meta/port/interfacename/%s", origEntity.InterfaceName)
+		txn.CheckMeta(ctx, forfeitKey2, origEntity.Id.String())
+		txn.DeleteMeta(ctx, forfeitKey2)
+		claimKey2 := fmt.Sprintf("/minicloud/db/meta/port/interfacename/%s", entity.InterfaceName)
+		txn.CreateMeta(ctx, claimKey2, entity.Id.String())
+	}
+	PortFSM.Notify(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+func (m *PortManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	entity, err := Ports(m.conn).Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
+	if err := PortFSM.CheckTransition(entity.State, db.StateDeleting, initiator); err != nil {
+		return err
+	}
+	if entity.ServerId != utils.Zero {
+		return &db.FieldError{Entity: "port", Field: "ServerId", Message: "Should be empty"}
+	}
+	entity.State = db.StateDeleting
+	txn := m.conn.NewTransaction()
+	txn.Update(ctx, entity)
+	PortFSM.Notify(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+func (m *PortManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	entity, err := Ports(m.conn).Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
+	if err := PortFSM.CheckTransition(entity.State, db.StateDeleted, initiator); err != nil {
+		return err
+	}
+	if entity.ServerId != utils.Zero {
+		return &db.FieldError{Entity: "port", Field: "ServerId", Message: "Should be empty"}
+	}
+	txn := m.conn.NewTransaction()
+	txn.Delete(ctx, entity)
+	if network, err := Networks(m.conn).Get(ctx, entity.NetworkId); err != nil {
+		return err
+	} else {
+		network.PortIds = utils.RemoveULID(network.PortIds, entity.Id)
+		txn.Update(ctx, network)
+	}
+	key0 := fmt.Sprintf("/minicloud/db/meta/port/network/%s/ipaddress/%s", entity.NetworkId, entity.IPAddress)
+	txn.CheckMeta(ctx, key0, entity.Id.String())
+	txn.DeleteMeta(ctx, key0)
+	key1 := fmt.Sprintf("/minicloud/db/meta/port/macaddress/%s", entity.MacAddress)
+	txn.CheckMeta(ctx, key1, entity.Id.String())
+	txn.DeleteMeta(ctx, key1)
+	key2 := fmt.Sprintf("/minicloud/db/meta/port/interfacename/%s", entity.InterfaceName)
+	txn.CheckMeta(ctx, key2, entity.Id.String())
+	txn.DeleteMeta(ctx, key2)
+	PortFSM.DeleteNotification(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+type portManager struct {
+	typed *PortManager
+}
+
+func init() {
+	registerManager("port", true, func(conn db.Connection) Manager {
+		return &portManager{typed: Ports(conn)}
+	})
+}
+func (m *portManager) EntityName() string {
+	return "Port"
+}
+func (m *portManager) StateMachine() *StateMachine {
+	return PortFSM
+}
+func (m *portManager) NewEntity() db.Entity {
+	return m.typed.NewEntity()
+}
+func (m *portManager) List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error) {
+	entities, next, err := m.typed.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, next, nil
+}
+func (m *portManager) Get(ctx context.Context, id ulid.ULID) (db.Entity, error) {
+	entity, err := m.typed.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *portManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (db.Entity, error) {
+	entity, err := m.typed.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *portManager) NameScoped() bool {
+	return true
+}
+func (m *portManager) GetByName(ctx context.Context, scope ulid.ULID, name string) (db.Entity, error) {
+	entity, err := m.typed.GetByName(ctx, scope, name)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *portManager) History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error) {
+	entities, err := m.typed.History(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *portManager) Create(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Port)
+	if !ok {
+		return &EntityTypeError{Expected: "Port", Actual: entity.EntityName()}
+	}
+	return m.typed.Create(ctx, typedEntity, initiator)
+}
+func (m *portManager) Update(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Port)
+	if !ok {
+		return &EntityTypeError{Expected: "Port", Actual: entity.EntityName()}
+	}
+	return m.typed.Update(ctx, typedEntity, initiator)
+}
+func (m *portManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	return m.typed.IntentDelete(ctx, id, initiator)
+}
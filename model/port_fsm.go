@@ -0,0 +1,155 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"net"
+	"strings"
+)
+
+var PortFSM *StateMachine
+
+// Source of generated MAC addresses and interface names, replaced by tests
+var randomRead = rand.Read
+
+func init() {
+	PortFSM = NewStateMachine().
+		InitialState(db.StateCreated).
+		UserTransition(db.StateReady, db.StateDeleting).
+		UserTransition(db.StateError, db.StateDeleting).
+		SystemTransition(db.StateCreated, db.StateReady).
+		SystemTransition(db.StateCreated, db.StateError).
+		SystemTransition(db.StateReady, db.StateInUse).
+		SystemTransition(db.StateInUse, db.StateReady).
+		SystemTransition(db.StateDeleting, db.StateDeleted).
+		Hook(db.StateCreated, HandlePortCreated).
+		Hook(db.StateDeleting, HandlePortDeleting)
+}
+
+// Port gets free address of network unless fixed one is requested. Addresses
+// and interface name are claimed by unique keys of port, so allocation of the
+// same value fails with conflict and is retried with new one.
+func preparePort(ctx context.Context, conn db.Connection, port *Port) error {
+	if port.InterfaceName != "" {
+		return &db.FieldError{Entity: "port", Field: "InterfaceName", Message: "Should be empty"}
+	}
+	network, err := Networks(conn).Get(ctx, port.NetworkId)
+	if err != nil {
+		return err
+	}
+	if network.State == db.StateDeleting {
+		return &InvalidStateError{State: network.State}
+	}
+	_, ipNet, err := net.ParseCIDR(network.CIDR)
+	if err != nil {
+		return err
+	}
+	if port.IPAddress == "" {
+		ip, err := allocateIPAddress(ctx, conn, network, ipNet)
+		if err != nil {
+			return err
+		}
+		port.IPAddress = ip.String()
+	} else {
+		ip := net.ParseIP(port.IPAddress).To4()
+		if ip == nil || !isHostAddress(ipNet, ip) || ip.String() == network.Gateway {
+			return &db.FieldError{Entity: "port", Field: "IPAddress", Message: "Should be free host address within network"}
+		}
+		port.IPAddress = ip.String()
+	}
+	if port.MacAddress == "" {
+		suffix := make([]byte, 3)
+		if _, err := randomRead(suffix); err != nil {
+			return err
+		}
+		port.MacAddress = fmt.Sprintf("52:54:00:%02x:%02x:%02x", suffix[0], suffix[1], suffix[2])
+	} else {
+		mac, err := net.ParseMAC(port.MacAddress)
+		if err != nil || len(mac) != 6 || mac[0]&1 != 0 {
+			return &db.FieldError{Entity: "port", Field: "MacAddress", Message: "Should be unicast Ethernet address"}
+		}
+		port.MacAddress = strings.ToLower(mac.String())
+	}
+	// Name of TAP device of port, it should fit into IFNAMSIZ
+	suffix := make([]byte, 5)
+	if _, err := randomRead(suffix); err != nil {
+		return err
+	}
+	port.InterfaceName = "tap" + hex.EncodeToString(suffix)
+	return nil
+}
+
+// First host address that isn't gateway or claimed by other port
+func allocateIPAddress(ctx context.Context, conn db.Connection, network *Network, ipNet *net.IPNet) (net.IP, error) {
+	used := map[string]bool{network.Gateway: true}
+	keyPrefix := fmt.Sprintf("%s/port/network/%s/ipaddress/", db.MetaPrefix, network.Id)
+	_, err := scanPrefix(ctx, conn, keyPrefix, 0, func(value *db.RawValue) error {
+		used[strings.TrimPrefix(value.Key, keyPrefix)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for n := uint32(1); n <= hostCount(ipNet); n++ {
+		if ip := hostAddress(ipNet, n); !used[ip.String()] {
+			return ip, nil
+		}
+	}
+	return nil, &db.FieldError{Entity: "port", Field: "IPAddress", Message: "No free addresses left in network"}
+}
+
+func HandlePortCreated(ctx context.Context, conn db.Connection, entity db.Entity) {
+	port := entity.(*Port)
+	setPortState(ctx, conn, port, db.StateReady)
+}
+
+func HandlePortDeleting(ctx context.Context, conn db.Connection, entity db.Entity) {
+	port := entity.(*Port)
+	err := utils.Retry(ctx, func(ctx context.Context) error {
+		return Ports(conn).Delete(ctx, port.Id, db.InitiatorSystem)
+	})
+	if err != nil {
+		logger.Error(ctx, "failed to delete port from database", "id", port.Id, "error", err)
+	}
+}
+
+func setPortState(ctx context.Context, conn db.Connection, port *Port, state db.State) {
+	id := port.Id
+	utils.Retry(ctx, func(ctx context.Context) error {
+		// Re-read port only if previous attempt failed
+		if port == nil {
+			var err error
+			if port, err = Ports(conn).Get(ctx, id); err != nil {
+				return err
+			}
+		}
+		port.State = state
+		if err := Ports(conn).Update(ctx, port, db.InitiatorSystem); err != nil {
+			logger.Error(ctx, "failed to change port state", "id", id, "state", state, "error", err)
+			port = nil
+			return err
+		}
+		return nil
+	})
+}
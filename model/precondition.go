@@ -0,0 +1,45 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+)
+
+type expectedRevisionsKey struct{}
+
+// Make operations on existing entity fail with PreconditionFailedError unless
+// entity's ModifyRev is one of revs
+func WithExpectedRevisions(ctx context.Context, revs ...int64) context.Context {
+	return context.WithValue(ctx, expectedRevisionsKey{}, revs)
+}
+
+func checkExpectedRevision(ctx context.Context, entity db.Entity) error {
+	revs, ok := ctx.Value(expectedRevisionsKey{}).([]int64)
+	if !ok {
+		return nil
+	}
+	hdr := entity.Header()
+	for _, rev := range revs {
+		if rev == hdr.ModifyRev {
+			return nil
+		}
+	}
+	return &db.PreconditionFailedError{Entity: entity.EntityName(), Id: hdr.Id, ModifyRev: hdr.ModifyRev}
+}
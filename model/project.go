@@ -15,11 +15,13 @@
  * You should have received a copy of the GNU Affero General Public License
  * along with this program.  If not, see <http://www.gnu.org/licenses/>.
  */
+
+// Code generated by gen/main.go from entities.json. DO NOT EDIT.
+
 package model
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/antonf/minicloud/db"
 	"github.com/antonf/minicloud/utils"
@@ -38,29 +40,37 @@ func Projects(conn db.Connection) *ProjectManager {
 var regexpProjectName = regexp.MustCompile("^[a-zA-Z0-9_.:-]{3,200}$")
 
 func (m *ProjectManager) NewEntity() *Project {
-	return &Project{EntityHeader: db.EntityHeader{SchemaVersion: 1, State: db.StateCreated}}
+	return &Project{EntityHeader: db.EntityHeader{SchemaVersion: SchemaVersion("Project"), State: db.StateCreated}}
 }
-func (m *ProjectManager) List(ctx context.Context) ([]*Project, error) {
-	values, err := m.conn.RawReadPrefix(ctx, "/minicloud/db/data/project/")
-	if err != nil {
-		return nil, err
+func (m *ProjectManager) List(ctx context.Context, opts *ListOptions) ([]*Project, string, error) {
+	if opts.ProjectId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "project", Field: "ProjectId", Message: "Filter not supported"}
 	}
-	result := make([]*Project, len(values))
-	for i, value := range values {
+	if opts.DiskId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "project", Field: "DiskId", Message: "Filter not supported"}
+	}
+	if opts.NetworkId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "project", Field: "NetworkId", Message: "Filter not supported"}
+	}
+	result := []*Project{}
+	next, err := listEntities(ctx, m.conn, "project", opts, func(value *db.RawValue) (bool, error) {
 		entity := &Project{}
-		origEntity := &Project{}
-		if err := json.Unmarshal(value.Data, entity); err != nil {
-			return nil, err
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return false, err
 		}
-		if err := json.Unmarshal(value.Data, origEntity); err != nil {
-			return nil, err
+		if !opts.matchState(entity.State) || !opts.matchName(entity.Name) {
+			return false, nil
 		}
 		entity.CreateRev = value.CreateRev
 		entity.ModifyRev = value.ModifyRev
-		entity.Original = origEntity
-		result[i] = entity
+		entity.Original = entity.Copy()
+		result = append(result, entity)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
 	}
-	return result, nil
+	return result, next, nil
 }
 func (m *ProjectManager) Get(ctx context.Context, id ulid.ULID) (*Project, error) {
 	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/data/project/%s", id))
@@ -71,7 +81,43 @@ func (m *ProjectManager) Get(ctx context.Context, id ulid.ULID) (*Project, error
 		return nil, &db.NotFoundError{Entity: "Project", Id: id}
 	}
 	entity := &Project{}
-	if err := json.Unmarshal(value.Data, entity); err != nil {
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *ProjectManager) GetByName(ctx context.Context, name string) (*Project, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/meta/project/name/%s", name))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NameNotFoundError{Entity: "Project", Name: name}
+	}
+	id, err := ulid.Parse(string(value.Data))
+	if err != nil {
+		return nil, err
+	}
+	entity, err := m.Get(ctx, id)
+	if _, notFound := err.(*db.NotFoundError); notFound || (err == nil && (entity.Name != name)) {
+		// Renamed or deleted after name lookup
+		return nil, &db.NameNotFoundError{Entity: "Project", Name: name}
+	}
+	return entity, err
+}
+func (m *ProjectManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (*Project, error) {
+	value, err := m.conn.RawReadRev(ctx, fmt.Sprintf("/minicloud/db/data/project/%s", id), rev)
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Project", Id: id}
+	}
+	entity := &Project{}
+	if err := decodeEntity(value.Data, entity); err != nil {
 		return nil, err
 	}
 	entity.CreateRev = value.CreateRev
@@ -79,6 +125,27 @@ func (m *ProjectManager) Get(ctx context.Context, id ulid.ULID) (*Project, error
 	entity.Original = entity.Copy()
 	return entity, nil
 }
+func (m *ProjectManager) History(ctx context.Context, id ulid.ULID, limit int) ([]*Project, error) {
+	values, err := m.conn.RawReadHistory(ctx, fmt.Sprintf("/minicloud/db/data/project/%s", id), limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &db.NotFoundError{Entity: "Project", Id: id}
+	}
+	result := make([]*Project, len(values))
+	for i, value := range values {
+		entity := &Project{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return nil, err
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result[i] = entity
+	}
+	return result, nil
+}
 func (m *ProjectManager) Create(ctx context.Context, entity *Project, initiator db.Initiator) error {
 	entity.Id = utils.NewULID()
 	if !regexpProjectName.MatchString(entity.Name) {
@@ -93,14 +160,26 @@ func (m *ProjectManager) Create(ctx context.Context, entity *Project, initiator
 	if len(entity.ServerIds) != 0 {
 		return &db.FieldError{Entity: "project", Field: "ServerIds", Message: "Should be empty"}
 	}
+	if len(entity.NetworkIds) != 0 {
+		return &db.FieldError{Entity: "project", Field: "NetworkIds", Message: "Should be empty"}
+	}
+	if entity.Usage != (Quota{}) {
+		return &db.FieldError{Entity: "project", Field: "Usage", Message: "Should be empty"}
+	}
 	txn := m.conn.NewTransaction()
 	txn.Create(ctx, entity)
 	key0 := fmt.Sprintf("/minicloud/db/meta/project/name/%s", entity.Name)
 	txn.CreateMeta(ctx, key0, entity.Id.String())
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *ProjectManager) Update(ctx context.Context, entity *Project, initiator db.Initiator) error {
 	origEntity := entity.Original.(*Project)
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if !regexpProjectName.MatchString(entity.Name) {
 		return &db.FieldError{Entity: "project", Field: "Name", Message: "Name should be between 3 and 200 characters from following set: a-z A-Z 0-9 _.:-"}
 	}
@@ -113,6 +192,12 @@ func (m *ProjectManager) Update(ctx context.Context, entity *Project, initiator
 	if !utils.ULIDListsEqual(entity.ServerIds, origEntity.ServerIds) {
 		return &db.FieldError{Entity: "project", Field: "ServerIds", Message: "Field change prohibited"}
 	}
+	if !utils.ULIDListsEqual(entity.NetworkIds, origEntity.NetworkIds) {
+		return &db.FieldError{Entity: "project", Field: "NetworkIds", Message: "Field change prohibited"}
+	}
+	if initiator != db.InitiatorSystem && entity.Usage != origEntity.Usage {
+		return &db.FieldError{Entity: "project", Field: "Usage", Message: "Field change prohibited"}
+	}
 	txn := m.conn.NewTransaction()
 	txn.Update(ctx, entity)
 	if entity.Name != origEntity.Name {
@@ -122,13 +207,19 @@ func (m *ProjectManager) Update(ctx context.Context, entity *Project, initiator
 		claimKey0 := fmt.Sprintf("/minicloud/db/meta/project/name/%s", entity.Name)
 		txn.CreateMeta(ctx, claimKey0, entity.Id.String())
 	}
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *ProjectManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
 	entity, err := Projects(m.conn).Get(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if len(entity.ImageIds) != 0 {
 		return &db.FieldError{Entity: "project", Field: "ImageIds", Message: "Should be empty"}
 	}
@@ -138,10 +229,98 @@ func (m *ProjectManager) Delete(ctx context.Context, id ulid.ULID, initiator db.
 	if len(entity.ServerIds) != 0 {
 		return &db.FieldError{Entity: "project", Field: "ServerIds", Message: "Should be empty"}
 	}
+	if len(entity.NetworkIds) != 0 {
+		return &db.FieldError{Entity: "project", Field: "NetworkIds", Message: "Should be empty"}
+	}
 	txn := m.conn.NewTransaction()
 	txn.Delete(ctx, entity)
 	key0 := fmt.Sprintf("/minicloud/db/meta/project/name/%s", entity.Name)
 	txn.CheckMeta(ctx, key0, entity.Id.String())
 	txn.DeleteMeta(ctx, key0)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+type projectManager struct {
+	typed *ProjectManager
+}
+
+func init() {
+	registerManager("project", false, func(conn db.Connection) Manager {
+		return &projectManager{typed: Projects(conn)}
+	})
+}
+func (m *projectManager) EntityName() string {
+	return "Project"
+}
+func (m *projectManager) StateMachine() *StateMachine {
+	return nil
+}
+func (m *projectManager) NewEntity() db.Entity {
+	return m.typed.NewEntity()
+}
+func (m *projectManager) List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error) {
+	entities, next, err := m.typed.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, next, nil
+}
+func (m *projectManager) Get(ctx context.Context, id ulid.ULID) (db.Entity, error) {
+	entity, err := m.typed.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *projectManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (db.Entity, error) {
+	entity, err := m.typed.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *projectManager) NameScoped() bool {
+	return false
+}
+func (m *projectManager) GetByName(ctx context.Context, scope ulid.ULID, name string) (db.Entity, error) {
+	entity, err := m.typed.GetByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *projectManager) History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error) {
+	entities, err := m.typed.History(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *projectManager) Create(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Project)
+	if !ok {
+		return &EntityTypeError{Expected: "Project", Actual: entity.EntityName()}
+	}
+	return m.typed.Create(ctx, typedEntity, initiator)
+}
+func (m *projectManager) Update(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Project)
+	if !ok {
+		return &EntityTypeError{Expected: "Project", Actual: entity.EntityName()}
+	}
+	return m.typed.Update(ctx, typedEntity, initiator)
+}
+func (m *projectManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	return m.typed.Delete(ctx, id, initiator)
 }
@@ -0,0 +1,271 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/config"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/log"
+	"github.com/antonf/minicloud/utils"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+	log.Initialize(ctx)
+	config.InitOptions(ctx, memdb.NewConnection())
+	os.Exit(m.Run())
+}
+
+func createProject(t *testing.T, conn db.Connection, name string) *Project {
+	project := Projects(conn).NewEntity()
+	project.Name = name
+	if err := Projects(conn).Create(context.Background(), project, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create project %s: %s", name, err)
+	}
+	return project
+}
+
+func TestProjectCreate(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+
+	stored, err := Projects(conn).Get(ctx, project.Id)
+	if err != nil {
+		t.Fatalf("failed to get project: %s", err)
+	}
+	if stored.Name != "foo" || stored.State != db.StateCreated || stored.ModifyRev == 0 {
+		t.Fatalf("unexpected project: %s", stored)
+	}
+
+	duplicate := Projects(conn).NewEntity()
+	duplicate.Name = "foo"
+	err = Projects(conn).Create(ctx, duplicate, db.InitiatorUser)
+	if _, ok := err.(*db.ConflictError); !ok {
+		t.Fatalf("expected conflict creating project with same name, got %v", err)
+	}
+
+	invalid := Projects(conn).NewEntity()
+	invalid.Name = "<html>"
+	err = Projects(conn).Create(ctx, invalid, db.InitiatorUser)
+	if _, ok := err.(*db.FieldError); !ok {
+		t.Fatalf("expected field error, got %v", err)
+	}
+}
+
+func TestProjectRename(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	createProject(t, conn, "bar")
+
+	project, _ = Projects(conn).Get(ctx, project.Id)
+	project.Name = "bar"
+	if err := Projects(conn).Update(ctx, project, db.InitiatorUser); err == nil {
+		t.Fatalf("project renamed to existing name")
+	}
+	project.Name = "baz"
+	if err := Projects(conn).Update(ctx, project, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to rename project: %s", err)
+	}
+
+	// Committed update refreshes header, so project can be updated again
+	project.Name = "qux"
+	if err := Projects(conn).Update(ctx, project, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to rename project second time: %s", err)
+	}
+	createProject(t, conn, "baz")
+
+	// Old name should be released
+	createProject(t, conn, "foo")
+}
+
+func TestProjectConcurrentUpdate(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+
+	first, _ := Projects(conn).Get(ctx, project.Id)
+	second, _ := Projects(conn).Get(ctx, project.Id)
+	first.Name = "first"
+	if err := Projects(conn).Update(ctx, first, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to update project: %s", err)
+	}
+	second.Name = "second"
+	err := Projects(conn).Update(ctx, second, db.InitiatorUser)
+	if _, ok := err.(*db.ConflictError); !ok {
+		t.Fatalf("expected conflict on stale update, got %v", err)
+	}
+
+	attempts := 0
+	err = utils.Retry(ctx, func(ctx context.Context) error {
+		attempts += 1
+		if attempts == 1 {
+			return Projects(conn).Update(ctx, second, db.InitiatorUser)
+		}
+		project, err := Projects(conn).Get(ctx, project.Id)
+		if err != nil {
+			return err
+		}
+		project.Name = "second"
+		return Projects(conn).Update(ctx, project, db.InitiatorUser)
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("retry failed: %v after %d attempts", err, attempts)
+	}
+	if project, _ := Projects(conn).Get(ctx, project.Id); project.Name != "second" {
+		t.Fatalf("unexpected project name after retry: %s", project.Name)
+	}
+}
+
+func TestProjectDelete(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	if err := Projects(conn).Delete(ctx, project.Id, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to delete project: %s", err)
+	}
+	if _, err := Projects(conn).Get(ctx, project.Id); err == nil {
+		t.Fatalf("project still exists after delete")
+	}
+	createProject(t, conn, "foo")
+}
+
+// Counts pages read by list
+type countingConnection struct {
+	db.Connection
+	pages int
+}
+
+func (c *countingConnection) RawReadPage(ctx context.Context, prefix, fromKey string, rev int64, limit int) (*db.RawPage, error) {
+	c.pages += 1
+	return c.Connection.RawReadPage(ctx, prefix, fromKey, rev, limit)
+}
+
+func TestProjectList(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	names := []string{"one", "two", "three", "four", "five"}
+	for _, name := range names {
+		createProject(t, conn, name)
+	}
+
+	seen := make(map[string]bool)
+	opts := &ListOptions{Limit: 2}
+	for pages := 0; ; pages++ {
+		projects, next, err := Projects(conn).List(ctx, opts)
+		if err != nil {
+			t.Fatalf("failed to list projects: %s", err)
+		}
+		if len(projects) > 2 || pages > 2 {
+			t.Fatalf("unexpected page: %v", projects)
+		}
+		for _, project := range projects {
+			if seen[project.Name] {
+				t.Fatalf("project %s listed twice", project.Name)
+			}
+			seen[project.Name] = true
+		}
+		if next == "" {
+			break
+		}
+		// Projects created after first page shouldn't be listed
+		if pages == 0 {
+			createProject(t, conn, "six")
+		}
+		opts.Continue = next
+	}
+	if len(seen) != len(names) {
+		t.Fatalf("unexpected projects listed: %v", seen)
+	}
+
+	projects, next, err := Projects(conn).List(ctx, &ListOptions{Name: "three", Limit: 1})
+	if err != nil || len(projects) != 1 || projects[0].Name != "three" {
+		t.Fatalf("unexpected filtered list: %v %v", projects, err)
+	}
+	if next != "" {
+		projects, next, err = Projects(conn).List(ctx, &ListOptions{Name: "three", Limit: 1, Continue: next})
+		if err != nil || next != "" || len(projects) != 0 {
+			t.Fatalf("unexpected filtered list continuation: %v %q %v", projects, next, err)
+		}
+	}
+	// Selective filter doesn't read entities one by one
+	counting := &countingConnection{Connection: conn}
+	projects, _, err = Projects(counting).List(ctx, &ListOptions{Name: "six", Limit: 1})
+	if err != nil || len(projects) != 1 || counting.pages != 1 {
+		t.Fatalf("unexpected filtered list: %v %v after %d reads", projects, err, counting.pages)
+	}
+	_, _, err = Projects(conn).List(ctx, &ListOptions{ProjectId: utils.NewULID()})
+	if _, ok := err.(*db.FieldError); !ok {
+		t.Fatalf("expected field error, got %v", err)
+	}
+	_, _, err = Projects(conn).List(ctx, &ListOptions{Continue: "garbage"})
+	if _, ok := err.(*db.FieldError); !ok {
+		t.Fatalf("expected field error, got %v", err)
+	}
+}
+
+func TestProjectHistory(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+	createRev := project.ModifyRev
+	project.Name = "bar"
+	if err := Projects(conn).Update(ctx, project, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to rename project: %s", err)
+	}
+
+	old, err := Projects(conn).GetRevision(ctx, project.Id, createRev)
+	if err != nil || old.Name != "foo" || old.ModifyRev != createRev {
+		t.Fatalf("unexpected project at revision %d: %v (%v)", createRev, old, err)
+	}
+	history, err := Projects(conn).History(ctx, project.Id, 0)
+	if err != nil || len(history) != 2 || history[0].Name != "bar" || history[1].Name != "foo" {
+		t.Fatalf("unexpected project history: %v (%v)", history, err)
+	}
+	if _, err := Projects(conn).History(ctx, utils.NewULID(), 0); err == nil {
+		t.Fatalf("got history of missing project")
+	}
+}
+
+func TestProjectGetByName(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	project := createProject(t, conn, "foo")
+
+	found, err := Projects(conn).GetByName(ctx, "foo")
+	if err != nil || found.Id != project.Id {
+		t.Fatalf("unexpected project found by name: %v (%v)", found, err)
+	}
+	project.Name = "bar"
+	if err := Projects(conn).Update(ctx, project, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to rename project: %s", err)
+	}
+	if _, err := Projects(conn).GetByName(ctx, "foo"); err == nil {
+		t.Fatalf("project found by old name")
+	} else if _, ok := err.(*db.NameNotFoundError); !ok {
+		t.Fatalf("expected name not found error, got %v", err)
+	}
+	if found, err := Projects(conn).GetByName(ctx, "bar"); err != nil || found.Id != project.Id {
+		t.Fatalf("project not found by new name: %v (%v)", found, err)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+)
+
+// Amounts of resources used by or allowed to project, zero limit means
+// resource isn't limited
+type Quota struct {
+	Servers  uint64
+	CPUs     uint64
+	RAM      uint64
+	Disks    uint64
+	DiskSize uint64
+	Images   uint64
+}
+
+var quotaResources = []string{"Servers", "CPUs", "RAM", "Disks", "DiskSize", "Images"}
+
+// Pointers to amounts in order of quotaResources
+func (q *Quota) values() []*uint64 {
+	return []*uint64{&q.Servers, &q.CPUs, &q.RAM, &q.Disks, &q.DiskSize, &q.Images}
+}
+
+// Add usage to project, failing if any resource would exceed its limit
+func (p *Project) charge(usage Quota) error {
+	limits, current, requested := p.Limits.values(), p.Usage.values(), usage.values()
+	for i, resource := range quotaResources {
+		if *limits[i] != 0 && *current[i]+*requested[i] > *limits[i] {
+			return &QuotaExceededError{
+				Resource:  resource,
+				Limit:     *limits[i],
+				Usage:     *current[i],
+				Requested: *requested[i],
+			}
+		}
+	}
+	for i := range quotaResources {
+		*current[i] += *requested[i]
+	}
+	return nil
+}
+
+func (p *Project) release(usage Quota) {
+	current, released := p.Usage.values(), usage.values()
+	for i := range quotaResources {
+		if *current[i] > *released[i] {
+			*current[i] -= *released[i]
+		} else {
+			*current[i] = 0
+		}
+	}
+}
+
+func flavorUsage(flavor *Flavor) Quota {
+	usage := Quota{Servers: 1}
+	if flavor.NumCPUs > 0 {
+		usage.CPUs = uint64(flavor.NumCPUs)
+	}
+	if flavor.RAM > 0 {
+		usage.RAM = uint64(flavor.RAM)
+	}
+	return usage
+}
+
+func serverUsage(ctx context.Context, conn db.Connection, server *Server) (Quota, error) {
+	flavor, err := Flavors(conn).Get(ctx, server.FlavorId)
+	if err != nil {
+		return Quota{}, err
+	}
+	return flavorUsage(flavor), nil
+}
+
+func diskUsage(ctx context.Context, conn db.Connection, disk *Disk) (Quota, error) {
+	return Quota{Disks: 1, DiskSize: disk.Size}, nil
+}
+
+func imageUsage(ctx context.Context, conn db.Connection, image *Image) (Quota, error) {
+	return Quota{Images: 1}, nil
+}
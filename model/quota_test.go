@@ -0,0 +1,116 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+	project, _ := Projects(conn).Get(ctx, server.ProjectId)
+	if project.Usage != (Quota{Servers: 1, CPUs: 1, RAM: 512}) {
+		t.Fatalf("unexpected usage after server create: %+v", project.Usage)
+	}
+	project.Usage.Servers = 0
+	if err := Projects(conn).Update(ctx, project, db.InitiatorUser); err == nil {
+		t.Fatalf("usage changed by user")
+	}
+	project.Usage.Servers = 1
+	project.Limits = Quota{Servers: 1, Disks: 1, DiskSize: 2 << 30, Images: 1}
+	if err := Projects(conn).Update(ctx, project, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to set limits: %s", err)
+	}
+
+	second := Servers(conn).NewEntity()
+	second.Name = "bar"
+	second.ProjectId = project.Id
+	second.FlavorId = server.FlavorId
+	err := Servers(conn).Create(ctx, second, db.InitiatorUser)
+	if quotaErr, ok := err.(*QuotaExceededError); !ok || quotaErr.Resource != "Servers" || quotaErr.Limit != 1 || quotaErr.Usage != 1 || quotaErr.Requested != 1 {
+		t.Fatalf("expected servers quota error, got %v", err)
+	}
+	if _, err := Servers(conn).GetByName(ctx, project.Id, "bar"); err == nil {
+		t.Fatalf("server created over quota")
+	}
+
+	disk := createDisk(t, conn, project)
+	image := Images(conn).NewEntity()
+	image.Name = "second"
+	image.ProjectId = project.Id
+	if err := Images(conn).Create(ctx, image, db.InitiatorUser); err == nil {
+		t.Fatalf("image created over quota")
+	}
+	disk.Size = 4 << 30
+	disk.State = db.StateUpdated
+	err = Disks(conn).Update(ctx, disk, db.InitiatorUser)
+	if quotaErr, ok := err.(*QuotaExceededError); !ok || quotaErr.Resource != "DiskSize" {
+		t.Fatalf("expected disk size quota error, got %v", err)
+	}
+	disk.Size = 2 << 30
+	if err := Disks(conn).Update(ctx, disk, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to grow disk within quota: %s", err)
+	}
+	project, _ = Projects(conn).Get(ctx, project.Id)
+	if project.Usage.Disks != 1 || project.Usage.DiskSize != 2<<30 || project.Usage.Images != 1 {
+		t.Fatalf("unexpected usage after disk resize: %+v", project.Usage)
+	}
+
+	// Flavor can't change usage of servers behind quota's back
+	flavor, _ := Flavors(conn).Get(ctx, server.FlavorId)
+	flavor.RAM = 1024
+	if err := Flavors(conn).Update(ctx, flavor, db.InitiatorUser); err == nil {
+		t.Fatalf("RAM of flavor in use changed")
+	}
+
+	// Usage is released only when entity is actually deleted
+	setServerState(ctx, conn, server, db.StateReady)
+	if err := Servers(conn).IntentDelete(ctx, server.Id, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to delete server: %s", err)
+	}
+	if project, _ := Projects(conn).Get(ctx, project.Id); project.Usage.Servers != 1 {
+		t.Fatalf("usage released before server is deleted: %+v", project.Usage)
+	}
+	if err := Servers(conn).Delete(ctx, server.Id, db.InitiatorSystem); err != nil {
+		t.Fatalf("failed to delete server: %s", err)
+	}
+	disk.State = db.StateReady
+	if err := Disks(conn).Update(ctx, disk, db.InitiatorSystem); err != nil {
+		t.Fatalf("failed to make disk ready: %s", err)
+	}
+	if err := Disks(conn).IntentDelete(ctx, disk.Id, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to delete disk: %s", err)
+	}
+	if err := Disks(conn).Delete(ctx, disk.Id, db.InitiatorSystem); err != nil {
+		t.Fatalf("failed to delete disk: %s", err)
+	}
+	project, _ = Projects(conn).Get(ctx, project.Id)
+	if project.Usage != (Quota{Images: 1}) {
+		t.Fatalf("usage not released: %+v", project.Usage)
+	}
+	flavor, _ = Flavors(conn).Get(ctx, flavor.Id)
+	flavor.RAM = 1024
+	if err := Flavors(conn).Update(ctx, flavor, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to change RAM of unused flavor: %s", err)
+	}
+}
@@ -15,11 +15,13 @@
  * You should have received a copy of the GNU Affero General Public License
  * along with this program.  If not, see <http://www.gnu.org/licenses/>.
  */
+
+// Code generated by gen/main.go from entities.json. DO NOT EDIT.
+
 package model
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/antonf/minicloud/db"
 	"github.com/antonf/minicloud/utils"
@@ -38,7 +40,34 @@ func Servers(conn db.Connection) *ServerManager {
 var regexpServerName = regexp.MustCompile("^[a-z]([a-z0-9-]*[a-z0-9])?$|^[0-9][a-z0-9-]*([a-z]([a-z0-9-]*[a-z0-9])?|-[a-z0-9-]*[a-z0-9])$")
 
 func (m *ServerManager) NewEntity() *Server {
-	return &Server{EntityHeader: db.EntityHeader{SchemaVersion: 1, State: db.StateCreated}}
+	return &Server{EntityHeader: db.EntityHeader{SchemaVersion: SchemaVersion("Server"), State: db.StateCreated}}
+}
+func (m *ServerManager) List(ctx context.Context, opts *ListOptions) ([]*Server, string, error) {
+	if opts.DiskId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "server", Field: "DiskId", Message: "Filter not supported"}
+	}
+	if opts.NetworkId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "server", Field: "NetworkId", Message: "Filter not supported"}
+	}
+	result := []*Server{}
+	next, err := listEntities(ctx, m.conn, "server", opts, func(value *db.RawValue) (bool, error) {
+		entity := &Server{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return false, err
+		}
+		if !opts.matchState(entity.State) || !opts.matchName(entity.Name) || !opts.matchProject(entity.ProjectId) {
+			return false, nil
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result = append(result, entity)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return result, next, nil
 }
 func (m *ServerManager) Get(ctx context.Context, id ulid.ULID) (*Server, error) {
 	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/data/server/%s", id))
@@ -49,7 +78,7 @@ func (m *ServerManager) Get(ctx context.Context, id ulid.ULID) (*Server, error)
 		return nil, &db.NotFoundError{Entity: "Server", Id: id}
 	}
 	entity := &Server{}
-	if err := json.Unmarshal(value.Data, entity); err != nil {
+	if err := decodeEntity(value.Data, entity); err != nil {
 		return nil, err
 	}
 	entity.CreateRev = value.CreateRev
@@ -57,6 +86,63 @@ func (m *ServerManager) Get(ctx context.Context, id ulid.ULID) (*Server, error)
 	entity.Original = entity.Copy()
 	return entity, nil
 }
+func (m *ServerManager) GetByName(ctx context.Context, projectId ulid.ULID, name string) (*Server, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/meta/server/project/%s/name/%s", projectId, name))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NameNotFoundError{Entity: "Server", Name: name}
+	}
+	id, err := ulid.Parse(string(value.Data))
+	if err != nil {
+		return nil, err
+	}
+	entity, err := m.Get(ctx, id)
+	if _, notFound := err.(*db.NotFoundError); notFound || (err == nil && (entity.ProjectId != projectId || entity.Name != name)) {
+		// Renamed or deleted after name lookup
+		return nil, &db.NameNotFoundError{Entity: "Server", Name: name}
+	}
+	return entity, err
+}
+func (m *ServerManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (*Server, error) {
+	value, err := m.conn.RawReadRev(ctx, fmt.Sprintf("/minicloud/db/data/server/%s", id), rev)
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Server", Id: id}
+	}
+	entity := &Server{}
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *ServerManager) History(ctx context.Context, id ulid.ULID, limit int) ([]*Server, error) {
+	values, err := m.conn.RawReadHistory(ctx, fmt.Sprintf("/minicloud/db/data/server/%s", id), limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &db.NotFoundError{Entity: "Server", Id: id}
+	}
+	result := make([]*Server, len(values))
+	for i, value := range values {
+		entity := &Server{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return nil, err
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result[i] = entity
+	}
+	return result, nil
+}
 func (m *ServerManager) Create(ctx context.Context, entity *Server, initiator db.Initiator) error {
 	entity.Id = utils.NewULID()
 	if err := ServerFSM.CheckInitialState(entity.State); err != nil {
@@ -71,6 +157,11 @@ func (m *ServerManager) Create(ctx context.Context, entity *Server, initiator db
 		return err
 	} else {
 		project.ServerIds = append(project.ServerIds, entity.Id)
+		if usage, err := serverUsage(ctx, m.conn, entity); err != nil {
+			return err
+		} else if err := project.charge(usage); err != nil {
+			return err
+		}
 		txn.Update(ctx, project)
 	}
 	if flavor, err := Flavors(m.conn).Get(ctx, entity.FlavorId); err != nil {
@@ -93,13 +184,33 @@ func (m *ServerManager) Create(ctx context.Context, entity *Server, initiator db
 			txn.Update(ctx, disk)
 		}
 	}
+	for _, refEntityId := range entity.PortIds {
+		if port, err := Ports(m.conn).Get(ctx, refEntityId); err != nil {
+			return err
+		} else {
+			if port.ServerId != utils.Zero {
+				return &db.FieldError{Entity: "Port", Field: "ServerId", Message: "Should be empty"}
+			}
+			port.ServerId = entity.Id
+			if err := PortFSM.ChangeState(port, db.StateInUse, db.InitiatorSystem); err != nil {
+				return err
+			}
+			txn.Update(ctx, port)
+		}
+	}
 	key0 := fmt.Sprintf("/minicloud/db/meta/server/project/%s/name/%s", entity.ProjectId, entity.Name)
 	txn.CreateMeta(ctx, key0, entity.Id.String())
 	ServerFSM.Notify(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *ServerManager) Update(ctx context.Context, entity *Server, initiator db.Initiator) error {
 	origEntity := entity.Original.(*Server)
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if err := ServerFSM.CheckTransition(origEntity.State, entity.State, initiator); err != nil {
 		return err
 	}
@@ -112,6 +223,9 @@ func (m *ServerManager) Update(ctx context.Context, entity *Server, initiator db
 	if !utils.ULIDListsEqual(entity.DiskIds, origEntity.DiskIds) {
 		return &db.FieldError{Entity: "server", Field: "DiskIds", Message: "Field change prohibited"}
 	}
+	if !utils.ULIDListsEqual(entity.PortIds, origEntity.PortIds) {
+		return &db.FieldError{Entity: "server", Field: "PortIds", Message: "Field change prohibited"}
+	}
 	if !regexpServerName.MatchString(entity.Name) {
 		return &db.FieldError{Entity: "server", Field: "Name", Message: "Should contain only lowercase letters, digits and dash, but shouldn't start or end with dash"}
 	}
@@ -125,13 +239,26 @@ func (m *ServerManager) Update(ctx context.Context, entity *Server, initiator db
 		txn.CreateMeta(ctx, claimKey0, entity.Id.String())
 	}
 	ServerFSM.Notify(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if entity.State == db.StateReady && origEntity.State != db.StateReady {
+		if usage, err := serverUsage(ctx, m.conn, entity); err != nil {
+			return err
+		} else if err := recordUsage(ctx, txn, entity, usage); err != nil {
+			return err
+		}
+	}
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *ServerManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
 	entity, err := Servers(m.conn).Get(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if err := ServerFSM.CheckTransition(entity.State, db.StateDeleting, initiator); err != nil {
 		return err
 	}
@@ -139,13 +266,19 @@ func (m *ServerManager) IntentDelete(ctx context.Context, id ulid.ULID, initiato
 	txn := m.conn.NewTransaction()
 	txn.Update(ctx, entity)
 	ServerFSM.Notify(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
 }
 func (m *ServerManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
 	entity, err := Servers(m.conn).Get(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
 	if err := ServerFSM.CheckTransition(entity.State, db.StateDeleted, initiator); err != nil {
 		return err
 	}
@@ -155,6 +288,11 @@ func (m *ServerManager) Delete(ctx context.Context, id ulid.ULID, initiator db.I
 		return err
 	} else {
 		project.ServerIds = utils.RemoveULID(project.ServerIds, entity.Id)
+		if usage, err := serverUsage(ctx, m.conn, entity); err != nil {
+			return err
+		} else {
+			project.release(usage)
+		}
 		txn.Update(ctx, project)
 	}
 	if flavor, err := Flavors(m.conn).Get(ctx, entity.FlavorId); err != nil {
@@ -168,15 +306,118 @@ func (m *ServerManager) Delete(ctx context.Context, id ulid.ULID, initiator db.I
 			return err
 		} else {
 			disk.ServerId = utils.Zero
-			if err := DiskFSM.ChangeState(disk, db.StateReady, db.InitiatorSystem); err != nil {
-				return err
+			if disk.State == db.StateInUse {
+				if err := DiskFSM.ChangeState(disk, db.StateReady, db.InitiatorSystem); err != nil {
+					return err
+				}
 			}
 			txn.Update(ctx, disk)
 		}
 	}
+	for _, refEntityId := range entity.PortIds {
+		if port, err := Ports(m.conn).Get(ctx, refEntityId); err != nil {
+			return err
+		} else {
+			port.ServerId = utils.Zero
+			if port.State == db.StateInUse {
+				if err := PortFSM.ChangeState(port, db.StateReady, db.InitiatorSystem); err != nil {
+					return err
+				}
+			}
+			txn.Update(ctx, port)
+		}
+	}
 	key0 := fmt.Sprintf("/minicloud/db/meta/server/project/%s/name/%s", entity.ProjectId, entity.Name)
 	txn.CheckMeta(ctx, key0, entity.Id.String())
 	txn.DeleteMeta(ctx, key0)
 	ServerFSM.DeleteNotification(ctx, txn, entity)
-	return txn.Commit(ctx)
+	if err := recordUsage(ctx, txn, entity, Quota{}); err != nil {
+		return err
+	}
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+type serverManager struct {
+	typed *ServerManager
+}
+
+func init() {
+	registerManager("server", true, func(conn db.Connection) Manager {
+		return &serverManager{typed: Servers(conn)}
+	})
+}
+func (m *serverManager) EntityName() string {
+	return "Server"
+}
+func (m *serverManager) StateMachine() *StateMachine {
+	return ServerFSM
+}
+func (m *serverManager) NewEntity() db.Entity {
+	return m.typed.NewEntity()
+}
+func (m *serverManager) List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error) {
+	entities, next, err := m.typed.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, next, nil
+}
+func (m *serverManager) Get(ctx context.Context, id ulid.ULID) (db.Entity, error) {
+	entity, err := m.typed.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *serverManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (db.Entity, error) {
+	entity, err := m.typed.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *serverManager) NameScoped() bool {
+	return true
+}
+func (m *serverManager) GetByName(ctx context.Context, scope ulid.ULID, name string) (db.Entity, error) {
+	entity, err := m.typed.GetByName(ctx, scope, name)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *serverManager) History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error) {
+	entities, err := m.typed.History(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *serverManager) Create(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Server)
+	if !ok {
+		return &EntityTypeError{Expected: "Server", Actual: entity.EntityName()}
+	}
+	return m.typed.Create(ctx, typedEntity, initiator)
+}
+func (m *serverManager) Update(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Server)
+	if !ok {
+		return &EntityTypeError{Expected: "Server", Actual: entity.EntityName()}
+	}
+	return m.typed.Update(ctx, typedEntity, initiator)
+}
+func (m *serverManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	return m.typed.IntentDelete(ctx, id, initiator)
 }
@@ -0,0 +1,199 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/config"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/qemu"
+	"github.com/antonf/minicloud/utils"
+	"github.com/oklog/ulid"
+	"time"
+)
+
+var OptDiskDetachTimeout = config.NewDurationOpt("disk_detach_timeout", 30*time.Second)
+
+// Attach disk to server. Disk of running server is attaching until state
+// machine hook plugs it to virtual machine.
+func AttachDisk(ctx context.Context, conn db.Connection, serverId, diskId ulid.ULID) (*Server, error) {
+	server, err := Servers(conn).Get(ctx, serverId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExpectedRevision(ctx, server); err != nil {
+		return nil, err
+	}
+	hotPlug, err := needsHotPlug(server)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := Disks(conn).Get(ctx, diskId)
+	if err != nil {
+		return nil, err
+	}
+	if disk.ProjectId != server.ProjectId {
+		return nil, &db.FieldError{Entity: "disk", Field: "ProjectId", Message: "Disk belongs to other project"}
+	}
+	if disk.ServerId != utils.Zero {
+		return nil, &db.FieldError{Entity: "disk", Field: "ServerId", Message: "Disk is already attached"}
+	}
+	state := db.StateInUse
+	if hotPlug {
+		state = db.StateAttaching
+	}
+	if err := DiskFSM.ChangeState(disk, state, db.InitiatorSystem); err != nil {
+		return nil, err
+	}
+	disk.ServerId = server.Id
+	server.DiskIds = append(server.DiskIds, disk.Id)
+	txn := conn.NewTransaction()
+	txn.Update(ctx, server)
+	txn.Update(ctx, disk)
+	DiskFSM.Notify(ctx, txn, disk)
+	if _, err := txn.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Detach disk from server. Disk of running server is detaching until state
+// machine hook unplugs it and guest releases device.
+func DetachDisk(ctx context.Context, conn db.Connection, serverId, diskId ulid.ULID) (*Server, error) {
+	server, err := Servers(conn).Get(ctx, serverId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExpectedRevision(ctx, server); err != nil {
+		return nil, err
+	}
+	hotPlug, err := needsHotPlug(server)
+	if err != nil {
+		return nil, err
+	}
+	if !utils.ContainsULID(server.DiskIds, diskId) {
+		return nil, &db.FieldError{Entity: "server", Field: "DiskIds", Message: "Disk is not attached"}
+	}
+	if !hotPlug {
+		return releaseDisk(ctx, conn, diskId, db.StateInUse)
+	}
+
+	disk, err := Disks(conn).Get(ctx, diskId)
+	if err != nil {
+		return nil, err
+	}
+	if err := DiskFSM.ChangeState(disk, db.StateDetaching, db.InitiatorSystem); err != nil {
+		return nil, err
+	}
+	// Server is updated as well, so that concurrent stop conflicts
+	txn := conn.NewTransaction()
+	txn.Update(ctx, server)
+	txn.Update(ctx, disk)
+	DiskFSM.Notify(ctx, txn, disk)
+	if _, err := txn.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Servers are only changed while stable, running ones need hot plug
+func needsHotPlug(server *Server) (bool, error) {
+	switch server.State {
+	case db.StateStopped, db.StateError:
+		return false, nil
+	case db.StateReady:
+		return true, nil
+	default:
+		return false, &InvalidStateError{State: server.State}
+	}
+}
+
+// Hot plug disk to virtual machine of server, disk is detached back if that
+// fails or server was stopped meanwhile
+func HandleDiskAttaching(ctx context.Context, conn db.Connection, entity db.Entity) {
+	disk := entity.(*Disk)
+	err := ErrVirtualMachineNotRunning
+	if vm := registeredVirtualMachine(disk.ServerId); vm != nil {
+		err = vm.AttachDisk(ctx, storageDevice(disk))
+	}
+	if err != nil {
+		logger.Error(ctx, "failed to hot plug disk", "server_id", disk.ServerId, "disk_id", disk.Id, "error", err)
+		if _, err := releaseDisk(ctx, conn, disk.Id, db.StateAttaching); err != nil {
+			logger.Error(ctx, "failed to release disk", "server_id", disk.ServerId, "disk_id", disk.Id, "error", err)
+		}
+		return
+	}
+	setDiskState(ctx, conn, disk, db.StateInUse)
+}
+
+// Unplug disk from virtual machine of server, disk stays in use if guest
+// doesn't release device in time
+func HandleDiskDetaching(ctx context.Context, conn db.Connection, entity db.Entity) {
+	disk := entity.(*Disk)
+	// Stopped server has no device to unplug
+	if vm := registeredVirtualMachine(disk.ServerId); vm != nil {
+		detachCtx, cancel := context.WithTimeout(ctx, OptDiskDetachTimeout.Value())
+		err := vm.DetachDisk(detachCtx, disk.Id.String())
+		cancel()
+		if err != nil && err != qemu.ErrDiskNotAttached {
+			logger.Error(ctx, "failed to unplug disk", "server_id", disk.ServerId, "disk_id", disk.Id, "error", err)
+			setDiskState(ctx, conn, disk, db.StateInUse)
+			return
+		}
+	}
+	if _, err := releaseDisk(ctx, conn, disk.Id, db.StateDetaching); err != nil {
+		logger.Error(ctx, "failed to release disk", "server_id", disk.ServerId, "disk_id", disk.Id, "error", err)
+	}
+}
+
+// Detach disk in given state from its server, server is nil if it was deleted
+// already
+func releaseDisk(ctx context.Context, conn db.Connection, diskId ulid.ULID, state db.State) (*Server, error) {
+	var server *Server
+	err := utils.Retry(ctx, func(ctx context.Context) error {
+		disk, err := Disks(conn).Get(ctx, diskId)
+		if err != nil {
+			return err
+		}
+		// Disk held by rollback or capture can't be detached meanwhile
+		if disk.State != state {
+			return &InvalidStateError{State: disk.State}
+		}
+		txn := conn.NewTransaction()
+		server = nil
+		if disk.ServerId != utils.Zero {
+			if server, err = Servers(conn).Get(ctx, disk.ServerId); err != nil {
+				return err
+			}
+			server.DiskIds = utils.RemoveULID(server.DiskIds, diskId)
+			txn.Update(ctx, server)
+		}
+		disk.ServerId = utils.Zero
+		if err := DiskFSM.ChangeState(disk, db.StateReady, db.InitiatorSystem); err != nil {
+			return err
+		}
+		txn.Update(ctx, disk)
+		DiskFSM.Notify(ctx, txn, disk)
+		_, err = txn.Commit(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
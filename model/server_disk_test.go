@@ -0,0 +1,157 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/utils"
+	"testing"
+)
+
+func createDisk(t *testing.T, conn db.Connection, project *Project) *Disk {
+	ctx := context.Background()
+	image := Images(conn).NewEntity()
+	image.Name = "base-" + utils.NewULID().String()
+	image.ProjectId = project.Id
+	if err := Images(conn).Create(ctx, image, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create image: %s", err)
+	}
+	disk := Disks(conn).NewEntity()
+	disk.ProjectId = project.Id
+	disk.ImageId = image.Id
+	disk.Pool = "disks"
+	disk.Size = 1 << 30
+	if err := Disks(conn).Create(ctx, disk, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create disk: %s", err)
+	}
+	disk.State = db.StateReady
+	if err := Disks(conn).Update(ctx, disk, db.InitiatorSystem); err != nil {
+		t.Fatalf("failed to make disk ready: %s", err)
+	}
+	return disk
+}
+
+func TestServerAttachDisk(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+	project, _ := Projects(conn).Get(ctx, server.ProjectId)
+	disk := createDisk(t, conn, project)
+
+	if _, err := AttachDisk(ctx, conn, server.Id, disk.Id); err == nil {
+		t.Fatalf("disk attached to server being created")
+	}
+	// Disk of running server is hot plugged by hook, which releases it as
+	// there is no virtual machine to plug disk to
+	setServerState(ctx, conn, server, db.StateReady)
+	server, err := AttachDisk(ctx, conn, server.Id, disk.Id)
+	if err != nil || len(server.DiskIds) != 1 {
+		t.Fatalf("unexpected server after hot plug: %v (%v)", server, err)
+	}
+	disk, _ = Disks(conn).Get(ctx, disk.Id)
+	if disk.ServerId != server.Id || disk.State != db.StateAttaching {
+		t.Fatalf("unexpected disk after hot plug: %v", disk)
+	}
+	if _, err := ServerAction(ctx, conn, server.Id, "stop"); err != nil {
+		t.Fatalf("failed to stop server: %s", err)
+	}
+	HandleDiskAttaching(ctx, conn, disk)
+	server, _ = Servers(conn).Get(ctx, server.Id)
+	disk, _ = Disks(conn).Get(ctx, disk.Id)
+	if len(server.DiskIds) != 0 || disk.ServerId != utils.Zero || disk.State != db.StateReady {
+		t.Fatalf("disk not released after failed hot plug: %v %v", server, disk)
+	}
+	setServerState(ctx, conn, server, db.StateStopped)
+
+	server, err = AttachDisk(ctx, conn, server.Id, disk.Id)
+	if err != nil || len(server.DiskIds) != 1 || server.DiskIds[0] != disk.Id {
+		t.Fatalf("unexpected server after attach: %v (%v)", server, err)
+	}
+	disk, _ = Disks(conn).Get(ctx, disk.Id)
+	if disk.ServerId != server.Id || disk.State != db.StateInUse {
+		t.Fatalf("unexpected disk after attach: %v", disk)
+	}
+	if _, err := AttachDisk(ctx, conn, server.Id, disk.Id); err == nil {
+		t.Fatalf("disk attached twice")
+	}
+	other := createServer(t, conn, "bar")
+	setServerState(ctx, conn, other, db.StateReady)
+	other, _ = ServerAction(ctx, conn, other.Id, "stop")
+	setServerState(ctx, conn, other, db.StateStopped)
+	if _, err := AttachDisk(ctx, conn, other.Id, createDisk(t, conn, project).Id); err == nil {
+		t.Fatalf("disk attached to server of other project")
+	} else if fieldErr, ok := err.(*db.FieldError); !ok || fieldErr.Field != "ProjectId" {
+		t.Fatalf("expected project field error, got %v", err)
+	}
+
+	if _, err := AttachDisk(WithExpectedRevisions(ctx, server.ModifyRev-1), conn, server.Id, disk.Id); err == nil {
+		t.Fatalf("disk attached to stale server")
+	} else if _, ok := err.(*db.PreconditionFailedError); !ok {
+		t.Fatalf("expected precondition failed error, got %v", err)
+	}
+	server, err = DetachDisk(ctx, conn, server.Id, disk.Id)
+	if err != nil || len(server.DiskIds) != 0 {
+		t.Fatalf("unexpected server after detach: %v (%v)", server, err)
+	}
+	disk, _ = Disks(conn).Get(ctx, disk.Id)
+	if disk.ServerId != utils.Zero || disk.State != db.StateReady {
+		t.Fatalf("unexpected disk after detach: %v", disk)
+	}
+	if _, err := DetachDisk(ctx, conn, server.Id, disk.Id); err == nil {
+		t.Fatalf("disk detached twice")
+	}
+}
+
+func TestServerDetachDiskHotPlug(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+	project, _ := Projects(conn).Get(ctx, server.ProjectId)
+	disk := createDisk(t, conn, project)
+	setServerState(ctx, conn, server, db.StateReady)
+	server, _ = AttachDisk(ctx, conn, server.Id, disk.Id)
+	disk, _ = Disks(conn).Get(ctx, disk.Id)
+	setDiskState(ctx, conn, disk, db.StateInUse)
+
+	server, err := DetachDisk(ctx, conn, server.Id, disk.Id)
+	if err != nil || len(server.DiskIds) != 1 {
+		t.Fatalf("unexpected server after unplug: %v (%v)", server, err)
+	}
+	disk, _ = Disks(conn).Get(ctx, disk.Id)
+	if disk.State != db.StateDetaching {
+		t.Fatalf("unexpected disk after unplug: %v", disk)
+	}
+	if _, err := DetachDisk(ctx, conn, server.Id, disk.Id); err == nil {
+		t.Fatalf("disk detached while previous detach is in progress")
+	}
+	if _, err := ServerAction(ctx, conn, server.Id, "stop"); err != nil {
+		t.Fatalf("failed to stop server: %s", err)
+	}
+	// Stopped server has no device to unplug
+	HandleDiskDetaching(ctx, conn, disk)
+	server, _ = Servers(conn).Get(ctx, server.Id)
+	disk, _ = Disks(conn).Get(ctx, disk.Id)
+	if len(server.DiskIds) != 0 || disk.ServerId != utils.Zero || disk.State != db.StateReady {
+		t.Fatalf("disk not released after unplug: %v %v", server, disk)
+	}
+	if value, _ := conn.RawRead(ctx, notificationKey("disk", disk.Id, db.StateDetaching)); value.Data != nil {
+		t.Fatalf("notification of detaching disk not deleted")
+	}
+}
@@ -19,17 +19,36 @@ package model
 
 import (
 	"context"
-	"fmt"
+	"github.com/antonf/minicloud/config"
 	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/log"
 	"github.com/antonf/minicloud/qemu"
 	"github.com/antonf/minicloud/utils"
 	"github.com/oklog/ulid"
 	"os"
+	"sync"
+	"time"
 )
 
 var (
-	ServerFSM       *StateMachine
-	virtualMachines = make(map[ulid.ULID]*qemu.VirtualMachine)
+	ServerFSM            *StateMachine
+	OptServerStopTimeout = config.NewDurationOpt("server_stop_timeout", 60*time.Second)
+	// Limits of CPUs and RAM hot plugging on resize, zero disables hot plug
+	OptServerMaxCPUs = config.NewIntOpt("server_max_cpus", 0)
+	OptServerMaxRAM  = config.NewIntOpt("server_max_ram", 0)
+	vmLock           sync.Mutex
+	virtualMachines  = make(map[ulid.ULID]*qemu.VirtualMachine)
+	// States servers are switched to by user actions
+	serverActions = map[string]db.State{
+		"start":  db.StateStarting,
+		"stop":   db.StateStopping,
+		"reboot": db.StateRebooting,
+		"pause":  db.StatePausing,
+		"resume": db.StateResuming,
+	}
+	// Replaced in tests, which can't run qemu
+	launchVirtualMachine = launchServer
+	haltVirtualMachine   = stopVirtualMachine
 )
 
 func init() {
@@ -37,43 +56,265 @@ func init() {
 		InitialState(db.StateCreated).
 		UserTransition(db.StateReady, db.StateDeleting).
 		UserTransition(db.StateError, db.StateDeleting).
+		UserTransition(db.StateStopped, db.StateDeleting).
+		UserTransition(db.StatePaused, db.StateDeleting).
+		UserTransition(db.StateStopped, db.StateStarting).
+		UserTransition(db.StateError, db.StateStarting).
+		UserTransition(db.StateReady, db.StateStopping).
+		UserTransition(db.StatePaused, db.StateStopping).
+		UserTransition(db.StateReady, db.StateRebooting).
+		UserTransition(db.StateReady, db.StatePausing).
+		UserTransition(db.StatePaused, db.StateResuming).
+		UserTransition(db.StateReady, db.StateResizing).
 		SystemTransition(db.StateCreated, db.StateReady).
 		SystemTransition(db.StateCreated, db.StateError).
+		SystemTransition(db.StateStarting, db.StateReady).
+		SystemTransition(db.StateStarting, db.StateError).
+		SystemTransition(db.StateStopping, db.StateStopped).
+		SystemTransition(db.StateStopping, db.StateError).
+		SystemTransition(db.StateRebooting, db.StateReady).
+		SystemTransition(db.StateRebooting, db.StateError).
+		SystemTransition(db.StatePausing, db.StatePaused).
+		SystemTransition(db.StatePausing, db.StateError).
+		SystemTransition(db.StateResuming, db.StateReady).
+		SystemTransition(db.StateResuming, db.StateError).
+		SystemTransition(db.StateResizing, db.StateReady).
+		SystemTransition(db.StateResizing, db.StateError).
+		// Virtual machine exited by itself, e.g. guest OS was shut down
+		SystemTransition(db.StateReady, db.StateStopped).
+		SystemTransition(db.StatePaused, db.StateStopped).
 		SystemTransition(db.StateDeleting, db.StateDeleted).
-		Hook(db.StateCreated, HandleServerCreated).
+		Hook(db.StateCreated, HandleServerStarting).
+		Hook(db.StateStarting, HandleServerStarting).
+		Hook(db.StateStopping, HandleServerStopping).
+		Hook(db.StateRebooting, HandleServerRebooting).
+		Hook(db.StatePausing, HandleServerPausing).
+		Hook(db.StateResuming, HandleServerResuming).
+		Hook(db.StateResizing, HandleServerResizing).
 		Hook(db.StateDeleting, HandleServerDeleting)
 }
 
-func HandleServerCreated(ctx context.Context, conn db.Connection, entity db.Entity) {
+// Switch server to state of user action, state change is then handled by
+// server state machine hooks
+func ServerAction(ctx context.Context, conn db.Connection, id ulid.ULID, action string) (*Server, error) {
+	state, ok := serverActions[action]
+	if !ok {
+		return nil, &db.FieldError{Entity: "server", Field: "action", Message: "Unknown action"}
+	}
+	server, err := Servers(conn).Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// Disk held by rollback or capture updates server, so started server
+	// either sees busy disk or conflicts
+	if state == db.StateStarting {
+		for _, diskId := range server.DiskIds {
+			disk, err := Disks(conn).Get(ctx, diskId)
+			if err != nil {
+				return nil, err
+			}
+			if disk.State != db.StateInUse {
+				return nil, &db.FieldError{Entity: "server", Field: "DiskIds", Message: "Disk is busy"}
+			}
+		}
+	}
+	server.State = state
+	if err := Servers(conn).Update(ctx, server, db.InitiatorUser); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Change flavor of server, running server is resized by state machine hook
+func ResizeServer(ctx context.Context, conn db.Connection, id, flavorId ulid.ULID) (*Server, error) {
+	server, err := Servers(conn).Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExpectedRevision(ctx, server); err != nil {
+		return nil, err
+	}
+	if server.State != db.StateReady && server.State != db.StateStopped {
+		return nil, &InvalidStateError{State: server.State}
+	}
+	if server.FlavorId == flavorId {
+		return server, nil
+	}
+	oldFlavor, err := Flavors(conn).Get(ctx, server.FlavorId)
+	if err != nil {
+		return nil, err
+	}
+	newFlavor, err := Flavors(conn).Get(ctx, flavorId)
+	if err != nil {
+		return nil, err
+	}
+	if server.State == db.StateReady {
+		if err := ServerFSM.ChangeState(server, db.StateResizing, db.InitiatorUser); err != nil {
+			return nil, err
+		}
+	}
+	project, err := Projects(conn).Get(ctx, server.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	project.release(flavorUsage(oldFlavor))
+	if err := project.charge(flavorUsage(newFlavor)); err != nil {
+		return nil, err
+	}
+	server.FlavorId = newFlavor.Id
+	oldFlavor.ServerIds = utils.RemoveULID(oldFlavor.ServerIds, server.Id)
+	newFlavor.ServerIds = append(newFlavor.ServerIds, server.Id)
+	txn := conn.NewTransaction()
+	txn.Update(ctx, server)
+	txn.Update(ctx, oldFlavor)
+	txn.Update(ctx, newFlavor)
+	txn.Update(ctx, project)
+	ServerFSM.Notify(ctx, txn, server)
+	// Resized running server records usage once it's ready again
+	if server.State == db.StateStopped {
+		if err := recordUsage(ctx, txn, server, flavorUsage(newFlavor)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := txn.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+func HandleServerStarting(ctx context.Context, conn db.Connection, entity db.Entity) {
 	server := entity.(*Server)
+	// VM is left running when reboot, pause, resume or resize fails and
+	// must not share disks with the new one
+	if vm := takeVirtualMachine(server.Id); vm != nil {
+		haltVirtualMachine(ctx, vm)
+	}
+	if err := launchVirtualMachine(ctx, conn, server); err != nil {
+		failServerHandling(ctx, conn, server, err)
+		return
+	}
+	setServerState(ctx, conn, server, db.StateReady)
+}
+
+func HandleServerStopping(ctx context.Context, conn db.Connection, entity db.Entity) {
+	server := entity.(*Server)
+	// VM is forgotten first, so its exit isn't handled as unexpected
+	if vm := takeVirtualMachine(server.Id); vm != nil {
+		stopVirtualMachine(ctx, vm)
+	}
+	setServerState(ctx, conn, server, db.StateStopped)
+}
 
+func HandleServerResizing(ctx context.Context, conn db.Connection, entity db.Entity) {
+	server := entity.(*Server)
 	flavor, err := Flavors(conn).Get(ctx, server.FlavorId)
 	if err != nil {
 		failServerHandling(ctx, conn, server, err)
 		return
 	}
+	vmLock.Lock()
+	vm := virtualMachines[server.Id]
+	vmLock.Unlock()
+	if vm == nil {
+		failServerHandling(ctx, conn, server, ErrVirtualMachineNotRunning)
+		return
+	}
+
+	err = vm.SetCPUs(ctx, flavor.NumCPUs)
+	if err == nil {
+		err = vm.SetRAM(ctx, flavor.RAM)
+	}
+	if err != nil {
+		logger.Info(ctx, "failed to hot plug resources, restarting virtual machine", "error", err)
+		if vm := takeVirtualMachine(server.Id); vm != nil {
+			stopVirtualMachine(ctx, vm)
+		}
+		if err := launchServer(ctx, conn, server); err != nil {
+			failServerHandling(ctx, conn, server, err)
+			return
+		}
+	}
+	setServerState(ctx, conn, server, db.StateReady)
+}
+
+func HandleServerRebooting(ctx context.Context, conn db.Connection, entity db.Entity) {
+	server := entity.(*Server)
+	if err := runMonitorCommand(ctx, server, (*qemu.Monitor).SystemReset); err != nil {
+		failServerHandling(ctx, conn, server, err)
+		return
+	}
+	setServerState(ctx, conn, server, db.StateReady)
+}
+
+func HandleServerPausing(ctx context.Context, conn db.Connection, entity db.Entity) {
+	server := entity.(*Server)
+	if err := runMonitorCommand(ctx, server, (*qemu.Monitor).Stop); err != nil {
+		failServerHandling(ctx, conn, server, err)
+		return
+	}
+	setServerState(ctx, conn, server, db.StatePaused)
+}
+
+func HandleServerResuming(ctx context.Context, conn db.Connection, entity db.Entity) {
+	server := entity.(*Server)
+	if err := runMonitorCommand(ctx, server, (*qemu.Monitor).Cont); err != nil {
+		failServerHandling(ctx, conn, server, err)
+		return
+	}
+	setServerState(ctx, conn, server, db.StateReady)
+}
+
+func HandleServerDeleting(ctx context.Context, conn db.Connection, entity db.Entity) {
+	server := entity.(*Server)
+
+	if vm := takeVirtualMachine(server.Id); vm != nil {
+		if err := vm.Monitor().Quit(ctx); err != nil {
+			logger.Error(ctx, "failed to turn virtual machine off", "error", err)
+			vm.Kill(ctx)
+		}
+		vm.Monitor().Close()
+	}
+
+	if err := Servers(conn).Delete(ctx, server.Id, db.InitiatorSystem); err != nil {
+		logger.Error(ctx, "failed to delete server", "error", err)
+	}
+}
+
+func launchServer(ctx context.Context, conn db.Connection, server *Server) error {
+	flavor, err := Flavors(conn).Get(ctx, server.FlavorId)
+	if err != nil {
+		return err
+	}
 
 	storageDevices := make([]qemu.StorageDevice, len(server.DiskIds))
 	for idx, diskId := range server.DiskIds {
 		disk, err := Disks(conn).Get(ctx, diskId)
 		if err != nil {
-			failServerHandling(ctx, conn, server, err)
-			return
+			return err
 		}
-		device := &storageDevices[idx]
-		device.Disk = disk.Id.String()
-		device.Pool = disk.Pool
-		device.Cache = qemu.CacheWriteBack
+		storageDevices[idx] = storageDevice(disk)
 	}
 
-	netDevices := []qemu.NetworkDevice{
-	//		{MacAddress: randomMac(server.Id), InterfaceName: tapNameFromId(server.Id)},
+	netDevices := make([]qemu.NetworkDevice, len(server.PortIds))
+	for idx, portId := range server.PortIds {
+		port, err := Ports(conn).Get(ctx, portId)
+		if err != nil {
+			return err
+		}
+		network, err := Networks(conn).Get(ctx, port.NetworkId)
+		if err != nil {
+			return err
+		}
+		netDevices[idx] = qemu.NetworkDevice{
+			MacAddress:    port.MacAddress,
+			InterfaceName: port.InterfaceName,
+			Bridge:        network.BridgeName,
+		}
 	}
 
 	root := "/home/anton/vm/" + server.Id.String() // TODO: option
 	if err := os.MkdirAll(root, 0700); err != nil {
-		failServerHandling(ctx, conn, server, err)
-		return
+		return err
 	}
 
 	vm := &qemu.VirtualMachine{
@@ -87,65 +328,129 @@ func HandleServerCreated(ctx context.Context, conn db.Connection, entity db.Enti
 		VncPort:  0,    // TODO: port allocation
 		NumCPUs:  flavor.NumCPUs,
 		RAM:      flavor.RAM,
+		MaxCPUs:  OptServerMaxCPUs.Value(),
+		MaxRAM:   OptServerMaxRAM.Value(),
 	}
 
-	if err := vm.Start(ctx); err != nil {
-		failServerHandling(ctx, conn, server, err)
-		return
+	// Hook context is cancelled once hook returns, while process and monitor
+	// should live until VM is stopped
+	vmCtx := log.WithValues(context.Background(), "server_id", server.Id)
+	if err := vm.Start(vmCtx); err != nil {
+		return err
 	}
-	go vm.Wait()
 
 	if err := vm.Monitor().Cont(ctx); err != nil {
 		vm.Kill(ctx)
-		failServerHandling(ctx, conn, server, err)
-		return
+		return err
 	}
 
+	vmLock.Lock()
 	virtualMachines[server.Id] = vm
+	vmLock.Unlock()
+	go watchVirtualMachine(vmCtx, conn, vm)
+	return nil
+}
+
+// Power virtual machine down, killing it if guest doesn't react in time
+func stopVirtualMachine(ctx context.Context, vm *qemu.VirtualMachine) {
+	if err := vm.Monitor().SystemPowerdown(ctx); err != nil {
+		logger.Error(ctx, "failed to power virtual machine down", "error", err)
+		vm.Kill(ctx)
+	}
+	select {
+	case <-vm.Exited():
+	case <-time.After(OptServerStopTimeout.Value()):
+		logger.Warn(ctx, "virtual machine didn't power down in time, killing it")
+		vm.Kill(ctx)
+		<-vm.Exited()
+	case <-ctx.Done():
+		vm.Kill(ctx)
+		<-vm.Exited()
+	}
+	vm.Monitor().Close()
+}
+
+func takeVirtualMachine(id ulid.ULID) *qemu.VirtualMachine {
+	vmLock.Lock()
+	defer vmLock.Unlock()
+	vm := virtualMachines[id]
+	delete(virtualMachines, id)
+	return vm
+}
+
+func registeredVirtualMachine(id ulid.ULID) *qemu.VirtualMachine {
+	vmLock.Lock()
+	defer vmLock.Unlock()
+	return virtualMachines[id]
+}
+
+func runMonitorCommand(ctx context.Context, server *Server, command func(*qemu.Monitor, context.Context) error) error {
+	vmLock.Lock()
+	vm := virtualMachines[server.Id]
+	vmLock.Unlock()
+	if vm == nil {
+		return ErrVirtualMachineNotRunning
+	}
+	return command(vm.Monitor(), ctx)
+}
+
+// Mark server stopped if its virtual machine exits while it's still
+// registered, i.e. not stopped or deleted by hook
+func watchVirtualMachine(ctx context.Context, conn db.Connection, vm *qemu.VirtualMachine) {
+	err := vm.Wait()
+	vmLock.Lock()
+	unexpected := virtualMachines[vm.Id] == vm
+	if unexpected {
+		delete(virtualMachines, vm.Id)
+	}
+	vmLock.Unlock()
+	if !unexpected {
+		return
+	}
+	logger.Warn(ctx, "virtual machine exited", "error", err)
+	vm.Monitor().Close()
 	utils.Retry(ctx, func(ctx context.Context) error {
-		server, err := Servers(conn).Get(ctx, server.Id)
+		server, err := Servers(conn).Get(ctx, vm.Id)
 		if err != nil {
 			return err
 		}
-		server.State = db.StateReady
+		if ServerFSM.CheckTransition(server.State, db.StateStopped, db.InitiatorSystem) != nil {
+			// Server is being handled by hook which will notice missing VM
+			return nil
+		}
+		server.State = db.StateStopped
 		return Servers(conn).Update(ctx, server, db.InitiatorSystem)
 	})
 }
 
-func HandleServerDeleting(ctx context.Context, conn db.Connection, entity db.Entity) {
-	server := entity.(*Server)
-
-	if vm, ok := virtualMachines[server.Id]; ok {
-		delete(virtualMachines, server.Id)
-		if err := vm.Monitor().Quit(ctx); err != nil {
-			logger.Error(ctx, "failed to turn virtual machine off", "error", err)
-			vm.Kill(ctx)
-		}
-		vm.Monitor().Close()
-	}
-
-	if err := Servers(conn).Delete(ctx, server.Id, db.InitiatorSystem); err != nil {
-		logger.Error(ctx, "failed to delete server", "error", err)
+func storageDevice(disk *Disk) qemu.StorageDevice {
+	return qemu.StorageDevice{
+		Disk:  disk.Id.String(),
+		Pool:  disk.Pool,
+		Cache: qemu.CacheWriteBack,
 	}
 }
 
-func tapNameFromId(id ulid.ULID) string {
-	idStr := id.String()
-	return "tap" + idStr[len(idStr)-12:]
-}
-
 func failServerHandling(ctx context.Context, conn db.Connection, server *Server, err error) {
 	logger.Error(ctx, "state handling failed", "state", server.State, "error", err)
+	setServerState(ctx, conn, server, db.StateError)
+}
+
+func setServerState(ctx context.Context, conn db.Connection, server *Server, state db.State) {
+	id := server.Id
 	utils.Retry(ctx, func(ctx context.Context) error {
-		server, err := Servers(conn).Get(ctx, server.Id)
-		if err != nil {
+		// Re-read server only if previous attempt failed
+		if server == nil {
+			var err error
+			if server, err = Servers(conn).Get(ctx, id); err != nil {
+				return err
+			}
+		}
+		server.State = state
+		if err := Servers(conn).Update(ctx, server, db.InitiatorSystem); err != nil {
+			server = nil
 			return err
 		}
-		server.State = db.StateError
-		return Servers(conn).Update(ctx, server, db.InitiatorSystem)
+		return nil
 	})
 }
-
-func randomMac(id ulid.ULID) string {
-	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", id[15], id[14], id[13])
-}
@@ -0,0 +1,197 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"errors"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/qemu"
+	"github.com/antonf/minicloud/utils"
+	"testing"
+	"time"
+)
+
+func createServer(t *testing.T, conn db.Connection, name string) *Server {
+	ctx := context.Background()
+	project := createProject(t, conn, name)
+	flavor := Flavors(conn).NewEntity()
+	flavor.Name = name
+	flavor.NumCPUs = 1
+	flavor.RAM = 512
+	if err := Flavors(conn).Create(ctx, flavor, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create flavor: %s", err)
+	}
+	server := Servers(conn).NewEntity()
+	server.Name = name
+	server.ProjectId = project.Id
+	server.FlavorId = flavor.Id
+	if err := Servers(conn).Create(ctx, server, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	return server
+}
+
+func TestServerAction(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+
+	// Server isn't running yet
+	_, err := ServerAction(ctx, conn, server.Id, "stop")
+	if _, ok := err.(*InvalidTransitionError); !ok {
+		t.Fatalf("expected invalid transition error, got %v", err)
+	}
+	_, err = ServerAction(ctx, conn, server.Id, "hibernate")
+	if _, ok := err.(*db.FieldError); !ok {
+		t.Fatalf("expected field error, got %v", err)
+	}
+
+	// Complete transitions like hooks would do
+	steps := []struct {
+		action string
+		state  db.State
+		result db.State
+	}{
+		{"pause", db.StatePausing, db.StatePaused},
+		{"resume", db.StateResuming, db.StateReady},
+		{"reboot", db.StateRebooting, db.StateReady},
+		{"stop", db.StateStopping, db.StateStopped},
+		{"start", db.StateStarting, db.StateReady},
+	}
+	setServerState(ctx, conn, server, db.StateReady)
+	for _, step := range steps {
+		server, err = ServerAction(ctx, conn, server.Id, step.action)
+		if err != nil || server.State != step.state {
+			t.Fatalf("unexpected server after %s: %v (%v)", step.action, server, err)
+		}
+		if _, err := ServerAction(ctx, conn, server.Id, step.action); err == nil {
+			t.Fatalf("%s accepted while previous action is in progress", step.action)
+		}
+		setServerState(ctx, conn, server, step.result)
+	}
+	if _, err := ServerAction(ctx, conn, server.Id, "resume"); err == nil {
+		t.Fatalf("resumed server which isn't paused")
+	}
+}
+
+func TestServerStartAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+
+	var halted []*qemu.VirtualMachine
+	launched := &qemu.VirtualMachine{Id: server.Id}
+	haltVirtualMachine = func(ctx context.Context, vm *qemu.VirtualMachine) {
+		halted = append(halted, vm)
+	}
+	launchVirtualMachine = func(ctx context.Context, conn db.Connection, server *Server) error {
+		if len(halted) == 0 {
+			t.Errorf("virtual machine launched before old one is halted")
+		}
+		vmLock.Lock()
+		virtualMachines[server.Id] = launched
+		vmLock.Unlock()
+		return nil
+	}
+	defer func() {
+		launchVirtualMachine = launchServer
+		haltVirtualMachine = stopVirtualMachine
+		takeVirtualMachine(server.Id)
+	}()
+
+	// Failed monitor command leaves VM registered and server in error
+	vm := &qemu.VirtualMachine{Id: server.Id}
+	vmLock.Lock()
+	virtualMachines[server.Id] = vm
+	vmLock.Unlock()
+	setServerState(ctx, conn, server, db.StateReady)
+	server, _ = ServerAction(ctx, conn, server.Id, "reboot")
+	failServerHandling(ctx, conn, server, errors.New("monitor command failed"))
+
+	server, err := ServerAction(ctx, conn, server.Id, "start")
+	if err != nil || server.State != db.StateStarting {
+		t.Fatalf("unexpected server after start: %v (%v)", server, err)
+	}
+	HandleServerStarting(ctx, conn, server)
+	if len(halted) != 1 || halted[0] != vm {
+		t.Fatalf("old virtual machine not halted: %v", halted)
+	}
+	vmLock.Lock()
+	registered := virtualMachines[server.Id]
+	vmLock.Unlock()
+	if registered != launched {
+		t.Fatalf("new virtual machine not registered")
+	}
+	if server, _ := Servers(conn).Get(ctx, server.Id); server.State != db.StateReady {
+		t.Fatalf("server not ready after start: %v", server.State)
+	}
+}
+
+func TestServerResize(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+	oldFlavorId := server.FlavorId
+	flavor := Flavors(conn).NewEntity()
+	flavor.Name = "large"
+	flavor.NumCPUs = 4
+	flavor.RAM = 4096
+	if err := Flavors(conn).Create(ctx, flavor, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create flavor: %s", err)
+	}
+
+	if _, err := ResizeServer(ctx, conn, server.Id, flavor.Id); err == nil {
+		t.Fatalf("resized server being created")
+	}
+	setServerState(ctx, conn, server, db.StateReady)
+	server, err := ResizeServer(ctx, conn, server.Id, flavor.Id)
+	if err != nil || server.State != db.StateResizing || server.FlavorId != flavor.Id {
+		t.Fatalf("unexpected server after resize: %v (%v)", server, err)
+	}
+	if flavor, _ := Flavors(conn).Get(ctx, flavor.Id); !utils.ContainsULID(flavor.ServerIds, server.Id) {
+		t.Fatalf("server not added to new flavor: %v", flavor.ServerIds)
+	}
+	if flavor, _ := Flavors(conn).Get(ctx, oldFlavorId); len(flavor.ServerIds) != 0 {
+		t.Fatalf("server not removed from old flavor: %v", flavor.ServerIds)
+	}
+	if _, err := ResizeServer(ctx, conn, server.Id, oldFlavorId); err == nil {
+		t.Fatalf("resize accepted while previous one is in progress")
+	}
+	if project, _ := Projects(conn).Get(ctx, server.ProjectId); project.Usage.CPUs != 4 || project.Usage.RAM != 4096 {
+		t.Fatalf("quota usage not moved to new flavor: %+v", project.Usage)
+	}
+
+	// Stopped server is resized right away
+	setServerState(ctx, conn, server, db.StateReady)
+	server, _ = ServerAction(ctx, conn, server.Id, "stop")
+	setServerState(ctx, conn, server, db.StateStopped)
+	server, err = ResizeServer(ctx, conn, server.Id, oldFlavorId)
+	if err != nil || server.State != db.StateStopped || server.FlavorId != oldFlavorId {
+		t.Fatalf("unexpected stopped server after resize: %v (%v)", server, err)
+	}
+	now := time.Now()
+	usage, err := ProjectUsage(ctx, conn, server.ProjectId, now, now.Add(time.Hour))
+	if err != nil || len(usage.Flavors) != 1 || usage.Flavors[0].FlavorId != oldFlavorId {
+		t.Fatalf("usage of stopped server not moved to new flavor: %+v (%v)", usage, err)
+	}
+	if _, err := ResizeServer(ctx, conn, server.Id, utils.NewULID()); err == nil {
+		t.Fatalf("resized server to missing flavor")
+	}
+}
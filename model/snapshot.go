@@ -0,0 +1,328 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Code generated by gen/main.go from entities.json. DO NOT EDIT.
+
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"github.com/oklog/ulid"
+	"regexp"
+)
+
+type SnapshotManager struct {
+	conn db.Connection
+}
+
+func Snapshots(conn db.Connection) *SnapshotManager {
+	return &SnapshotManager{conn: conn}
+}
+
+var regexpSnapshotName = regexp.MustCompile("^[a-zA-Z0-9_.:-]{3,200}$")
+
+func (m *SnapshotManager) NewEntity() *Snapshot {
+	return &Snapshot{EntityHeader: db.EntityHeader{SchemaVersion: SchemaVersion("Snapshot"), State: db.StateCreated}}
+}
+func (m *SnapshotManager) List(ctx context.Context, opts *ListOptions) ([]*Snapshot, string, error) {
+	if opts.ProjectId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "snapshot", Field: "ProjectId", Message: "Filter not supported"}
+	}
+	if opts.NetworkId != (ulid.ULID{}) {
+		return nil, "", &db.FieldError{Entity: "snapshot", Field: "NetworkId", Message: "Filter not supported"}
+	}
+	result := []*Snapshot{}
+	next, err := listEntities(ctx, m.conn, "snapshot", opts, func(value *db.RawValue) (bool, error) {
+		entity := &Snapshot{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return false, err
+		}
+		if !opts.matchState(entity.State) || !opts.matchName(entity.Name) || !opts.matchDisk(entity.DiskId) {
+			return false, nil
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result = append(result, entity)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return result, next, nil
+}
+func (m *SnapshotManager) Get(ctx context.Context, id ulid.ULID) (*Snapshot, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/data/snapshot/%s", id))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Snapshot", Id: id}
+	}
+	entity := &Snapshot{}
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *SnapshotManager) GetByName(ctx context.Context, diskId ulid.ULID, name string) (*Snapshot, error) {
+	value, err := m.conn.RawRead(ctx, fmt.Sprintf("/minicloud/db/meta/snapshot/disk/%s/name/%s", diskId, name))
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NameNotFoundError{Entity: "Snapshot", Name: name}
+	}
+	id, err := ulid.Parse(string(value.Data))
+	if err != nil {
+		return nil, err
+	}
+	entity, err := m.Get(ctx, id)
+	if _, notFound := err.(*db.NotFoundError); notFound || (err == nil && (entity.DiskId != diskId || entity.Name != name)) {
+		// Renamed or deleted after name lookup
+		return nil, &db.NameNotFoundError{Entity: "Snapshot", Name: name}
+	}
+	return entity, err
+}
+func (m *SnapshotManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (*Snapshot, error) {
+	value, err := m.conn.RawReadRev(ctx, fmt.Sprintf("/minicloud/db/data/snapshot/%s", id), rev)
+	if err != nil {
+		return nil, err
+	}
+	if value.Data == nil {
+		return nil, &db.NotFoundError{Entity: "Snapshot", Id: id}
+	}
+	entity := &Snapshot{}
+	if err := decodeEntity(value.Data, entity); err != nil {
+		return nil, err
+	}
+	entity.CreateRev = value.CreateRev
+	entity.ModifyRev = value.ModifyRev
+	entity.Original = entity.Copy()
+	return entity, nil
+}
+func (m *SnapshotManager) History(ctx context.Context, id ulid.ULID, limit int) ([]*Snapshot, error) {
+	values, err := m.conn.RawReadHistory(ctx, fmt.Sprintf("/minicloud/db/data/snapshot/%s", id), limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &db.NotFoundError{Entity: "Snapshot", Id: id}
+	}
+	result := make([]*Snapshot, len(values))
+	for i, value := range values {
+		entity := &Snapshot{}
+		if err := decodeEntity(value.Data, entity); err != nil {
+			return nil, err
+		}
+		entity.CreateRev = value.CreateRev
+		entity.ModifyRev = value.ModifyRev
+		entity.Original = entity.Copy()
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *SnapshotManager) Create(ctx context.Context, entity *Snapshot, initiator db.Initiator) error {
+	entity.Id = utils.NewULID()
+	if err := SnapshotFSM.CheckInitialState(entity.State); err != nil {
+		return err
+	}
+	if !regexpSnapshotName.MatchString(entity.Name) {
+		return &db.FieldError{Entity: "snapshot", Field: "Name", Message: "Name should be between 3 and 200 characters from following set: a-z A-Z 0-9 _.:-"}
+	}
+	txn := m.conn.NewTransaction()
+	txn.Create(ctx, entity)
+	if disk, err := Disks(m.conn).Get(ctx, entity.DiskId); err != nil {
+		return err
+	} else {
+		disk.SnapshotIds = append(disk.SnapshotIds, entity.Id)
+		txn.Update(ctx, disk)
+	}
+	key0 := fmt.Sprintf("/minicloud/db/meta/snapshot/disk/%s/name/%s", entity.DiskId, entity.Name)
+	txn.CreateMeta(ctx, key0, entity.Id.String())
+	SnapshotFSM.Notify(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+func (m *SnapshotManager) Update(ctx context.Context, entity *Snapshot, initiator db.Initiator) error {
+	origEntity := entity.Original.(*Snapshot)
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
+	if err := SnapshotFSM.CheckTransition(origEntity.State, entity.State, initiator); err != nil {
+		return err
+	}
+	if entity.DiskId != origEntity.DiskId {
+		return &db.FieldError{Entity: "snapshot", Field: "DiskId", Message: "Field change prohibited"}
+	}
+	if !regexpSnapshotName.MatchString(entity.Name) {
+		return &db.FieldError{Entity: "snapshot", Field: "Name", Message: "Name should be between 3 and 200 characters from following set: a-z A-Z 0-9 _.:-"}
+	}
+	txn := m.conn.NewTransaction()
+	txn.Update(ctx, entity)
+	if entity.DiskId != origEntity.DiskId || entity.Name != origEntity.Name {
+		forfeitKey0 := fmt.Sprintf("/minicloud/db/meta/snapshot/disk/%s/name/%s", origEntity.DiskId, origEntity.Name)
+		txn.CheckMeta(ctx, forfeitKey0, origEntity.Id.String())
+		txn.DeleteMeta(ctx, forfeitKey0)
+		claimKey0 := fmt.Sprintf("/minicloud/db/meta/snapshot/disk/%s/name/%s", entity.DiskId, entity.Name)
+		txn.CreateMeta(ctx, claimKey0, entity.Id.String())
+	}
+	SnapshotFSM.Notify(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+func (m *SnapshotManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	entity, err := Snapshots(m.conn).Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
+	if err := SnapshotFSM.CheckTransition(entity.State, db.StateDeleting, initiator); err != nil {
+		return err
+	}
+	entity.State = db.StateDeleting
+	txn := m.conn.NewTransaction()
+	txn.Update(ctx, entity)
+	SnapshotFSM.Notify(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+func (m *SnapshotManager) Delete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	entity, err := Snapshots(m.conn).Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkExpectedRevision(ctx, entity); err != nil {
+		return err
+	}
+	if err := SnapshotFSM.CheckTransition(entity.State, db.StateDeleted, initiator); err != nil {
+		return err
+	}
+	txn := m.conn.NewTransaction()
+	txn.Delete(ctx, entity)
+	if disk, err := Disks(m.conn).Get(ctx, entity.DiskId); err != nil {
+		return err
+	} else {
+		disk.SnapshotIds = utils.RemoveULID(disk.SnapshotIds, entity.Id)
+		txn.Update(ctx, disk)
+	}
+	key0 := fmt.Sprintf("/minicloud/db/meta/snapshot/disk/%s/name/%s", entity.DiskId, entity.Name)
+	txn.CheckMeta(ctx, key0, entity.Id.String())
+	txn.DeleteMeta(ctx, key0)
+	SnapshotFSM.DeleteNotification(ctx, txn, entity)
+	if _, err := txn.Commit(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+type snapshotManager struct {
+	typed *SnapshotManager
+}
+
+func init() {
+	registerManager("snapshot", true, func(conn db.Connection) Manager {
+		return &snapshotManager{typed: Snapshots(conn)}
+	})
+}
+func (m *snapshotManager) EntityName() string {
+	return "Snapshot"
+}
+func (m *snapshotManager) StateMachine() *StateMachine {
+	return SnapshotFSM
+}
+func (m *snapshotManager) NewEntity() db.Entity {
+	return m.typed.NewEntity()
+}
+func (m *snapshotManager) List(ctx context.Context, opts *ListOptions) ([]db.Entity, string, error) {
+	entities, next, err := m.typed.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, next, nil
+}
+func (m *snapshotManager) Get(ctx context.Context, id ulid.ULID) (db.Entity, error) {
+	entity, err := m.typed.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *snapshotManager) GetRevision(ctx context.Context, id ulid.ULID, rev int64) (db.Entity, error) {
+	entity, err := m.typed.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *snapshotManager) NameScoped() bool {
+	return true
+}
+func (m *snapshotManager) GetByName(ctx context.Context, scope ulid.ULID, name string) (db.Entity, error) {
+	entity, err := m.typed.GetByName(ctx, scope, name)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+func (m *snapshotManager) History(ctx context.Context, id ulid.ULID, limit int) ([]db.Entity, error) {
+	entities, err := m.typed.History(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]db.Entity, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result, nil
+}
+func (m *snapshotManager) Create(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Snapshot)
+	if !ok {
+		return &EntityTypeError{Expected: "Snapshot", Actual: entity.EntityName()}
+	}
+	return m.typed.Create(ctx, typedEntity, initiator)
+}
+func (m *snapshotManager) Update(ctx context.Context, entity db.Entity, initiator db.Initiator) error {
+	typedEntity, ok := entity.(*Snapshot)
+	if !ok {
+		return &EntityTypeError{Expected: "Snapshot", Actual: entity.EntityName()}
+	}
+	return m.typed.Update(ctx, typedEntity, initiator)
+}
+func (m *snapshotManager) IntentDelete(ctx context.Context, id ulid.ULID, initiator db.Initiator) error {
+	return m.typed.IntentDelete(ctx, id, initiator)
+}
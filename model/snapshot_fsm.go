@@ -0,0 +1,171 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/ceph"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"github.com/oklog/ulid"
+)
+
+var SnapshotFSM *StateMachine
+
+func init() {
+	SnapshotFSM = NewStateMachine().
+		InitialState(db.StateCreated).
+		UserTransition(db.StateReady, db.StateReady). // Allow update in ready state
+		UserTransition(db.StateReady, db.StateRollingBack).
+		UserTransition(db.StateReady, db.StateDeleting).
+		UserTransition(db.StateError, db.StateDeleting).
+		SystemTransition(db.StateCreated, db.StateReady).
+		SystemTransition(db.StateCreated, db.StateError).
+		SystemTransition(db.StateRollingBack, db.StateReady).
+		SystemTransition(db.StateRollingBack, db.StateError).
+		SystemTransition(db.StateDeleting, db.StateDeleted).
+		SystemTransition(db.StateDeleting, db.StateError).
+		Hook(db.StateCreated, HandleSnapshotCreated).
+		Hook(db.StateRollingBack, HandleSnapshotRollingBack).
+		Hook(db.StateDeleting, HandleSnapshotDeleting)
+}
+
+// Rollback disk to snapshot, disk is held in rolling-back state meanwhile, so
+// it can't be attached or used by started server
+func RollbackSnapshot(ctx context.Context, conn db.Connection, id ulid.ULID) (*Snapshot, error) {
+	snapshot, err := Snapshots(conn).Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExpectedRevision(ctx, snapshot); err != nil {
+		return nil, err
+	}
+	if err := SnapshotFSM.ChangeState(snapshot, db.StateRollingBack, db.InitiatorUser); err != nil {
+		return nil, err
+	}
+	disk, err := Disks(conn).Get(ctx, snapshot.DiskId)
+	if err != nil {
+		return nil, err
+	}
+	txn := conn.NewTransaction()
+	if err := holdDisk(ctx, conn, txn, disk, db.StateRollingBack); err != nil {
+		return nil, err
+	}
+	txn.Update(ctx, snapshot)
+	SnapshotFSM.Notify(ctx, txn, snapshot)
+	if _, err := txn.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func HandleSnapshotCreated(ctx context.Context, conn db.Connection, entity db.Entity) {
+	snapshot := entity.(*Snapshot)
+	disk, err := Disks(conn).Get(ctx, snapshot.DiskId)
+	if err == nil {
+		err = ceph.CreateDiskSnapshot(ctx, disk.Pool, disk.Id.String(), snapshot.Id.String())
+	}
+	finishSnapshotHandling(ctx, conn, snapshot, err)
+}
+
+func HandleSnapshotRollingBack(ctx context.Context, conn db.Connection, entity db.Entity) {
+	snapshot := entity.(*Snapshot)
+	disk, err := Disks(conn).Get(ctx, snapshot.DiskId)
+	if err == nil {
+		err = ceph.RollbackDiskSnapshot(ctx, disk.Pool, disk.Id.String(), snapshot.Id.String())
+	}
+	finishSnapshotRollback(ctx, conn, snapshot.Id, err)
+}
+
+func HandleSnapshotDeleting(ctx context.Context, conn db.Connection, entity db.Entity) {
+	snapshot := entity.(*Snapshot)
+	disk, err := Disks(conn).Get(ctx, snapshot.DiskId)
+	if err == nil {
+		err = ceph.DeleteDiskSnapshot(ctx, disk.Pool, disk.Id.String(), snapshot.Id.String())
+	}
+	if err != nil {
+		finishSnapshotHandling(ctx, conn, snapshot, err)
+		return
+	}
+	err = utils.Retry(ctx, func(ctx context.Context) error {
+		return Snapshots(conn).Delete(ctx, snapshot.Id, db.InitiatorSystem)
+	})
+	if err != nil {
+		logger.Error(ctx, "failed to delete snapshot from database", "id", snapshot.Id, "error", err)
+	}
+}
+
+// Set snapshot ready, or error if handling failed
+func finishSnapshotHandling(ctx context.Context, conn db.Connection, snapshot *Snapshot, err error) {
+	state := db.StateReady
+	if err != nil {
+		logger.Debug(ctx, "setting snapshot state to error", "id", snapshot.Id, "cause", err)
+		state = db.StateError
+	}
+	id := snapshot.Id
+	utils.Retry(ctx, func(ctx context.Context) error {
+		// Re-read snapshot only if previous attempt failed
+		if snapshot == nil {
+			var err error
+			if snapshot, err = Snapshots(conn).Get(ctx, id); err != nil {
+				return err
+			}
+		}
+		snapshot.State = state
+		if err := Snapshots(conn).Update(ctx, snapshot, db.InitiatorSystem); err != nil {
+			logger.Error(ctx, "failed to change snapshot state", "id", id, "state", state, "error", err)
+			snapshot = nil
+			return err
+		}
+		return nil
+	})
+}
+
+// Set snapshot ready, or error if rollback failed, and release disk in the
+// same transaction
+func finishSnapshotRollback(ctx context.Context, conn db.Connection, id ulid.ULID, err error) {
+	state := db.StateReady
+	if err != nil {
+		logger.Debug(ctx, "setting snapshot state to error", "id", id, "cause", err)
+		state = db.StateError
+	}
+	err = utils.Retry(ctx, func(ctx context.Context) error {
+		snapshot, err := Snapshots(conn).Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		disk, err := Disks(conn).Get(ctx, snapshot.DiskId)
+		if err != nil {
+			return err
+		}
+		if err := SnapshotFSM.ChangeState(snapshot, state, db.InitiatorSystem); err != nil {
+			return err
+		}
+		txn := conn.NewTransaction()
+		txn.Update(ctx, snapshot)
+		SnapshotFSM.Notify(ctx, txn, snapshot)
+		if err := releaseHeldDisk(ctx, txn, disk); err != nil {
+			return err
+		}
+		_, err = txn.Commit(ctx)
+		return err
+	})
+	if err != nil {
+		logger.Error(ctx, "failed to finish snapshot rollback", "id", id, "state", state, "error", err)
+	}
+}
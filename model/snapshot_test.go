@@ -0,0 +1,117 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"testing"
+)
+
+func createSnapshot(t *testing.T, conn db.Connection, disk *Disk, name string) *Snapshot {
+	ctx := context.Background()
+	snapshot := Snapshots(conn).NewEntity()
+	snapshot.DiskId = disk.Id
+	snapshot.Name = name
+	if err := Snapshots(conn).Create(ctx, snapshot, db.InitiatorUser); err != nil {
+		t.Fatalf("failed to create snapshot %s: %s", name, err)
+	}
+	snapshot.State = db.StateReady
+	if err := Snapshots(conn).Update(ctx, snapshot, db.InitiatorSystem); err != nil {
+		t.Fatalf("failed to make snapshot ready: %s", err)
+	}
+	return snapshot
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+	project, _ := Projects(conn).Get(ctx, server.ProjectId)
+	disk := createDisk(t, conn, project)
+	other := createDisk(t, conn, project)
+	snapshot := createSnapshot(t, conn, disk, "first")
+	createSnapshot(t, conn, disk, "second")
+	createSnapshot(t, conn, other, "first")
+
+	snapshots, _, err := Snapshots(conn).List(ctx, &ListOptions{DiskId: disk.Id})
+	if err != nil || len(snapshots) != 2 {
+		t.Fatalf("unexpected snapshots of disk: %v (%v)", snapshots, err)
+	}
+	if found, err := Snapshots(conn).GetByName(ctx, other.Id, "first"); err != nil || found.DiskId != other.Id {
+		t.Fatalf("unexpected snapshot found by name: %v (%v)", found, err)
+	}
+	if _, _, err := Disks(conn).List(ctx, &ListOptions{DiskId: disk.Id}); err == nil {
+		t.Fatalf("disks filtered by disk")
+	}
+
+	err = Disks(conn).IntentDelete(ctx, other.Id, db.InitiatorUser)
+	if fieldErr, ok := err.(*db.FieldError); !ok || fieldErr.Field != "SnapshotIds" {
+		t.Fatalf("expected snapshots field error deleting disk, got %v", err)
+	}
+
+	snapshot, err = RollbackSnapshot(ctx, conn, snapshot.Id)
+	if err != nil || snapshot.State != db.StateRollingBack {
+		t.Fatalf("unexpected snapshot after rollback: %v (%v)", snapshot, err)
+	}
+	if _, err := RollbackSnapshot(ctx, conn, snapshot.Id); err == nil {
+		t.Fatalf("rollback accepted while previous one is in progress")
+	}
+	if disk, _ := Disks(conn).Get(ctx, disk.Id); disk.State != db.StateRollingBack {
+		t.Fatalf("disk not held by rollback: %v", disk)
+	}
+	setServerState(ctx, conn, server, db.StateReady)
+	server, _ = ServerAction(ctx, conn, server.Id, "stop")
+	setServerState(ctx, conn, server, db.StateStopped)
+	if _, err := AttachDisk(ctx, conn, server.Id, disk.Id); err == nil {
+		t.Fatalf("disk attached during rollback")
+	}
+	finishSnapshotRollback(ctx, conn, snapshot.Id, nil)
+	if disk, _ := Disks(conn).Get(ctx, disk.Id); disk.State != db.StateReady {
+		t.Fatalf("disk not released after rollback: %v", disk)
+	}
+
+	// Disk can be rolled back only while server using it is stopped
+	if _, err := AttachDisk(ctx, conn, server.Id, disk.Id); err != nil {
+		t.Fatalf("failed to attach disk: %s", err)
+	}
+	server, _ = Servers(conn).Get(ctx, server.Id)
+	if snapshot, err = RollbackSnapshot(ctx, conn, snapshot.Id); err != nil {
+		t.Fatalf("failed to rollback disk of stopped server: %s", err)
+	}
+	if _, err := ServerAction(WithExpectedRevisions(ctx, server.ModifyRev), conn, server.Id, "start"); err == nil {
+		t.Fatalf("server read before rollback started")
+	}
+	if _, err := ServerAction(ctx, conn, server.Id, "start"); err == nil {
+		t.Fatalf("server started during rollback")
+	}
+	if _, err := DetachDisk(ctx, conn, server.Id, disk.Id); err == nil {
+		t.Fatalf("disk detached during rollback")
+	}
+	finishSnapshotRollback(ctx, conn, snapshot.Id, nil)
+	if disk, _ := Disks(conn).Get(ctx, disk.Id); disk.State != db.StateInUse {
+		t.Fatalf("disk not released after rollback: %v", disk)
+	}
+	if _, err := ServerAction(ctx, conn, server.Id, "start"); err != nil {
+		t.Fatalf("failed to start server after rollback: %s", err)
+	}
+	if _, err := RollbackSnapshot(ctx, conn, snapshot.Id); err == nil {
+		t.Fatalf("rolled back disk of running server")
+	}
+}
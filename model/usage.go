@@ -0,0 +1,175 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/utils"
+	"github.com/oklog/ulid"
+	"sort"
+	"time"
+)
+
+// Usage events are kept after project is deleted, so it can still be billed
+var usagePrefix = db.MetaPrefix + "/usage/"
+
+const bytesPerGB = 1 << 30
+
+// Resources used by entity starting from Time until next event of the same
+// entity, deleted entity has zero usage
+type UsageEvent struct {
+	Time       time.Time
+	EntityName string
+	EntityId   ulid.ULID
+	FlavorId   ulid.ULID
+	Usage      Quota
+}
+
+type FlavorUsage struct {
+	FlavorId    ulid.ULID
+	ServerHours float64
+	CPUHours    float64
+	RAMHours    float64
+}
+
+type DiskSizeUsage struct {
+	Size      uint64
+	DiskHours float64
+	GBHours   float64
+}
+
+// Usage of project resources within [From, To), RAM is measured in
+// MiB-hours and disk sizes in gigabytes
+type UsageReport struct {
+	From        time.Time
+	To          time.Time
+	CPUHours    float64
+	RAMHours    float64
+	DiskGBHours float64
+	Flavors     []*FlavorUsage
+	Disks       []*DiskSizeUsage
+}
+
+func recordUsage(ctx context.Context, txn db.Transaction, entity db.Entity, usage Quota) error {
+	event := &UsageEvent{
+		Time:       time.Now().UTC(),
+		EntityName: entity.EntityName(),
+		EntityId:   entity.Header().Id,
+		Usage:      usage,
+	}
+	var projectId ulid.ULID
+	switch e := entity.(type) {
+	case *Server:
+		projectId = e.ProjectId
+		event.FlavorId = e.FlavorId
+	case *Disk:
+		projectId = e.ProjectId
+	default:
+		return &EntityTypeError{Expected: "Server or Disk", Actual: entity.EntityName()}
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%s/%s", usagePrefix, projectId, utils.NewULID())
+	txn.CreateMeta(ctx, key, string(data))
+	return nil
+}
+
+func ProjectUsage(ctx context.Context, conn db.Connection, projectId ulid.ULID, from, to time.Time) (*UsageReport, error) {
+	if !from.Before(to) {
+		return nil, &db.FieldError{Entity: "query", Field: "from", Message: "Should be before end of period"}
+	}
+	var events []*UsageEvent
+	_, err := scanPrefix(ctx, conn, fmt.Sprintf("%s%s/", usagePrefix, projectId), 0, func(value *db.RawValue) error {
+		event := &UsageEvent{}
+		if err := json.Unmarshal(value.Data, event); err != nil {
+			return err
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aggregateUsage(events, from, to), nil
+}
+
+// Integrate usage of every entity over time, usage of entity that has no
+// later event lasts until end of period
+func aggregateUsage(events []*UsageEvent, from, to time.Time) *UsageReport {
+	report := &UsageReport{From: from, To: to, Flavors: []*FlavorUsage{}, Disks: []*DiskSizeUsage{}}
+	byEntity := make(map[ulid.ULID][]*UsageEvent)
+	var entityIds []ulid.ULID
+	for _, event := range events {
+		if byEntity[event.EntityId] == nil {
+			entityIds = append(entityIds, event.EntityId)
+		}
+		byEntity[event.EntityId] = append(byEntity[event.EntityId], event)
+	}
+	flavors := make(map[ulid.ULID]*FlavorUsage)
+	disks := make(map[uint64]*DiskSizeUsage)
+	for _, id := range entityIds {
+		entityEvents := byEntity[id]
+		sort.SliceStable(entityEvents, func(i, j int) bool {
+			return entityEvents[i].Time.Before(entityEvents[j].Time)
+		})
+		for i, event := range entityEvents {
+			start, end := event.Time, to
+			if i+1 < len(entityEvents) && entityEvents[i+1].Time.Before(to) {
+				end = entityEvents[i+1].Time
+			}
+			if start.Before(from) {
+				start = from
+			}
+			if !start.Before(end) || event.Usage == (Quota{}) {
+				continue
+			}
+			hours := end.Sub(start).Hours()
+			switch event.EntityName {
+			case "Server":
+				usage := flavors[event.FlavorId]
+				if usage == nil {
+					usage = &FlavorUsage{FlavorId: event.FlavorId}
+					flavors[event.FlavorId] = usage
+					report.Flavors = append(report.Flavors, usage)
+				}
+				usage.ServerHours += hours * float64(event.Usage.Servers)
+				usage.CPUHours += hours * float64(event.Usage.CPUs)
+				usage.RAMHours += hours * float64(event.Usage.RAM)
+				report.CPUHours += hours * float64(event.Usage.CPUs)
+				report.RAMHours += hours * float64(event.Usage.RAM)
+			case "Disk":
+				usage := disks[event.Usage.DiskSize]
+				if usage == nil {
+					usage = &DiskSizeUsage{Size: event.Usage.DiskSize}
+					disks[event.Usage.DiskSize] = usage
+					report.Disks = append(report.Disks, usage)
+				}
+				gbHours := hours * float64(event.Usage.DiskSize) / bytesPerGB
+				usage.DiskHours += hours * float64(event.Usage.Disks)
+				usage.GBHours += gbHours
+				report.DiskGBHours += gbHours
+			}
+		}
+	}
+	return report
+}
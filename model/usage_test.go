@@ -0,0 +1,90 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/utils"
+	"testing"
+	"time"
+)
+
+func TestAggregateUsage(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time {
+		return start.Add(time.Duration(hours) * time.Hour)
+	}
+	serverId, diskId := utils.NewULID(), utils.NewULID()
+	small, large := utils.NewULID(), utils.NewULID()
+	events := []*UsageEvent{
+		// Deletion is recorded out of order to check sorting by time
+		{Time: at(10), EntityName: "Server", EntityId: serverId, FlavorId: large},
+		{Time: at(0), EntityName: "Server", EntityId: serverId, FlavorId: small, Usage: Quota{Servers: 1, CPUs: 1, RAM: 512}},
+		{Time: at(4), EntityName: "Server", EntityId: serverId, FlavorId: large, Usage: Quota{Servers: 1, CPUs: 4, RAM: 4096}},
+		{Time: at(2), EntityName: "Disk", EntityId: diskId, Usage: Quota{Disks: 1, DiskSize: 2 << 30}},
+	}
+	report := aggregateUsage(events, at(2), at(12))
+	if report.CPUHours != 2+24 || report.RAMHours != 2*512+6*4096 || report.DiskGBHours != 20 {
+		t.Fatalf("unexpected totals: %+v", report)
+	}
+	if len(report.Flavors) != 2 || len(report.Disks) != 1 {
+		t.Fatalf("unexpected groups: %v %v", report.Flavors, report.Disks)
+	}
+	for _, usage := range report.Flavors {
+		if (usage.FlavorId == small && usage.ServerHours != 2) || (usage.FlavorId == large && usage.ServerHours != 6) {
+			t.Fatalf("unexpected flavor usage: %+v", usage)
+		}
+	}
+	if disk := report.Disks[0]; disk.Size != 2<<30 || disk.DiskHours != 10 || disk.GBHours != 20 {
+		t.Fatalf("unexpected disk usage: %+v", disk)
+	}
+	if report := aggregateUsage(events, at(20), at(30)); report.CPUHours != 0 || report.DiskGBHours != 20 {
+		t.Fatalf("unexpected usage after server deletion: %+v", report)
+	}
+}
+
+func TestProjectUsage(t *testing.T) {
+	ctx := context.Background()
+	conn := memdb.NewConnection()
+	server := createServer(t, conn, "foo")
+	from := time.Now().UTC()
+	setServerState(ctx, conn, server, db.StateReady)
+	// Restarted server is still metered once
+	for _, step := range []struct {
+		action string
+		state  db.State
+	}{{"stop", db.StateStopped}, {"start", db.StateReady}} {
+		if server, err := ServerAction(ctx, conn, server.Id, step.action); err != nil {
+			t.Fatalf("failed to %s server: %s", step.action, err)
+		} else {
+			setServerState(ctx, conn, server, step.state)
+		}
+	}
+	report, err := ProjectUsage(ctx, conn, server.ProjectId, from, time.Now().UTC().Add(time.Hour))
+	if err != nil || len(report.Flavors) != 1 || report.Flavors[0].FlavorId != server.FlavorId {
+		t.Fatalf("unexpected usage report: %+v (%v)", report, err)
+	}
+	if usage := report.Flavors[0]; usage.ServerHours > 1.01 || usage.ServerHours < 0.99 || usage.CPUHours != usage.ServerHours {
+		t.Fatalf("unexpected flavor usage: %+v", usage)
+	}
+	if _, err := ProjectUsage(ctx, conn, server.ProjectId, from, from); err == nil {
+		t.Fatalf("usage reported for empty period")
+	}
+}
@@ -19,55 +19,33 @@ package model
 
 import (
 	"context"
+	"github.com/antonf/minicloud/config"
 	"github.com/antonf/minicloud/db"
 	"github.com/antonf/minicloud/log"
+	"github.com/antonf/minicloud/utils"
 	"github.com/oklog/ulid"
 	"strings"
 	"sync"
-)
-
-var (
-	entityGetters = map[string]func(context.Context, db.Connection, ulid.ULID) (db.Entity, error){
-		"project": func(ctx context.Context, conn db.Connection, id ulid.ULID) (db.Entity, error) {
-			return Projects(conn).Get(ctx, id)
-		},
-		"image": func(ctx context.Context, conn db.Connection, id ulid.ULID) (db.Entity, error) {
-			return Images(conn).Get(ctx, id)
-		},
-		"disk": func(ctx context.Context, conn db.Connection, id ulid.ULID) (db.Entity, error) {
-			return Disks(conn).Get(ctx, id)
-		},
-		"server": func(ctx context.Context, conn db.Connection, id ulid.ULID) (db.Entity, error) {
-			return Servers(conn).Get(ctx, id)
-		},
-	}
+	"time"
 )
 
 const prefix = db.MetaPrefix + "/notify-fsm/"
 
-func getStateMachine(name string) *StateMachine {
-	switch name {
-	case "disk":
-		return DiskFSM
-	case "server":
-		return ServerFSM
-	case "image":
-		return ImageFSM
-	default:
-		return nil
-	}
-}
+// Maximum number of times lock retry interval is doubled
+const maxLockRetryShift = 6
+
+var OptLockRetryInterval = config.NewDurationOpt("lock_retry_interval", time.Second)
 
 func WatchNotifications(ctx context.Context, conn db.Connection) error {
-	notifyCh := conn.RawWatchPrefix(ctx, prefix)
-	notifications, err := conn.RawReadPrefix(ctx, prefix)
-	if err != nil {
-		logger.Error(ctx, "failed to read notifications", "error", err)
-		return err
+	eventCh := conn.RawListWatchPrefix(ctx, prefix)
+	initial := <-eventCh
+	if initial == nil {
+		logger.Error(ctx, "failed to read notifications")
+		return utils.ErrInterrupted
 	}
 	watcher := &watcher{
-		initial:  notifications,
-		notifyCh: notifyCh,
+		initial:  initial,
+		eventCh:  eventCh,
 		interest: make(map[string]ulid.ULID),
 	}
 	worker := &worker{
@@ -80,48 +58,53 @@ func WatchNotifications(ctx context.Context, conn db.Connection) error {
 }
 
 type watcher struct {
-	initial  []db.RawValue
-	notifyCh chan *db.RawValue
-	minRev   int64
+	initial  *db.WatchEvent
+	eventCh  chan *db.WatchEvent
 	interest map[string]ulid.ULID
 }
 
 func (w *watcher) watch(ctx context.Context, wrk *worker) {
-	for i := range w.initial {
-		w.handleRawValue(ctx, wrk, &w.initial[i], true)
-	}
-	for {
-		select {
-		case rv := <-w.notifyCh:
-			if rv == nil {
-				logger.Info(ctx, "stopping to watch state change notifications")
-				return
-			}
-			w.handleRawValue(ctx, wrk, rv, false)
+	w.handleSnapshot(ctx, wrk, w.initial)
+	for event := range w.eventCh {
+		if event.Snapshot {
+			w.handleSnapshot(ctx, wrk, event)
+			continue
+		}
+		for i := range event.Values {
+			w.handleRawValue(ctx, wrk, &event.Values[i])
 		}
 	}
+	logger.Info(ctx, "stopping to watch state change notifications")
 }
 
-func (w *watcher) handleRawValue(ctx context.Context, wrk *worker, rv *db.RawValue, force bool) {
-	if !force && rv.ModifyRev < w.minRev {
-		logger.Notice(ctx, "skipping stale notification",
-			"key", rv.Key, "rev", rv.ModifyRev, "min_rev", w.minRev)
-		return
+func (w *watcher) handleSnapshot(ctx context.Context, wrk *worker, event *db.WatchEvent) {
+	// Forget notifications removed while watch was interrupted
+	present := make(map[string]bool)
+	for i := range event.Values {
+		present[event.Values[i].Key] = true
 	}
-	if rv.ModifyRev > w.minRev {
-		w.minRev = rv.ModifyRev
+	for key := range w.interest {
+		if !present[key] {
+			wrk.remove(key)
+			delete(w.interest, key)
+		}
+	}
+	for i := range event.Values {
+		w.handleRawValue(ctx, wrk, &event.Values[i])
 	}
+}
 
+func (w *watcher) handleRawValue(ctx context.Context, wrk *worker, rv *db.RawValue) {
 	if strings.HasSuffix(rv.Key, "/lock") {
 		// Handle notification lock
+		key := rv.Key[:len(rv.Key)-5]
 		if rv.Data != nil {
 			// Lock acquired
 			logger.Debug(ctx, "got lock", "key", rv.Key)
-			wrk.remove(rv.Key)
+			wrk.remove(key)
 		} else {
 			// Lock released
 			logger.Debug(ctx, "released lock", "key", rv.Key)
-			key := rv.Key[:len(rv.Key)-5]
 			if notificationId, ok := w.interest[key]; ok {
 				wrk.enqueue(key, notificationId)
 			}
@@ -147,8 +130,9 @@ func (w *watcher) handleRawValue(ctx context.Context, wrk *worker, rv *db.RawVal
 }
 
 type job struct {
-	id  ulid.ULID
-	key string
+	id      ulid.ULID
+	key     string
+	retries int
 }
 
 type worker struct {
@@ -172,13 +156,23 @@ func (wrk *worker) remove(key string) {
 }
 
 func (wrk *worker) enqueue(key string, notificationId ulid.ULID) {
-	newJob := &job{id: notificationId, key: key}
+	wrk.enqueueJob(&job{id: notificationId, key: key})
+}
+
+func (wrk *worker) enqueueJob(newJob *job) {
+	key := newJob.key
 	select {
 	case wrk.workerCh <- newJob:
 		return
 	default:
 		wrk.Lock()
 		defer wrk.Unlock()
+		for idx, unlockedJob := range wrk.unlocked {
+			if key == unlockedJob.key {
+				wrk.unlocked[idx] = newJob
+				return
+			}
+		}
 		wrk.unlocked = append(wrk.unlocked, newJob)
 	}
 }
@@ -234,12 +228,31 @@ func (wrk *worker) processJob(ctx context.Context, job *job) {
 		return
 	}
 
-	if getter, ok := entityGetters[entityName]; ok {
-		if !wrk.lock(ctx, job) {
+	if manager := GetManager(wrk.conn, entityName); manager != nil {
+		session := wrk.conn.Session()
+		if err := wrk.lock(ctx, session, job); err != nil {
+			// Lost compare means notification was changed or is handled by
+			// other worker, otherwise job would be lost until relist
+			if _, ok := err.(*db.ConflictError); !ok {
+				wrk.retry(ctx, job, err)
+			}
 			return
 		}
-		defer wrk.unlock(ctx, job)
-		entity, err := getter(ctx, wrk.conn, id)
+		defer wrk.unlock(ctx, session, job)
+
+		// Stop hook if lock is lost together with session
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-session.Done():
+				logger.Warn(ctx, "session lost, cancelling state handling", "key", job.key)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		entity, err := manager.Get(ctx, id)
 		if err != nil {
 			logger.Error(ctx, "failed to get entity",
 				"entity_name", entityName,
@@ -256,7 +269,7 @@ func (wrk *worker) processJob(ctx context.Context, job *job) {
 				"error", err)
 			return
 		}
-		if stateMachine := getStateMachine(entityName); stateMachine != nil {
+		if stateMachine := manager.StateMachine(); stateMachine != nil {
 			stateMachine.InvokeHook(ctx, wrk.conn, entity)
 		} else {
 			logger.Error(ctx, "no machine for entity", "entity_name", entityName)
@@ -265,21 +278,49 @@ func (wrk *worker) processJob(ctx context.Context, job *job) {
 }
 
 // acquire lock in etcd
-func (wrk *worker) lock(ctx context.Context, job *job) bool {
+func (wrk *worker) lock(ctx context.Context, session db.Session, job *job) error {
 	tx := wrk.conn.NewTransaction()
 	tx.CheckMeta(ctx, job.key, job.id.String())
-	tx.AcquireLock(ctx, job.key+"/lock")
-	if err := tx.Commit(ctx); err != nil {
-		return false
+	tx.AcquireLock(ctx, session, job.key+"/lock")
+	_, err := tx.Commit(ctx)
+	return err
+}
+
+// enqueue job again after interval doubled with each retry, e.g. while
+// session is being re-granted
+func (wrk *worker) retry(ctx context.Context, failed *job, err error) {
+	shift := failed.retries
+	if shift > maxLockRetryShift {
+		shift = maxLockRetryShift
 	}
-	return true
+	delay := OptLockRetryInterval.Value() << uint(shift)
+	logger.Warn(ctx, "failed to acquire lock, retrying", "key", failed.key, "delay", delay, "error", err)
+	retried := &job{id: failed.id, key: failed.key, retries: failed.retries + 1}
+	time.AfterFunc(delay, func() {
+		// Newer notification for the same key supersedes retried one
+		wrk.Lock()
+		for _, pending := range wrk.unlocked {
+			if pending.key == retried.key {
+				wrk.Unlock()
+				return
+			}
+		}
+		wrk.Unlock()
+		wrk.enqueueJob(retried)
+	})
 }
 
-// release lock in etcd, crash process on release failure
-func (wrk *worker) unlock(ctx context.Context, job *job) {
+// release lock in etcd, crash process on release failure unless lock was
+// already released together with session
+func (wrk *worker) unlock(ctx context.Context, session db.Session, job *job) {
 	tx := wrk.conn.NewTransaction()
-	tx.ReleaseLock(ctx, job.key+"/lock")
-	if err := tx.Commit(ctx); err != nil {
-		logger.Fatal(ctx, "failed to release lock", "key", job.key+"/lock")
+	tx.ReleaseLock(ctx, session, job.key+"/lock")
+	if _, err := tx.Commit(ctx); err != nil {
+		select {
+		case <-session.Done():
+			logger.Warn(ctx, "lock lost together with session", "key", job.key+"/lock")
+		default:
+			logger.Fatal(ctx, "failed to release lock", "key", job.key+"/lock")
+		}
 	}
 }
@@ -0,0 +1,76 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package model
+
+import (
+	"context"
+	"github.com/antonf/minicloud/db"
+	"github.com/antonf/minicloud/db/memdb"
+	"github.com/antonf/minicloud/utils"
+	"testing"
+	"time"
+)
+
+// Hands out session which was revoked, like connection does while session is
+// being re-granted
+type revokedSessionConnection struct {
+	db.Connection
+	session db.Session
+}
+
+func (c *revokedSessionConnection) Session() db.Session {
+	return c.session
+}
+
+func TestWatcherLockRetry(t *testing.T) {
+	ctx := context.Background()
+	store := memdb.NewStore()
+	conn := store.NewConnection()
+	session := conn.Session()
+	store.RevokeLease(conn)
+
+	key := prefix + "image/" + utils.NewULID().String() + "/deleting"
+	notificationId := utils.NewULID()
+	txn := conn.NewTransaction()
+	txn.CreateMeta(ctx, key, notificationId.String())
+	if _, err := txn.Commit(ctx); err != nil {
+		t.Fatalf("failed to create notification: %s", err)
+	}
+	wrk := &worker{
+		conn:     &revokedSessionConnection{Connection: conn, session: session},
+		workerCh: make(chan *job, 1),
+	}
+	wrk.processJob(ctx, &job{id: notificationId, key: key})
+	select {
+	case retried := <-wrk.workerCh:
+		if retried.key != key || retried.id != notificationId || retried.retries != 1 {
+			t.Fatalf("unexpected retried job: %+v", retried)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job not retried after lock failure")
+	}
+
+	// Job of changed notification is dropped
+	wrk.conn = conn
+	wrk.processJob(ctx, &job{id: utils.NewULID(), key: key})
+	select {
+	case retried := <-wrk.workerCh:
+		t.Fatalf("job retried after lost compare: %+v", retried)
+	case <-time.After(2 * OptLockRetryInterval.Value()):
+	}
+}
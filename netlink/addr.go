@@ -0,0 +1,123 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package netlink
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+type Addr struct {
+	Index int
+	// Address with prefix length, like 10.0.0.1/24
+	IPNet *net.IPNet
+}
+
+func ipFamily(ip net.IP) uint8 {
+	if ip.To4() != nil {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+// Address bytes of length matching its family
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+func ipNet(ip net.IP, prefixLen int) *net.IPNet {
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLen, len(ip)*8)}
+}
+
+func decodeAddr(msg *Message) (*Addr, error) {
+	var header syscall.IfAddrmsg
+	attrs, err := msg.Decode(&header)
+	if err != nil {
+		return nil, err
+	}
+	// Local is address of interface, for point-to-point links address is
+	// one of peer
+	attr := FindAttr(attrs, syscall.IFA_LOCAL)
+	if attr == nil {
+		attr = FindAttr(attrs, syscall.IFA_ADDRESS)
+	}
+	if attr == nil {
+		return nil, syscall.EINVAL
+	}
+	ip := net.IP(attr.Value)
+	return &Addr{Index: int(header.Index), IPNet: ipNet(ip, int(header.Prefixlen))}, nil
+}
+
+// Addresses of given family, or of any if it's syscall.AF_UNSPEC, assigned to
+// link or to all links if index is zero
+func (s *Socket) AddrList(ctx context.Context, family, index int) ([]*Addr, error) {
+	msgs, err := s.Execute(ctx, &Request{
+		Type:   syscall.RTM_GETADDR,
+		Flags:  syscall.NLM_F_DUMP,
+		Header: syscall.IfAddrmsg{Family: uint8(family)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*Addr
+	for i := range msgs {
+		if msgs[i].Type != syscall.RTM_NEWADDR {
+			continue
+		}
+		addr, err := decodeAddr(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		if index == 0 || addr.Index == index {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+func addrRequest(addr *Addr, msgType, flags uint16) *Request {
+	prefixLen, _ := addr.IPNet.Mask.Size()
+	ip := ipBytes(addr.IPNet.IP)
+	return &Request{
+		Type:  msgType,
+		Flags: flags,
+		Header: syscall.IfAddrmsg{
+			Family:    ipFamily(addr.IPNet.IP),
+			Prefixlen: uint8(prefixLen),
+			Index:     uint32(addr.Index),
+		},
+		Attrs: []Attr{
+			BytesAttr(syscall.IFA_LOCAL, ip),
+			BytesAttr(syscall.IFA_ADDRESS, ip),
+		},
+	}
+}
+
+func (s *Socket) AddrAdd(ctx context.Context, addr *Addr) error {
+	_, err := s.Execute(ctx, addrRequest(addr, syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL))
+	return err
+}
+
+func (s *Socket) AddrDel(ctx context.Context, addr *Addr) error {
+	_, err := s.Execute(ctx, addrRequest(addr, syscall.RTM_DELADDR, 0))
+	return err
+}
@@ -0,0 +1,157 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package netlink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+)
+
+// Attribute types have flag bits, which are stripped when decoding
+const attrTypeMask = 0x3fff
+
+// Route attribute, nested attributes are encoded from Children instead of
+// Value. Decoded attributes have only Value, use Nested to parse it.
+type Attr struct {
+	Type     uint16
+	Value    []byte
+	Children []Attr
+}
+
+func BytesAttr(attrType uint16, value []byte) Attr {
+	return Attr{Type: attrType, Value: value}
+}
+
+func StringAttr(attrType uint16, value string) Attr {
+	return Attr{Type: attrType, Value: append([]byte(value), 0)}
+}
+
+func Uint8Attr(attrType uint16, value uint8) Attr {
+	return Attr{Type: attrType, Value: []byte{value}}
+}
+
+func Uint16Attr(attrType uint16, value uint16) Attr {
+	data := make([]byte, 2)
+	nativeOrder.PutUint16(data, value)
+	return Attr{Type: attrType, Value: data}
+}
+
+// Some attributes, like ports, are in network byte order
+func BigEndianUint16Attr(attrType uint16, value uint16) Attr {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return Attr{Type: attrType, Value: data}
+}
+
+func Uint32Attr(attrType uint16, value uint32) Attr {
+	data := make([]byte, 4)
+	nativeOrder.PutUint32(data, value)
+	return Attr{Type: attrType, Value: data}
+}
+
+func NestedAttr(attrType uint16, children ...Attr) Attr {
+	if children == nil {
+		children = []Attr{}
+	}
+	return Attr{Type: attrType, Children: children}
+}
+
+func (a *Attr) Uint8() uint8 {
+	if len(a.Value) < 1 {
+		return 0
+	}
+	return a.Value[0]
+}
+
+func (a *Attr) Uint16() uint16 {
+	if len(a.Value) < 2 {
+		return 0
+	}
+	return nativeOrder.Uint16(a.Value)
+}
+
+func (a *Attr) Uint32() uint32 {
+	if len(a.Value) < 4 {
+		return 0
+	}
+	return nativeOrder.Uint32(a.Value)
+}
+
+func (a *Attr) String() string {
+	return string(bytes.TrimRight(a.Value, "\x00"))
+}
+
+func (a *Attr) Nested() ([]Attr, error) {
+	return ParseAttrs(a.Value)
+}
+
+// First attribute of given type, nil if there is none
+func FindAttr(attrs []Attr, attrType uint16) *Attr {
+	for i := range attrs {
+		if attrs[i].Type == attrType {
+			return &attrs[i]
+		}
+	}
+	return nil
+}
+
+func encodeAttrs(buf *bytes.Buffer, attrs []Attr) {
+	for _, attr := range attrs {
+		value, attrType := attr.Value, attr.Type
+		if attr.Children != nil {
+			nested := bytes.Buffer{}
+			encodeAttrs(&nested, attr.Children)
+			value, attrType = nested.Bytes(), attrType|syscall.NLA_F_NESTED
+		}
+		length := syscall.SizeofRtAttr + len(value)
+		binary.Write(buf, nativeOrder, syscall.RtAttr{Len: uint16(length), Type: attrType})
+		buf.Write(value)
+		alignBuffer(buf)
+	}
+}
+
+func ParseAttrs(data []byte) ([]Attr, error) {
+	var attrs []Attr
+	for len(data) >= syscall.SizeofRtAttr {
+		length := int(nativeOrder.Uint16(data[0:2]))
+		if length < syscall.SizeofRtAttr || length > len(data) {
+			return nil, syscall.EINVAL
+		}
+		attrs = append(attrs, Attr{
+			Type:  nativeOrder.Uint16(data[2:4]) & attrTypeMask,
+			Value: data[syscall.SizeofRtAttr:length],
+		})
+		if aligned := align(length); aligned < len(data) {
+			data = data[aligned:]
+		} else {
+			break
+		}
+	}
+	return attrs, nil
+}
+
+func align(length int) int {
+	return (length + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+}
+
+func alignBuffer(buf *bytes.Buffer) {
+	for buf.Len()%syscall.NLMSG_ALIGNTO != 0 {
+		buf.WriteByte(0)
+	}
+}
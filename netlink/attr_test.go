@@ -0,0 +1,57 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package netlink
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+)
+
+func TestAttrs(t *testing.T) {
+	buf := bytes.Buffer{}
+	encodeAttrs(&buf, []Attr{
+		StringAttr(1, "foo"),
+		NestedAttr(2, Uint32Attr(3, 42), BigEndianUint16Attr(4, 4789)),
+		Uint8Attr(5, 7),
+	})
+	if buf.Len()%syscall.NLMSG_ALIGNTO != 0 {
+		t.Fatalf("attributes not aligned: %d bytes", buf.Len())
+	}
+	attrs, err := ParseAttrs(buf.Bytes())
+	if err != nil || len(attrs) != 3 {
+		t.Fatalf("unexpected attributes: %v (%v)", attrs, err)
+	}
+	if attrs[0].Type != 1 || attrs[0].String() != "foo" {
+		t.Fatalf("unexpected string attribute: %v", attrs[0])
+	}
+	// Nested flag is stripped from type
+	if attrs[1].Type != 2 || attrs[2].Uint8() != 7 {
+		t.Fatalf("unexpected attributes: %v", attrs)
+	}
+	nested, err := attrs[1].Nested()
+	if err != nil || FindAttr(nested, 3).Uint32() != 42 || !bytes.Equal(FindAttr(nested, 4).Value, []byte{0x12, 0xb5}) {
+		t.Fatalf("unexpected nested attributes: %v (%v)", nested, err)
+	}
+	if FindAttr(nested, 5) != nil {
+		t.Fatalf("found missing attribute")
+	}
+	if _, err := ParseAttrs([]byte{0xff, 0, 1, 0}); err == nil {
+		t.Fatalf("parsed attribute longer than data")
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package netlink
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// Nested in IFLA_LINKINFO, not defined by syscall package
+const (
+	IFLA_INFO_KIND = 1
+	IFLA_INFO_DATA = 2
+)
+
+// Nested in IFLA_INFO_DATA of vlan links
+const IFLA_VLAN_ID = 1
+
+// Nested in IFLA_INFO_DATA of vxlan links, port is big endian
+const (
+	IFLA_VXLAN_ID    = 1
+	IFLA_VXLAN_GROUP = 2
+	IFLA_VXLAN_LINK  = 3
+	IFLA_VXLAN_LOCAL = 4
+	IFLA_VXLAN_PORT  = 15
+)
+
+type Link struct {
+	Index        int
+	Name         string
+	Flags        uint32
+	MTU          int
+	Master       int
+	HardwareAddr net.HardwareAddr
+	// Lower device, like physical interface of VLAN
+	ParentIndex int
+	// Kind and kind specific IFLA_INFO_DATA attributes, like "bridge"
+	Kind string
+	Data []Attr
+}
+
+func (l *Link) IsUp() bool {
+	return l.Flags&syscall.IFF_UP != 0
+}
+
+func decodeLink(msg *Message) (*Link, error) {
+	var header syscall.IfInfomsg
+	attrs, err := msg.Decode(&header)
+	if err != nil {
+		return nil, err
+	}
+	link := &Link{Index: int(header.Index), Flags: header.Flags}
+	for i := range attrs {
+		attr := &attrs[i]
+		switch attr.Type {
+		case syscall.IFLA_IFNAME:
+			link.Name = attr.String()
+		case syscall.IFLA_MTU:
+			link.MTU = int(attr.Uint32())
+		case syscall.IFLA_MASTER:
+			link.Master = int(attr.Uint32())
+		case syscall.IFLA_LINK:
+			link.ParentIndex = int(attr.Uint32())
+		case syscall.IFLA_ADDRESS:
+			link.HardwareAddr = net.HardwareAddr(attr.Value)
+		case syscall.IFLA_LINKINFO:
+			info, err := attr.Nested()
+			if err != nil {
+				return nil, err
+			}
+			if kind := FindAttr(info, IFLA_INFO_KIND); kind != nil {
+				link.Kind = kind.String()
+			}
+			if data := FindAttr(info, IFLA_INFO_DATA); data != nil {
+				if link.Data, err = data.Nested(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return link, nil
+}
+
+func (s *Socket) LinkList(ctx context.Context) ([]*Link, error) {
+	msgs, err := s.Execute(ctx, &Request{
+		Type:   syscall.RTM_GETLINK,
+		Flags:  syscall.NLM_F_DUMP,
+		Header: syscall.IfInfomsg{Family: syscall.AF_UNSPEC},
+	})
+	if err != nil {
+		return nil, err
+	}
+	links := make([]*Link, 0, len(msgs))
+	for i := range msgs {
+		if msgs[i].Type != syscall.RTM_NEWLINK {
+			continue
+		}
+		link, err := decodeLink(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// Returns ENODEV if there is no such link
+func (s *Socket) LinkGet(ctx context.Context, name string) (*Link, error) {
+	msgs, err := s.Execute(ctx, &Request{
+		Type:   syscall.RTM_GETLINK,
+		Header: syscall.IfInfomsg{Family: syscall.AF_UNSPEC},
+		Attrs:  []Attr{StringAttr(syscall.IFLA_IFNAME, name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, syscall.EINVAL
+	}
+	return decodeLink(&msgs[0])
+}
+
+// Create link from Name, Kind and optional attributes, setting its Index.
+// Returns EEXIST if link with the same name exists.
+func (s *Socket) LinkAdd(ctx context.Context, link *Link) error {
+	header := syscall.IfInfomsg{Family: syscall.AF_UNSPEC}
+	if link.IsUp() {
+		header.Flags, header.Change = syscall.IFF_UP, syscall.IFF_UP
+	}
+	attrs := []Attr{StringAttr(syscall.IFLA_IFNAME, link.Name)}
+	if link.MTU != 0 {
+		attrs = append(attrs, Uint32Attr(syscall.IFLA_MTU, uint32(link.MTU)))
+	}
+	if link.Master != 0 {
+		attrs = append(attrs, Uint32Attr(syscall.IFLA_MASTER, uint32(link.Master)))
+	}
+	if link.ParentIndex != 0 {
+		attrs = append(attrs, Uint32Attr(syscall.IFLA_LINK, uint32(link.ParentIndex)))
+	}
+	if link.HardwareAddr != nil {
+		attrs = append(attrs, BytesAttr(syscall.IFLA_ADDRESS, link.HardwareAddr))
+	}
+	info := []Attr{StringAttr(IFLA_INFO_KIND, link.Kind)}
+	if link.Data != nil {
+		info = append(info, NestedAttr(IFLA_INFO_DATA, link.Data...))
+	}
+	attrs = append(attrs, NestedAttr(syscall.IFLA_LINKINFO, info...))
+	if _, err := s.Execute(ctx, &Request{
+		Type:   syscall.RTM_NEWLINK,
+		Flags:  syscall.NLM_F_CREATE | syscall.NLM_F_EXCL,
+		Header: header,
+		Attrs:  attrs,
+	}); err != nil {
+		return err
+	}
+	created, err := s.LinkGet(ctx, link.Name)
+	if err != nil {
+		return err
+	}
+	link.Index = created.Index
+	return nil
+}
+
+func (s *Socket) LinkDel(ctx context.Context, index int) error {
+	_, err := s.Execute(ctx, &Request{
+		Type:   syscall.RTM_DELLINK,
+		Header: syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(index)},
+	})
+	return err
+}
+
+func (s *Socket) LinkSetUp(ctx context.Context, index int, up bool) error {
+	header := syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(index), Change: syscall.IFF_UP}
+	if up {
+		header.Flags = syscall.IFF_UP
+	}
+	_, err := s.Execute(ctx, &Request{Type: syscall.RTM_NEWLINK, Header: header})
+	return err
+}
+
+// Zero master index detaches link from its master
+func (s *Socket) LinkSetMaster(ctx context.Context, index, master int) error {
+	_, err := s.Execute(ctx, &Request{
+		Type:   syscall.RTM_NEWLINK,
+		Header: syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(index)},
+		Attrs:  []Attr{Uint32Attr(syscall.IFLA_MASTER, uint32(master))},
+	})
+	return err
+}
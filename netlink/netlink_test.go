@@ -0,0 +1,206 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package netlink_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonf/minicloud/netlink"
+	"github.com/antonf/minicloud/netlink/nettest"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func openNetns(t *testing.T) *netlink.Socket {
+	nettest.EnterNetns(t)
+	s, err := netlink.Open()
+	if err != nil {
+		t.Fatalf("failed to open netlink socket: %s", err)
+	}
+	return s
+}
+
+func TestLinks(t *testing.T) {
+	s := openNetns(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	bridge := &netlink.Link{Name: "brtest", Kind: "bridge", Flags: syscall.IFF_UP}
+	if err := s.LinkAdd(ctx, bridge); err != nil || bridge.Index == 0 {
+		t.Fatalf("failed to create bridge: %v (%d)", err, bridge.Index)
+	}
+	if err := s.LinkAdd(ctx, &netlink.Link{Name: "brtest", Kind: "bridge"}); err != syscall.EEXIST {
+		t.Fatalf("expected EEXIST creating duplicate bridge, got %v", err)
+	}
+	vxlan := &netlink.Link{Name: "vxtest", Kind: "vxlan", MTU: 1400, Data: []netlink.Attr{
+		netlink.Uint32Attr(netlink.IFLA_VXLAN_ID, 42),
+		netlink.BigEndianUint16Attr(netlink.IFLA_VXLAN_PORT, 4789),
+	}}
+	if err := s.LinkAdd(ctx, vxlan); err != nil {
+		t.Fatalf("failed to create vxlan: %s", err)
+	}
+	if err := s.LinkSetMaster(ctx, vxlan.Index, bridge.Index); err != nil {
+		t.Fatalf("failed to attach vxlan to bridge: %s", err)
+	}
+	if err := s.LinkSetUp(ctx, vxlan.Index, true); err != nil {
+		t.Fatalf("failed to bring vxlan up: %s", err)
+	}
+
+	link, err := s.LinkGet(ctx, "vxtest")
+	if err != nil {
+		t.Fatalf("failed to get vxlan: %s", err)
+	}
+	if link.Index != vxlan.Index || link.Kind != "vxlan" || link.MTU != 1400 || link.Master != bridge.Index || !link.IsUp() {
+		t.Fatalf("unexpected vxlan link: %+v", link)
+	}
+	if id := netlink.FindAttr(link.Data, netlink.IFLA_VXLAN_ID); id == nil || id.Uint32() != 42 {
+		t.Fatalf("unexpected vxlan data: %v", link.Data)
+	}
+	if len(link.HardwareAddr) != 6 {
+		t.Fatalf("unexpected vxlan address: %s", link.HardwareAddr)
+	}
+	if _, err := s.LinkGet(ctx, "missing"); err != syscall.ENODEV {
+		t.Fatalf("expected ENODEV getting missing link, got %v", err)
+	}
+
+	if err := s.LinkDel(ctx, vxlan.Index); err != nil {
+		t.Fatalf("failed to delete vxlan: %s", err)
+	}
+	if _, err := s.LinkGet(ctx, "vxtest"); err != syscall.ENODEV {
+		t.Fatalf("vxlan still exists after delete: %v", err)
+	}
+}
+
+func TestLinkDump(t *testing.T) {
+	s := openNetns(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	// Enough links so dump doesn't fit into single receive buffer
+	const count = 64
+	for i := 0; i < count; i++ {
+		if err := s.LinkAdd(ctx, &netlink.Link{Name: fmt.Sprintf("br%d", i), Kind: "bridge"}); err != nil {
+			t.Fatalf("failed to create bridge: %s", err)
+		}
+	}
+	links, err := s.LinkList(ctx)
+	if err != nil {
+		t.Fatalf("failed to list links: %s", err)
+	}
+	seen := make(map[string]bool)
+	for _, link := range links {
+		seen[link.Name] = true
+	}
+	if len(links) != count+1 || !seen["lo"] || !seen["br0"] || !seen[fmt.Sprintf("br%d", count-1)] {
+		t.Fatalf("unexpected links listed: %v", seen)
+	}
+	// Socket is usable after dump
+	if _, err := s.LinkGet(ctx, "lo"); err != nil {
+		t.Fatalf("failed to get link after dump: %s", err)
+	}
+}
+
+func TestAddrsAndRoutes(t *testing.T) {
+	s := openNetns(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	bridge := &netlink.Link{Name: "brtest", Kind: "bridge", Flags: syscall.IFF_UP}
+	if err := s.LinkAdd(ctx, bridge); err != nil {
+		t.Fatalf("failed to create bridge: %s", err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/24")
+	addr := &netlink.Addr{Index: bridge.Index, IPNet: &net.IPNet{IP: net.ParseIP("10.1.0.1"), Mask: subnet.Mask}}
+	if err := s.AddrAdd(ctx, addr); err != nil {
+		t.Fatalf("failed to add address: %s", err)
+	}
+	addrs, err := s.AddrList(ctx, syscall.AF_INET, bridge.Index)
+	if err != nil || len(addrs) != 1 || addrs[0].IPNet.String() != "10.1.0.1/24" {
+		t.Fatalf("unexpected addresses: %v (%v)", addrs, err)
+	}
+
+	_, dst, _ := net.ParseCIDR("10.2.0.0/16")
+	route := &netlink.Route{Dst: dst, Gateway: net.ParseIP("10.1.0.254")}
+	if err := s.RouteAdd(ctx, route); err != nil {
+		t.Fatalf("failed to add route: %s", err)
+	}
+	findRoute := func() *netlink.Route {
+		routes, err := s.RouteList(ctx, syscall.AF_INET)
+		if err != nil {
+			t.Fatalf("failed to list routes: %s", err)
+		}
+		for _, r := range routes {
+			if r.Dst != nil && r.Dst.String() == "10.2.0.0/16" {
+				return r
+			}
+		}
+		return nil
+	}
+	found := findRoute()
+	if found == nil || !found.Gateway.Equal(route.Gateway) || found.OutIndex != bridge.Index || found.Table != syscall.RT_TABLE_MAIN {
+		t.Fatalf("unexpected route: %+v", found)
+	}
+	if err := s.RouteDel(ctx, route); err != nil {
+		t.Fatalf("failed to delete route: %s", err)
+	}
+	if found := findRoute(); found != nil {
+		t.Fatalf("route still exists after delete: %+v", found)
+	}
+
+	if err := s.AddrDel(ctx, addr); err != nil {
+		t.Fatalf("failed to delete address: %s", err)
+	}
+	if addrs, err := s.AddrList(ctx, syscall.AF_INET, bridge.Index); err != nil || len(addrs) != 0 {
+		t.Fatalf("unexpected addresses after delete: %v (%v)", addrs, err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := openNetns(t)
+	defer s.Close()
+	listener, err := netlink.Open()
+	if err != nil {
+		t.Fatalf("failed to open netlink socket: %s", err)
+	}
+	defer listener.Close()
+	if err := listener.Subscribe(netlink.RTNLGRP_LINK); err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.LinkAdd(ctx, &netlink.Link{Name: "brtest", Kind: "bridge"}); err != nil {
+		t.Fatalf("failed to create bridge: %s", err)
+	}
+	for {
+		msgs, err := listener.Receive(ctx)
+		if err != nil {
+			t.Fatalf("no link notification received: %s", err)
+		}
+		for i := range msgs {
+			if msgs[i].Type != syscall.RTM_NEWLINK || msgs[i].Seq != 0 {
+				continue
+			}
+			if link, err := netlink.DecodeLink(&msgs[i]); err == nil && link.Name == "brtest" && link.Kind == "bridge" {
+				return
+			}
+		}
+	}
+}
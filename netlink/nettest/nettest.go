@@ -0,0 +1,77 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package nettest
+
+import (
+	"context"
+	"github.com/antonf/minicloud/netlink"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// Run test in throwaway network namespace, thread is never unlocked, so it's
+// destroyed together with namespace when test finishes
+func EnterNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespace requires root")
+	}
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		t.Skipf("failed to create network namespace: %s", err)
+	}
+}
+
+// TAP device attached to bridge and brought up, frames read from it are ones
+// guest would get
+func OpenTap(t *testing.T, name, bridge string) *os.File {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("failed to open tun device: %s", err)
+	}
+	if name, err = netlink.SetTapIface(uintptr(fd), name); err != nil {
+		syscall.Close(fd)
+		t.Fatalf("failed to create tap: %s", err)
+	}
+	// Device is pollable only once it's attached to interface, so file is
+	// created after that to support read deadline
+	file := os.NewFile(uintptr(fd), name)
+
+	ctx := context.Background()
+	s, err := netlink.Open()
+	if err != nil {
+		t.Fatalf("failed to open netlink socket: %s", err)
+	}
+	defer s.Close()
+	tap, err := s.LinkGet(ctx, name)
+	if err != nil {
+		t.Fatalf("failed to get tap: %s", err)
+	}
+	master, err := s.LinkGet(ctx, bridge)
+	if err != nil {
+		t.Fatalf("failed to get bridge: %s", err)
+	}
+	if err := s.LinkSetMaster(ctx, tap.Index, master.Index); err != nil {
+		t.Fatalf("failed to attach tap to bridge: %s", err)
+	}
+	if err := s.LinkSetUp(ctx, tap.Index, true); err != nil {
+		t.Fatalf("failed to bring tap up: %s", err)
+	}
+	return file
+}
@@ -0,0 +1,129 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package netlink
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+type Route struct {
+	// Nil for default route
+	Dst      *net.IPNet
+	Gateway  net.IP
+	OutIndex int
+	// Main table if zero
+	Table int
+}
+
+func (r *Route) family() uint8 {
+	if r.Dst != nil {
+		return ipFamily(r.Dst.IP)
+	} else if r.Gateway != nil {
+		return ipFamily(r.Gateway)
+	}
+	return syscall.AF_INET
+}
+
+func decodeRoute(msg *Message) (*Route, error) {
+	var header syscall.RtMsg
+	attrs, err := msg.Decode(&header)
+	if err != nil {
+		return nil, err
+	}
+	route := &Route{Table: int(header.Table)}
+	for i := range attrs {
+		attr := &attrs[i]
+		switch attr.Type {
+		case syscall.RTA_DST:
+			route.Dst = ipNet(net.IP(attr.Value), int(header.Dst_len))
+		case syscall.RTA_GATEWAY:
+			route.Gateway = net.IP(attr.Value)
+		case syscall.RTA_OIF:
+			route.OutIndex = int(attr.Uint32())
+		case syscall.RTA_TABLE:
+			route.Table = int(attr.Uint32())
+		}
+	}
+	return route, nil
+}
+
+// Routes of all tables for given address family, like syscall.AF_INET
+func (s *Socket) RouteList(ctx context.Context, family int) ([]*Route, error) {
+	msgs, err := s.Execute(ctx, &Request{
+		Type:   syscall.RTM_GETROUTE,
+		Flags:  syscall.NLM_F_DUMP,
+		Header: syscall.RtMsg{Family: uint8(family)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var routes []*Route
+	for i := range msgs {
+		if msgs[i].Type != syscall.RTM_NEWROUTE {
+			continue
+		}
+		route, err := decodeRoute(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func routeRequest(route *Route, msgType, flags uint16) *Request {
+	header := syscall.RtMsg{
+		Family:   route.family(),
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    syscall.RT_SCOPE_UNIVERSE,
+		Type:     syscall.RTN_UNICAST,
+	}
+	var attrs []Attr
+	if route.Dst != nil {
+		dstLen, _ := route.Dst.Mask.Size()
+		header.Dst_len = uint8(dstLen)
+		attrs = append(attrs, BytesAttr(syscall.RTA_DST, ipBytes(route.Dst.IP)))
+	}
+	if route.Gateway != nil {
+		attrs = append(attrs, BytesAttr(syscall.RTA_GATEWAY, ipBytes(route.Gateway)))
+	} else {
+		// Destination is reachable directly through interface
+		header.Scope = syscall.RT_SCOPE_LINK
+	}
+	if route.OutIndex != 0 {
+		attrs = append(attrs, Uint32Attr(syscall.RTA_OIF, uint32(route.OutIndex)))
+	}
+	if route.Table != 0 {
+		header.Table = syscall.RT_TABLE_UNSPEC
+		attrs = append(attrs, Uint32Attr(syscall.RTA_TABLE, uint32(route.Table)))
+	}
+	return &Request{Type: msgType, Flags: flags, Header: header, Attrs: attrs}
+}
+
+func (s *Socket) RouteAdd(ctx context.Context, route *Route) error {
+	_, err := s.Execute(ctx, routeRequest(route, syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL))
+	return err
+}
+
+func (s *Socket) RouteDel(ctx context.Context, route *Route) error {
+	_, err := s.Execute(ctx, routeRequest(route, syscall.RTM_DELROUTE, 0))
+	return err
+}
@@ -0,0 +1,230 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package netlink
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/antonf/minicloud/utils"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Not defined by syscall package
+const solNetlink = 270
+
+// Multicast groups of NETLINK_ROUTE, for Subscribe
+const (
+	RTNLGRP_LINK        = 1
+	RTNLGRP_IPV4_IFADDR = 5
+	RTNLGRP_IPV4_ROUTE  = 7
+	RTNLGRP_IPV6_IFADDR = 9
+	RTNLGRP_IPV6_ROUTE  = 11
+)
+
+const receiveBufferSize = 65536
+
+var (
+	nextSeqNr   uint32
+	nativeOrder binary.ByteOrder
+)
+
+func init() {
+	var x uint32 = 0x01020304
+	if *(*byte)(unsafe.Pointer(&x)) == 0x01 {
+		nativeOrder = binary.BigEndian
+	} else {
+		nativeOrder = binary.LittleEndian
+	}
+}
+
+// NETLINK_ROUTE socket. Requests are executed one at a time, so socket
+// shouldn't be shared between goroutines.
+type Socket struct {
+	fd  int
+	sa  syscall.SockaddrNetlink
+	pid uint32
+}
+
+// Request message, Header is fixed family specific struct like
+// syscall.IfInfomsg written before attributes
+type Request struct {
+	Type   uint16
+	Flags  uint16
+	Header interface{}
+	Attrs  []Attr
+}
+
+type Message struct {
+	Type  uint16
+	Flags uint16
+	Seq   uint32
+	Pid   uint32
+	Data  []byte
+}
+
+func Open() (*Socket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	nlsa := syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, &nlsa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// Port id is process id only for the first socket of process
+	local, err := syscall.Getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &Socket{fd, nlsa, local.(*syscall.SockaddrNetlink).Pid}, nil
+}
+
+func (s *Socket) Close() {
+	syscall.Close(s.fd)
+}
+
+// Join multicast groups, notifications are returned by Receive with zero
+// sequence number
+func (s *Socket) Subscribe(groups ...int) error {
+	for _, group := range groups {
+		if err := syscall.SetsockoptInt(s.fd, solNetlink, syscall.NETLINK_ADD_MEMBERSHIP, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Request) encode(seq uint32) []byte {
+	buf := bytes.Buffer{}
+	buf.Grow(256)
+	binary.Write(&buf, nativeOrder, syscall.NlMsghdr{Type: r.Type, Flags: r.Flags, Seq: seq})
+	if r.Header != nil {
+		binary.Write(&buf, nativeOrder, r.Header)
+		alignBuffer(&buf)
+	}
+	encodeAttrs(&buf, r.Attrs)
+	data := buf.Bytes()
+	nativeOrder.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+func (s *Socket) Send(req *Request) (uint32, error) {
+	seq := atomic.AddUint32(&nextSeqNr, 1)
+	if err := syscall.Sendto(s.fd, req.encode(seq), 0, &s.sa); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+func (s *Socket) Receive(ctx context.Context) ([]Message, error) {
+	if value, err := utils.WrapContext(ctx, func() (interface{}, error) {
+		buf := make([]byte, receiveBufferSize)
+		nr, _, err := syscall.Recvfrom(s.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		return parseMessages(buf[:nr])
+	}); err != nil {
+		return nil, err
+	} else {
+		return value.([]Message), nil
+	}
+}
+
+func parseMessages(data []byte) ([]Message, error) {
+	var msgs []Message
+	for len(data) >= syscall.NLMSG_HDRLEN {
+		length := int(nativeOrder.Uint32(data[0:4]))
+		if length < syscall.NLMSG_HDRLEN || length > len(data) {
+			return nil, syscall.EINVAL
+		}
+		msgs = append(msgs, Message{
+			Type:  nativeOrder.Uint16(data[4:6]),
+			Flags: nativeOrder.Uint16(data[6:8]),
+			Seq:   nativeOrder.Uint32(data[8:12]),
+			Pid:   nativeOrder.Uint32(data[12:16]),
+			Data:  data[syscall.NLMSG_HDRLEN:length],
+		})
+		if aligned := align(length); aligned < len(data) {
+			data = data[aligned:]
+		} else {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+// Send request with ack requested and collect replies. Dump replies span
+// several multipart messages terminated by NLMSG_DONE. Messages not related
+// to request, like notifications, are skipped.
+func (s *Socket) Execute(ctx context.Context, req *Request) ([]Message, error) {
+	withAck := *req
+	withAck.Flags |= syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+	seq, err := s.Send(&withAck)
+	if err != nil {
+		return nil, err
+	}
+	var replies []Message
+	for {
+		msgs, err := s.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.Seq != seq || msg.Pid != s.pid {
+				continue
+			}
+			switch msg.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return nil, syscall.EINVAL
+				}
+				if errno := int32(nativeOrder.Uint32(msg.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return replies, nil
+			default:
+				// Ack follows replies unless it's a dump
+				replies = append(replies, msg)
+			}
+		}
+	}
+}
+
+// Decode fixed header into struct pointed by header and parse attributes
+// following it
+func (m *Message) Decode(header interface{}) ([]Attr, error) {
+	size := binary.Size(header)
+	if size < 0 || len(m.Data) < size {
+		return nil, syscall.EINVAL
+	}
+	if err := binary.Read(bytes.NewReader(m.Data[:size]), nativeOrder, header); err != nil {
+		return nil, err
+	}
+	if aligned := align(size); aligned < len(m.Data) {
+		return ParseAttrs(m.Data[aligned:])
+	}
+	return nil, nil
+}
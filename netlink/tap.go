@@ -0,0 +1,46 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package netlink
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Create TAP interface, or attach to existing one, backed by file descriptor
+// of opened /dev/net/tun. Returns name of interface, which is assigned by
+// kernel if name is empty or contains %d.
+func SetTapIface(fd uintptr, name string) (string, error) {
+	type ifreqFlags struct {
+		Name  [0x10]byte
+		Flags uint16
+		pad   [0x28 - 0x10 - 0x02]byte
+	}
+	req := ifreqFlags{Flags: syscall.IFF_TAP | syscall.IFF_NO_PI}
+	copy(req.Name[:], name)
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		fd,
+		uintptr(syscall.TUNSETIFF),
+		uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return "", errno
+	}
+	return strings.Trim(string(req.Name[:]), "\x00"), nil
+}
@@ -0,0 +1,137 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package qemu
+
+import (
+	"context"
+	"github.com/antonf/minicloud/netlink"
+	"sync"
+	"syscall"
+)
+
+var (
+	bridgesLock    sync.Mutex
+	bridgeUsers    = make(map[string]int)
+	bridgeServices []BridgeService
+	// Bridges created by this process, others are never deleted
+	createdBridges = make(map[string]bool)
+)
+
+// Service running on every bridge while it's used, like DHCP server. It's
+// started when first VM attaches to bridge and stopped before bridge is
+// deleted.
+type BridgeService interface {
+	Start(ctx context.Context, bridge string) error
+	Stop(ctx context.Context, bridge string)
+}
+
+// Services should be registered before any VM is started
+func RegisterBridgeService(service BridgeService) {
+	bridgesLock.Lock()
+	defer bridgesLock.Unlock()
+	bridgeServices = append(bridgeServices, service)
+}
+
+// Bridge is created when first VM attaches to it and deleted when last VM
+// attached to it exits. Existing link with the same name is used as is and
+// left in place.
+func acquireBridge(ctx context.Context, s *netlink.Socket, name string) (*netlink.Link, error) {
+	bridgesLock.Lock()
+	defer bridgesLock.Unlock()
+	err := s.LinkAdd(ctx, &netlink.Link{Name: name, Kind: "bridge"})
+	if err != nil && err != syscall.EEXIST {
+		return nil, err
+	}
+	if err == nil {
+		createdBridges[name] = true
+	}
+	bridge, err := setUpBridge(ctx, s, name)
+	if err != nil {
+		if bridgeUsers[name] == 0 {
+			deleteCreatedBridge(ctx, name)
+		}
+		return nil, err
+	}
+	bridgeUsers[name] += 1
+	return bridge, nil
+}
+
+func setUpBridge(ctx context.Context, s *netlink.Socket, name string) (*netlink.Link, error) {
+	bridge, err := s.LinkGet(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.LinkSetUp(ctx, bridge.Index, true); err != nil {
+		return nil, err
+	}
+	if bridgeUsers[name] == 0 {
+		for i, service := range bridgeServices {
+			if err := service.Start(ctx, name); err != nil {
+				for _, started := range bridgeServices[:i] {
+					started.Stop(ctx, name)
+				}
+				return nil, err
+			}
+		}
+	}
+	return bridge, nil
+}
+
+func releaseBridge(ctx context.Context, name string) {
+	bridgesLock.Lock()
+	defer bridgesLock.Unlock()
+	bridgeUsers[name] -= 1
+	if bridgeUsers[name] > 0 {
+		return
+	}
+	delete(bridgeUsers, name)
+	for _, service := range bridgeServices {
+		service.Stop(ctx, name)
+	}
+	deleteCreatedBridge(ctx, name)
+}
+
+func deleteCreatedBridge(ctx context.Context, name string) {
+	if !createdBridges[name] {
+		return
+	}
+	delete(createdBridges, name)
+	if err := deleteLink(ctx, name); err != nil {
+		logger.Error(ctx, "failed to delete bridge", "bridge", name, "error", err)
+	}
+}
+
+func (vm *VirtualMachine) releaseBridges(ctx context.Context) {
+	for _, name := range vm.bridges {
+		releaseBridge(ctx, name)
+	}
+	vm.bridges = nil
+}
+
+func deleteLink(ctx context.Context, name string) error {
+	s, err := netlink.Open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	link, err := s.LinkGet(ctx, name)
+	if err != nil {
+		return err
+	}
+	return s.LinkDel(ctx, link.Index)
+}
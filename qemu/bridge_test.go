@@ -0,0 +1,128 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package qemu
+
+import (
+	"context"
+	"errors"
+	"github.com/antonf/minicloud/netlink"
+	"github.com/antonf/minicloud/netlink/nettest"
+	"net"
+	"testing"
+)
+
+// Records whether bridge existed when service was started and stopped
+type testService struct {
+	started, stopped []bool
+	err              error
+}
+
+func (s *testService) Start(ctx context.Context, bridge string) error {
+	_, err := net.InterfaceByName(bridge)
+	s.started = append(s.started, err == nil)
+	return s.err
+}
+
+func (s *testService) Stop(ctx context.Context, bridge string) {
+	_, err := net.InterfaceByName(bridge)
+	s.stopped = append(s.stopped, err == nil)
+}
+
+func TestBridge(t *testing.T) {
+	nettest.EnterNetns(t)
+	ctx := context.Background()
+	service := &testService{}
+	RegisterBridgeService(service)
+	defer func() { bridgeServices = nil }()
+	s, err := netlink.Open()
+	if err != nil {
+		t.Fatalf("failed to open netlink socket: %s", err)
+	}
+	defer s.Close()
+	first, err := acquireBridge(ctx, s, "brtest")
+	if err != nil {
+		t.Fatalf("failed to create bridge: %s", err)
+	}
+	second, err := acquireBridge(ctx, s, "brtest")
+	if err != nil || second.Index != first.Index || !second.IsUp() {
+		t.Fatalf("unexpected existing bridge: %v (%v)", second, err)
+	}
+
+	file := nettest.OpenTap(t, "taptest", "brtest")
+	if link, err := s.LinkGet(ctx, "taptest"); err != nil || link.Master != first.Index {
+		t.Fatalf("tap not attached to bridge %d: %v (%v)", first.Index, link, err)
+	}
+	file.Close()
+
+	releaseBridge(ctx, "brtest")
+	if _, err := net.InterfaceByName("brtest"); err != nil {
+		t.Fatalf("bridge deleted while still used: %s", err)
+	}
+	releaseBridge(ctx, "brtest")
+	if _, err := net.InterfaceByName("brtest"); err == nil {
+		t.Fatalf("unused bridge not deleted")
+	}
+	// Service is running on existing bridge once for all its users
+	if len(service.started) != 1 || !service.started[0] || len(service.stopped) != 1 || !service.stopped[0] {
+		t.Fatalf("unexpected bridge service calls: %+v", service)
+	}
+}
+
+func TestBridgeExisting(t *testing.T) {
+	nettest.EnterNetns(t)
+	ctx := context.Background()
+	s, err := netlink.Open()
+	if err != nil {
+		t.Fatalf("failed to open netlink socket: %s", err)
+	}
+	defer s.Close()
+	if err := s.LinkAdd(ctx, &netlink.Link{Name: "brtest", Kind: "bridge"}); err != nil {
+		t.Fatalf("failed to create bridge: %s", err)
+	}
+	if _, err := acquireBridge(ctx, s, "brtest"); err != nil {
+		t.Fatalf("failed to acquire existing bridge: %s", err)
+	}
+	releaseBridge(ctx, "brtest")
+	if _, err := net.InterfaceByName("brtest"); err != nil {
+		t.Fatalf("bridge not created by VM deleted: %s", err)
+	}
+}
+
+func TestBridgeServiceFailure(t *testing.T) {
+	nettest.EnterNetns(t)
+	ctx := context.Background()
+	started := &testService{}
+	failed := &testService{err: errors.New("service failed")}
+	RegisterBridgeService(started)
+	RegisterBridgeService(failed)
+	defer func() { bridgeServices = nil }()
+	s, err := netlink.Open()
+	if err != nil {
+		t.Fatalf("failed to open netlink socket: %s", err)
+	}
+	defer s.Close()
+	if _, err := acquireBridge(ctx, s, "brtest"); err != failed.err {
+		t.Fatalf("expected service error, got %v", err)
+	}
+	if _, err := net.InterfaceByName("brtest"); err == nil {
+		t.Fatalf("bridge not deleted after service failure")
+	}
+	if len(started.stopped) != 1 || bridgeUsers["brtest"] != 0 || createdBridges["brtest"] {
+		t.Fatalf("bridge not released after service failure: %+v", started)
+	}
+}
@@ -19,6 +19,7 @@ package qemu
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/antonf/minicloud/utils"
 	"os"
@@ -123,9 +124,15 @@ func (vm *VirtualMachine) prepareCommand(ctx context.Context) (err error) {
 	}
 
 	for _, disk := range vm.Disks {
-		vm.appendArgs("-drive", fmt.Sprintf(
-			"format=rbd,file=rbd:%s/%s,if=virtio,discard=on,cache=%s",
-			disk.Pool, disk.Disk, disk.Cache))
+		// Same options as for hot plugged disks, so any disk can be unplugged
+		var blockdev []byte
+		if blockdev, err = json.Marshal(disk.blockdevArgs()); err != nil {
+			return
+		}
+		vm.appendArgs("-blockdev", string(blockdev))
+		vm.appendArgs("-device", fmt.Sprintf(
+			"virtio-blk-pci,drive=%s,id=%s,write-cache=%s",
+			disk.nodeName(), disk.deviceId(), disk.Cache.writeCache()))
 	}
 
 	vhost := "off"
@@ -153,8 +160,16 @@ func (vm *VirtualMachine) prepareCommand(ctx context.Context) (err error) {
 			idx, idx, netdev.MacAddress))
 	}
 
-	vm.appendArgs("-m", strconv.Itoa(vm.RAM))
-	vm.appendArgs("-smp", strconv.Itoa(vm.NumCPUs))
+	if vm.MaxRAM > vm.RAM {
+		vm.appendArgs("-m", fmt.Sprintf("%dM,slots=%d,maxmem=%dM", vm.RAM, memorySlots, vm.MaxRAM))
+	} else {
+		vm.appendArgs("-m", strconv.Itoa(vm.RAM))
+	}
+	if vm.MaxCPUs > vm.NumCPUs {
+		vm.appendArgs("-smp", fmt.Sprintf("%d,maxcpus=%d", vm.NumCPUs, vm.MaxCPUs))
+	} else {
+		vm.appendArgs("-smp", strconv.Itoa(vm.NumCPUs))
+	}
 
 	vm.appendVnc()
 
@@ -164,11 +179,20 @@ func (vm *VirtualMachine) prepareCommand(ctx context.Context) (err error) {
 func (vm *VirtualMachine) Start(ctx context.Context) error {
 	defer vm.closeFiles()
 	if err := vm.prepareCommand(ctx); err != nil {
+		vm.releaseBridges(ctx)
 		return err
 	}
 	if err := vm.cmd.Start(); err != nil {
+		vm.releaseBridges(ctx)
 		return err
 	}
+	vm.exited = make(chan struct{})
+	go func() {
+		vm.exitErr = vm.cmd.Wait()
+		// TAP devices are gone with process, so bridges may be unused
+		vm.releaseBridges(ctx)
+		close(vm.exited)
+	}()
 	vm.closeFiles()
 	if mon, err := NewMonitor(ctx, path.Join(vm.Root, "mon.sock")); err != nil {
 		if killErr := vm.cmd.Process.Kill(); killErr != nil {
@@ -183,5 +207,6 @@ func (vm *VirtualMachine) Start(ctx context.Context) error {
 }
 
 func (vm *VirtualMachine) Wait() error {
-	return vm.cmd.Wait()
+	<-vm.exited
+	return vm.exitErr
 }
@@ -0,0 +1,70 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/antonf/minicloud/utils"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDiskArgs(t *testing.T) {
+	root, err := ioutil.TempDir("", "minicloud-qemu")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	dev := StorageDevice{Pool: "disks", Disk: "disk0", Cache: CacheNone}
+	vm := &VirtualMachine{Id: utils.NewULID(), Root: root, Cpu: "host", RAM: 512, NumCPUs: 1, Disks: []StorageDevice{dev}}
+	if err := vm.prepareCommand(context.Background()); err != nil {
+		t.Fatalf("failed to prepare command: %s", err)
+	}
+	vm.closeFiles()
+
+	var blockdevs, devices []string
+	for i, arg := range vm.cmd.Args[:len(vm.cmd.Args)-1] {
+		switch arg {
+		case "-blockdev":
+			blockdevs = append(blockdevs, vm.cmd.Args[i+1])
+		case "-device":
+			devices = append(devices, vm.cmd.Args[i+1])
+		}
+	}
+	expected := `{"cache":{"direct":true,"no-flush":false},"discard":"unmap","driver":"rbd","image":"disk0","node-name":"drive-disk0","pool":"disks"}`
+	if len(blockdevs) != 1 || blockdevs[0] != expected {
+		t.Fatalf("unexpected boot disk block devices: %v", blockdevs)
+	}
+	if len(devices) != 1 || devices[0] != "virtio-blk-pci,drive=drive-disk0,id=virtio-disk0,write-cache=on" {
+		t.Fatalf("unexpected boot disk devices: %v", devices)
+	}
+
+	// Hot plugged disk gets the same node and device, so boot disk can be
+	// unplugged the same way
+	if hotPlugged, _ := json.Marshal(dev.blockdevArgs()); string(hotPlugged) != expected {
+		t.Fatalf("unexpected hot plugged block device: %s", hotPlugged)
+	}
+	args := dev.deviceArgs()
+	device := fmt.Sprintf("%s,drive=%s,id=%s,write-cache=%s", args["driver"], args["drive"], args["id"], args["write-cache"])
+	if device != devices[0] {
+		t.Fatalf("hot plugged device %s differs from boot one %s", device, devices[0])
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package qemu
+
+import (
+	"context"
+)
+
+func (cache DiskCache) direct() bool {
+	return cache == CacheNone || cache == CacheDirectSync
+}
+
+func (cache DiskCache) noFlush() bool {
+	return cache == CacheUnsafe
+}
+
+func (cache DiskCache) writeCache() string {
+	if cache == CacheWriteThrough || cache == CacheDirectSync {
+		return "off"
+	}
+	return "on"
+}
+
+func (dev *StorageDevice) nodeName() string {
+	return "drive-" + dev.Disk
+}
+
+func (dev *StorageDevice) deviceId() string {
+	return "virtio-" + dev.Disk
+}
+
+func (dev *StorageDevice) blockdevArgs() map[string]interface{} {
+	return map[string]interface{}{
+		"driver":    "rbd",
+		"node-name": dev.nodeName(),
+		"pool":      dev.Pool,
+		"image":     dev.Disk,
+		"discard":   "unmap",
+		"cache": map[string]interface{}{
+			"direct":   dev.Cache.direct(),
+			"no-flush": dev.Cache.noFlush(),
+		},
+	}
+}
+
+func (dev *StorageDevice) deviceArgs() map[string]interface{} {
+	return map[string]interface{}{
+		"driver":      "virtio-blk-pci",
+		"id":          dev.deviceId(),
+		"drive":       dev.nodeName(),
+		"write-cache": dev.Cache.writeCache(),
+	}
+}
+
+// Hot plug disk to running virtual machine
+func (vm *VirtualMachine) AttachDisk(ctx context.Context, dev StorageDevice) error {
+	vm.disksLock.Lock()
+	defer vm.disksLock.Unlock()
+	mon := vm.Monitor()
+	if err := mon.BlockdevAdd(ctx, dev.blockdevArgs()); err != nil {
+		return err
+	}
+	if err := mon.DeviceAdd(ctx, dev.deviceArgs()); err != nil {
+		if delErr := mon.BlockdevDel(ctx, dev.nodeName()); delErr != nil {
+			logger.Error(ctx, "failed to remove block device", "vm_id", vm.Id, "disk", dev.Disk, "error", delErr)
+		}
+		return err
+	}
+	vm.Disks = append(vm.Disks, dev)
+	return nil
+}
+
+// Unplug disk from running virtual machine, waits for guest to release device
+func (vm *VirtualMachine) DetachDisk(ctx context.Context, disk string) error {
+	vm.disksLock.Lock()
+	defer vm.disksLock.Unlock()
+	for idx := range vm.Disks {
+		dev := &vm.Disks[idx]
+		if dev.Disk != disk {
+			continue
+		}
+		mon := vm.Monitor()
+		if err := mon.DeviceDel(ctx, dev.deviceId()); err != nil {
+			return err
+		}
+		if err := mon.BlockdevDel(ctx, dev.nodeName()); err != nil {
+			return err
+		}
+		vm.Disks = append(vm.Disks[:idx], vm.Disks[idx+1:]...)
+		return nil
+	}
+	return ErrDiskNotAttached
+}
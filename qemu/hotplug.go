@@ -0,0 +1,96 @@
+/*
+ * This file is part of the MiniCloud project.
+ * Copyright (C) 2017 Anton Frolov <frolov.anton@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package qemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Memory slots reserved for hot plugged DIMMs
+const memorySlots = 8
+
+var ErrHotplugUnsupported = errors.New("Requested change can't be hot plugged")
+
+// Hot plug vCPUs until virtual machine has numCPUs of them, CPUs can't be
+// removed this way
+func (vm *VirtualMachine) SetCPUs(ctx context.Context, numCPUs int) error {
+	if numCPUs == vm.NumCPUs {
+		return nil
+	}
+	if numCPUs < vm.NumCPUs || numCPUs > vm.MaxCPUs {
+		return ErrHotplugUnsupported
+	}
+	mon := vm.Monitor()
+	cpus, err := mon.QueryHotpluggableCpus(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cpu := range cpus {
+		if vm.NumCPUs >= numCPUs {
+			break
+		}
+		if cpu.QomPath != "" {
+			// Already plugged
+			continue
+		}
+		args := map[string]interface{}{
+			"driver": cpu.Type,
+			"id":     fmt.Sprintf("cpu%d", vm.NumCPUs),
+		}
+		for key, value := range cpu.Props {
+			args[key] = value
+		}
+		if err := mon.DeviceAdd(ctx, args); err != nil {
+			return err
+		}
+		vm.NumCPUs += cpu.VcpusCount
+	}
+	if vm.NumCPUs != numCPUs {
+		return ErrHotplugUnsupported
+	}
+	return nil
+}
+
+// Hot plug DIMM to grow virtual machine memory to ram megabytes, memory can't
+// be removed this way
+func (vm *VirtualMachine) SetRAM(ctx context.Context, ram int) error {
+	if ram == vm.RAM {
+		return nil
+	}
+	if ram < vm.RAM || ram > vm.MaxRAM || vm.dimms >= memorySlots {
+		return ErrHotplugUnsupported
+	}
+	mon := vm.Monitor()
+	id := fmt.Sprintf("dimm%d", vm.dimms)
+	memId := "mem-" + id
+	size := uint64(ram-vm.RAM) << 20
+	if err := mon.ObjectAdd(ctx, "memory-backend-ram", memId, map[string]interface{}{"size": size}); err != nil {
+		return err
+	}
+	if err := mon.DeviceAdd(ctx, map[string]interface{}{"driver": "pc-dimm", "id": id, "memdev": memId}); err != nil {
+		if delErr := mon.ObjectDel(ctx, memId); delErr != nil {
+			logger.Error(ctx, "failed to remove memory backend", "vm_id", vm.Id, "id", memId, "error", delErr)
+		}
+		return err
+	}
+	vm.dimms += 1
+	vm.RAM = ram
+	return nil
+}
@@ -40,9 +40,16 @@ type Monitor struct {
 	path      string
 	conn      net.Conn
 	responses map[ulid.ULID]chan *response
+	waiters   map[*eventWaiter]struct{}
 	done      chan struct{}
 }
 
+type eventWaiter struct {
+	event string
+	match func(data json.RawMessage) bool
+	ch    chan struct{}
+}
+
 type request struct {
 	Id        ulid.ULID   `json:"id"`
 	Execute   string      `json:"execute"`
@@ -77,6 +84,7 @@ func NewMonitor(ctx context.Context, path string) (*Monitor, error) {
 	mon := &Monitor{
 		path:      path,
 		responses: make(map[ulid.ULID]chan *response),
+		waiters:   make(map[*eventWaiter]struct{}),
 		done:      make(chan struct{}),
 	}
 	backoff := utils.NewBackoff(100*time.Millisecond, OptMonitorConnectTimeout.Value())
@@ -190,6 +198,33 @@ func (mon *Monitor) sendResponse(ctx context.Context, resp *response) {
 	}
 }
 
+// Waiter should be registered before issuing command causing event, so event
+// can't be missed
+func (mon *Monitor) waitEvent(event string, match func(data json.RawMessage) bool) *eventWaiter {
+	waiter := &eventWaiter{event: event, match: match, ch: make(chan struct{})}
+	mon.Lock()
+	defer mon.Unlock()
+	mon.waiters[waiter] = struct{}{}
+	return waiter
+}
+
+func (mon *Monitor) cancelWait(waiter *eventWaiter) {
+	mon.Lock()
+	defer mon.Unlock()
+	delete(mon.waiters, waiter)
+}
+
+func (mon *Monitor) sendEvent(resp *response) {
+	mon.Lock()
+	defer mon.Unlock()
+	for waiter := range mon.waiters {
+		if waiter.event == resp.Event && waiter.match(resp.Data) {
+			close(waiter.ch)
+			delete(mon.waiters, waiter)
+		}
+	}
+}
+
 func (mon *Monitor) decodeResponses(ctx context.Context) {
 	decoder := json.NewDecoder(mon.conn)
 	ch := make(chan *response)
@@ -226,7 +261,7 @@ func (mon *Monitor) decodeResponses(ctx context.Context) {
 						"event", resp.Event,
 						"timestamp", timestamp,
 						"data", string(resp.Data))
-					// TODO: send events to subscribers
+					mon.sendEvent(resp)
 				}
 			} else {
 				return
@@ -236,6 +271,11 @@ func (mon *Monitor) decodeResponses(ctx context.Context) {
 }
 
 func (mon *Monitor) voidCommand(ctx context.Context, cmdName string, args interface{}) error {
+	return mon.command(ctx, cmdName, args, nil)
+}
+
+// Issue command and decode its return value into result unless it's nil
+func (mon *Monitor) command(ctx context.Context, cmdName string, args interface{}, result interface{}) error {
 	// Prepare request
 	req, ch := mon.prepareRequest(cmdName, args)
 	defer mon.closeRequest(req.Id)
@@ -251,6 +291,8 @@ func (mon *Monitor) voidCommand(ctx context.Context, cmdName string, args interf
 	case resp := <-ch:
 		if resp.Error != nil {
 			return resp.Error
+		} else if result != nil {
+			return json.Unmarshal(resp.Return, result)
 		} else {
 			return nil
 		}
@@ -283,3 +325,71 @@ func (mon *Monitor) Stop(ctx context.Context) error {
 func (mon *Monitor) Quit(ctx context.Context) error {
 	return mon.voidCommand(ctx, "quit", nil)
 }
+
+func (mon *Monitor) SystemPowerdown(ctx context.Context) error {
+	return mon.voidCommand(ctx, "system_powerdown", nil)
+}
+
+func (mon *Monitor) SystemReset(ctx context.Context) error {
+	return mon.voidCommand(ctx, "system_reset", nil)
+}
+
+func (mon *Monitor) BlockdevAdd(ctx context.Context, args interface{}) error {
+	return mon.voidCommand(ctx, "blockdev-add", args)
+}
+
+func (mon *Monitor) BlockdevDel(ctx context.Context, nodeName string) error {
+	return mon.voidCommand(ctx, "blockdev-del", map[string]string{"node-name": nodeName})
+}
+
+func (mon *Monitor) DeviceAdd(ctx context.Context, args interface{}) error {
+	return mon.voidCommand(ctx, "device_add", args)
+}
+
+// Device removal requires guest cooperation, so command returns only after
+// qemu reports device was deleted
+func (mon *Monitor) DeviceDel(ctx context.Context, id string) error {
+	waiter := mon.waitEvent("DEVICE_DELETED", func(data json.RawMessage) bool {
+		var event struct {
+			Device string `json:"device"`
+		}
+		return json.Unmarshal(data, &event) == nil && event.Device == id
+	})
+	defer mon.cancelWait(waiter)
+	if err := mon.voidCommand(ctx, "device_del", map[string]string{"id": id}); err != nil {
+		return err
+	}
+	select {
+	case <-waiter.ch:
+		return nil
+	case <-ctx.Done():
+		return utils.ErrInterrupted
+	}
+}
+
+type HotpluggableCpu struct {
+	Type       string                 `json:"type"`
+	VcpusCount int                    `json:"vcpus-count"`
+	Props      map[string]interface{} `json:"props"`
+	QomPath    string                 `json:"qom-path"`
+}
+
+func (mon *Monitor) QueryHotpluggableCpus(ctx context.Context) ([]HotpluggableCpu, error) {
+	var cpus []HotpluggableCpu
+	if err := mon.command(ctx, "query-hotpluggable-cpus", nil, &cpus); err != nil {
+		return nil, err
+	}
+	return cpus, nil
+}
+
+func (mon *Monitor) ObjectAdd(ctx context.Context, qomType, id string, props interface{}) error {
+	return mon.voidCommand(ctx, "object-add", map[string]interface{}{
+		"qom-type": qomType,
+		"id":       id,
+		"props":    props,
+	})
+}
+
+func (mon *Monitor) ObjectDel(ctx context.Context, id string) error {
+	return mon.voidCommand(ctx, "object-del", map[string]string{"id": id})
+}
@@ -19,11 +19,9 @@ package qemu
 
 import (
 	"context"
+	"github.com/antonf/minicloud/netlink"
 	"net"
 	"os"
-	"strings"
-	"syscall"
-	"unsafe"
 )
 
 func (vm *VirtualMachine) createTap(ctx context.Context, netdev NetworkDevice) (int, error) {
@@ -35,48 +33,31 @@ func (vm *VirtualMachine) createTap(ctx context.Context, netdev NetworkDevice) (
 	if err != nil {
 		return 0, err
 	}
-	if err = bringIfaceUp(ctx, iface); err != nil {
+	s, err := netlink.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	if netdev.Bridge != "" {
+		bridge, err := acquireBridge(ctx, s, netdev.Bridge)
+		if err != nil {
+			return 0, err
+		}
+		vm.bridges = append(vm.bridges, netdev.Bridge)
+		if err := s.LinkSetMaster(ctx, iface.Index, bridge.Index); err != nil {
+			return 0, err
+		}
+	}
+	if err = s.LinkSetUp(ctx, iface.Index, true); err != nil {
 		return 0, err
 	}
 	return fd, nil
 }
 
 func allocTapIface(fd uintptr, name string) (*net.Interface, error) {
-	type ifreqFlags struct {
-		Name  [0x10]byte
-		Flags uint16
-		pad   [0x28 - 0x10 - 0x02]byte
-	}
-	req := ifreqFlags{Flags: syscall.IFF_TAP | syscall.IFF_NO_PI}
-	copy(req.Name[:], name)
-	_, _, errno := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		fd,
-		uintptr(syscall.TUNSETIFF),
-		uintptr(unsafe.Pointer(&req)))
-	if errno != 0 {
-		return nil, errno
-	}
-	return net.InterfaceByName(strings.Trim(string(req.Name[:]), "\x00"))
-}
-
-func bringIfaceUp(ctx context.Context, iface *net.Interface) error {
-	s, err := NewNetlinkSocket()
+	name, err := netlink.SetTapIface(fd, name)
 	if err != nil {
-		return err
-	}
-	defer s.Close()
-
-	msg := syscall.IfInfomsg{
-		Family: syscall.AF_UNSPEC,
-		Index:  int32(iface.Index),
-		Flags:  syscall.IFF_UP,
-		Change: syscall.IFF_UP,
+		return nil, err
 	}
-	seq, err := s.Send(syscall.RTM_NEWLINK, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, msg)
-	if err != nil {
-		return err
-	}
-
-	return s.WaitAck(ctx, seq)
+	return net.InterfaceByName(name)
 }
@@ -19,11 +19,15 @@ package qemu
 
 import (
 	"context"
+	"errors"
 	"github.com/oklog/ulid"
 	"os"
 	"os/exec"
+	"sync"
 )
 
+var ErrDiskNotAttached = errors.New("Disk is not attached to virtual machine")
+
 type DiskCache string
 
 const (
@@ -37,6 +41,8 @@ const (
 type NetworkDevice struct {
 	InterfaceName string
 	MacAddress    string
+	// TAP device is attached to bridge unless it's empty
+	Bridge string
 }
 
 type StorageDevice struct {
@@ -56,10 +62,19 @@ type VirtualMachine struct {
 	VhostNet bool
 	RAM      int
 	NumCPUs  int
+	// Limits for hot plugging, disabled unless greater than RAM and NumCPUs
+	MaxRAM  int
+	MaxCPUs int
+
+	cmd     *exec.Cmd
+	files   []*os.File
+	mon     *Monitor
+	exited  chan struct{}
+	exitErr error
+	bridges []string
 
-	cmd   *exec.Cmd
-	files []*os.File
-	mon   *Monitor
+	disksLock sync.Mutex
+	dimms     int
 }
 
 func (vm *VirtualMachine) Monitor() *Monitor {
@@ -69,6 +84,11 @@ func (vm *VirtualMachine) Monitor() *Monitor {
 	return vm.mon
 }
 
+// Closed when VM process exits
+func (vm *VirtualMachine) Exited() <-chan struct{} {
+	return vm.exited
+}
+
 func (vm *VirtualMachine) Kill(ctx context.Context) {
 	err := vm.cmd.Process.Kill()
 	if err != nil {
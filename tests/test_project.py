@@ -41,6 +41,37 @@ class ProjectTest(base.TestCase, mixins.ProjectMixin):
         asserts.assert_equal(resp.status_code, 200)
         asserts.assert_is_instance(resp.json(), list)
 
+    def test_list_paginated(self):
+        for _ in range(3):
+            self._create_project(utils.random_name(NAME_BASE))
+        seen = set()
+        params = {'limit': 2}
+        while True:
+            resp = self.session.get('/projects', params=params)
+            asserts.assert_equal(resp.status_code, 200)
+            asserts.assert_less_equal(len(resp.json()), 2)
+            for project in resp.json():
+                asserts.assert_not_in(project['Id'], seen)
+                seen.add(project['Id'])
+            if 'X-MiniCloud-Continue' not in resp.headers:
+                break
+            params['continue'] = resp.headers['X-MiniCloud-Continue']
+        resp = self.session.get('/projects')
+        asserts.assert_equal(seen, {p['Id'] for p in resp.json()})
+
+    def test_list_filtered_by_name(self):
+        project_name = utils.random_name(NAME_BASE)
+        project_id = self._create_project(project_name)
+        resp = self.session.get('/projects', params={'name': project_name})
+        asserts.assert_equal(resp.status_code, 200)
+        asserts.assert_equal([p['Id'] for p in resp.json()], [project_id])
+
+    def test_list_unsupported_filter_rejected(self):
+        resp = self.session.get('/projects', params={
+            'project': '01B984TSNZSVK7VX6STPAE95D0'
+        })
+        asserts.assert_equal(resp.status_code, 400)
+
     def test_create_get(self):
         project_name = utils.random_name(NAME_BASE)
         project_id = self._create_project(project_name)
@@ -82,3 +113,51 @@ class ProjectTest(base.TestCase, mixins.ProjectMixin):
             'Name': '<html>'
         })
         asserts.assert_equal(resp.status_code, 400)
+
+    def test_conditional_update(self):
+        project_id = self._create_project(utils.random_name(NAME_BASE))
+        resp = self.session.get(f'/projects/{project_id}')
+        etag = resp.headers['ETag']
+        resp = self.session.get(f'/projects/{project_id}',
+                                headers={'If-None-Match': etag})
+        asserts.assert_equal(resp.status_code, 304)
+        resp = self.session.put(f'/projects/{project_id}',
+                                json={'Name': utils.random_name(NAME_BASE)},
+                                headers={'If-Match': etag})
+        asserts.assert_equal(resp.status_code, 204)
+        resp = self.session.put(f'/projects/{project_id}',
+                                json={'Name': utils.random_name(NAME_BASE)},
+                                headers={'If-Match': etag})
+        asserts.assert_equal(resp.status_code, 412)
+        resp = self.session.delete(f'/projects/{project_id}',
+                                   headers={'If-Match': etag})
+        asserts.assert_equal(resp.status_code, 412)
+
+    def test_history(self):
+        project_name = utils.random_name(NAME_BASE)
+        project_id = self._create_project(project_name)
+        resp = self.session.put(f'/projects/{project_id}', json={
+            'Name': utils.random_name(NAME_BASE)
+        })
+        asserts.assert_equal(resp.status_code, 204)
+        resp = self.session.get(f'/projects/{project_id}/history')
+        asserts.assert_equal(resp.status_code, 200)
+        history = resp.json()
+        asserts.assert_equal(len(history), 2)
+        asserts.assert_equal(history[1]['Entity']['Name'], project_name)
+        resp = self.session.get(f'/projects/{project_id}', params={
+            'revision': history[1]['ModifyRev']
+        })
+        asserts.assert_equal(resp.status_code, 200)
+        asserts.assert_equal(resp.json()['Name'], project_name)
+
+    def test_get_by_name(self):
+        project_name = utils.random_name(NAME_BASE)
+        project_id = self._create_project(project_name)
+        resp = self.session.get(f'/projects/by-name/{project_name}')
+        asserts.assert_equal(resp.status_code, 200)
+        asserts.assert_equal(resp.json()['Id'], project_id)
+        asserts.assert_in('ETag', resp.headers)
+        resp = self.session.get(
+            f'/projects/by-name/{utils.random_name(NAME_BASE)}')
+        asserts.assert_equal(resp.status_code, 404)
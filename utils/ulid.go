@@ -41,6 +41,15 @@ func RemoveULID(list []ulid.ULID, item ulid.ULID) []ulid.ULID {
 	return list
 }
 
+func ContainsULID(list []ulid.ULID, item ulid.ULID) bool {
+	for _, elem := range list {
+		if elem == item {
+			return true
+		}
+	}
+	return false
+}
+
 func ULIDListsEqual(x []ulid.ULID, y []ulid.ULID) bool {
 	if len(x) != len(y) {
 		return false